@@ -0,0 +1,193 @@
+// Package collector provides a service that periodically collects
+// runtime and system metrics, as message.Composers, and sends them
+// to a send.Sender.
+//
+// Each Source maintains its own state, so that the deltas and rates
+// reported by one Collector are independent of any other collection
+// in the process. Thresholds make it possible to escalate the
+// priority of a message when a metric crosses a limit, for instance
+// to log the process' resident memory at "Warning" level when it
+// exceeds some number of bytes.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/send"
+)
+
+// Options configures a Collector.
+type Options struct {
+	// Interval is the time between collections, and must be
+	// specified.
+	Interval time.Duration
+
+	// Priority is the level of messages that do not exceed a
+	// threshold, and defaults to "Info".
+	Priority level.Priority
+
+	// Sources produce the messages for each collection, which are
+	// sent in order. At least one source must be specified.
+	Sources []Source
+
+	// Thresholds escalate the priority of messages that exceed
+	// them.
+	Thresholds []Threshold
+}
+
+// Validate checks the options for required values and sets defaults.
+func (o *Options) Validate() error {
+	if o == nil {
+		return errors.New("collector options cannot be nil")
+	}
+
+	if o.Interval <= 0 {
+		return errors.New("collector interval must be greater than zero")
+	}
+
+	if o.Priority == level.Invalid {
+		o.Priority = level.Info
+	}
+
+	if !o.Priority.IsValid() {
+		return fmt.Errorf("%s (%d) is not a valid priority", o.Priority, o.Priority)
+	}
+
+	if len(o.Sources) == 0 {
+		return errors.New("collector must have at least one source")
+	}
+
+	for _, t := range o.Thresholds {
+		if t.Check == nil {
+			return fmt.Errorf("threshold '%s' does not specify a check", t.Name)
+		}
+		if !t.Priority.IsValid() {
+			return fmt.Errorf("threshold '%s' has invalid priority %d", t.Name, t.Priority)
+		}
+	}
+
+	return nil
+}
+
+// Collector sends messages produced by its sources to a sender on a
+// regular interval.
+type Collector struct {
+	sender send.Sender
+	opts   Options
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New constructs a Collector that sends messages to the sender, and
+// returns an error if the options are not valid.
+func New(s send.Sender, opts Options) (*Collector, error) {
+	if s == nil {
+		return nil, errors.New("collector must have a sender")
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Collector{sender: s, opts: opts}, nil
+}
+
+// Start begins collecting in a background goroutine, immediately and
+// then on every interval, until the context is canceled or Stop is
+// called. Start returns an error if the collector is already
+// running.
+func (c *Collector) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done != nil {
+		select {
+		case <-c.done:
+			// the context was canceled, so the previous
+			// collection has ended.
+			c.cancel()
+		default:
+			return errors.New("collector is already running")
+		}
+	}
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	done := make(chan struct{})
+	c.done = done
+
+	c.wg.Add(1)
+	go func() {
+		defer close(done)
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			c.Collect()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop ends collection and waits for the background goroutine to
+// return. After Stop returns the collector may be started again.
+func (c *Collector) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel == nil {
+		return
+	}
+
+	c.cancel()
+	c.wg.Wait()
+	c.cancel = nil
+	c.done = nil
+}
+
+// Collect performs a single collection, sending a message from each
+// source to the sender.
+func (c *Collector) Collect() {
+	for _, source := range c.opts.Sources {
+		m := source()
+		if m == nil {
+			continue
+		}
+
+		p := c.opts.Priority
+		exceeded := []string{}
+		for _, t := range c.opts.Thresholds {
+			if !t.Check(m) {
+				continue
+			}
+
+			exceeded = append(exceeded, t.Name)
+			if t.Priority > p {
+				p = t.Priority
+			}
+		}
+
+		if len(exceeded) > 0 {
+			_ = m.Annotate("thresholds", exceeded)
+		}
+
+		_ = m.SetPriority(p)
+		c.sender.Send(m)
+	}
+}
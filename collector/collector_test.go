@@ -0,0 +1,155 @@
+package collector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"cdr.dev/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSender(t *testing.T) *send.InternalSender {
+	sender := send.MakeInternalLogger()
+	require.NoError(t, sender.SetLevel(send.LevelInfo{Default: level.Trace, Threshold: level.Trace}))
+	return sender
+}
+
+func TestOptions(t *testing.T) {
+	var nilOpts *Options
+	assert.Error(t, nilOpts.Validate())
+	assert.Error(t, (&Options{}).Validate())
+	assert.Error(t, (&Options{Interval: time.Second}).Validate())
+	assert.Error(t, (&Options{Interval: time.Second, Sources: []Source{GoStatsTotals()}, Priority: 101}).Validate())
+	assert.Error(t, (&Options{
+		Interval:   time.Second,
+		Sources:    []Source{GoStatsTotals()},
+		Thresholds: []Threshold{{Name: "nocheck", Priority: level.Warning}},
+	}).Validate())
+
+	opts := &Options{Interval: time.Second, Sources: []Source{GoStatsTotals()}}
+	assert.NoError(t, opts.Validate())
+	assert.Equal(t, level.Info, opts.Priority)
+
+	_, err := New(nil, *opts)
+	assert.Error(t, err)
+}
+
+func TestCollector(t *testing.T) {
+	t.Run("Collect", func(t *testing.T) {
+		sender := newTestSender(t)
+		c, err := New(sender, Options{
+			Interval: time.Hour,
+			Sources:  []Source{GoStatsDeltas(), GoStatsTotals(), func() message.Composer { return nil }},
+		})
+		require.NoError(t, err)
+
+		c.Collect()
+		assert.Equal(t, 2, sender.Len())
+		msg := sender.GetMessage()
+		assert.Equal(t, level.Info, msg.Priority)
+		_, ok := msg.Message.(*message.GoRuntimeInfo)
+		assert.True(t, ok)
+	})
+	t.Run("GoMetrics", func(t *testing.T) {
+		sender := newTestSender(t)
+		c, err := New(sender, Options{
+			Interval: time.Hour,
+			Sources:  []Source{GoMetricsDeltas()},
+		})
+		require.NoError(t, err)
+
+		c.Collect()
+		c.Collect()
+		assert.Equal(t, 2, sender.Len())
+		msg := sender.GetMessage()
+		metrics, ok := msg.Message.(*message.GoRuntimeMetrics)
+		require.True(t, ok)
+		assert.NotEmpty(t, metrics.Values)
+	})
+	t.Run("Thresholds", func(t *testing.T) {
+		sender := newTestSender(t)
+		c, err := New(sender, Options{
+			Interval: time.Hour,
+			Priority: level.Debug,
+			Sources:  []Source{GoStatsTotals()},
+			Thresholds: []Threshold{
+				GoroutinesAbove(0, level.Warning),
+				HeapInUseAbove(0, level.Notice),
+				RSSAbove(0, level.Emergency),
+			},
+		})
+		require.NoError(t, err)
+
+		c.Collect()
+		msg := sender.GetMessage()
+		assert.Equal(t, level.Warning, msg.Priority)
+		info := msg.Message.(*message.GoRuntimeInfo)
+		assert.Equal(t, []string{"goroutines>0", "heap.inuse>0"}, info.Context["thresholds"])
+	})
+	t.Run("StartStop", func(t *testing.T) {
+		sender := newTestSender(t)
+		c, err := New(sender, Options{Interval: time.Millisecond, Sources: []Source{GoStatsRates()}})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		require.NoError(t, c.Start(ctx))
+		assert.Error(t, c.Start(ctx))
+		time.Sleep(20 * time.Millisecond)
+		c.Stop()
+
+		count := sender.Len()
+		assert.True(t, count > 1)
+		time.Sleep(5 * time.Millisecond)
+		assert.Equal(t, count, sender.Len())
+
+		c.Stop()
+		require.NoError(t, c.Start(ctx))
+		cancel()
+		c.Stop()
+	})
+	t.Run("Canceled", func(t *testing.T) {
+		sender := newTestSender(t)
+		c, err := New(sender, Options{Interval: time.Millisecond, Sources: []Source{GoStatsRates()}})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		require.NoError(t, c.Start(ctx))
+		cancel()
+
+		// the collector can be restarted once the canceled
+		// collection has ended.
+		err = c.Start(context.Background())
+		for deadline := time.Now().Add(5 * time.Second); err != nil && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			err = c.Start(context.Background())
+		}
+		require.NoError(t, err)
+		assert.Error(t, c.Start(context.Background()))
+
+		count := sender.Len()
+		time.Sleep(20 * time.Millisecond)
+		assert.True(t, sender.Len() > count)
+		c.Stop()
+	})
+}
+
+func TestIndependentDeltas(t *testing.T) {
+	first := message.NewGoStatsCollector()
+	second := message.NewGoStatsCollector()
+
+	_ = first.Deltas("")
+	garbage := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		garbage = append(garbage, make([]byte, 1024))
+	}
+	assert.Len(t, garbage, 1000)
+
+	firstDelta := first.Deltas("").(*message.GoRuntimeInfo)
+	secondDelta := second.Deltas("").(*message.GoRuntimeInfo)
+	assert.True(t, secondDelta.Mallocs > firstDelta.Mallocs)
+}
@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"os"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// Source produces a message for each collection. Sources may return
+// nil to skip a collection.
+type Source func() message.Composer
+
+// GoStatsTotals reports Go runtime statistics, as in
+// message.CollectGoStatsTotals.
+func GoStatsTotals() Source {
+	c := message.NewGoStatsCollector()
+	return func() message.Composer { return c.Totals("") }
+}
+
+// GoStatsDeltas reports Go runtime statistics, as in
+// message.CollectGoStatsDeltas, with deltas computed relative to the
+// previous collection by this source.
+func GoStatsDeltas() Source {
+	c := message.NewGoStatsCollector()
+	return func() message.Composer { return c.Deltas("") }
+}
+
+// GoStatsRates reports Go runtime statistics, as in
+// message.CollectGoStatsRates, with rates computed relative to the
+// previous collection by this source.
+func GoStatsRates() Source {
+	c := message.NewGoStatsCollector()
+	return func() message.Composer { return c.Rates("") }
+}
+
+// SystemInfo reports system-wide resource utilization, as in
+// message.CollectSystemInfo.
+func SystemInfo() Source { return message.CollectSystemInfo }
+
+// ContainerInfo reports the resource accounting for the cgroup of
+// the current process, as in message.CollectContainerInfo.
+func ContainerInfo() Source { return message.CollectContainerInfo }
+
+// ProcessInfo reports the resource utilization of the process with
+// the specified pid, as in message.CollectProcessInfo.
+func ProcessInfo(pid int32) Source {
+	return func() message.Composer { return message.CollectProcessInfo(pid) }
+}
+
+// ProcessInfoSelf reports the resource utilization of the current
+// process, as in message.CollectProcessInfoSelf.
+func ProcessInfoSelf() Source { return ProcessInfo(int32(os.Getpid())) }
+
+// ProcfsSystemInfo reports system-wide resource utilization, as in
+// SystemInfo, but parses the Linux proc file system directly rather
+// than using gopsutil. See message.Procfs for the differences
+// between the two.
+func ProcfsSystemInfo(opts message.ProcfsOptions) Source {
+	fs := message.NewProcfs(opts)
+	return func() message.Composer { return fs.SystemInfo(level.Trace, "") }
+}
+
+// ProcfsProcessInfo reports the resource utilization of the process
+// with the specified pid, as in ProcessInfo, but parses the Linux
+// proc file system directly rather than using gopsutil.
+func ProcfsProcessInfo(pid int32, opts message.ProcfsOptions) Source {
+	fs := message.NewProcfs(opts)
+	return func() message.Composer { return fs.ProcessInfo(level.Trace, pid, "") }
+}
+
+// ProcfsProcessInfoSelf reports the resource utilization of the
+// current process, as in ProcfsProcessInfo.
+func ProcfsProcessInfoSelf(opts message.ProcfsOptions) Source {
+	return ProcfsProcessInfo(int32(os.Getpid()), opts)
+}
+
+// GoMetricsTotals reports all runtime/metrics values, as in
+// message.CollectGoMetricsTotals.
+func GoMetricsTotals() Source {
+	c := message.NewGoMetricsCollector()
+	return func() message.Composer { return c.Totals("") }
+}
+
+// GoMetricsDeltas reports all runtime/metrics values, as in
+// message.CollectGoMetricsDeltas, with deltas computed relative to
+// the previous collection by this source.
+func GoMetricsDeltas() Source {
+	c := message.NewGoMetricsCollector()
+	return func() message.Composer { return c.Deltas("") }
+}
+
+// GoMetricsRates reports all runtime/metrics values, as in
+// message.CollectGoMetricsRates, with rates computed relative to the
+// previous collection by this source.
+func GoMetricsRates() Source {
+	c := message.NewGoMetricsCollector()
+	return func() message.Composer { return c.Rates("") }
+}
+
+// ProcessTree reports the resource utilization of the process with
+// the specified pid and its descendants, as in
+// message.NewProcessTree. The filter may be nil.
+func ProcessTree(pid int32, filter *message.ProcessFilter) Source {
+	return func() message.Composer { return message.NewProcessTree(level.Trace, pid, "", filter) }
+}
@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"fmt"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// Threshold escalates the priority of a collected message when its
+// check returns true. When several thresholds match a message, the
+// message takes the highest of their priorities, and the names of all
+// matching thresholds are annotated on the message as "thresholds".
+type Threshold struct {
+	Name     string
+	Priority level.Priority
+	Check    func(message.Composer) bool
+}
+
+// RSSAbove matches ProcessInfo messages when the resident memory of
+// the process exceeds the specified number of bytes.
+func RSSAbove(bytes uint64, p level.Priority) Threshold {
+	return Threshold{
+		Name:     fmt.Sprintf("rss>%d", bytes),
+		Priority: p,
+		Check: func(m message.Composer) bool {
+			info, ok := m.(*message.ProcessInfo)
+			return ok && info.Memory.RSS > bytes
+		},
+	}
+}
+
+// HeapInUseAbove matches GoRuntimeInfo messages when the in-use heap
+// exceeds the specified number of bytes.
+func HeapInUseAbove(bytes uint64, p level.Priority) Threshold {
+	return Threshold{
+		Name:     fmt.Sprintf("heap.inuse>%d", bytes),
+		Priority: p,
+		Check: func(m message.Composer) bool {
+			info, ok := m.(*message.GoRuntimeInfo)
+			return ok && info.HeapInUse > bytes
+		},
+	}
+}
+
+// GoroutinesAbove matches GoRuntimeInfo messages when the number of
+// goroutines exceeds the specified count.
+func GoroutinesAbove(count int64, p level.Priority) Threshold {
+	return Threshold{
+		Name:     fmt.Sprintf("goroutines>%d", count),
+		Priority: p,
+		Check: func(m message.Composer) bool {
+			info, ok := m.(*message.GoRuntimeInfo)
+			return ok && info.Goroutines > count
+		},
+	}
+}
+
+// CPUPercentAbove matches SystemInfo messages when the system-wide
+// CPU utilization exceeds the specified percentage.
+func CPUPercentAbove(percent float64, p level.Priority) Threshold {
+	return Threshold{
+		Name:     fmt.Sprintf("cpu.percent>%g", percent),
+		Priority: p,
+		Check: func(m message.Composer) bool {
+			info, ok := m.(*message.SystemInfo)
+			return ok && info.CPUPercent > percent
+		},
+	}
+}
+
+// MemoryAvailableBelow matches SystemInfo messages when the
+// system-wide available memory falls below the specified number of
+// bytes.
+func MemoryAvailableBelow(bytes uint64, p level.Priority) Threshold {
+	return Threshold{
+		Name:     fmt.Sprintf("memory.available<%d", bytes),
+		Priority: p,
+		Check: func(m message.Composer) bool {
+			info, ok := m.(*message.SystemInfo)
+			return ok && info.VMStat.Total > 0 && info.VMStat.Available < bytes
+		},
+	}
+}
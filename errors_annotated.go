@@ -0,0 +1,137 @@
+package grip
+
+import (
+	"fmt"
+
+	"cdr.dev/grip/message"
+	"github.com/pkg/errors"
+)
+
+// ErrorFieldsFinder collects the structured fields attached to an
+// error, and any error in its chain, with WrapErrorFields and
+// related functions. The outermost value of each key wins.
+func ErrorFieldsFinder(err error) (message.Fields, bool) {
+	fields := message.CollectErrorFields(err)
+	return fields, len(fields) > 0
+}
+
+// ErrorStackFinder returns the stack trace captured when an error, or
+// an error in its chain, was first annotated with WrapErrorFields or
+// related functions.
+func ErrorStackFinder(err error) (message.StackTrace, bool) {
+	for err != nil {
+		if ferr, ok := err.(*fieldsError); ok && ferr != nil && len(ferr.stack.Frames) > 0 {
+			return ferr.stack, true
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case errorCauser:
+			err = e.Cause()
+		default:
+			err = nil
+		}
+	}
+
+	return message.StackTrace{}, false
+}
+
+type fieldsError struct {
+	err    error
+	fields message.Fields
+	stack  message.StackTrace
+}
+
+func newFieldsError(err error, f message.Fields) *fieldsError {
+	if err == nil {
+		return nil
+	}
+
+	ferr := &fieldsError{
+		err:    err,
+		fields: message.Fields{},
+	}
+
+	for k, v := range f {
+		ferr.fields[k] = v
+	}
+
+	// only capture the stack once per chain, so that the trace
+	// reported points at where the error was first annotated.
+	if _, ok := ErrorStackFinder(err); !ok {
+		ferr.stack = message.NewStack(3, "").Raw().(message.StackTrace)
+	}
+
+	return ferr
+}
+
+// WrapErrorFields annotates an error with structured fields and, if
+// no error in its chain has one yet, a stack trace. The fields
+// survive further wrapping with pkg/errors or fmt.Errorf's %w, and
+// message.NewErrorMessage (and so all of the Catch and error logging
+// methods) merges them into the Raw() form of the log message.
+func WrapErrorFields(err error, f message.Fields) error {
+	if err == nil {
+		return nil
+	}
+
+	return newFieldsError(err, f)
+}
+
+// WrapErrorFieldsMessage annotates an error with structured fields,
+// a stack trace, and a string form, like WrapErrorFields.
+func WrapErrorFieldsMessage(err error, f message.Fields, m string) error {
+	if err == nil {
+		return nil
+	}
+
+	return newFieldsError(errors.WithMessage(err, m), f)
+}
+
+// WrapErrorFieldsMessagef annotates an error with structured fields,
+// a stack trace, and a string formated message, like fmt.Sprintf or
+// fmt.Errorf.
+func WrapErrorFieldsMessagef(err error, f message.Fields, m string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+
+	return newFieldsError(errors.WithMessage(err, fmt.Sprintf(m, args...)), f)
+}
+
+func (e *fieldsError) Error() string             { return e.err.Error() }
+func (e *fieldsError) Cause() error              { return e.err }
+func (e *fieldsError) Unwrap() error             { return e.err }
+func (e *fieldsError) Stack() message.StackTrace { return e.stack }
+func (e *fieldsError) ErrorFields() message.Fields {
+	if len(e.stack.Frames) == 0 {
+		return e.fields
+	}
+
+	out := make(message.Fields, len(e.fields)+1)
+	for k, v := range e.fields {
+		out[k] = v
+	}
+	out["stack.frames"] = e.stack.Frames
+
+	return out
+}
+
+func (e *fieldsError) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if s.Flag('+') {
+			_, _ = fmt.Fprintf(s, "%+v", e.err)
+			if len(e.stack.Frames) > 0 {
+				_, _ = fmt.Fprintf(s, "\n%s", e.stack.String())
+			}
+			return
+		}
+		fallthrough
+	case 's':
+		_, _ = fmt.Fprint(s, e.Error())
+	case 'q':
+		_, _ = fmt.Fprintf(s, "%q", e.Error())
+	}
+}
@@ -0,0 +1,82 @@
+package grip
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldsError(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		assert.Nil(t, WrapErrorFields(nil, message.Fields{"a": 1}))
+		assert.Nil(t, WrapErrorFieldsMessage(nil, message.Fields{"a": 1}, "hi"))
+		assert.Nil(t, WrapErrorFieldsMessagef(nil, message.Fields{"a": 1}, "hi %d", 1))
+
+		fields, ok := ErrorFieldsFinder(nil)
+		assert.False(t, ok)
+		assert.Nil(t, fields)
+
+		stack, ok := ErrorStackFinder(nil)
+		assert.False(t, ok)
+		assert.Zero(t, stack)
+	})
+	t.Run("Message", func(t *testing.T) {
+		err := WrapErrorFieldsMessage(errors.New("hello"), message.Fields{"a": 1}, "earth")
+		assert.Equal(t, "earth: hello", err.Error())
+
+		err = WrapErrorFieldsMessagef(errors.New("hello"), message.Fields{"a": 1}, "earth %d", 42)
+		assert.Equal(t, "earth 42: hello", err.Error())
+		assert.Equal(t, err.Error(), fmt.Sprint(err))
+		assert.NotEqual(t, fmt.Sprintf("%+v", err), fmt.Sprintf("%v", err))
+	})
+	t.Run("FinderThroughWrapping", func(t *testing.T) {
+		err := WrapErrorFields(errors.New("hello"), message.Fields{"a": 1, "b": 2})
+		err = errors.Wrap(err, "world")
+		err = fmt.Errorf("outer: %w", err)
+		err = WrapErrorFields(err, message.Fields{"b": 3, "c": 4})
+		err = WrapErrorTime(err)
+
+		fields, ok := ErrorFieldsFinder(err)
+		require.True(t, ok)
+		assert.Equal(t, 1, fields["a"])
+		assert.Equal(t, 3, fields["b"])
+		assert.Equal(t, 4, fields["c"])
+	})
+	t.Run("StackCapturedOnce", func(t *testing.T) {
+		inner := WrapErrorFields(errors.New("hello"), message.Fields{"a": 1})
+		outer := WrapErrorFields(errors.WithStack(inner), message.Fields{"b": 2})
+
+		stack, ok := ErrorStackFinder(outer)
+		require.True(t, ok)
+		require.NotEmpty(t, stack.Frames)
+		assert.Equal(t, inner.(*fieldsError).stack, stack)
+		assert.Empty(t, outer.(*fieldsError).stack.Frames)
+		assert.True(t, strings.HasSuffix(stack.Frames[0].Function, "TestFieldsError.func4"), stack.Frames[0].Function)
+	})
+	t.Run("Composer", func(t *testing.T) {
+		err := WrapErrorFields(errors.New("hello"), message.Fields{"a": 1})
+		err = errors.Wrap(err, "world")
+
+		for name, msg := range map[string]message.Composer{
+			"Converted": message.ConvertToComposer(level.Error, err),
+			"Error":     message.NewErrorMessage(level.Error, err),
+		} {
+			t.Run(name, func(t *testing.T) {
+				assert.True(t, msg.Loggable())
+				assert.Equal(t, "world: hello", msg.String())
+				raw, ok := msg.Raw().(message.Fields)
+				require.True(t, ok)
+				assert.Equal(t, 1, raw["a"])
+				assert.Equal(t, "world: hello", raw["error"])
+				assert.Contains(t, raw, "stack.frames")
+				assert.Contains(t, raw, "metadata")
+			})
+		}
+	})
+}
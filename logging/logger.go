@@ -1,9 +1,11 @@
 package logging
 
 import (
+	"context"
 	"errors"
 	"os"
 	"sync"
+	"time"
 
 	"cdr.dev/grip/level"
 	"cdr.dev/grip/message"
@@ -17,9 +19,16 @@ import (
 type Grip struct {
 	impl         send.Sender
 	defaultLevel level.Priority
+	exit         func(int)
+	exitTimeout  time.Duration
 	mu           sync.RWMutex
 }
 
+// DefaultExitFlushTimeout is the longest that the fatal logging
+// methods wait for the sender to flush buffered messages before
+// exiting, unless the logger specifies a different timeout.
+const DefaultExitFlushTimeout = 5 * time.Second
+
 // MakeGrip builds a new logging interface from a sender implmementation
 func MakeGrip(s send.Sender) *Grip {
 	return &Grip{
@@ -114,6 +123,46 @@ func (g *Grip) GetSender() send.Sender {
 	return g.impl
 }
 
+// SetExitHandler replaces the function that the fatal logging methods
+// (e.g. EmergencyFatal) call, after flushing the sender, to exit the
+// process. This is primarily useful in tests, to observe fatal
+// paths without exiting. A nil handler restores the default, os.Exit.
+func (g *Grip) SetExitHandler(fn func(code int)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.exit = fn
+}
+
+// SetExitFlushTimeout sets how long the fatal logging methods wait for
+// the sender to flush buffered messages before exiting. Values less
+// than or equal to zero restore the default, DefaultExitFlushTimeout.
+func (g *Grip) SetExitFlushTimeout(dur time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.exitTimeout = dur
+}
+
+// ExitHandler returns the function set with SetExitHandler, or nil if
+// the fatal logging methods use the default, os.Exit.
+func (g *Grip) ExitHandler() func(code int) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.exit
+}
+
+// ExitFlushTimeout returns the timeout set with SetExitFlushTimeout, or
+// zero if the fatal logging methods use the default,
+// DefaultExitFlushTimeout.
+func (g *Grip) ExitFlushTimeout() time.Duration {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.exitTimeout
+}
+
 // Internal
 
 // For sending logging messages, in most cases, use the
@@ -139,7 +188,31 @@ func (g *Grip) sendFatal(m message.Composer) {
 
 	if g.impl.Level().ShouldLog(m) {
 		g.impl.Send(m)
-		os.Exit(1)
+
+		timeout := g.exitTimeout
+		if timeout <= 0 {
+			timeout = DefaultExitFlushTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// not all senders respect the context's deadline, so
+		// flush in the background to ensure that we exit.
+		flushed := make(chan struct{})
+		go func() {
+			defer close(flushed)
+			_ = g.impl.Flush(ctx)
+		}()
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+		}
+
+		exit := g.exit
+		if exit == nil {
+			exit = os.Exit
+		}
+		exit(1)
 	}
 }
 
@@ -1,15 +1,18 @@
 package logging
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"testing"
+	"time"
 
 	"cdr.dev/grip/level"
 	"cdr.dev/grip/message"
 	"cdr.dev/grip/send"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -249,3 +252,54 @@ func TestSendFatalExits(t *testing.T) {
 		t.Errorf("sendFatal should have exited 0, instead: %+v", err)
 	}
 }
+
+type blockingFlushSender struct {
+	send.Sender
+	flushed chan struct{}
+	block   bool
+}
+
+func (s *blockingFlushSender) Flush(ctx context.Context) error {
+	if s.block {
+		select {}
+	}
+	close(s.flushed)
+	return nil
+}
+
+func TestSendFatalExitHandler(t *testing.T) {
+	t.Run("FlushesBeforeExit", func(t *testing.T) {
+		sender := &blockingFlushSender{Sender: send.MakeInternalLogger(), flushed: make(chan struct{})}
+		grip := MakeGrip(sender)
+
+		codes := []int{}
+		grip.SetExitHandler(func(code int) {
+			select {
+			case <-sender.flushed:
+			default:
+				t.Error("exited before flushing the sender")
+			}
+			codes = append(codes, code)
+		})
+
+		grip.EmergencyFatal(nil)
+		assert.Empty(t, codes)
+
+		grip.EmergencyFatal("foo")
+		assert.Equal(t, []int{1}, codes)
+		assert.True(t, sender.Sender.(*send.InternalSender).HasMessage())
+	})
+	t.Run("FlushDeadline", func(t *testing.T) {
+		sender := &blockingFlushSender{Sender: send.MakeInternalLogger(), block: true}
+		grip := MakeGrip(sender)
+		grip.SetExitFlushTimeout(10 * time.Millisecond)
+
+		codes := []int{}
+		grip.SetExitHandler(func(code int) { codes = append(codes, code) })
+
+		start := time.Now()
+		grip.EmergencyFatal("foo")
+		assert.Equal(t, []int{1}, codes)
+		assert.True(t, time.Since(start) < DefaultExitFlushTimeout)
+	})
+}
@@ -0,0 +1,79 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+
+	"cdr.dev/grip/level"
+)
+
+// Alert describes an incident for alerting senders. An alert either
+// triggers an incident, or, if Resolve is true, resolves the incident
+// with the same deduplication key.
+type Alert struct {
+	Summary string `bson:"summary" json:"summary" yaml:"summary"`
+	// DedupKey identifies the incident. If it is empty, senders
+	// derive the key from the fields.
+	DedupKey string `bson:"dedup_key,omitempty" json:"dedup_key,omitempty" yaml:"dedup_key,omitempty"`
+	Resolve  bool   `bson:"resolve,omitempty" json:"resolve,omitempty" yaml:"resolve,omitempty"`
+	Fields   Fields `bson:"fields,omitempty" json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+type alertMessage struct {
+	data Alert
+	Base `bson:"metadata" json:"metadata" yaml:"metadata"`
+}
+
+// NewAlertMessage returns a composer for an alert.
+func NewAlertMessage(p level.Priority, a Alert) Composer {
+	m := MakeAlertMessage(a)
+	_ = m.SetPriority(p)
+
+	return m
+}
+
+// MakeAlertMessage creates a composer for an alert without a priority
+// set.
+func MakeAlertMessage(a Alert) Composer {
+	return &alertMessage{data: a}
+}
+
+// NewAlertResolution returns a composer that resolves the incident
+// with the deduplication key, or, if the key is empty, the key
+// derived from the fields.
+func NewAlertResolution(p level.Priority, dedupKey string, f Fields) Composer {
+	return NewAlertMessage(p, Alert{DedupKey: dedupKey, Resolve: true, Fields: f})
+}
+
+// Loggable returns true when the alert has a summary, or, for
+// resolutions, when it has a deduplication key or fields.
+func (m *alertMessage) Loggable() bool {
+	if m.data.Resolve {
+		return m.data.DedupKey != "" || len(m.data.Fields) > 0
+	}
+
+	return m.data.Summary != ""
+}
+
+func (m *alertMessage) Raw() interface{} {
+	_ = m.Collect()
+	return &m.data
+}
+
+func (m *alertMessage) String() string {
+	out := []string{}
+	if m.data.Resolve {
+		out = append(out, "resolve")
+	}
+	if m.data.Summary != "" {
+		out = append(out, m.data.Summary)
+	}
+	if m.data.DedupKey != "" {
+		out = append(out, fmt.Sprintf("dedup_key='%s'", m.data.DedupKey))
+	}
+	if len(m.data.Fields) > 0 {
+		out = append(out, MakeSimpleFields(m.data.Fields).String())
+	}
+
+	return strings.Join(out, " ")
+}
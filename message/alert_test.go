@@ -0,0 +1,26 @@
+package message
+
+import (
+	"testing"
+
+	"cdr.dev/grip/level"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertMessage(t *testing.T) {
+	m := NewAlertMessage(level.Alert, Alert{Summary: "disk full", Fields: Fields{"host": "db1"}})
+	assert.True(t, m.Loggable())
+	assert.Equal(t, level.Alert, m.Priority())
+	assert.Equal(t, "disk full [host='db1']", m.String())
+	assert.Equal(t, &Alert{Summary: "disk full", Fields: Fields{"host": "db1"}}, m.Raw())
+
+	assert.False(t, NewAlertMessage(level.Alert, Alert{Fields: Fields{"host": "db1"}}).Loggable())
+
+	m = NewAlertResolution(level.Info, "disk-db1", nil)
+	assert.True(t, m.Loggable())
+	assert.Equal(t, "resolve dedup_key='disk-db1'", m.String())
+	assert.True(t, m.Raw().(*Alert).Resolve)
+
+	assert.True(t, NewAlertResolution(level.Info, "", Fields{"host": "db1"}).Loggable())
+	assert.False(t, NewAlertResolution(level.Info, "", nil).Loggable())
+}
@@ -0,0 +1,452 @@
+package message
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cdr.dev/grip/level"
+)
+
+// cgroupUnlimited is the threshold above which cgroup v1 reports
+// limits that are, in practice, unset.
+const cgroupUnlimited = 1 << 62
+
+// ContainerInfo is a Composer that reports the resource accounting
+// for the cgroup of the current process, which, unlike the host-wide
+// data in SystemInfo, reflects the limits and usage of the container
+// that the process runs in. Both cgroup v1 and v2 hierarchies are
+// supported.
+type ContainerInfo struct {
+	Message     string `json:"message" bson:"message"`
+	CgroupStats `json:",inline" bson:",inline"`
+	Base        `json:"metadata,omitempty" bson:"metadata,omitempty"`
+	loggable    bool
+	rendered    string
+}
+
+// CgroupStats holds the resource accounting for a cgroup. Limits of
+// zero indicate that the cgroup does not impose a limit.
+type CgroupStats struct {
+	Version int            `json:"version" bson:"version"`
+	Path    string         `json:"path" bson:"path"`
+	Memory  CgroupMemory   `json:"memory" bson:"memory"`
+	CPU     CgroupCPU      `json:"cpu" bson:"cpu"`
+	Pids    CgroupPids     `json:"pids" bson:"pids"`
+	IO      []CgroupIOStat `json:"io,omitempty" bson:"io,omitempty"`
+	Errors  []string       `json:"errors,omitempty" bson:"errors,omitempty"`
+}
+
+// CgroupMemory reports memory use of a cgroup in bytes, along with the
+// number of times usage reached the limit (LimitHits), including the
+// times that reclaiming memory resolved it, the number of times the
+// cgroup ran out of memory (OOMEvents), and the number of processes
+// killed as a result (OOMKills). Version 1 cgroups do not count out of
+// memory conditions, so OOMEvents is always zero for them.
+type CgroupMemory struct {
+	Usage     uint64 `json:"usage" bson:"usage"`
+	Limit     uint64 `json:"limit" bson:"limit"`
+	MaxUsage  uint64 `json:"max_usage,omitempty" bson:"max_usage,omitempty"`
+	LimitHits uint64 `json:"limit_hits" bson:"limit_hits"`
+	OOMEvents uint64 `json:"oom_events" bson:"oom_events"`
+	OOMKills  uint64 `json:"oom_kills" bson:"oom_kills"`
+}
+
+// CgroupCPU reports the CPU quota of a cgroup, as a number of cores,
+// as well as its CPU time and the time that it was throttled for
+// exceeding its quota.
+type CgroupCPU struct {
+	LimitCores       float64 `json:"limit_cores" bson:"limit_cores"`
+	UsageNanos       uint64  `json:"usage_ns" bson:"usage_ns"`
+	Periods          uint64  `json:"periods" bson:"periods"`
+	ThrottledPeriods uint64  `json:"throttled_periods" bson:"throttled_periods"`
+	ThrottledNanos   uint64  `json:"throttled_ns" bson:"throttled_ns"`
+}
+
+// CgroupPids reports the number of tasks in a cgroup, and its limit.
+type CgroupPids struct {
+	Current uint64 `json:"current" bson:"current"`
+	Limit   uint64 `json:"limit" bson:"limit"`
+}
+
+// CgroupIOStat reports block IO for a single device.
+type CgroupIOStat struct {
+	Device     string `json:"device" bson:"device"`
+	ReadBytes  uint64 `json:"read_bytes" bson:"read_bytes"`
+	WriteBytes uint64 `json:"write_bytes" bson:"write_bytes"`
+	ReadOps    uint64 `json:"read_ops" bson:"read_ops"`
+	WriteOps   uint64 `json:"write_ops" bson:"write_ops"`
+}
+
+// CollectContainerInfo returns a populated ContainerInfo object,
+// without a message.
+func CollectContainerInfo() Composer {
+	return NewContainerInfo(level.Trace, "")
+}
+
+// MakeContainerInfo builds a populated ContainerInfo object with the
+// specified message.
+func MakeContainerInfo(message string) Composer {
+	return NewContainerInfo(level.Info, message)
+}
+
+// NewContainerInfo returns a fully configured and populated
+// ContainerInfo object.
+func NewContainerInfo(priority level.Priority, message string) Composer {
+	return NewContainerInfoWithRoot(priority, message, "/")
+}
+
+// NewContainerInfoWithRoot is the same as NewContainerInfo, but reads
+// the "proc" and "sys/fs/cgroup" trees relative to the specified root
+// directory rather than the root of the file system.
+func NewContainerInfoWithRoot(priority level.Priority, message, root string) Composer {
+	c := &ContainerInfo{Message: message}
+
+	if err := c.SetPriority(priority); err != nil {
+		c.Errors = append(c.Errors, err.Error())
+		return c
+	}
+
+	stats, err := collectCgroupStats(root)
+	if err != nil {
+		c.Errors = append(c.Errors, err.Error())
+		return c
+	}
+
+	c.CgroupStats = *stats
+	c.loggable = true
+
+	return c
+}
+
+// Loggable returns true when the ContainerInfo structure has been
+// populated.
+func (c *ContainerInfo) Loggable() bool { return c.loggable }
+
+// Raw always returns the ContainerInfo object.
+func (c *ContainerInfo) Raw() interface{} { return c }
+
+// String returns a string representation of the message, lazily
+// rendering the message, and caching it privately.
+func (c *ContainerInfo) String() string {
+	if c.rendered == "" {
+		c.rendered = renderStatsString(c.Message, c)
+	}
+
+	return c.rendered
+}
+
+////////////////////////////////////////////////////////////////////////
+//
+// cgroup file system parsing
+//
+////////////////////////////////////////////////////////////////////////
+
+func collectCgroupStats(root string) (*CgroupStats, error) {
+	paths, err := readProcCgroup(filepath.Join(root, "proc", "self", "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	mount := filepath.Join(root, "sys", "fs", "cgroup")
+	stats := &CgroupStats{}
+
+	if path, ok := paths[""]; ok && len(paths) == 1 {
+		stats.Version = 2
+		stats.Path = path
+		stats.collectV2(cgroupDir(mount, path))
+		return stats, nil
+	}
+
+	stats.Version = 1
+	stats.Path = paths["memory"]
+	stats.collectV1(func(controller string) string {
+		for name, path := range paths {
+			for _, c := range strings.Split(name, ",") {
+				if c == controller {
+					return cgroupDir(filepath.Join(mount, name), path)
+				}
+			}
+		}
+		return cgroupDir(filepath.Join(mount, controller), "/")
+	})
+
+	return stats, nil
+}
+
+// readProcCgroup maps the controllers listed in /proc/<pid>/cgroup to
+// cgroup paths. The cgroup v2 unified hierarchy has no controllers,
+// and is mapped to the empty string.
+func readProcCgroup(fn string) (map[string]string, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	out := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		out[parts[1]] = parts[2]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no cgroups listed in '%s'", fn)
+	}
+
+	return out, nil
+}
+
+// cgroupDir resolves the directory for a cgroup path. When the process
+// runs in a container without a cgroup namespace, /proc/self/cgroup
+// reports the path on the host, while the container's own cgroup is
+// mounted at the root of the hierarchy.
+func cgroupDir(mount, path string) string {
+	dir := filepath.Join(mount, path)
+	if _, err := os.Stat(dir); err != nil {
+		return mount
+	}
+
+	return dir
+}
+
+func (s *CgroupStats) saveError(stat string, err error) {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.Errors = append(s.Errors, fmt.Sprintf("%s: %v", stat, err))
+	}
+}
+
+func (s *CgroupStats) collectV2(dir string) {
+	var err error
+
+	s.Memory.Usage, err = readCgroupUint(filepath.Join(dir, "memory.current"))
+	s.saveError("memory.current", err)
+	s.Memory.Limit, err = readCgroupUint(filepath.Join(dir, "memory.max"))
+	s.saveError("memory.max", err)
+	s.Memory.MaxUsage, err = readCgroupUint(filepath.Join(dir, "memory.peak"))
+	s.saveError("memory.peak", err)
+
+	events, err := readCgroupKeyValues(filepath.Join(dir, "memory.events"))
+	s.saveError("memory.events", err)
+	s.Memory.LimitHits = events["max"]
+	s.Memory.OOMEvents = events["oom"]
+	s.Memory.OOMKills = events["oom_kill"]
+
+	quota, err := readCgroupString(filepath.Join(dir, "cpu.max"))
+	s.saveError("cpu.max", err)
+	if fields := strings.Fields(quota); len(fields) == 2 && fields[0] != "max" {
+		s.CPU.LimitCores = cgroupCores(fields[0], fields[1])
+	}
+
+	cpu, err := readCgroupKeyValues(filepath.Join(dir, "cpu.stat"))
+	s.saveError("cpu.stat", err)
+	s.CPU.UsageNanos = cpu["usage_usec"] * 1000
+	s.CPU.Periods = cpu["nr_periods"]
+	s.CPU.ThrottledPeriods = cpu["nr_throttled"]
+	s.CPU.ThrottledNanos = cpu["throttled_usec"] * 1000
+
+	s.Pids.Current, err = readCgroupUint(filepath.Join(dir, "pids.current"))
+	s.saveError("pids.current", err)
+	s.Pids.Limit, err = readCgroupUint(filepath.Join(dir, "pids.max"))
+	s.saveError("pids.max", err)
+
+	lines, err := readCgroupLines(filepath.Join(dir, "io.stat"))
+	s.saveError("io.stat", err)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		stat := CgroupIOStat{Device: fields[0]}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value, _ := strconv.ParseUint(kv[1], 10, 64)
+			switch kv[0] {
+			case "rbytes":
+				stat.ReadBytes = value
+			case "wbytes":
+				stat.WriteBytes = value
+			case "rios":
+				stat.ReadOps = value
+			case "wios":
+				stat.WriteOps = value
+			}
+		}
+		s.IO = append(s.IO, stat)
+	}
+}
+
+func (s *CgroupStats) collectV1(dir func(controller string) string) {
+	var err error
+
+	memory := dir("memory")
+	s.Memory.Usage, err = readCgroupUint(filepath.Join(memory, "memory.usage_in_bytes"))
+	s.saveError("memory.usage_in_bytes", err)
+	s.Memory.Limit, err = readCgroupUint(filepath.Join(memory, "memory.limit_in_bytes"))
+	s.saveError("memory.limit_in_bytes", err)
+	s.Memory.MaxUsage, err = readCgroupUint(filepath.Join(memory, "memory.max_usage_in_bytes"))
+	s.saveError("memory.max_usage_in_bytes", err)
+	s.Memory.LimitHits, err = readCgroupUint(filepath.Join(memory, "memory.failcnt"))
+	s.saveError("memory.failcnt", err)
+
+	oom, err := readCgroupKeyValues(filepath.Join(memory, "memory.oom_control"))
+	s.saveError("memory.oom_control", err)
+	s.Memory.OOMKills = oom["oom_kill"]
+
+	cpu := dir("cpu")
+	quota, err := readCgroupString(filepath.Join(cpu, "cpu.cfs_quota_us"))
+	s.saveError("cpu.cfs_quota_us", err)
+	period, err := readCgroupString(filepath.Join(cpu, "cpu.cfs_period_us"))
+	s.saveError("cpu.cfs_period_us", err)
+	if quota != "" && !strings.HasPrefix(quota, "-") {
+		s.CPU.LimitCores = cgroupCores(quota, period)
+	}
+
+	stat, err := readCgroupKeyValues(filepath.Join(cpu, "cpu.stat"))
+	s.saveError("cpu.stat", err)
+	s.CPU.Periods = stat["nr_periods"]
+	s.CPU.ThrottledPeriods = stat["nr_throttled"]
+	s.CPU.ThrottledNanos = stat["throttled_time"]
+
+	s.CPU.UsageNanos, err = readCgroupUint(filepath.Join(dir("cpuacct"), "cpuacct.usage"))
+	s.saveError("cpuacct.usage", err)
+
+	pids := dir("pids")
+	s.Pids.Current, err = readCgroupUint(filepath.Join(pids, "pids.current"))
+	s.saveError("pids.current", err)
+	s.Pids.Limit, err = readCgroupUint(filepath.Join(pids, "pids.max"))
+	s.saveError("pids.max", err)
+
+	blkio := dir("blkio")
+	devices := map[string]*CgroupIOStat{}
+	for _, fn := range []string{"blkio.throttle.io_service_bytes", "blkio.throttle.io_serviced"} {
+		lines, err := readCgroupLines(filepath.Join(blkio, fn))
+		s.saveError(fn, err)
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				continue
+			}
+
+			stat, ok := devices[fields[0]]
+			if !ok {
+				stat = &CgroupIOStat{Device: fields[0]}
+				devices[fields[0]] = stat
+			}
+
+			value, _ := strconv.ParseUint(fields[2], 10, 64)
+			switch {
+			case fields[1] == "Read" && fn == "blkio.throttle.io_service_bytes":
+				stat.ReadBytes = value
+			case fields[1] == "Write" && fn == "blkio.throttle.io_service_bytes":
+				stat.WriteBytes = value
+			case fields[1] == "Read":
+				stat.ReadOps = value
+			case fields[1] == "Write":
+				stat.WriteOps = value
+			}
+		}
+	}
+
+	for _, stat := range devices {
+		s.IO = append(s.IO, *stat)
+	}
+	sort.Slice(s.IO, func(i, j int) bool { return s.IO[i].Device < s.IO[j].Device })
+}
+
+func cgroupCores(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil {
+		return 0
+	}
+
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+
+	return q / p
+}
+
+func readCgroupString(fn string) (string, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readCgroupUint reads a file holding a single integer, where "max",
+// or very large values, indicate that there is no limit and are
+// reported as zero.
+func readCgroupUint(fn string) (uint64, error) {
+	value, err := readCgroupString(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	if value == "max" {
+		return 0, nil
+	}
+
+	out, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if out >= cgroupUnlimited {
+		return 0, nil
+	}
+
+	return out, nil
+}
+
+func readCgroupLines(fn string) ([]string, error) {
+	value, err := readCgroupString(fn)
+	if err != nil || value == "" {
+		return nil, err
+	}
+
+	return strings.Split(value, "\n"), nil
+}
+
+func readCgroupKeyValues(fn string) (map[string]uint64, error) {
+	lines, err := readCgroupLines(fn)
+	if err != nil {
+		return map[string]uint64{}, err
+	}
+
+	out := make(map[string]uint64, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		out[fields[0]] = value
+	}
+
+	return out, nil
+}
@@ -0,0 +1,91 @@
+package message
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"cdr.dev/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerInfo(t *testing.T) {
+	t.Run("V2", func(t *testing.T) {
+		msg := NewContainerInfoWithRoot(level.Info, "container", filepath.Join("testdata", "cgroup", "v2"))
+		require.True(t, msg.Loggable())
+
+		info := msg.Raw().(*ContainerInfo)
+		assert.Empty(t, info.Errors)
+		assert.Equal(t, 2, info.Version)
+		assert.Equal(t, "/system.slice/app.service", info.Path)
+		assert.Equal(t, CgroupMemory{
+			Usage:     104857600,
+			Limit:     268435456,
+			MaxUsage:  134217728,
+			LimitHits: 12,
+			OOMEvents: 3,
+			OOMKills:  1,
+		}, info.Memory)
+		assert.Equal(t, CgroupCPU{
+			LimitCores:       1.5,
+			UsageNanos:       5000000000,
+			Periods:          200,
+			ThrottledPeriods: 25,
+			ThrottledNanos:   750000000,
+		}, info.CPU)
+		assert.Equal(t, CgroupPids{Current: 12}, info.Pids)
+		assert.Equal(t, []CgroupIOStat{
+			{Device: "8:0", ReadBytes: 4096, WriteBytes: 8192, ReadOps: 1, WriteOps: 2},
+			{Device: "259:0", ReadBytes: 100, WriteBytes: 200, ReadOps: 3, WriteOps: 4},
+		}, info.IO)
+	})
+	t.Run("V1", func(t *testing.T) {
+		msg := NewContainerInfoWithRoot(level.Info, "container", filepath.Join("testdata", "cgroup", "v1"))
+		require.True(t, msg.Loggable())
+
+		info := msg.Raw().(*ContainerInfo)
+		assert.Empty(t, info.Errors)
+		assert.Equal(t, 1, info.Version)
+		assert.Equal(t, "/docker/abc123", info.Path)
+		assert.Equal(t, CgroupMemory{
+			Usage:     52428800,
+			MaxUsage:  62914560,
+			LimitHits: 2,
+			OOMKills:  1,
+		}, info.Memory)
+		assert.Equal(t, CgroupCPU{
+			LimitCores:       0.5,
+			UsageNanos:       3000000000,
+			Periods:          100,
+			ThrottledPeriods: 10,
+			ThrottledNanos:   2000000,
+		}, info.CPU)
+		assert.Equal(t, CgroupPids{Current: 4, Limit: 1024}, info.Pids)
+		assert.Equal(t, []CgroupIOStat{
+			{Device: "8:0", ReadBytes: 4096, WriteBytes: 8192, ReadOps: 1, WriteOps: 2},
+		}, info.IO)
+	})
+	t.Run("Serialization", func(t *testing.T) {
+		msg := NewContainerInfoWithRoot(level.Info, "container", filepath.Join("testdata", "cgroup", "v2"))
+		out := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(msg.String()[len("container:\n"):]), &out))
+		assert.Equal(t, "container", out["message"])
+		assert.EqualValues(t, 2, out["version"])
+		assert.Contains(t, out, "memory")
+	})
+	t.Run("Missing", func(t *testing.T) {
+		msg := NewContainerInfoWithRoot(level.Info, "container", filepath.Join("testdata", "cgroup", "none"))
+		assert.False(t, msg.Loggable())
+		assert.NotEmpty(t, msg.Raw().(*ContainerInfo).Errors)
+	})
+	t.Run("InvalidPriority", func(t *testing.T) {
+		msg := NewContainerInfoWithRoot(level.Invalid, "container", filepath.Join("testdata", "cgroup", "v2"))
+		assert.False(t, msg.Loggable())
+	})
+	t.Run("Constructors", func(t *testing.T) {
+		for _, msg := range []Composer{CollectContainerInfo(), MakeContainerInfo("hi"), NewContainerInfo(level.Info, "hi")} {
+			assert.NotNil(t, msg.Raw())
+		}
+	})
+}
@@ -409,3 +409,40 @@ func TestErrors(t *testing.T) {
 		})
 	}
 }
+
+type fieldsErr struct {
+	error
+	fields Fields
+}
+
+func (e *fieldsErr) ErrorFields() Fields { return e.fields }
+func (e *fieldsErr) Unwrap() error       { return e.error }
+
+func TestErrorChainFields(t *testing.T) {
+	inner := &fieldsErr{error: errors.New("err"), fields: Fields{"a": 1, "b": 2}}
+	outer := &fieldsErr{error: errors.Wrap(inner, "wrap"), fields: Fields{"b": 3}}
+
+	t.Run("Collect", func(t *testing.T) {
+		assert.Nil(t, CollectErrorFields(nil))
+		assert.Nil(t, CollectErrorFields(errors.New("err")))
+		assert.Equal(t, Fields{"a": 1, "b": 3}, CollectErrorFields(outer))
+	})
+	t.Run("ErrorMessage", func(t *testing.T) {
+		raw, ok := NewError(outer).Raw().(Fields)
+		require.True(t, ok)
+		assert.Equal(t, 1, raw["a"])
+		assert.Equal(t, 3, raw["b"])
+		assert.Equal(t, "wrap: err", raw["error"])
+	})
+	t.Run("PlainError", func(t *testing.T) {
+		_, ok := NewError(errors.New("err")).Raw().(Fields)
+		assert.False(t, ok)
+	})
+	t.Run("WrappedComposer", func(t *testing.T) {
+		raw, ok := WrapError(outer, Fields{"b": 4, "c": 5}).Raw().(Fields)
+		require.True(t, ok)
+		assert.Equal(t, 1, raw["a"])
+		assert.Equal(t, 4, raw["b"])
+		assert.Equal(t, 5, raw["c"])
+	})
+}
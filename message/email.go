@@ -1,8 +1,13 @@
 package message
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"net/mail"
+	"strings"
+	texttemplate "text/template"
 
 	"cdr.dev/grip/level"
 )
@@ -11,21 +16,145 @@ import (
 type Email struct {
 	From       string   `bson:"from" json:"from" yaml:"from"`
 	Recipients []string `bson:"recipients" json:"recipients" yaml:"recipients"`
-	Subject    string   `bson:"subject" json:"subject" yaml:"subject"`
-	Body       string   `bson:"body" json:"body" yaml:"body"`
+	// Cc recipients are listed in the headers of the email, while Bcc
+	// recipients receive the email without being listed.
+	Cc      []string `bson:"cc,omitempty" json:"cc,omitempty" yaml:"cc,omitempty"`
+	Bcc     []string `bson:"bcc,omitempty" json:"bcc,omitempty" yaml:"bcc,omitempty"`
+	ReplyTo string   `bson:"reply_to,omitempty" json:"reply_to,omitempty" yaml:"reply_to,omitempty"`
+	Subject string   `bson:"subject" json:"subject" yaml:"subject"`
+	Body    string   `bson:"body" json:"body" yaml:"body"`
 	// PlainTextContents dictates the Content-Type of the email. If true,
 	// it will text/plain; otherwise, it is text/html. This value is overridden
 	// by the presence of a "Content-Type" header in Headers.
 	PlainTextContents bool `bson:"is_plain_text" json:"is_plain_text" yaml:"is_plain_text"`
 
+	// HTMLBody is an HTML version of the email. When both Body and
+	// HTMLBody are set, the email is sent as multipart/alternative,
+	// with Body as the text/plain part, and PlainTextContents is
+	// ignored.
+	HTMLBody string `bson:"html_body,omitempty" json:"html_body,omitempty" yaml:"html_body,omitempty"`
+
+	// Attachments are added to the email, either as regular
+	// attachments or as inline content referenced from HTMLBody.
+	Attachments []EmailAttachment `bson:"attachments,omitempty" json:"attachments,omitempty" yaml:"attachments,omitempty"`
+
 	// Headers adds additional headers to the email body, ignoring any
 	// named "To", "From", "Subject", or "Content-Transfer-Encoding"
 	// (which should be set with the above fields)
 	Headers map[string][]string `bson:"headers" json:"headers" yaml:"headers"`
 }
 
+// EmailAttachment describes a file attached to an email. The contents
+// are either in Data, or read from the file at Path when the email is
+// sent.
+//
+// Inline attachments, typically images, are displayed in the HTML
+// body rather than as a separate file, and are referenced from the
+// HTML by their ContentID, as in <img src="cid:logo">.
+type EmailAttachment struct {
+	Filename    string `bson:"filename" json:"filename" yaml:"filename"`
+	ContentType string `bson:"content_type,omitempty" json:"content_type,omitempty" yaml:"content_type,omitempty"`
+	Path        string `bson:"path,omitempty" json:"path,omitempty" yaml:"path,omitempty"`
+	Data        []byte `bson:"data,omitempty" json:"data,omitempty" yaml:"data,omitempty"`
+	Inline      bool   `bson:"inline,omitempty" json:"inline,omitempty" yaml:"inline,omitempty"`
+	ContentID   string `bson:"content_id,omitempty" json:"content_id,omitempty" yaml:"content_id,omitempty"`
+}
+
+// Validate checks that the attachment has contents and, for inline
+// attachments, a content ID.
+func (a EmailAttachment) Validate() error {
+	if a.Path == "" && len(a.Data) == 0 {
+		return errors.New("attachment must specify a path or data")
+	}
+
+	if a.Path == "" && a.Filename == "" {
+		return errors.New("attachment with data must specify a filename")
+	}
+
+	if a.Inline && a.ContentID == "" {
+		return errors.New("inline attachment must specify a content id")
+	}
+
+	if strings.ContainsAny(a.ContentID, "<>\r\n") {
+		return fmt.Errorf("invalid content id '%s'", a.ContentID)
+	}
+
+	return nil
+}
+
+// EmailTemplate renders the subject and bodies of an email from
+// Fields. The subject and text body are rendered with text/template,
+// and the HTML body with html/template, which escapes the values.
+// Any of the templates may be nil, in which case the corresponding
+// field of the email is unchanged.
+type EmailTemplate struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	HTML    *htmltemplate.Template
+}
+
+// ParseEmailTemplate parses the subject, text, and HTML templates,
+// any of which may be empty.
+func ParseEmailTemplate(subject, text, html string) (*EmailTemplate, error) {
+	var err error
+	t := &EmailTemplate{}
+
+	if subject != "" {
+		if t.Subject, err = texttemplate.New("subject").Parse(subject); err != nil {
+			return nil, fmt.Errorf("parsing subject template: %w", err)
+		}
+	}
+
+	if text != "" {
+		if t.Text, err = texttemplate.New("text").Parse(text); err != nil {
+			return nil, fmt.Errorf("parsing text template: %w", err)
+		}
+	}
+
+	if html != "" {
+		if t.HTML, err = htmltemplate.New("html").Parse(html); err != nil {
+			return nil, fmt.Errorf("parsing html template: %w", err)
+		}
+	}
+
+	return t, nil
+}
+
+// Render returns a copy of the email with the subject and bodies
+// rendered from the fields.
+func (t *EmailTemplate) Render(e Email, data Fields) (Email, error) {
+	buf := &bytes.Buffer{}
+
+	if t.Subject != nil {
+		if err := t.Subject.Execute(buf, data); err != nil {
+			return e, fmt.Errorf("rendering subject: %w", err)
+		}
+		// subjects are a single header line
+		e.Subject = strings.Join(strings.Fields(buf.String()), " ")
+		buf.Reset()
+	}
+
+	if t.Text != nil {
+		if err := t.Text.Execute(buf, data); err != nil {
+			return e, fmt.Errorf("rendering text body: %w", err)
+		}
+		e.Body = buf.String()
+		buf.Reset()
+	}
+
+	if t.HTML != nil {
+		if err := t.HTML.Execute(buf, data); err != nil {
+			return e, fmt.Errorf("rendering html body: %w", err)
+		}
+		e.HTMLBody = buf.String()
+	}
+
+	return e, nil
+}
+
 type emailMessage struct {
 	data Email
+	err  error
 	Base `bson:"metadata" json:"metadata" yaml:"metadata"`
 }
 
@@ -44,29 +173,72 @@ func MakeEmailMessage(e Email) Composer {
 	}
 }
 
+// NewEmailTemplateMessage returns a composer for an email with the
+// subject and bodies rendered from the fields by the template. If
+// rendering fails, the message is not loggable, and its string form
+// reports the error.
+func NewEmailTemplateMessage(l level.Priority, e Email, t *EmailTemplate, data Fields) Composer {
+	m := MakeEmailTemplateMessage(e, t, data)
+	_ = m.SetPriority(l)
+
+	return m
+}
+
+// MakeEmailTemplateMessage creates a composer for a templated email
+// without a priority set.
+func MakeEmailTemplateMessage(e Email, t *EmailTemplate, data Fields) Composer {
+	if t == nil {
+		return &emailMessage{data: e, err: errors.New("nil email template")}
+	}
+
+	rendered, err := t.Render(e, data)
+
+	return &emailMessage{
+		data: rendered,
+		err:  err,
+	}
+}
+
 func (e *emailMessage) Loggable() bool {
+	if e.err != nil {
+		return false
+	}
+
 	if len(e.data.From) != 0 {
 		if _, err := mail.ParseAddress(e.data.From); err != nil {
 			return false
 		}
 	}
+	if len(e.data.ReplyTo) != 0 {
+		if _, err := mail.ParseAddress(e.data.ReplyTo); err != nil {
+			return false
+		}
+	}
 
-	if len(e.data.Recipients) == 0 {
+	if len(e.data.Recipients)+len(e.data.Cc)+len(e.data.Bcc) == 0 {
 		return false
 	}
-	for i := range e.data.Recipients {
-		_, err := mail.ParseAddress(e.data.Recipients[i])
-		if err != nil {
-			return false
+	for _, addrs := range [][]string{e.data.Recipients, e.data.Cc, e.data.Bcc} {
+		for i := range addrs {
+			_, err := mail.ParseAddress(addrs[i])
+			if err != nil {
+				return false
+			}
 		}
 	}
 	if len(e.data.Subject) == 0 {
 		return false
 	}
-	if len(e.data.Body) == 0 {
+	if len(e.data.Body) == 0 && len(e.data.HTMLBody) == 0 {
 		return false
 	}
 
+	for i := range e.data.Attachments {
+		if err := e.data.Attachments[i].Validate(); err != nil {
+			return false
+		}
+	}
+
 	// reject empty headers
 	for _, v := range e.data.Headers {
 		if len(v) == 0 {
@@ -82,6 +254,10 @@ func (e *emailMessage) Raw() interface{} {
 }
 
 func (e *emailMessage) String() string {
+	if e.err != nil {
+		return fmt.Sprintf("invalid email: %s", e.err.Error())
+	}
+
 	const (
 		tmpl       = `To: %s; %sBody: %s`
 		headerTmpl = "%s: %s\n"
@@ -97,13 +273,33 @@ func (e *emailMessage) String() string {
 		headers += "; "
 	}
 
-	to := ""
-	for i, recp := range e.data.Recipients {
-		to += recp
-		if i != (len(e.data.Recipients) - 1) {
-			to += ", "
+	to := strings.Join(e.data.Recipients, ", ")
+	if len(e.data.Cc) > 0 {
+		headers = fmt.Sprintf("Cc: %s; %s", strings.Join(e.data.Cc, ", "), headers)
+	}
+
+	body := e.data.Body
+	if body == "" {
+		body = e.data.HTMLBody
+	}
+
+	out := fmt.Sprintf(tmpl, to, headers, body)
+	if len(e.data.Attachments) > 0 {
+		names := make([]string, 0, len(e.data.Attachments))
+		for _, a := range e.data.Attachments {
+			names = append(names, a.name())
 		}
+		out += fmt.Sprintf("; Attachments: %s", strings.Join(names, ", "))
+	}
+
+	return out
+}
+
+func (a EmailAttachment) name() string {
+	if a.Filename != "" {
+		return a.Filename
 	}
 
-	return fmt.Sprintf(tmpl, to, headers, e.data.Body)
+	idx := strings.LastIndexAny(a.Path, `/\`)
+	return a.Path[idx+1:]
 }
@@ -0,0 +1,112 @@
+package message
+
+import (
+	"testing"
+
+	"cdr.dev/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailLoggable(t *testing.T) {
+	valid := func() Email {
+		return Email{
+			Recipients: []string{"to@example.com"},
+			Subject:    "subject",
+			Body:       "body",
+		}
+	}
+
+	for name, test := range map[string]struct {
+		mutate   func(*Email)
+		loggable bool
+	}{
+		"Valid":             {func(*Email) {}, true},
+		"HTMLOnly":          {func(e *Email) { e.Body, e.HTMLBody = "", "<p>body</p>" }, true},
+		"NoBody":            {func(e *Email) { e.Body = "" }, false},
+		"CcOnly":            {func(e *Email) { e.Recipients, e.Cc = nil, []string{"cc@example.com"} }, true},
+		"BccOnly":           {func(e *Email) { e.Recipients, e.Bcc = nil, []string{"bcc@example.com"} }, true},
+		"NoRecipients":      {func(e *Email) { e.Recipients = nil }, false},
+		"InvalidCc":         {func(e *Email) { e.Cc = []string{"not an address"} }, false},
+		"InvalidBcc":        {func(e *Email) { e.Bcc = []string{"not an address"} }, false},
+		"InvalidReplyTo":    {func(e *Email) { e.ReplyTo = "not an address" }, false},
+		"ValidReplyTo":      {func(e *Email) { e.ReplyTo = "Replies <replies@example.com>" }, true},
+		"FileAttachment":    {func(e *Email) { e.Attachments = []EmailAttachment{{Path: "/tmp/report.csv"}} }, true},
+		"DataAttachment":    {func(e *Email) { e.Attachments = []EmailAttachment{{Filename: "a.txt", Data: []byte("a")}} }, true},
+		"EmptyAttachment":   {func(e *Email) { e.Attachments = []EmailAttachment{{Filename: "a.txt"}} }, false},
+		"UnnamedAttachment": {func(e *Email) { e.Attachments = []EmailAttachment{{Data: []byte("a")}} }, false},
+		"InlineNoContentID": {func(e *Email) {
+			e.Attachments = []EmailAttachment{{Filename: "a.png", Data: []byte("a"), Inline: true}}
+		}, false},
+		"InvalidContentID": {func(e *Email) {
+			e.Attachments = []EmailAttachment{{Filename: "a.png", Data: []byte("a"), ContentID: "<a>"}}
+		}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			e := valid()
+			test.mutate(&e)
+			assert.Equal(t, test.loggable, NewEmailMessage(level.Info, e).Loggable())
+		})
+	}
+}
+
+func TestEmailString(t *testing.T) {
+	m := NewEmailMessage(level.Info, Email{
+		Recipients: []string{"one@example.com", "two@example.com"},
+		Cc:         []string{"cc@example.com"},
+		Subject:    "subject",
+		HTMLBody:   "<p>body</p>",
+		Attachments: []EmailAttachment{
+			{Path: "/tmp/report.csv"},
+			{Filename: "logo.png", Data: []byte("png")},
+		},
+	})
+	assert.Equal(t, "To: one@example.com, two@example.com; Cc: cc@example.com; Body: <p>body</p>; Attachments: report.csv, logo.png", m.String())
+}
+
+func TestEmailTemplate(t *testing.T) {
+	t.Run("Render", func(t *testing.T) {
+		tmpl, err := ParseEmailTemplate("{{.service}}\nfailed", "{{.service}}: {{.error}}", "<b>{{.service}}</b>: {{.error}}")
+		require.NoError(t, err)
+
+		base := Email{Recipients: []string{"to@example.com"}, Subject: "unchanged"}
+		m := NewEmailTemplateMessage(level.Error, base, tmpl, Fields{"service": "api", "error": "<timeout>"})
+		assert.Equal(t, level.Error, m.Priority())
+		assert.True(t, m.Loggable())
+
+		e := m.Raw().(*Email)
+		assert.Equal(t, "api failed", e.Subject)
+		assert.Equal(t, "api: <timeout>", e.Body)
+		assert.Equal(t, "<b>api</b>: &lt;timeout&gt;", e.HTMLBody)
+		assert.Equal(t, "unchanged", base.Subject)
+	})
+	t.Run("Partial", func(t *testing.T) {
+		tmpl, err := ParseEmailTemplate("", "", "<p>{{.message}}</p>")
+		require.NoError(t, err)
+
+		e, err := tmpl.Render(Email{Subject: "static", Body: "text"}, Fields{"message": "hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "static", e.Subject)
+		assert.Equal(t, "text", e.Body)
+		assert.Equal(t, "<p>hello</p>", e.HTMLBody)
+	})
+	t.Run("ParseError", func(t *testing.T) {
+		for _, args := range [][3]string{{"{{", "", ""}, {"", "{{", ""}, {"", "", "{{"}} {
+			tmpl, err := ParseEmailTemplate(args[0], args[1], args[2])
+			assert.Error(t, err)
+			assert.Nil(t, tmpl)
+		}
+	})
+	t.Run("RenderError", func(t *testing.T) {
+		tmpl, err := ParseEmailTemplate("", "{{.missing.field}}", "")
+		require.NoError(t, err)
+		tmpl.Text = tmpl.Text.Option("missingkey=error")
+
+		m := NewEmailTemplateMessage(level.Error, Email{Recipients: []string{"to@example.com"}, Subject: "s"}, tmpl, Fields{})
+		assert.False(t, m.Loggable())
+		assert.Contains(t, m.String(), "rendering text body")
+
+		m = NewEmailTemplateMessage(level.Error, Email{}, nil, Fields{})
+		assert.False(t, m.Loggable())
+	})
+}
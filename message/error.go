@@ -64,7 +64,18 @@ func (e *errorMessage) Raw() interface{} {
 		e.Extended = extended
 	}
 
-	return e
+	fields := CollectErrorFields(e.err)
+	if len(fields) == 0 {
+		return e
+	}
+
+	fields["error"] = e.ErrorValue
+	if e.Extended != "" {
+		fields["extended"] = e.Extended
+	}
+	fields["metadata"] = &e.Base
+
+	return fields
 }
 
 func (e *errorMessage) Error() string { return e.String() }
@@ -83,3 +94,49 @@ func (e *errorMessage) Format(s fmt.State, verb rune) {
 		_, _ = io.WriteString(s, e.Error())
 	}
 }
+
+// FieldsError describes errors that carry structured metadata. Error
+// composers merge the fields of every FieldsError in an error's
+// chain into their Raw() output.
+type FieldsError interface {
+	error
+	ErrorFields() Fields
+}
+
+// CollectErrorFields walks the chain of an error, following both
+// Unwrap() and pkg/errors' Cause() methods, and merges the fields of
+// every FieldsError it finds into a single Fields value. When the same
+// key appears at several points in the chain, the outermost value
+// wins. Returns nil if the chain contains no fields.
+func CollectErrorFields(err error) Fields {
+	var chain []Fields
+	for err != nil {
+		if fe, ok := err.(FieldsError); ok {
+			if f := fe.ErrorFields(); len(f) > 0 {
+				chain = append(chain, f)
+			}
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			err = nil
+		}
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+
+	out := Fields{}
+	for idx := len(chain) - 1; idx >= 0; idx-- {
+		for k, v := range chain[idx] {
+			out[k] = v
+		}
+	}
+
+	return out
+}
@@ -89,14 +89,21 @@ func (m *errorComposerWrap) Loggable() bool {
 
 func (m *errorComposerWrap) Raw() interface{} {
 	errStr := m.err.Error()
-	out := Fields{
-		"error": errStr,
+	out := CollectErrorFields(m.err)
+	if out == nil {
+		out = Fields{}
 	}
+	out["error"] = errStr
 
 	if m.Composer.Loggable() {
 		// special handling for fields - merge keys in with output keys
 		switch t := m.Composer.(type) {
 		case *fieldMessage:
+			for k, v := range out {
+				if _, ok := t.fields[k]; !ok {
+					t.fields[k] = v
+				}
+			}
 			t.fields["error"] = errStr
 			out = t.fields
 		default:
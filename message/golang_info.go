@@ -130,6 +130,44 @@ func CollectBasicGoStats() Composer {
 	})
 }
 
+// GoStatsCollector holds the state used to compute the deltas and
+// rates reported by GoRuntimeInfo messages. The CollectGoStats*,
+// MakeGoStats*, and NewGoStats* constructors all share a single
+// package-level collector, so that each call computes deltas relative
+// to the last call anywhere in the process. Use separate
+// GoStatsCollectors for independent periodic collections.
+type GoStatsCollector struct {
+	stats goStats
+}
+
+// NewGoStatsCollector constructs a GoStatsCollector, the first
+// collection from which reports deltas since the beginning of the
+// runtime.
+func NewGoStatsCollector() *GoStatsCollector { return &GoStatsCollector{} }
+
+// Totals has the same semantics as MakeGoStatsTotals.
+func (c *GoStatsCollector) Totals(msg string) Composer {
+	s := &GoRuntimeInfo{Message: msg}
+	s.buildFrom(&c.stats)
+	return s
+}
+
+// Deltas has the same semantics as MakeGoStatsDeltas, but computes
+// deltas relative to the last collection from this collector.
+func (c *GoStatsCollector) Deltas(msg string) Composer {
+	s := &GoRuntimeInfo{Message: msg, useDeltas: true}
+	s.buildFrom(&c.stats)
+	return s
+}
+
+// Rates has the same semantics as MakeGoStatsRates, but computes
+// rates relative to the last collection from this collector.
+func (c *GoStatsCollector) Rates(msg string) Composer {
+	s := &GoRuntimeInfo{Message: msg, useRates: true}
+	s.buildFrom(&c.stats)
+	return s
+}
+
 // GoRuntimeInfo provides
 type GoRuntimeInfo struct {
 	HeapObjects uint64        `bson:"memory.objects.heap" json:"memory.objects.heap" yaml:"memory.objects.heap"`
@@ -263,10 +301,12 @@ func NewGoStatsRates(p level.Priority, msg string) Composer {
 
 func (s *GoRuntimeInfo) doCollect() { _ = s.Collect() }
 
-func (s *GoRuntimeInfo) build() {
-	goStatsCache.Lock()
-	defer goStatsCache.Unlock()
-	m := goStatsCache.update()
+func (s *GoRuntimeInfo) build() { s.buildFrom(goStatsCache) }
+
+func (s *GoRuntimeInfo) buildFrom(cache *goStats) {
+	cache.Lock()
+	defer cache.Unlock()
+	m := cache.update()
 
 	s.HeapObjects = m.HeapObjects
 	s.Alloc = m.Alloc
@@ -275,24 +315,24 @@ func (s *GoRuntimeInfo) build() {
 	s.HeapInUse = m.HeapInuse
 	s.Goroutines = int64(runtime.NumGoroutine())
 
-	s.GCLatency = time.Since(goStatsCache.lastGC)
-	s.GCPause = time.Duration(goStatsCache.gcPause)
+	s.GCLatency = time.Since(cache.lastGC)
+	s.GCPause = time.Duration(cache.gcPause)
 
 	if s.useDeltas {
-		s.Mallocs = goStatsCache.mallocs().Delta
-		s.Frees = goStatsCache.frees().Delta
-		s.GC = goStatsCache.gcs().Delta
-		s.CgoCalls = goStatsCache.cgo().Delta
+		s.Mallocs = cache.mallocs().Delta
+		s.Frees = cache.frees().Delta
+		s.GC = cache.gcs().Delta
+		s.CgoCalls = cache.cgo().Delta
 	} else if s.useRates {
-		s.Mallocs = goStatsCache.mallocs().int()
-		s.Frees = goStatsCache.frees().int()
-		s.GC = goStatsCache.gcs().int()
-		s.CgoCalls = goStatsCache.cgo().int()
+		s.Mallocs = cache.mallocs().int()
+		s.Frees = cache.frees().int()
+		s.GC = cache.gcs().int()
+		s.CgoCalls = cache.cgo().int()
 	} else {
-		s.Mallocs = goStatsCache.mallocCounter.current
-		s.Frees = goStatsCache.freesCounter.current
-		s.GC = goStatsCache.gcRate.current
-		s.CgoCalls = goStatsCache.cgoCalls.current
+		s.Mallocs = cache.mallocCounter.current
+		s.Frees = cache.freesCounter.current
+		s.GC = cache.gcRate.current
+		s.CgoCalls = cache.cgoCalls.current
 	}
 
 	s.loggable = true
@@ -0,0 +1,368 @@
+package message
+
+import (
+	"math"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/level"
+)
+
+// GoRuntimeMetrics is a Composer that reports every metric supported
+// by the runtime/metrics package. Unlike GoRuntimeInfo, which uses
+// runtime.ReadMemStats, collecting these metrics does not stop the
+// world.
+//
+// Scalar metrics are reported in Values, and histogram metrics (e.g.
+// GC pause and scheduler latency distributions) are summarized with
+// counts and quantiles in Histograms. Both maps use the runtime's
+// metric names (e.g. "/gc/heap/allocs:bytes") as keys.
+//
+// When reporting deltas or rates, cumulative metrics are reported
+// relative to the previous collection, and histogram summaries
+// describe only the observations recorded since the previous
+// collection. Non-cumulative metrics (e.g. the current heap size)
+// are always reported as their current value.
+type GoRuntimeMetrics struct {
+	Message    string                      `bson:"message,omitempty" json:"message,omitempty" yaml:"message,omitempty"`
+	Values     map[string]float64          `bson:"values" json:"values" yaml:"values"`
+	Histograms map[string]HistogramSummary `bson:"histograms" json:"histograms" yaml:"histograms"`
+	Duration   time.Duration               `bson:"duration,omitempty" json:"duration,omitempty" yaml:"duration,omitempty"`
+	Base       `json:"metadata,omitempty" bson:"metadata,omitempty" yaml:"metadata,omitempty"`
+
+	loggable  bool
+	useDeltas bool
+	useRates  bool
+	rendered  string
+}
+
+// HistogramSummary describes the distribution of the observations in
+// a histogram. Because the runtime records observations in buckets,
+// the quantiles, minimum, maximum, mean, and sum of its histograms are
+// estimates, interpolated within the buckets.
+type HistogramSummary struct {
+	Count uint64  `bson:"count" json:"count" yaml:"count"`
+	Min   float64 `bson:"min" json:"min" yaml:"min"`
+	Max   float64 `bson:"max" json:"max" yaml:"max"`
+	Mean  float64 `bson:"mean" json:"mean" yaml:"mean"`
+	Sum   float64 `bson:"sum" json:"sum" yaml:"sum"`
+	P50   float64 `bson:"p50" json:"p50" yaml:"p50"`
+	P90   float64 `bson:"p90" json:"p90" yaml:"p90"`
+	P99   float64 `bson:"p99" json:"p99" yaml:"p99"`
+}
+
+var goMetricsCache = newGoMetricsState()
+
+// GoMetricsCollector holds the state used to compute the deltas and
+// rates reported by GoRuntimeMetrics messages. The CollectGoMetrics*,
+// MakeGoMetrics*, and NewGoMetrics* constructors all share a single
+// package-level collector; use separate GoMetricsCollectors for
+// independent periodic collections.
+type GoMetricsCollector struct {
+	state *goMetricsState
+}
+
+// NewGoMetricsCollector constructs a GoMetricsCollector, the first
+// collection from which reports deltas since the beginning of the
+// runtime.
+func NewGoMetricsCollector() *GoMetricsCollector {
+	return &GoMetricsCollector{state: newGoMetricsState()}
+}
+
+// Totals has the same semantics as MakeGoMetricsTotals.
+func (c *GoMetricsCollector) Totals(msg string) Composer {
+	return buildGoMetrics(c.state, msg, false, false)
+}
+
+// Deltas has the same semantics as MakeGoMetricsDeltas, but computes
+// deltas relative to the last collection from this collector.
+func (c *GoMetricsCollector) Deltas(msg string) Composer {
+	return buildGoMetrics(c.state, msg, true, false)
+}
+
+// Rates has the same semantics as MakeGoMetricsRates, but computes
+// rates relative to the last collection from this collector.
+func (c *GoMetricsCollector) Rates(msg string) Composer {
+	return buildGoMetrics(c.state, msg, false, true)
+}
+
+// CollectGoMetricsTotals constructs a Composer, which is a
+// GoRuntimeMetrics internally, that contains all metrics reported by
+// the runtime/metrics package. Cumulative metrics are totals since
+// the beginning of the runtime.
+func CollectGoMetricsTotals() Composer {
+	return buildGoMetrics(goMetricsCache, "", false, false)
+}
+
+// MakeGoMetricsTotals has the same semantics as
+// CollectGoMetricsTotals, but additionally allows you to set a message
+// string to annotate the data.
+func MakeGoMetricsTotals(msg string) Composer {
+	return buildGoMetrics(goMetricsCache, msg, false, false)
+}
+
+// NewGoMetricsTotals has the same semantics as CollectGoMetricsTotals,
+// but additionally allows you to set a message string and log level
+// to annotate the data.
+func NewGoMetricsTotals(p level.Priority, msg string) Composer {
+	m := buildGoMetrics(goMetricsCache, msg, false, false)
+	_ = m.SetPriority(p)
+	return m
+}
+
+// CollectGoMetricsDeltas constructs a Composer, which is a
+// GoRuntimeMetrics internally, that contains all metrics reported by
+// the runtime/metrics package. Cumulative metrics are the change
+// since the last time metrics were collected.
+//
+// Values are cached between calls, to produce the deltas. For the
+// best results, collect these messages on a regular interval.
+func CollectGoMetricsDeltas() Composer {
+	return buildGoMetrics(goMetricsCache, "", true, false)
+}
+
+// MakeGoMetricsDeltas has the same semantics as
+// CollectGoMetricsDeltas, but additionally allows you to set a message
+// string to annotate the data.
+func MakeGoMetricsDeltas(msg string) Composer {
+	return buildGoMetrics(goMetricsCache, msg, true, false)
+}
+
+// NewGoMetricsDeltas has the same semantics as CollectGoMetricsDeltas,
+// but additionally allows you to set a message string and log level
+// to annotate the data.
+func NewGoMetricsDeltas(p level.Priority, msg string) Composer {
+	m := buildGoMetrics(goMetricsCache, msg, true, false)
+	_ = m.SetPriority(p)
+	return m
+}
+
+// CollectGoMetricsRates constructs a Composer, which is a
+// GoRuntimeMetrics internally, that contains all metrics reported by
+// the runtime/metrics package. Cumulative metrics are the change
+// since the last time metrics were collected, divided by the number
+// of seconds since the last collection.
+//
+// For the best results, collect these messages on a regular interval.
+func CollectGoMetricsRates() Composer {
+	return buildGoMetrics(goMetricsCache, "", false, true)
+}
+
+// MakeGoMetricsRates has the same semantics as CollectGoMetricsRates,
+// but additionally allows you to set a message string to annotate the
+// data.
+func MakeGoMetricsRates(msg string) Composer {
+	return buildGoMetrics(goMetricsCache, msg, false, true)
+}
+
+// NewGoMetricsRates has the same semantics as CollectGoMetricsRates,
+// but additionally allows you to set a message string and log level
+// to annotate the data.
+func NewGoMetricsRates(p level.Priority, msg string) Composer {
+	m := buildGoMetrics(goMetricsCache, msg, false, true)
+	_ = m.SetPriority(p)
+	return m
+}
+
+// Loggable returns true when the GoRuntimeMetrics structure is
+// populated. Loggable is part of the Composer interface.
+func (m *GoRuntimeMetrics) Loggable() bool { return m.loggable }
+
+// Raw is part of the Composer interface and returns the
+// GoRuntimeMetrics object itself.
+func (m *GoRuntimeMetrics) Raw() interface{} { _ = m.Collect(); return m }
+
+func (m *GoRuntimeMetrics) String() string {
+	_ = m.Collect()
+
+	if m.rendered == "" {
+		m.rendered = renderStatsString(m.Message, m)
+	}
+
+	return m.rendered
+}
+
+////////////////////////////////////////////////////////////////////////
+//
+// Collection and Histogram Processing
+//
+////////////////////////////////////////////////////////////////////////
+
+type goMetricsState struct {
+	descs          map[string]metrics.Description
+	samples        []metrics.Sample
+	values         map[string]float64
+	histograms     map[string][]uint64
+	lastCollection time.Time
+	sync.Mutex
+}
+
+func newGoMetricsState() *goMetricsState {
+	all := metrics.All()
+	st := &goMetricsState{
+		descs:      make(map[string]metrics.Description, len(all)),
+		samples:    make([]metrics.Sample, len(all)),
+		values:     map[string]float64{},
+		histograms: map[string][]uint64{},
+	}
+
+	for idx, desc := range all {
+		st.descs[desc.Name] = desc
+		st.samples[idx].Name = desc.Name
+	}
+
+	return st
+}
+
+func buildGoMetrics(st *goMetricsState, msg string, useDeltas, useRates bool) *GoRuntimeMetrics {
+	m := &GoRuntimeMetrics{
+		Message:    msg,
+		Values:     map[string]float64{},
+		Histograms: map[string]HistogramSummary{},
+		useDeltas:  useDeltas,
+		useRates:   useRates,
+	}
+
+	st.Lock()
+	defer st.Unlock()
+
+	now := time.Now()
+	metrics.Read(st.samples)
+
+	var elapsed time.Duration
+	if !st.lastCollection.IsZero() {
+		elapsed = now.Sub(st.lastCollection)
+	}
+	st.lastCollection = now
+	if useDeltas || useRates {
+		m.Duration = elapsed
+	}
+
+	for _, sample := range st.samples {
+		cumulative := st.descs[sample.Name].Cumulative
+
+		switch sample.Value.Kind() {
+		case metrics.KindUint64, metrics.KindFloat64:
+			var current float64
+			if sample.Value.Kind() == metrics.KindUint64 {
+				current = float64(sample.Value.Uint64())
+			} else {
+				current = sample.Value.Float64()
+			}
+
+			value := current
+			if cumulative && (useDeltas || useRates) {
+				value -= st.values[sample.Name]
+				if useRates {
+					if elapsed > 0 {
+						value /= elapsed.Seconds()
+					} else {
+						value = 0
+					}
+				}
+			}
+			st.values[sample.Name] = current
+			m.Values[sample.Name] = value
+		case metrics.KindFloat64Histogram:
+			hist := sample.Value.Float64Histogram()
+			counts := make([]uint64, len(hist.Counts))
+			copy(counts, hist.Counts)
+
+			if previous, ok := st.histograms[sample.Name]; ok && (useDeltas || useRates) && len(previous) == len(counts) {
+				for idx := range counts {
+					counts[idx] -= previous[idx]
+				}
+			}
+			st.histograms[sample.Name] = append(st.histograms[sample.Name][:0], hist.Counts...)
+			m.Histograms[sample.Name] = summarizeHistogram(counts, hist.Buckets)
+		}
+	}
+
+	m.loggable = true
+	return m
+}
+
+// summarizeHistogram estimates the properties of a distribution from
+// bucketed counts, where buckets has one more element than counts and
+// bucket i covers the range [buckets[i], buckets[i+1]).
+func summarizeHistogram(counts []uint64, buckets []float64) HistogramSummary {
+	out := HistogramSummary{}
+	if len(buckets) != len(counts)+1 {
+		return out
+	}
+
+	first, last := -1, -1
+	var weighted float64
+	for idx, count := range counts {
+		if count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = idx
+		}
+		last = idx
+		out.Count += count
+		weighted += float64(count) * bucketMidpoint(buckets[idx], buckets[idx+1])
+	}
+
+	if out.Count == 0 {
+		return out
+	}
+
+	out.Min = finiteBound(buckets[first], buckets[first+1])
+	out.Max = finiteBound(buckets[last+1], buckets[last])
+	out.Mean = weighted / float64(out.Count)
+	out.Sum = weighted
+	out.P50 = histogramQuantile(0.5, out.Count, counts, buckets)
+	out.P90 = histogramQuantile(0.9, out.Count, counts, buckets)
+	out.P99 = histogramQuantile(0.99, out.Count, counts, buckets)
+
+	return out
+}
+
+func histogramQuantile(q float64, total uint64, counts []uint64, buckets []float64) float64 {
+	rank := q * float64(total)
+
+	var seen float64
+	for idx, count := range counts {
+		if count == 0 {
+			continue
+		}
+
+		next := seen + float64(count)
+		if next >= rank {
+			lower, upper := buckets[idx], buckets[idx+1]
+			if math.IsInf(lower, 0) || math.IsInf(upper, 0) {
+				return finiteBound(lower, upper)
+			}
+			return lower + (upper-lower)*(rank-seen)/float64(count)
+		}
+		seen = next
+	}
+
+	return 0
+}
+
+func bucketMidpoint(lower, upper float64) float64 {
+	if math.IsInf(lower, 0) || math.IsInf(upper, 0) {
+		return finiteBound(lower, upper)
+	}
+
+	return lower + (upper-lower)/2
+}
+
+// finiteBound returns the preferred bound of a bucket, unless it is
+// infinite, in which case it returns the other bound, or zero if
+// both are infinite.
+func finiteBound(preferred, other float64) float64 {
+	if !math.IsInf(preferred, 0) {
+		return preferred
+	}
+
+	if !math.IsInf(other, 0) {
+		return other
+	}
+
+	return 0
+}
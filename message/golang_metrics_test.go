@@ -0,0 +1,87 @@
+package message
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"cdr.dev/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoMetrics(t *testing.T) {
+	for name, cmp := range map[string]Composer{
+		"CollectTotals": CollectGoMetricsTotals(),
+		"MakeTotals":    MakeGoMetricsTotals("totals"),
+		"NewTotals":     NewGoMetricsTotals(level.Info, "totals"),
+		"CollectDeltas": CollectGoMetricsDeltas(),
+		"MakeDeltas":    MakeGoMetricsDeltas("deltas"),
+		"NewDeltas":     NewGoMetricsDeltas(level.Info, "deltas"),
+		"CollectRates":  CollectGoMetricsRates(),
+		"MakeRates":     MakeGoMetricsRates("rates"),
+		"NewRates":      NewGoMetricsRates(level.Info, "rates"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, cmp.Loggable())
+			assert.NotEmpty(t, cmp.String())
+
+			m, ok := cmp.Raw().(*GoRuntimeMetrics)
+			require.True(t, ok)
+			assert.Contains(t, m.Values, "/gc/heap/allocs:bytes")
+			assert.Contains(t, m.Histograms, "/sched/latencies:seconds")
+
+			_, err := json.Marshal(m)
+			assert.NoError(t, err)
+		})
+	}
+	t.Run("IndependentDeltas", func(t *testing.T) {
+		c := NewGoMetricsCollector()
+		assert.True(t, c.Totals("").Loggable())
+
+		garbage := make([][]byte, 0, 100)
+		for i := 0; i < 100; i++ {
+			garbage = append(garbage, make([]byte, 4096))
+		}
+		assert.Len(t, garbage, 100)
+
+		deltas := c.Deltas("").(*GoRuntimeMetrics)
+		assert.True(t, deltas.Duration > 0)
+		allocs := deltas.Values["/gc/heap/allocs:bytes"]
+		assert.True(t, allocs >= 100*4096)
+
+		// non-cumulative metrics are reported as is
+		assert.True(t, deltas.Values["/sched/goroutines:goroutines"] > 0)
+
+		rates := c.Rates("").(*GoRuntimeMetrics)
+		assert.True(t, rates.Duration > 0)
+	})
+}
+
+func TestHistogramSummary(t *testing.T) {
+	buckets := []float64{math.Inf(-1), 0, 10, 20, 30, math.Inf(1)}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Zero(t, summarizeHistogram([]uint64{0, 0, 0, 0, 0}, buckets))
+		assert.Zero(t, summarizeHistogram([]uint64{1}, buckets))
+	})
+	t.Run("Interpolated", func(t *testing.T) {
+		s := summarizeHistogram([]uint64{0, 10, 0, 10, 0}, buckets)
+		assert.EqualValues(t, 20, s.Count)
+		assert.Equal(t, 0.0, s.Min)
+		assert.Equal(t, 30.0, s.Max)
+		assert.Equal(t, 15.0, s.Mean)
+		assert.Equal(t, 300.0, s.Sum)
+		assert.Equal(t, 10.0, s.P50)
+		assert.Equal(t, 28.0, s.P90)
+	})
+	t.Run("InfiniteBuckets", func(t *testing.T) {
+		s := summarizeHistogram([]uint64{1, 0, 0, 0, 1}, buckets)
+		assert.Equal(t, 0.0, s.Min)
+		assert.Equal(t, 30.0, s.Max)
+		assert.Equal(t, 30.0, s.P99)
+
+		_, err := json.Marshal(s)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,347 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cdr.dev/grip/level"
+)
+
+// GoroutineRecord describes the state and stack of a single goroutine,
+// as parsed from the output of runtime.Stack.
+type GoroutineRecord struct {
+	ID             int64         `bson:"id" json:"id" yaml:"id"`
+	State          string        `bson:"state" json:"state" yaml:"state"`
+	WaitDuration   time.Duration `bson:"wait_duration,omitempty" json:"wait_duration,omitempty" yaml:"wait_duration,omitempty"`
+	LockedToThread bool          `bson:"locked_to_thread,omitempty" json:"locked_to_thread,omitempty" yaml:"locked_to_thread,omitempty"`
+	Frames         StackFrames   `bson:"frames" json:"frames" yaml:"frames"`
+	CreatedBy      *StackFrame   `bson:"created_by,omitempty" json:"created_by,omitempty" yaml:"created_by,omitempty"`
+}
+
+// GoroutineGroup collects goroutines that have the same state and
+// identical stacks. The MaxWaitDuration is the longest that any
+// goroutine in the group has been waiting.
+type GoroutineGroup struct {
+	Count           int           `bson:"count" json:"count" yaml:"count"`
+	State           string        `bson:"state" json:"state" yaml:"state"`
+	IDs             []int64       `bson:"ids" json:"ids" yaml:"ids"`
+	MaxWaitDuration time.Duration `bson:"max_wait_duration,omitempty" json:"max_wait_duration,omitempty" yaml:"max_wait_duration,omitempty"`
+	Frames          StackFrames   `bson:"frames" json:"frames" yaml:"frames"`
+	CreatedBy       *StackFrame   `bson:"created_by,omitempty" json:"created_by,omitempty" yaml:"created_by,omitempty"`
+}
+
+// GoroutineDump is a Composer that holds a snapshot of the stacks of
+// all goroutines in the process, grouped by identical stacks, ordered
+// so that the largest groups are first. The States field counts
+// goroutines in each state, which is often enough on its own to
+// diagnose leaks and deadlocks.
+type GoroutineDump struct {
+	Message string           `bson:"message,omitempty" json:"message,omitempty" yaml:"message,omitempty"`
+	Total   int              `bson:"total" json:"total" yaml:"total"`
+	States  map[string]int   `bson:"states" json:"states" yaml:"states"`
+	Groups  []GoroutineGroup `bson:"groups" json:"groups" yaml:"groups"`
+	Errors  []string         `bson:"errors,omitempty" json:"errors,omitempty" yaml:"errors,omitempty"`
+	Base    `json:"metadata,omitempty" bson:"metadata,omitempty" yaml:"metadata,omitempty"`
+
+	loggable bool
+	rendered string
+}
+
+// CollectGoroutines captures the stacks of all goroutines in the
+// process, and returns a GoroutineDump Composer.
+//
+// Like the stack Composers, and unlike most Composers, the snapshot
+// is captured when the Composer is constructed, rather than when the
+// message is sent.
+func CollectGoroutines() Composer {
+	return buildGoroutineDump("")
+}
+
+// MakeGoroutines has the same semantics as CollectGoroutines, but
+// additionally allows you to set a message string to annotate the
+// data.
+func MakeGoroutines(msg string) Composer {
+	return buildGoroutineDump(msg)
+}
+
+// NewGoroutines has the same semantics as CollectGoroutines, but
+// additionally allows you to set a message string and log level to
+// annotate the data.
+func NewGoroutines(p level.Priority, msg string) Composer {
+	m := buildGoroutineDump(msg)
+	_ = m.SetPriority(p)
+	return m
+}
+
+func buildGoroutineDump(msg string) *GoroutineDump {
+	m := &GoroutineDump{Message: msg}
+
+	records, err := ParseGoroutineStacks(captureAllStacks())
+	if err != nil {
+		m.Errors = append(m.Errors, err.Error())
+	}
+	m.setRecords(records)
+
+	return m
+}
+
+// Loggable returns true when the GoroutineDump contains at least one
+// goroutine. Loggable is part of the Composer interface.
+func (m *GoroutineDump) Loggable() bool { return m.loggable }
+
+// Raw is part of the Composer interface and returns the GoroutineDump
+// object itself.
+func (m *GoroutineDump) Raw() interface{} { _ = m.Collect(); return m }
+
+// String renders a summary of the goroutines states, followed by
+// each group of goroutines with its count and the call site at the
+// top of its stack.
+func (m *GoroutineDump) String() string {
+	_ = m.Collect()
+
+	if m.rendered != "" {
+		return m.rendered
+	}
+
+	states := make([]string, 0, len(m.States))
+	for state, count := range m.States {
+		states = append(states, fmt.Sprintf("%s=%d", state, count))
+	}
+	sort.Strings(states)
+
+	buf := &strings.Builder{}
+	if m.Message != "" {
+		buf.WriteString(m.Message)
+		buf.WriteString(": ")
+	}
+	fmt.Fprintf(buf, "goroutines=%d [%s]", m.Total, strings.Join(states, ", "))
+
+	for _, g := range m.Groups {
+		fmt.Fprintf(buf, "\n%d x [%s", g.Count, g.State)
+		if g.MaxWaitDuration > 0 {
+			fmt.Fprintf(buf, ", %s", g.MaxWaitDuration)
+		}
+		buf.WriteString("]")
+		if len(g.Frames) > 0 {
+			fmt.Fprintf(buf, " %s", g.Frames[0].Function)
+		}
+	}
+
+	m.rendered = buf.String()
+	return m.rendered
+}
+
+func (m *GoroutineDump) setRecords(records []GoroutineRecord) {
+	m.Total = len(records)
+	m.States = map[string]int{}
+	m.Groups = nil
+
+	index := map[string]int{}
+	for _, r := range records {
+		m.States[r.State]++
+
+		key := r.groupKey()
+		idx, ok := index[key]
+		if !ok {
+			idx = len(m.Groups)
+			index[key] = idx
+			m.Groups = append(m.Groups, GoroutineGroup{
+				State:     r.State,
+				Frames:    r.Frames,
+				CreatedBy: r.CreatedBy,
+			})
+		}
+
+		g := &m.Groups[idx]
+		g.Count++
+		g.IDs = append(g.IDs, r.ID)
+		if r.WaitDuration > g.MaxWaitDuration {
+			g.MaxWaitDuration = r.WaitDuration
+		}
+	}
+
+	sort.SliceStable(m.Groups, func(i, j int) bool { return m.Groups[i].Count > m.Groups[j].Count })
+
+	m.loggable = m.Total > 0
+	m.rendered = ""
+}
+
+func (r GoroutineRecord) groupKey() string {
+	buf := &strings.Builder{}
+	buf.WriteString(r.State)
+	for _, f := range r.Frames {
+		fmt.Fprintf(buf, "|%s:%s:%d", f.Function, f.File, f.Line)
+	}
+	if r.CreatedBy != nil {
+		fmt.Fprintf(buf, "|created:%s:%s:%d", r.CreatedBy.Function, r.CreatedBy.File, r.CreatedBy.Line)
+	}
+
+	return buf.String()
+}
+
+////////////////////////////////////////////////////////////////////////
+//
+// Parsing runtime.Stack output
+//
+////////////////////////////////////////////////////////////////////////
+
+var goroutineHeaderRegexp = regexp.MustCompile(`^goroutine (\d+)(?: [^\[]*)? \[(.*)\]:$`)
+
+func captureAllStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// ParseGoroutineStacks parses the output of runtime.Stack, or a
+// goroutine dump produced by a panic or a SIGQUIT, into a record for
+// each goroutine. Frames which cannot be parsed are skipped, and
+// reported in the error, while the remaining records are returned.
+func ParseGoroutineStacks(data []byte) ([]GoroutineRecord, error) {
+	var (
+		out     []GoroutineRecord
+		current *GoroutineRecord
+		frame   *StackFrame
+		created bool
+		errs    []string
+	)
+
+	flush := func() {
+		if current != nil {
+			out = append(out, *current)
+		}
+		current = nil
+		frame = nil
+		created = false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "goroutine "):
+			flush()
+			match := goroutineHeaderRegexp.FindStringSubmatch(line)
+			if match == nil {
+				errs = append(errs, fmt.Sprintf("malformed goroutine header %q", line))
+				continue
+			}
+			current = parseGoroutineHeader(match[1], match[2])
+		case current == nil:
+			continue
+		case strings.HasPrefix(line, "\t"):
+			if frame == nil {
+				continue
+			}
+			if err := parseFrameLocation(frame, strings.TrimSpace(line)); err != nil {
+				errs = append(errs, err.Error())
+			}
+			if created {
+				current.CreatedBy = frame
+			} else {
+				current.Frames = append(current.Frames, *frame)
+			}
+			frame = nil
+		case strings.HasPrefix(line, "created by "):
+			created = true
+			fn := strings.TrimPrefix(line, "created by ")
+			if idx := strings.Index(fn, " in goroutine "); idx >= 0 {
+				fn = fn[:idx]
+			}
+			frame = &StackFrame{Function: fn}
+		case strings.HasPrefix(line, "..."):
+			continue
+		default:
+			frame = &StackFrame{Function: trimFunctionArgs(line)}
+		}
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return out, fmt.Errorf("problem parsing goroutine stacks: %s", strings.Join(errs, "; "))
+	}
+
+	return out, nil
+}
+
+func parseGoroutineHeader(id, status string) *GoroutineRecord {
+	r := &GoroutineRecord{}
+	r.ID, _ = strconv.ParseInt(id, 10, 64)
+
+	parts := strings.Split(status, ", ")
+	r.State = parts[0]
+	for _, part := range parts[1:] {
+		switch {
+		case part == "locked to thread":
+			r.LockedToThread = true
+		case strings.HasSuffix(part, " minutes"):
+			if mins, err := strconv.Atoi(strings.TrimSuffix(part, " minutes")); err == nil {
+				r.WaitDuration = time.Duration(mins) * time.Minute
+			}
+		}
+	}
+
+	return r
+}
+
+func parseFrameLocation(f *StackFrame, loc string) error {
+	if idx := strings.LastIndex(loc, " +0x"); idx >= 0 {
+		loc = loc[:idx]
+	}
+
+	idx := strings.LastIndex(loc, ":")
+	if idx < 0 {
+		f.File = loc
+		return fmt.Errorf("frame location %q has no line number", loc)
+	}
+
+	f.File = loc[:idx]
+	line, err := strconv.Atoi(loc[idx+1:])
+	if err != nil {
+		return fmt.Errorf("frame location %q has invalid line number", loc)
+	}
+	f.Line = line
+
+	return nil
+}
+
+func trimFunctionArgs(fn string) string {
+	if !strings.HasSuffix(fn, ")") {
+		return fn
+	}
+
+	depth := 0
+	for idx := len(fn) - 1; idx >= 0; idx-- {
+		switch fn[idx] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+			if depth == 0 {
+				return fn[:idx]
+			}
+		}
+	}
+
+	return fn
+}
@@ -0,0 +1,121 @@
+package message
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const goroutineFixture = `goroutine 1 [running]:
+main.main()
+	/src/app/main.go:10 +0x25
+
+goroutine 18 [chan receive, 5 minutes]:
+main.worker(0xc000010000, {0x4b2a10, 0x3})
+	/src/app/worker.go:42 +0x65
+created by main.start in goroutine 1
+	/src/app/worker.go:20 +0x85
+
+goroutine 19 [chan receive, 12 minutes]:
+main.worker(0xc000010008, {0x4b2a10, 0x3})
+	/src/app/worker.go:42 +0x65
+created by main.start in goroutine 1
+	/src/app/worker.go:20 +0x85
+
+goroutine 7 [select, locked to thread]:
+runtime.(*Timer).run(...)
+	/usr/lib/go/src/runtime/time.go:100
+...additional frames elided...
+`
+
+func TestGoroutineStackParser(t *testing.T) {
+	records, err := ParseGoroutineStacks([]byte(goroutineFixture))
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+
+	assert.EqualValues(t, 1, records[0].ID)
+	assert.Equal(t, "running", records[0].State)
+	assert.Equal(t, StackFrames{{Function: "main.main", File: "/src/app/main.go", Line: 10}}, records[0].Frames)
+	assert.Nil(t, records[0].CreatedBy)
+
+	assert.EqualValues(t, 18, records[1].ID)
+	assert.Equal(t, "chan receive", records[1].State)
+	assert.Equal(t, 5*time.Minute, records[1].WaitDuration)
+	assert.Equal(t, "main.worker", records[1].Frames[0].Function)
+	require.NotNil(t, records[1].CreatedBy)
+	assert.Equal(t, StackFrame{Function: "main.start", File: "/src/app/worker.go", Line: 20}, *records[1].CreatedBy)
+
+	assert.Equal(t, "select", records[3].State)
+	assert.True(t, records[3].LockedToThread)
+	assert.Equal(t, "runtime.(*Timer).run", records[3].Frames[0].Function)
+
+	t.Run("Malformed", func(t *testing.T) {
+		records, err := ParseGoroutineStacks([]byte("goroutine one [running]:\nmain.main()\n\t/src/main.go:10\n"))
+		assert.Error(t, err)
+		assert.Empty(t, records)
+	})
+}
+
+func TestGoroutineDump(t *testing.T) {
+	t.Run("Grouping", func(t *testing.T) {
+		records, err := ParseGoroutineStacks([]byte(goroutineFixture))
+		require.NoError(t, err)
+
+		m := &GoroutineDump{}
+		m.setRecords(records)
+		assert.True(t, m.Loggable())
+		assert.Equal(t, 4, m.Total)
+		assert.Equal(t, map[string]int{"running": 1, "chan receive": 2, "select": 1}, m.States)
+		require.Len(t, m.Groups, 3)
+		assert.Equal(t, 2, m.Groups[0].Count)
+		assert.Equal(t, []int64{18, 19}, m.Groups[0].IDs)
+		assert.Equal(t, 12*time.Minute, m.Groups[0].MaxWaitDuration)
+		assert.Contains(t, m.String(), "2 x [chan receive, 12m0s] main.worker")
+	})
+	t.Run("Collect", func(t *testing.T) {
+		wg := &sync.WaitGroup{}
+		block := make(chan struct{})
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-block
+			}()
+		}
+		defer wg.Wait()
+		defer close(block)
+
+		var (
+			m     Composer
+			found bool
+		)
+		// the goroutines may not have parked yet
+		for attempt := 0; attempt < 100 && !found; attempt++ {
+			m = NewGoroutines(level.Info, "snapshot")
+			for _, g := range m.Raw().(*GoroutineDump).Groups {
+				if g.State == "chan receive" && g.Count >= 8 {
+					found = true
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		assert.True(t, found)
+		assert.True(t, m.Loggable())
+		assert.Equal(t, level.Info, m.Priority())
+		assert.True(t, strings.HasPrefix(m.String(), "snapshot: goroutines="))
+
+		dump, ok := m.Raw().(*GoroutineDump)
+		require.True(t, ok)
+		assert.Empty(t, dump.Errors)
+		assert.True(t, dump.Total >= 9)
+
+		_, err := json.Marshal(m.Raw())
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,189 @@
+package message
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/level"
+	"github.com/montanaflynn/stats"
+)
+
+// DefaultHistogramSamples is the number of observations that a
+// Histogram retains, by default, to estimate quantiles.
+const DefaultHistogramSamples = 1024
+
+// Histogram is a Composer that accumulates observations, such as
+// request latencies, and reports the count, minimum, maximum, mean,
+// and 50th, 90th, and 99th percentiles of the observations as a
+// HistogramSummary.
+//
+// The count, minimum, maximum, and mean are exact. To bound its
+// memory use, the Histogram estimates the percentiles from a uniform
+// random sample of the observations, of at most a fixed size.
+//
+// Histograms are safe for concurrent use: the Raw and String methods
+// report a snapshot of the observations at the time of the call. Use
+// Reset to start a new interval after logging a Histogram.
+type Histogram struct {
+	Message string `bson:"message,omitempty" json:"message,omitempty" yaml:"message,omitempty"`
+	// Unit describes the units of the observations. Histograms
+	// that record durations report them in seconds.
+	Unit string `bson:"unit,omitempty" json:"unit,omitempty" yaml:"unit,omitempty"`
+	HistogramSummary
+	Base `json:"metadata,omitempty" bson:"metadata,omitempty" yaml:"metadata,omitempty"`
+
+	mu         sync.Mutex
+	maxSamples int
+	samples    []float64
+	count      uint64
+	sum        float64
+	min        float64
+	max        float64
+	random     *rand.Rand
+}
+
+// MakeHistogram constructs an empty Histogram with the specified
+// message.
+func MakeHistogram(message string) *Histogram {
+	return NewHistogram(level.Info, message)
+}
+
+// NewHistogram constructs an empty Histogram with the specified
+// priority and message.
+func NewHistogram(p level.Priority, message string) *Histogram {
+	return NewHistogramWithSamples(p, message, DefaultHistogramSamples)
+}
+
+// NewHistogramWithSamples is the same as NewHistogram, but retains
+// the specified number of observations to estimate quantiles, which
+// trades memory for precision.
+func NewHistogramWithSamples(p level.Priority, message string, samples int) *Histogram {
+	if samples <= 0 {
+		samples = DefaultHistogramSamples
+	}
+
+	h := &Histogram{
+		Message:    message,
+		maxSamples: samples,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	_ = h.SetPriority(p)
+
+	return h
+}
+
+// Add records an observation.
+func (h *Histogram) Add(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += value
+
+	if h.count == 1 || value < h.min {
+		h.min = value
+	}
+	if h.count == 1 || value > h.max {
+		h.max = value
+	}
+
+	// reservoir sampling: each observation has an equal chance of
+	// being in the sample.
+	if len(h.samples) < h.maxSamples {
+		h.samples = append(h.samples, value)
+	} else if idx := h.random.Int63n(int64(h.count)); idx < int64(h.maxSamples) {
+		h.samples[idx] = value
+	}
+}
+
+// AddDuration records a duration, in seconds, and sets the unit of
+// the Histogram to "seconds" if it is unset.
+func (h *Histogram) AddDuration(d time.Duration) {
+	h.mu.Lock()
+	if h.Unit == "" {
+		h.Unit = "seconds"
+	}
+	h.mu.Unlock()
+
+	h.Add(d.Seconds())
+}
+
+// Reset discards all observations.
+func (h *Histogram) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.samples = h.samples[:0]
+	h.count = 0
+	h.sum = 0
+	h.min = 0
+	h.max = 0
+}
+
+// Summary returns the current summary of the observations.
+func (h *Histogram) Summary() HistogramSummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.summarize()
+}
+
+func (h *Histogram) summarize() HistogramSummary {
+	out := HistogramSummary{Count: h.count}
+	if h.count == 0 {
+		return out
+	}
+
+	out.Min = h.min
+	out.Max = h.max
+	out.Mean = h.sum / float64(h.count)
+	out.Sum = h.sum
+
+	data := stats.Float64Data(h.samples)
+	out.P50 = histogramPercentile(data, 50)
+	out.P90 = histogramPercentile(data, 90)
+	out.P99 = histogramPercentile(data, 99)
+
+	return out
+}
+
+func histogramPercentile(data stats.Float64Data, percent float64) float64 {
+	out, err := stats.PercentileNearestRank(data, percent)
+	if err != nil || math.IsNaN(out) {
+		return 0
+	}
+
+	return out
+}
+
+// Loggable returns true when the Histogram has at least one
+// observation.
+func (h *Histogram) Loggable() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.count > 0
+}
+
+// Raw returns a snapshot of the Histogram, with its summary
+// populated.
+func (h *Histogram) Raw() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_ = h.Collect()
+
+	return &Histogram{
+		Message:          h.Message,
+		Unit:             h.Unit,
+		HistogramSummary: h.summarize(),
+		Base:             h.Base,
+	}
+}
+
+// String renders the summary of the observations.
+func (h *Histogram) String() string {
+	return renderStatsString(h.Message, h.Raw())
+}
@@ -0,0 +1,96 @@
+package message
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		h := NewHistogram(level.Info, "empty")
+		assert.False(t, h.Loggable())
+		assert.Equal(t, HistogramSummary{}, h.Summary())
+		assert.Equal(t, level.Info, h.Priority())
+	})
+	t.Run("Summary", func(t *testing.T) {
+		h := MakeHistogram("values")
+		for i := 100; i >= 1; i-- {
+			h.Add(float64(i))
+		}
+		require.True(t, h.Loggable())
+
+		assert.Equal(t, HistogramSummary{
+			Count: 100,
+			Min:   1,
+			Max:   100,
+			Mean:  50.5,
+			Sum:   5050,
+			P50:   50,
+			P90:   90,
+			P99:   99,
+		}, h.Summary())
+	})
+	t.Run("Sampling", func(t *testing.T) {
+		h := NewHistogramWithSamples(level.Info, "sampled", 100)
+		for i := 1; i <= 10000; i++ {
+			h.Add(float64(i))
+		}
+
+		summary := h.Summary()
+		assert.Equal(t, uint64(10000), summary.Count)
+		assert.Equal(t, float64(1), summary.Min)
+		assert.Equal(t, float64(10000), summary.Max)
+		assert.Equal(t, 5000.5, summary.Mean)
+		assert.InDelta(t, 5000, summary.P50, 2000)
+		assert.Len(t, h.samples, 100)
+	})
+	t.Run("Durations", func(t *testing.T) {
+		h := MakeHistogram("latency")
+		h.AddDuration(time.Second)
+		h.AddDuration(3 * time.Second)
+
+		raw := h.Raw().(*Histogram)
+		assert.Equal(t, "seconds", raw.Unit)
+		assert.Equal(t, float64(2), raw.Mean)
+		assert.Equal(t, "latency", raw.Message)
+		assert.NotZero(t, raw.Pid)
+
+		out := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(h.String()[len("latency:\n"):]), &out))
+		assert.EqualValues(t, 2, out["count"])
+		assert.EqualValues(t, 3, out["max"])
+		assert.Equal(t, "seconds", out["unit"])
+	})
+	t.Run("Reset", func(t *testing.T) {
+		h := MakeHistogram("reset")
+		h.Add(42)
+		h.Reset()
+		assert.False(t, h.Loggable())
+		h.Add(-1)
+		assert.Equal(t, HistogramSummary{Count: 1, Min: -1, Max: -1, Mean: -1, Sum: -1, P50: -1, P90: -1, P99: -1}, h.Summary())
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		h := MakeHistogram("concurrent")
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					h.Add(float64(j))
+					if j%100 == 0 {
+						_ = h.String()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, uint64(8000), h.Summary().Count)
+	})
+}
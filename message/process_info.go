@@ -24,6 +24,8 @@ type ProcessInfo struct {
 	NetStat        []net.IOCountersStat     `json:"net" bson:"net"`
 	Memory         process.MemoryInfoStat   `json:"mem" bson:"mem"`
 	MemoryPlatform process.MemoryInfoExStat `json:"memExtra" bson:"memExtra"`
+	FDs            int32                    `json:"fds,omitempty" bson:"fds,omitempty"`
+	Smaps          *ProcessSmaps            `json:"smaps,omitempty" bson:"smaps,omitempty"`
 	Errors         []string                 `json:"errors" bson:"errors"`
 	Base           `json:"metadata,omitempty" bson:"metadata,omitempty"`
 	loggable       bool
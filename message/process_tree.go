@@ -0,0 +1,319 @@
+package message
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"cdr.dev/grip/level"
+	"github.com/shirou/gopsutil/process"
+)
+
+// ProcessTree is a Composer that captures a process and all of its
+// descendants, preserving the parent/child relationships between
+// them, and aggregates the resource use of each subtree.
+type ProcessTree struct {
+	Message string           `json:"message" bson:"message"`
+	Root    *ProcessTreeNode `json:"root" bson:"root"`
+	Errors  []string         `json:"errors,omitempty" bson:"errors,omitempty"`
+	Base    `json:"metadata,omitempty" bson:"metadata,omitempty"`
+
+	// observed holds the keys of all of the processes in the tree
+	// when it was collected, including those that the filter
+	// excluded.
+	observed map[string]struct{}
+	loggable bool
+	rendered string
+}
+
+// ProcessTreeNode holds a single process in a ProcessTree. Matched
+// reports whether the process matched the tree's filter; processes
+// that do not match are only included in the tree when one of their
+// descendants does. The Totals aggregate the resource use of all
+// matching processes in the subtree, including the process itself.
+type ProcessTreeNode struct {
+	Info       *ProcessInfo       `json:"info" bson:"info"`
+	User       string             `json:"user,omitempty" bson:"user,omitempty"`
+	CreateTime int64              `json:"create_time" bson:"create_time"`
+	Matched    bool               `json:"matched" bson:"matched"`
+	Totals     ProcessTreeTotals  `json:"totals" bson:"totals"`
+	Children   []*ProcessTreeNode `json:"children,omitempty" bson:"children,omitempty"`
+}
+
+// ProcessTreeTotals aggregates the resource use of a group of
+// processes.
+type ProcessTreeTotals struct {
+	Processes  int          `json:"processes" bson:"processes"`
+	Threads    int          `json:"threads" bson:"threads"`
+	CPU        StatCPUTimes `json:"cpu" bson:"cpu"`
+	RSS        uint64       `json:"rss" bson:"rss"`
+	VMS        uint64       `json:"vms" bson:"vms"`
+	ReadBytes  uint64       `json:"read_bytes" bson:"read_bytes"`
+	WriteBytes uint64       `json:"write_bytes" bson:"write_bytes"`
+}
+
+// ProcessFilter selects processes by their properties. A process
+// matches the filter if it matches all of the specified criteria. The
+// zero value matches all processes.
+type ProcessFilter struct {
+	// Command, if specified, must match the command line of the
+	// process.
+	Command *regexp.Regexp
+	// User, if specified, must equal the name of the user that
+	// owns the process.
+	User string
+	// MinRSS is the smallest resident memory, in bytes, of
+	// matching processes.
+	MinRSS uint64
+}
+
+func (f *ProcessFilter) match(info *ProcessInfo, user string) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.Command != nil && !f.Command.MatchString(info.Command) {
+		return false
+	}
+
+	if f.User != "" && f.User != user {
+		return false
+	}
+
+	return info.Memory.RSS >= f.MinRSS
+}
+
+// CollectProcessTree returns a ProcessTree Composer for the process
+// with the specified pid and all of its descendants.
+func CollectProcessTree(pid int32) Composer {
+	return NewProcessTree(level.Trace, pid, "", nil)
+}
+
+// CollectProcessTreeSelf returns a ProcessTree Composer for the
+// current process and all of its descendants.
+func CollectProcessTreeSelf() Composer {
+	return NewProcessTree(level.Trace, int32(os.Getpid()), "", nil)
+}
+
+// NewProcessTree returns a fully configured ProcessTree Composer for
+// the process with the specified pid and all of its descendants. If
+// the filter is non-nil, the tree includes only the processes that
+// match the filter and their ancestors. The root process is always
+// included.
+func NewProcessTree(priority level.Priority, pid int32, message string, filter *ProcessFilter) Composer {
+	t := &ProcessTree{Message: message}
+
+	if err := t.SetPriority(priority); err != nil {
+		t.Errors = append(t.Errors, fmt.Sprintf("priority: %v", err))
+		return t
+	}
+
+	proc, err := process.NewProcess(pid)
+	if err != nil {
+		t.Errors = append(t.Errors, fmt.Sprintf("process: %v", err))
+		return t
+	}
+
+	t.observed = map[string]struct{}{}
+	t.Root = buildProcessTreeNode(proc, filter, t.observed)
+	t.loggable = true
+
+	return t
+}
+
+// Loggable returns true when the ProcessTree has been populated.
+func (t *ProcessTree) Loggable() bool { return t.loggable }
+
+// Raw always returns the ProcessTree object.
+func (t *ProcessTree) Raw() interface{} { _ = t.Collect(); return t }
+
+// String returns a string representation of the message, lazily
+// rendering the message, and caching it privately.
+func (t *ProcessTree) String() string {
+	if t.rendered == "" {
+		t.rendered = renderStatsString(t.Message, t)
+	}
+
+	return t.rendered
+}
+
+// Flatten returns the processes in the tree, in depth first order.
+func (t *ProcessTree) Flatten() []*ProcessTreeNode {
+	if t.Root == nil {
+		return nil
+	}
+
+	return t.Root.flatten(nil)
+}
+
+func (n *ProcessTreeNode) flatten(out []*ProcessTreeNode) []*ProcessTreeNode {
+	out = append(out, n)
+	for _, child := range n.Children {
+		out = child.flatten(out)
+	}
+
+	return out
+}
+
+func (n *ProcessTreeNode) key() string { return fmt.Sprintf("%d:%d", n.Info.Pid, n.CreateTime) }
+
+func buildProcessTreeNode(proc *process.Process, filter *ProcessFilter, observed map[string]struct{}) *ProcessTreeNode {
+	info := &ProcessInfo{loggable: true}
+	info.populate(proc)
+
+	node := &ProcessTreeNode{Info: info}
+
+	var err error
+	node.User, err = proc.Username()
+	info.saveError("username", err)
+	node.CreateTime, err = proc.CreateTime()
+	info.saveError("create_time", err)
+	observed[node.key()] = struct{}{}
+
+	node.Matched = filter.match(info, node.User)
+	if node.Matched {
+		node.Totals.add(info)
+	}
+
+	children, _ := proc.Children()
+	for _, child := range children {
+		cn := buildProcessTreeNode(child, filter, observed)
+		if !cn.Matched && len(cn.Children) == 0 {
+			continue
+		}
+
+		node.Children = append(node.Children, cn)
+		node.Totals.merge(cn.Totals)
+	}
+
+	sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Info.Pid < node.Children[j].Info.Pid })
+
+	return node
+}
+
+func (t *ProcessTreeTotals) add(info *ProcessInfo) {
+	t.merge(ProcessTreeTotals{
+		Processes:  1,
+		Threads:    info.Threads,
+		CPU:        info.CPU,
+		RSS:        info.Memory.RSS,
+		VMS:        info.Memory.VMS,
+		ReadBytes:  info.IoStat.ReadBytes,
+		WriteBytes: info.IoStat.WriteBytes,
+	})
+}
+
+func (t *ProcessTreeTotals) merge(o ProcessTreeTotals) {
+	t.Processes += o.Processes
+	t.Threads += o.Threads
+	t.RSS += o.RSS
+	t.VMS += o.VMS
+	t.ReadBytes += o.ReadBytes
+	t.WriteBytes += o.WriteBytes
+	t.CPU.User += o.CPU.User
+	t.CPU.System += o.CPU.System
+	t.CPU.Idle += o.CPU.Idle
+	t.CPU.Nice += o.CPU.Nice
+	t.CPU.Iowait += o.CPU.Iowait
+	t.CPU.Irq += o.CPU.Irq
+	t.CPU.Softirq += o.CPU.Softirq
+	t.CPU.Steal += o.CPU.Steal
+	t.CPU.Guest += o.CPU.Guest
+	t.CPU.GuestNice += o.CPU.GuestNice
+}
+
+////////////////////////////////////////////////////////////////////////
+//
+// Process Tree Diffs
+//
+////////////////////////////////////////////////////////////////////////
+
+// ProcessTreeDiff is a Composer that reports the processes that were
+// spawned and the processes that exited between two ProcessTree
+// snapshots. Processes are identified by their pid and creation time,
+// so that reused pids are reported correctly.
+type ProcessTreeDiff struct {
+	Message string         `json:"message" bson:"message"`
+	Spawned []*ProcessInfo `json:"spawned" bson:"spawned"`
+	Exited  []*ProcessInfo `json:"exited" bson:"exited"`
+	Base    `json:"metadata,omitempty" bson:"metadata,omitempty"`
+
+	rendered string
+}
+
+// NewProcessTreeDiff compares two ProcessTree Composers, as produced
+// by CollectProcessTree or NewProcessTree, and returns a Composer
+// that reports the processes that appear only in the later snapshot
+// as spawned, and the processes that appear only in the earlier
+// snapshot as exited. Only processes that match the filter of the
+// snapshot that includes them are reported, and processes that the
+// other snapshot's filter excluded, for instance because their memory
+// use crossed the MinRSS threshold, are not reported as spawned or
+// exited. The message is only loggable if the snapshots differ.
+func NewProcessTreeDiff(priority level.Priority, message string, before, after Composer) Composer {
+	d := &ProcessTreeDiff{Message: message}
+	_ = d.SetPriority(priority)
+
+	previous, previousObserved := processTreeIndex(before)
+	current, currentObserved := processTreeIndex(after)
+
+	for key, node := range current {
+		if _, ok := previousObserved[key]; !ok {
+			d.Spawned = append(d.Spawned, node.Info)
+		}
+	}
+
+	for key, node := range previous {
+		if _, ok := currentObserved[key]; !ok {
+			d.Exited = append(d.Exited, node.Info)
+		}
+	}
+
+	sort.Slice(d.Spawned, func(i, j int) bool { return d.Spawned[i].Pid < d.Spawned[j].Pid })
+	sort.Slice(d.Exited, func(i, j int) bool { return d.Exited[i].Pid < d.Exited[j].Pid })
+
+	return d
+}
+
+// processTreeIndex returns the processes in the tree that matched its
+// filter, and the keys of all of the processes observed when
+// collecting the tree.
+func processTreeIndex(m Composer) (map[string]*ProcessTreeNode, map[string]struct{}) {
+	matched := map[string]*ProcessTreeNode{}
+	observed := map[string]struct{}{}
+
+	tree, ok := m.(*ProcessTree)
+	if !ok {
+		return matched, observed
+	}
+
+	for _, node := range tree.Flatten() {
+		if node.Matched {
+			matched[node.key()] = node
+		}
+		observed[node.key()] = struct{}{}
+	}
+	for key := range tree.observed {
+		observed[key] = struct{}{}
+	}
+
+	return matched, observed
+}
+
+// Loggable returns true when processes were spawned or exited between
+// the snapshots.
+func (d *ProcessTreeDiff) Loggable() bool { return len(d.Spawned) > 0 || len(d.Exited) > 0 }
+
+// Raw always returns the ProcessTreeDiff object.
+func (d *ProcessTreeDiff) Raw() interface{} { _ = d.Collect(); return d }
+
+// String returns a string representation of the message, lazily
+// rendering the message, and caching it privately.
+func (d *ProcessTreeDiff) String() string {
+	if d.rendered == "" {
+		d.rendered = renderStatsString(d.Message, d)
+	}
+
+	return d.rendered
+}
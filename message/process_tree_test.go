@@ -0,0 +1,142 @@
+package message
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"testing"
+
+	"cdr.dev/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessTree(t *testing.T) {
+	myPid := int32(os.Getpid())
+
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	childPid := int32(cmd.Process.Pid)
+	defer func() { _ = cmd.Process.Kill(); _ = cmd.Wait() }()
+
+	t.Run("Structure", func(t *testing.T) {
+		msg := CollectProcessTreeSelf()
+		require.True(t, msg.Loggable())
+
+		tree := msg.Raw().(*ProcessTree)
+		require.NotNil(t, tree.Root)
+		assert.Equal(t, myPid, tree.Root.Info.Pid)
+		assert.True(t, tree.Root.Matched)
+
+		var found *ProcessTreeNode
+		for _, child := range tree.Root.Children {
+			if child.Info.Pid == childPid {
+				found = child
+			}
+		}
+		require.NotNil(t, found)
+		assert.Equal(t, myPid, found.Info.Parent)
+		assert.True(t, found.Totals.Processes >= 1)
+
+		assert.True(t, tree.Root.Totals.Processes >= 2)
+		assert.True(t, tree.Root.Totals.RSS >= tree.Root.Info.Memory.RSS+found.Info.Memory.RSS)
+		assert.Len(t, tree.Flatten(), tree.Root.Totals.Processes)
+		assert.NotEmpty(t, msg.String())
+	})
+	t.Run("Filter", func(t *testing.T) {
+		msg := NewProcessTree(level.Info, myPid, "tree", &ProcessFilter{Command: regexp.MustCompile("^sleep 10$")})
+		tree := msg.Raw().(*ProcessTree)
+		require.NotNil(t, tree.Root)
+		assert.Equal(t, myPid, tree.Root.Info.Pid)
+		assert.False(t, tree.Root.Matched)
+		require.Len(t, tree.Root.Children, 1)
+		assert.Equal(t, childPid, tree.Root.Children[0].Info.Pid)
+		assert.Equal(t, 1, tree.Root.Totals.Processes)
+		assert.Equal(t, tree.Root.Children[0].Info.Memory.RSS, tree.Root.Totals.RSS)
+
+		msg = NewProcessTree(level.Info, myPid, "tree", &ProcessFilter{MinRSS: 1 << 50})
+		tree = msg.Raw().(*ProcessTree)
+		require.NotNil(t, tree.Root)
+		assert.Empty(t, tree.Root.Children)
+		assert.Equal(t, 0, tree.Root.Totals.Processes)
+
+		msg = NewProcessTree(level.Info, myPid, "tree", &ProcessFilter{User: tree.Root.User})
+		tree = msg.Raw().(*ProcessTree)
+		assert.True(t, tree.Root.Matched)
+	})
+	t.Run("Diff", func(t *testing.T) {
+		// restrict the snapshots to the spawned process, so that
+		// processes started by other tests don't affect the diff
+		filter := &ProcessFilter{Command: regexp.MustCompile("^sleep 11$")}
+		snapshot := func() Composer { return NewProcessTree(level.Info, myPid, "tree", filter) }
+		before := snapshot()
+
+		other := exec.Command("sleep", "11")
+		require.NoError(t, other.Start())
+		otherPid := int32(other.Process.Pid)
+
+		during := snapshot()
+		diff := NewProcessTreeDiff(level.Info, "diff", before, during).Raw().(*ProcessTreeDiff)
+		assert.True(t, diff.Loggable())
+		require.Len(t, diff.Spawned, 1)
+		assert.Equal(t, otherPid, diff.Spawned[0].Pid)
+		assert.Empty(t, diff.Exited)
+
+		require.NoError(t, other.Process.Kill())
+		_ = other.Wait()
+
+		after := snapshot()
+		diff = NewProcessTreeDiff(level.Info, "diff", during, after).Raw().(*ProcessTreeDiff)
+		assert.Empty(t, diff.Spawned)
+		require.Len(t, diff.Exited, 1)
+		assert.Equal(t, otherPid, diff.Exited[0].Pid)
+
+		assert.False(t, NewProcessTreeDiff(level.Info, "diff", after, after).Loggable())
+	})
+	t.Run("DiffFiltered", func(t *testing.T) {
+		filter := &ProcessFilter{MinRSS: 100}
+		node := func(pid int32, rss uint64, children ...*ProcessTreeNode) *ProcessTreeNode {
+			info := &ProcessInfo{Pid: pid}
+			info.Memory.RSS = rss
+			return &ProcessTreeNode{Info: info, CreateTime: 1, Matched: filter.match(info, ""), Children: children}
+		}
+		// snapshot keeps the processes that match the filter and
+		// their ancestors, like NewProcessTree.
+		snapshot := func(root *ProcessTreeNode) Composer {
+			tree := &ProcessTree{Root: root, observed: map[string]struct{}{}}
+			var prune func(*ProcessTreeNode) bool
+			prune = func(n *ProcessTreeNode) bool {
+				tree.observed[n.key()] = struct{}{}
+				kept := n.Children[:0]
+				for _, child := range n.Children {
+					if prune(child) {
+						kept = append(kept, child)
+					}
+				}
+				n.Children = kept
+				return n.Matched || len(kept) > 0
+			}
+			prune(root)
+			return tree
+		}
+
+		// the process with pid 2 crosses the threshold, and the
+		// unmatched process with pid 3 is only included in the
+		// tree while its child, with pid 4, runs.
+		before := snapshot(node(1, 0, node(2, 50), node(3, 0, node(4, 200))))
+		after := snapshot(node(1, 0, node(2, 150), node(3, 0), node(5, 300)))
+
+		diff := NewProcessTreeDiff(level.Info, "diff", before, after).Raw().(*ProcessTreeDiff)
+		require.Len(t, diff.Spawned, 1)
+		assert.Equal(t, int32(5), diff.Spawned[0].Pid)
+		require.Len(t, diff.Exited, 1)
+		assert.Equal(t, int32(4), diff.Exited[0].Pid)
+
+		diff = NewProcessTreeDiff(level.Info, "diff", after, snapshot(node(1, 0, node(2, 50), node(3, 0), node(5, 300)))).Raw().(*ProcessTreeDiff)
+		assert.False(t, diff.Loggable())
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		assert.False(t, NewProcessTree(level.Invalid, myPid, "tree", nil).Loggable())
+		assert.False(t, CollectProcessTree(-1).Loggable())
+	})
+}
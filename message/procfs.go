@@ -0,0 +1,540 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cdr.dev/grip/level"
+	"github.com/shirou/gopsutil/net"
+)
+
+// ProcessSmaps reports the memory of a process, in bytes, as
+// aggregated across all of its mappings by the kernel in
+// /proc/<pid>/smaps_rollup. Unlike RSS, the proportional set size
+// (Pss) divides shared pages among the processes that map them.
+type ProcessSmaps struct {
+	Rss          uint64 `json:"rss" bson:"rss"`
+	Pss          uint64 `json:"pss" bson:"pss"`
+	SharedClean  uint64 `json:"shared_clean" bson:"shared_clean"`
+	SharedDirty  uint64 `json:"shared_dirty" bson:"shared_dirty"`
+	PrivateClean uint64 `json:"private_clean" bson:"private_clean"`
+	PrivateDirty uint64 `json:"private_dirty" bson:"private_dirty"`
+	Anonymous    uint64 `json:"anonymous" bson:"anonymous"`
+	Swap         uint64 `json:"swap" bson:"swap"`
+	SwapPss      uint64 `json:"swap_pss" bson:"swap_pss"`
+}
+
+// PressureStats reports the pressure stall information for the
+// system, which describes the share of time in which tasks were
+// delayed waiting for each resource.
+type PressureStats struct {
+	CPU    PressureStat `json:"cpu" bson:"cpu"`
+	Memory PressureStat `json:"memory" bson:"memory"`
+	IO     PressureStat `json:"io" bson:"io"`
+}
+
+// PressureStat reports the pressure on a single resource. Some
+// describes the time in which at least one task was stalled, and Full
+// the time in which all non-idle tasks were stalled at once.
+type PressureStat struct {
+	Some PressureValues `json:"some" bson:"some"`
+	Full PressureValues `json:"full" bson:"full"`
+}
+
+// PressureValues holds the percentage of time stalled over the last
+// 10, 60, and 300 seconds, and the total stall time in microseconds.
+type PressureValues struct {
+	Avg10  float64 `json:"avg10" bson:"avg10"`
+	Avg60  float64 `json:"avg60" bson:"avg60"`
+	Avg300 float64 `json:"avg300" bson:"avg300"`
+	Total  uint64  `json:"total" bson:"total"`
+}
+
+// Procfs collects ProcessInfo and SystemInfo messages by parsing the
+// Linux proc file system directly, rather than with gopsutil, which
+// avoids much of gopsutil's overhead and reports some additional
+// data: the number of open file descriptors and, optionally, the
+// smaps_rollup memory accounting for processes, and the pressure
+// stall information for the system.
+//
+// The messages have the same form as those produced by
+// NewProcessInfo and NewSystemInfo, with the following differences:
+// ProcessInfo messages do not report MemoryPlatform, and SystemInfo
+// messages do not report disk partitions, usage, or IO. Files that
+// do not exist, for instance on kernels that predate smaps_rollup or
+// pressure stall information, are skipped without recording an
+// error.
+//
+// Procfs computes the system CPU percentage relative to its previous
+// collection, so use separate Procfs values for independent periodic
+// collections.
+type Procfs struct {
+	opts    ProcfsOptions
+	mu      sync.Mutex
+	lastCPU StatCPUTimes
+}
+
+// ProcfsOptions configures a Procfs.
+type ProcfsOptions struct {
+	// Root is the directory that contains the "proc" tree, and
+	// for cgroup accounting the "sys/fs/cgroup" tree. The default
+	// is the root of the file system.
+	Root string `bson:"root" json:"root" yaml:"root"`
+
+	// Smaps enables reporting the smaps_rollup memory accounting
+	// for processes. The kernel walks all of the memory mappings
+	// of the process to produce it, which makes it more expensive
+	// to collect than all other process statistics combined.
+	Smaps bool `bson:"smaps" json:"smaps" yaml:"smaps"`
+}
+
+// NewProcfs constructs a Procfs with the specified options.
+func NewProcfs(opts ProcfsOptions) *Procfs {
+	if opts.Root == "" {
+		opts.Root = "/"
+	}
+
+	return &Procfs{opts: opts}
+}
+
+func (fs *Procfs) path(parts ...string) string {
+	return filepath.Join(append([]string{fs.opts.Root, "proc"}, parts...)...)
+}
+
+// ProcessInfo returns a populated ProcessInfo message for the process
+// with the specified pid, which is only loggable if the process
+// exists.
+func (fs *Procfs) ProcessInfo(priority level.Priority, pid int32, message string) Composer {
+	p := &ProcessInfo{
+		Message: message,
+		Pid:     pid,
+	}
+
+	if err := p.SetPriority(priority); err != nil {
+		p.saveError("priority", err)
+		return p
+	}
+
+	dir := strconv.Itoa(int(pid))
+
+	stat, err := readProcStat(fs.path(dir, "stat"))
+	if err != nil {
+		p.saveError("process", err)
+		return p
+	}
+	p.loggable = true
+
+	// field numbers as documented in proc(5); the slice starts
+	// with the third field, after the command name.
+	p.Parent = int32(stat.field(4))
+	p.CPU.User = int64(stat.field(14))
+	p.CPU.System = int64(stat.field(15))
+	p.CPU.Iowait = int64(stat.field(42))
+	p.Threads = int(stat.field(20))
+	p.Memory.VMS = stat.field(23)
+	p.Memory.RSS = stat.field(24) * uint64(os.Getpagesize())
+
+	status, err := readProcKeyValues(fs.path(dir, "status"))
+	p.saveProcError("status", err)
+	if rss, ok := status["VmRSS"]; ok {
+		p.Memory.RSS = rss
+	}
+	p.Memory.HWM = status["VmHWM"]
+	p.Memory.Data = status["VmData"]
+	p.Memory.Stack = status["VmStk"]
+	p.Memory.Locked = status["VmLck"]
+	p.Memory.Swap = status["VmSwap"]
+
+	cmd, err := readProcFile(fs.path(dir, "cmdline"))
+	p.saveProcError("cmdline", err)
+	p.Command = strings.TrimSpace(strings.ReplaceAll(strings.TrimRight(string(cmd), "\x00"), "\x00", " "))
+
+	counters, err := readProcKeyValues(fs.path(dir, "io"))
+	p.saveProcError("io", err)
+	p.IoStat.ReadCount = counters["syscr"]
+	p.IoStat.WriteCount = counters["syscw"]
+	p.IoStat.ReadBytes = counters["read_bytes"]
+	p.IoStat.WriteBytes = counters["write_bytes"]
+
+	fds, err := os.ReadDir(fs.path(dir, "fd"))
+	p.saveProcError("fd", err)
+	p.FDs = int32(len(fds))
+
+	if fs.opts.Smaps {
+		smaps, err := readProcKeyValues(fs.path(dir, "smaps_rollup"))
+		p.saveProcError("smaps_rollup", err)
+		if err == nil {
+			p.Smaps = &ProcessSmaps{
+				Rss:          smaps["Rss"],
+				Pss:          smaps["Pss"],
+				SharedClean:  smaps["Shared_Clean"],
+				SharedDirty:  smaps["Shared_Dirty"],
+				PrivateClean: smaps["Private_Clean"],
+				PrivateDirty: smaps["Private_Dirty"],
+				Anonymous:    smaps["Anonymous"],
+				Swap:         smaps["Swap"],
+				SwapPss:      smaps["SwapPss"],
+			}
+		}
+	}
+
+	netstat, err := readProcNetDev(fs.path(dir, "net", "dev"))
+	p.saveProcError("net/dev", err)
+	if err == nil {
+		p.NetStat = []net.IOCountersStat{netstat}
+	}
+
+	return p
+}
+
+// SystemInfo returns a populated SystemInfo message.
+func (fs *Procfs) SystemInfo(priority level.Priority, message string) Composer {
+	s := &SystemInfo{
+		Message: message,
+		NumCPU:  runtime.NumCPU(),
+	}
+
+	if err := s.SetPriority(priority); err != nil {
+		s.Errors = append(s.Errors, err.Error())
+		return s
+	}
+
+	s.loggable = true
+
+	times, err := readProcCPUTimes(fs.path("stat"))
+	s.saveError("cpu_times", err)
+	if err == nil {
+		s.CPU = times
+		s.CPUPercent = fs.cpuPercent(times)
+	}
+
+	meminfo, err := readProcKeyValues(fs.path("meminfo"))
+	s.saveError("vmstat", err)
+	if err == nil {
+		s.VMStat.Total = meminfo["MemTotal"]
+		s.VMStat.Free = meminfo["MemFree"]
+		s.VMStat.Available = meminfo["MemAvailable"]
+		s.VMStat.Buffers = meminfo["Buffers"]
+		s.VMStat.Cached = meminfo["Cached"] + meminfo["SReclaimable"]
+		s.VMStat.Active = meminfo["Active"]
+		s.VMStat.Inactive = meminfo["Inactive"]
+		s.VMStat.Dirty = meminfo["Dirty"]
+		s.VMStat.Writeback = meminfo["Writeback"]
+		s.VMStat.Shared = meminfo["Shmem"]
+		s.VMStat.Slab = meminfo["Slab"]
+		s.VMStat.SReclaimable = meminfo["SReclaimable"]
+		s.VMStat.SUnreclaim = meminfo["SUnreclaim"]
+		s.VMStat.PageTables = meminfo["PageTables"]
+		s.VMStat.Mapped = meminfo["Mapped"]
+		s.VMStat.CommitLimit = meminfo["CommitLimit"]
+		s.VMStat.CommittedAS = meminfo["Committed_AS"]
+		s.VMStat.SwapCached = meminfo["SwapCached"]
+		s.VMStat.SwapTotal = meminfo["SwapTotal"]
+		s.VMStat.SwapFree = meminfo["SwapFree"]
+		s.VMStat.HugePagesTotal = meminfo["HugePages_Total"]
+		s.VMStat.HugePagesFree = meminfo["HugePages_Free"]
+		s.VMStat.HugePageSize = meminfo["Hugepagesize"]
+
+		if s.VMStat.Total > s.VMStat.Free+s.VMStat.Buffers+s.VMStat.Cached {
+			s.VMStat.Used = s.VMStat.Total - s.VMStat.Free - s.VMStat.Buffers - s.VMStat.Cached
+		}
+	}
+
+	netstat, err := readProcNetDev(fs.path("net", "dev"))
+	s.saveError("netstat", err)
+	if err == nil {
+		s.NetStat = netstat
+	}
+
+	pressure := &PressureStats{}
+	var found bool
+	for name, stat := range map[string]*PressureStat{"cpu": &pressure.CPU, "memory": &pressure.Memory, "io": &pressure.IO} {
+		err = readProcPressure(fs.path("pressure", name), stat)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			s.saveError("pressure/"+name, err)
+		}
+	}
+	if found {
+		s.Pressure = pressure
+	}
+
+	if cgroup, err := collectCgroupStats(fs.opts.Root); err == nil {
+		s.Cgroup = cgroup
+	}
+
+	return s
+}
+
+// cpuPercent returns the share of non-idle CPU time since the
+// previous collection, or since boot for the first collection.
+func (fs *Procfs) cpuPercent(times StatCPUTimes) float64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	busy := func(t StatCPUTimes) (int64, int64) {
+		total := t.User + t.Nice + t.System + t.Idle + t.Iowait + t.Irq + t.Softirq + t.Steal
+		return total - t.Idle - t.Iowait, total
+	}
+
+	lastBusy, lastTotal := busy(fs.lastCPU)
+	curBusy, curTotal := busy(times)
+	fs.lastCPU = times
+
+	if curTotal <= lastTotal || curBusy < lastBusy {
+		return 0
+	}
+
+	return 100 * float64(curBusy-lastBusy) / float64(curTotal-lastTotal)
+}
+
+func (p *ProcessInfo) saveProcError(stat string, err error) {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		p.saveError(stat, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+//
+// proc file system parsing
+//
+////////////////////////////////////////////////////////////////////////
+
+// procStat holds the fields of /proc/<pid>/stat that follow the
+// command name, which may itself contain spaces and parentheses.
+type procStat []string
+
+func readProcStat(fn string) (procStat, error) {
+	data, err := readProcFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := strings.LastIndexByte(string(data), ')')
+	if idx < 0 {
+		return nil, fmt.Errorf("malformed stat file '%s'", fn)
+	}
+
+	return procStat(strings.Fields(string(data[idx+1:]))), nil
+}
+
+// field returns the numbered field, counting from one as in proc(5),
+// or zero if the field is missing or not a number.
+func (s procStat) field(num int) uint64 {
+	idx := num - 3
+	if idx < 0 || idx >= len(s) {
+		return 0
+	}
+
+	out, _ := strconv.ParseUint(s[idx], 10, 64)
+	return out
+}
+
+// readProcKeyValues parses files with one "key: value [kB]" pair per
+// line, as in status, meminfo, io, and smaps_rollup, converting
+// values in kB to bytes. Lines with values that are not numbers are
+// skipped.
+func readProcKeyValues(fn string) (map[string]uint64, error) {
+	data, err := readProcFile(fn)
+	if err != nil {
+		return map[string]uint64{}, err
+	}
+
+	out := map[string]uint64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+
+		out[strings.TrimSpace(parts[0])] = value
+	}
+
+	return out, nil
+}
+
+// readProcFile reads a file in as few reads as possible: the kernel
+// generates some proc files, like smaps_rollup, anew for every read,
+// and files in proc report their size as zero, which causes
+// os.ReadFile to read in small increments.
+func readProcFile(fn string) ([]byte, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 0, 8192)
+	for {
+		n, err := file.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+	}
+}
+
+func readProcLines(fn string) ([]string, error) {
+	data, err := readProcFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimSpace(string(data)), "\n"), nil
+}
+
+// readProcCPUTimes reads the aggregate "cpu" line of /proc/stat, which
+// reports times in clock ticks.
+func readProcCPUTimes(fn string) (StatCPUTimes, error) {
+	lines, err := readProcLines(fn)
+	if err != nil {
+		return StatCPUTimes{}, err
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "cpu" {
+			continue
+		}
+
+		values := make([]int64, 10)
+		for idx := range values {
+			if idx+1 < len(fields) {
+				values[idx], _ = strconv.ParseInt(fields[idx+1], 10, 64)
+			}
+		}
+
+		return StatCPUTimes{
+			User:      values[0],
+			Nice:      values[1],
+			System:    values[2],
+			Idle:      values[3],
+			Iowait:    values[4],
+			Irq:       values[5],
+			Softirq:   values[6],
+			Steal:     values[7],
+			Guest:     values[8],
+			GuestNice: values[9],
+		}, nil
+	}
+
+	return StatCPUTimes{}, fmt.Errorf("no cpu times in '%s'", fn)
+}
+
+// readProcNetDev sums the counters of all interfaces listed in a
+// net/dev file, as gopsutil does when not reporting per-interface
+// counters.
+func readProcNetDev(fn string) (net.IOCountersStat, error) {
+	out := net.IOCountersStat{Name: "all"}
+
+	lines, err := readProcLines(fn)
+	if err != nil {
+		return out, err
+	}
+
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		fields := strings.Fields(parts[1])
+		if len(fields) < 13 {
+			continue
+		}
+
+		values := make([]uint64, len(fields))
+		for idx, f := range fields {
+			values[idx], _ = strconv.ParseUint(f, 10, 64)
+		}
+
+		out.BytesRecv += values[0]
+		out.PacketsRecv += values[1]
+		out.Errin += values[2]
+		out.Dropin += values[3]
+		out.Fifoin += values[4]
+		out.BytesSent += values[8]
+		out.PacketsSent += values[9]
+		out.Errout += values[10]
+		out.Dropout += values[11]
+		out.Fifoout += values[12]
+	}
+
+	return out, nil
+}
+
+// readProcPressure parses a pressure stall information file, with
+// "some" and "full" lines of the form:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func readProcPressure(fn string, stat *PressureStat) error {
+	lines, err := readProcLines(fn)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var values *PressureValues
+		switch fields[0] {
+		case "some":
+			values = &stat.Some
+		case "full":
+			values = &stat.Full
+		default:
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+
+			switch kv[0] {
+			case "avg10":
+				values.Avg10, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg60":
+				values.Avg60, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg300":
+				values.Avg300, _ = strconv.ParseFloat(kv[1], 64)
+			case "total":
+				values.Total, _ = strconv.ParseUint(kv[1], 10, 64)
+			}
+		}
+	}
+
+	return nil
+}
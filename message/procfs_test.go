@@ -0,0 +1,172 @@
+package message
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"cdr.dev/grip/level"
+	"github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcfs(t *testing.T) {
+	fs := NewProcfs(ProcfsOptions{Root: filepath.Join("testdata", "procfs"), Smaps: true})
+
+	t.Run("ProcessInfo", func(t *testing.T) {
+		msg := fs.ProcessInfo(level.Info, 42, "proc")
+		require.True(t, msg.Loggable())
+
+		info := msg.Raw().(*ProcessInfo)
+		assert.Empty(t, info.Errors)
+		assert.Equal(t, int32(42), info.Pid)
+		assert.Equal(t, int32(7), info.Parent)
+		assert.Equal(t, 3, info.Threads)
+		assert.Equal(t, "build --jobs 4", info.Command)
+		assert.Equal(t, StatCPUTimes{User: 150, System: 25, Iowait: 12}, info.CPU)
+		assert.Equal(t, process.MemoryInfoStat{
+			RSS:   1024 * 1024,
+			VMS:   10485760,
+			HWM:   2048 * 1024,
+			Data:  512 * 1024,
+			Stack: 132 * 1024,
+			Swap:  16 * 1024,
+		}, info.Memory)
+		assert.Equal(t, process.IOCountersStat{ReadCount: 9, WriteCount: 2, ReadBytes: 4096, WriteBytes: 8192}, info.IoStat)
+		assert.Equal(t, int32(4), info.FDs)
+		require.NotNil(t, info.Smaps)
+		assert.Equal(t, ProcessSmaps{
+			Rss:          1024 * 1024,
+			Pss:          433 * 1024,
+			SharedClean:  800 * 1024,
+			PrivateClean: 60 * 1024,
+			PrivateDirty: 164 * 1024,
+			Anonymous:    100 * 1024,
+			Swap:         16 * 1024,
+			SwapPss:      8 * 1024,
+		}, *info.Smaps)
+		assert.Equal(t, []net.IOCountersStat{{
+			Name:        "all",
+			BytesRecv:   6000,
+			PacketsRecv: 60,
+			Errin:       1,
+			Dropin:      2,
+			BytesSent:   4000,
+			PacketsSent: 40,
+			Errout:      3,
+			Dropout:     4,
+		}}, info.NetStat)
+	})
+	t.Run("WithoutSmaps", func(t *testing.T) {
+		msg := NewProcfs(ProcfsOptions{Root: filepath.Join("testdata", "procfs")}).ProcessInfo(level.Info, 42, "proc")
+		require.True(t, msg.Loggable())
+		assert.Nil(t, msg.Raw().(*ProcessInfo).Smaps)
+	})
+	t.Run("MissingProcess", func(t *testing.T) {
+		msg := fs.ProcessInfo(level.Info, 43, "proc")
+		assert.False(t, msg.Loggable())
+		assert.NotEmpty(t, msg.Raw().(*ProcessInfo).Errors)
+	})
+	t.Run("SystemInfo", func(t *testing.T) {
+		msg := NewProcfs(ProcfsOptions{Root: filepath.Join("testdata", "procfs")}).SystemInfo(level.Info, "sys")
+		require.True(t, msg.Loggable())
+
+		info := msg.Raw().(*SystemInfo)
+		assert.Empty(t, info.Errors)
+		assert.Equal(t, StatCPUTimes{User: 1000, Nice: 50, System: 300, Idle: 8000, Iowait: 100, Irq: 10, Softirq: 20, Steal: 5}, info.CPU)
+		assert.InDelta(t, 100*1385.0/9485.0, info.CPUPercent, 0.001)
+		assert.Equal(t, uint64(8000000*1024), info.VMStat.Total)
+		assert.Equal(t, uint64(5000000*1024), info.VMStat.Available)
+		assert.Equal(t, uint64(2700000*1024), info.VMStat.Cached)
+		assert.Equal(t, uint64(3200000*1024), info.VMStat.Used)
+		assert.Equal(t, uint64(2048*1024), info.VMStat.HugePageSize)
+		assert.Equal(t, uint64(6000), info.NetStat.BytesRecv)
+		assert.Equal(t, "all", info.NetStat.Name)
+
+		require.NotNil(t, info.Pressure)
+		assert.Equal(t, PressureValues{Avg10: 1.45, Avg60: 2.16, Avg300: 1.10, Total: 39437832}, info.Pressure.CPU.Some)
+		assert.Equal(t, PressureValues{Avg10: 0.2, Avg60: 0.1, Avg300: 0.05, Total: 400}, info.Pressure.Memory.Full)
+		assert.Equal(t, uint64(5000), info.Pressure.IO.Some.Total)
+		assert.Nil(t, info.Cgroup)
+
+		// the CPU percentage is relative to the previous
+		// collection, and the fixture doesn't change
+		next := fs.SystemInfo(level.Info, "sys").Raw().(*SystemInfo)
+		assert.InDelta(t, info.CPUPercent, next.CPUPercent, 0.001)
+		next = fs.SystemInfo(level.Info, "sys").Raw().(*SystemInfo)
+		assert.Zero(t, next.CPUPercent)
+	})
+	t.Run("MissingRoot", func(t *testing.T) {
+		msg := NewProcfs(ProcfsOptions{Root: filepath.Join("testdata", "procfs", "none")}).SystemInfo(level.Info, "sys")
+		info := msg.Raw().(*SystemInfo)
+		assert.NotEmpty(t, info.Errors)
+		assert.Nil(t, info.Pressure)
+	})
+	t.Run("InvalidPriority", func(t *testing.T) {
+		assert.False(t, fs.ProcessInfo(level.Invalid, 42, "proc").Loggable())
+		assert.False(t, fs.SystemInfo(level.Invalid, "sys").Loggable())
+	})
+	t.Run("Self", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("procfs is only available on linux")
+		}
+
+		msg := NewProcfs(ProcfsOptions{Smaps: true}).ProcessInfo(level.Info, int32(os.Getpid()), "self")
+		require.True(t, msg.Loggable())
+
+		info := msg.Raw().(*ProcessInfo)
+		assert.Empty(t, info.Errors)
+		assert.Equal(t, int32(os.Getppid()), info.Parent)
+		assert.True(t, info.Memory.RSS > 0)
+		assert.True(t, info.FDs > 0)
+		assert.True(t, info.Threads > 0)
+		require.NotNil(t, info.Smaps)
+		assert.True(t, info.Smaps.Pss > 0)
+	})
+}
+
+func BenchmarkProcessInfo(b *testing.B) {
+	if runtime.GOOS != "linux" {
+		b.Skip("procfs is only available on linux")
+	}
+
+	pid := int32(os.Getpid())
+	b.Run("Gopsutil", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = NewProcessInfo(level.Info, pid, "")
+		}
+	})
+	b.Run("Procfs", func(b *testing.B) {
+		fs := NewProcfs(ProcfsOptions{})
+		for i := 0; i < b.N; i++ {
+			_ = fs.ProcessInfo(level.Info, pid, "")
+		}
+	})
+	b.Run("ProcfsSmaps", func(b *testing.B) {
+		fs := NewProcfs(ProcfsOptions{Smaps: true})
+		for i := 0; i < b.N; i++ {
+			_ = fs.ProcessInfo(level.Info, pid, "")
+		}
+	})
+}
+
+func BenchmarkSystemInfo(b *testing.B) {
+	if runtime.GOOS != "linux" {
+		b.Skip("procfs is only available on linux")
+	}
+
+	b.Run("Gopsutil", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = NewSystemInfo(level.Info, "")
+		}
+	})
+	b.Run("Procfs", func(b *testing.B) {
+		fs := NewProcfs(ProcfsOptions{})
+		for i := 0; i < b.N; i++ {
+			_ = fs.SystemInfo(level.Info, "")
+		}
+	})
+}
@@ -14,7 +14,9 @@ import (
 
 // SystemInfo is a type that implements message.Composer but also
 // collects system-wide resource utilization statistics about memory,
-// CPU, and network use, along with an optional message.
+// CPU, and network use, along with an optional message. When the
+// process runs in a cgroup, as in a container, SystemInfo also
+// reports the cgroup's resource accounting, as in ContainerInfo.
 type SystemInfo struct {
 	Message    string                `json:"message" bson:"message"`
 	CPU        StatCPUTimes          `json:"cpu" bson:"cpu"`
@@ -25,6 +27,8 @@ type SystemInfo struct {
 	Partitions []disk.PartitionStat  `json:"partitions" bson:"partitions"`
 	Usage      []disk.UsageStat      `json:"usage" bson:"usage"`
 	IOStat     []disk.IOCountersStat `json:"iostat" bson:"iostat"`
+	Cgroup     *CgroupStats          `json:"cgroup,omitempty" bson:"cgroup,omitempty"`
+	Pressure   *PressureStats        `json:"pressure,omitempty" bson:"pressure,omitempty"`
 	Errors     []string              `json:"errors" bson:"errors"`
 	Base       `json:"metadata,omitempty" bson:"metadata,omitempty"`
 	loggable   bool
@@ -142,6 +146,10 @@ func NewSystemInfo(priority level.Priority, message string) Composer {
 		s.IOStat = append(s.IOStat, stat)
 	}
 
+	if cgroup, err := collectCgroupStats("/"); err == nil {
+		s.Cgroup = cgroup
+	}
+
 	return s
 }
 
@@ -0,0 +1,166 @@
+package recovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cdr.dev/grip"
+	"cdr.dev/grip/logging"
+	"cdr.dev/grip/message"
+)
+
+// Go runs a function in a new goroutine, and logs any panic in the
+// same manner as LogStackTraceAndContinue. Use Go in place of:
+//
+//    go func() { defer recovery.LogStackTraceAndContinue("op"); fn() }()
+//
+// Use a Group to wait for goroutines, collect panics as errors, or
+// restart long-lived workers.
+func Go(fn func(), opDetails ...string) {
+	(&Group{}).Go(fn, opDetails...)
+}
+
+// Group launches goroutines that recover from panics. When a
+// goroutine panics, the Group logs the panic with a stack trace at
+// "Alert" level, converts it to an error, and adds the error to
+// the Catcher and passes it to the OnPanic callback, if either are
+// specified. The zero value is ready to use, and Groups must not be
+// copied after first use.
+type Group struct {
+	// Logger receives log messages for panics. If nil, messages
+	// are logged with the default standard logger in the grip
+	// package.
+	Logger grip.Journaler
+
+	// Catcher and OnPanic, if specified, receive the errors
+	// produced by panics.
+	Catcher grip.Catcher
+	OnPanic func(error)
+
+	wg sync.WaitGroup
+}
+
+// RestartOptions controls how GoWorker restarts functions that
+// panic. Between restarts, GoWorker waits for a backoff interval
+// that starts at MinBackoff and doubles after every consecutive
+// panic, up to MaxBackoff. The interval resets if the worker runs for
+// longer than MaxBackoff before panicking.
+type RestartOptions struct {
+	// MinBackoff defaults to 100 milliseconds, and MaxBackoff
+	// defaults to one minute.
+	MinBackoff time.Duration `bson:"min_backoff" json:"min_backoff" yaml:"min_backoff"`
+	MaxBackoff time.Duration `bson:"max_backoff" json:"max_backoff" yaml:"max_backoff"`
+
+	// MaxRestarts limits the number of times that the worker is
+	// restarted. When zero, the worker is restarted until the
+	// context is canceled.
+	MaxRestarts int `bson:"max_restarts" json:"max_restarts" yaml:"max_restarts"`
+}
+
+func (o *RestartOptions) setDefaults() {
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 100 * time.Millisecond
+	}
+
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Minute
+	}
+
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+}
+
+// Go runs a function in a new goroutine tracked by the group,
+// recovering and reporting any panic.
+func (g *Group) Go(fn func(), opDetails ...string) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		_ = g.run(fn, opDetails)
+	}()
+}
+
+// GoWorker runs a long-lived function in a new goroutine tracked by
+// the group. If the function panics, the panic is reported and the
+// function is restarted after a backoff interval, until the function
+// returns without panicking, the context is canceled, or the worker
+// reaches the maximum number of restarts.
+func (g *Group) GoWorker(ctx context.Context, opts RestartOptions, fn func(context.Context), opDetails ...string) {
+	opts.setDefaults()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		backoff := opts.MinBackoff
+		for restarts := 0; ; restarts++ {
+			started := time.Now()
+			if !g.run(func() { fn(ctx) }, opDetails) {
+				return
+			}
+
+			if opts.MaxRestarts > 0 && restarts >= opts.MaxRestarts {
+				return
+			}
+
+			if time.Since(started) > opts.MaxBackoff {
+				backoff = opts.MinBackoff
+			}
+
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			backoff *= 2
+			if backoff > opts.MaxBackoff {
+				backoff = opts.MaxBackoff
+			}
+		}
+	}()
+}
+
+// Wait blocks until all goroutines started by the group return. If
+// the group has a Catcher, Wait returns the errors it collected.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+
+	if g.Catcher == nil {
+		return nil
+	}
+
+	return g.Catcher.Resolve()
+}
+
+// run calls the function and reports whether it panicked.
+func (g *Group) run(fn func(), opDetails []string) (panicked bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		panicked = true
+
+		logger := g.Logger
+		if logger == nil {
+			logger = logging.MakeGrip(grip.GetSender())
+		}
+		logAndContinue(p, logger, message.MakeFields(getMessage(opDetails)))
+
+		err := panicError(p)
+		if g.Catcher != nil {
+			g.Catcher.Add(err)
+		}
+		if g.OnPanic != nil {
+			g.OnPanic(err)
+		}
+	}()
+
+	fn()
+	return false
+}
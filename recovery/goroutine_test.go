@@ -0,0 +1,99 @@
+package recovery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cdr.dev/grip"
+	"cdr.dev/grip/logging"
+	"cdr.dev/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup(t *testing.T) {
+	t.Run("NoPanic", func(t *testing.T) {
+		sender := send.MakeInternalLogger()
+		g := &Group{Logger: logging.MakeGrip(sender), Catcher: grip.NewBasicCatcher()}
+
+		var count int64
+		for i := 0; i < 10; i++ {
+			g.Go(func() { atomic.AddInt64(&count, 1) })
+		}
+
+		assert.NoError(t, g.Wait())
+		assert.EqualValues(t, 10, count)
+		assert.False(t, sender.HasMessage())
+	})
+	t.Run("Panic", func(t *testing.T) {
+		sender := send.MakeInternalLogger()
+		var callbacks int64
+		g := &Group{
+			Logger:  logging.MakeGrip(sender),
+			Catcher: grip.NewBasicCatcher(),
+			OnPanic: func(err error) {
+				assert.EqualError(t, err, "sorry")
+				atomic.AddInt64(&callbacks, 1)
+			},
+		}
+
+		g.Go(func() { panic("sorry") }, "panic op")
+		g.Go(func() {})
+
+		err := g.Wait()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "sorry")
+		assert.EqualValues(t, 1, callbacks)
+
+		msg, ok := sender.GetMessageSafe()
+		require.True(t, ok)
+		assert.Contains(t, msg.Rendered, "hit panic; recovering")
+		assert.Contains(t, msg.Rendered, "panic op")
+		assert.False(t, sender.HasMessage())
+	})
+	t.Run("Worker", func(t *testing.T) {
+		t.Run("RestartsUntilSuccess", func(t *testing.T) {
+			g := &Group{Logger: logging.MakeGrip(send.MakeInternalLogger()), Catcher: grip.NewBasicCatcher()}
+
+			var runs int64
+			g.GoWorker(context.Background(), RestartOptions{MinBackoff: time.Millisecond}, func(ctx context.Context) {
+				if atomic.AddInt64(&runs, 1) < 3 {
+					panic("again")
+				}
+			})
+
+			assert.Error(t, g.Wait())
+			assert.EqualValues(t, 3, runs)
+			assert.Equal(t, 2, g.Catcher.Len())
+		})
+		t.Run("MaxRestarts", func(t *testing.T) {
+			g := &Group{Logger: logging.MakeGrip(send.MakeInternalLogger())}
+
+			var runs int64
+			g.GoWorker(context.Background(), RestartOptions{MinBackoff: time.Millisecond, MaxRestarts: 4}, func(ctx context.Context) {
+				atomic.AddInt64(&runs, 1)
+				panic("always")
+			})
+
+			assert.NoError(t, g.Wait())
+			assert.EqualValues(t, 5, runs)
+		})
+		t.Run("Canceled", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			g := &Group{Logger: logging.MakeGrip(send.MakeInternalLogger())}
+
+			var runs int64
+			g.GoWorker(ctx, RestartOptions{MinBackoff: time.Hour}, func(ctx context.Context) {
+				atomic.AddInt64(&runs, 1)
+				panic("always")
+			})
+
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+			assert.NoError(t, g.Wait())
+			assert.EqualValues(t, 1, runs)
+		})
+	})
+}
@@ -0,0 +1,160 @@
+package recovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"cdr.dev/grip"
+	"cdr.dev/grip/logging"
+	"cdr.dev/grip/message"
+)
+
+// DefaultRequestIDHeader is the header that the HTTP middleware
+// reads request IDs from, and sets on responses, when the
+// HTTPOptions do not specify another header.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+const redactedHeaderValue = "[redacted]"
+
+var defaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// HTTPOptions configures the panic handling middleware produced by
+// NewHTTPMiddleware.
+type HTTPOptions struct {
+	// RequestIDHeader names the header that holds the request
+	// ID. If the request does not have an ID, the middleware
+	// generates one and sets it on the response. Defaults to
+	// DefaultRequestIDHeader.
+	RequestIDHeader string `bson:"request_id_header" json:"request_id_header" yaml:"request_id_header"`
+
+	// RedactHeaders lists additional headers whose values are
+	// elided from log messages. The Authorization,
+	// Proxy-Authorization, Cookie, and Set-Cookie headers are
+	// always redacted.
+	RedactHeaders []string `bson:"redact_headers" json:"redact_headers" yaml:"redact_headers"`
+
+	// RepanicOnAbort causes the middleware to re-panic, without
+	// logging, when a handler panics with http.ErrAbortHandler, so
+	// that the http.Server can abort the response as intended.
+	RepanicOnAbort bool `bson:"repanic_on_abort" json:"repanic_on_abort" yaml:"repanic_on_abort"`
+}
+
+// NewHTTPMiddleware returns a function that wraps an http.Handler
+// with a handler that recovers from panics, logs them to the logger
+// at "Alert" level with a stack trace and information about the
+// request, and responds with a 500 error if the wrapped handler has
+// not already written a response.
+//
+// If the logger is nil, messages are logged with the default
+// standard logger in the grip package.
+func NewHTTPMiddleware(logger grip.Journaler, opts HTTPOptions) func(http.Handler) http.Handler {
+	if opts.RequestIDHeader == "" {
+		opts.RequestIDHeader = DefaultRequestIDHeader
+	}
+
+	redact := map[string]bool{}
+	for _, h := range append(defaultRedactedHeaders, opts.RedactHeaders...) {
+		redact[http.CanonicalHeaderKey(h)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(opts.RequestIDHeader)
+			if id == "" {
+				id = newRequestID()
+				r.Header.Set(opts.RequestIDHeader, id)
+				w.Header().Set(opts.RequestIDHeader, id)
+			}
+
+			rw := &recoveryResponseWriter{ResponseWriter: w}
+
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+
+				if p == http.ErrAbortHandler && opts.RepanicOnAbort {
+					panic(p)
+				}
+
+				l := logger
+				if l == nil {
+					l = logging.MakeGrip(grip.GetSender())
+				}
+
+				logAndContinue(p, l, message.MakeFields(message.Fields{
+					"operation":  "http request",
+					"request_id": id,
+					"method":     r.Method,
+					"path":       r.URL.Path,
+					"remote":     r.RemoteAddr,
+					"headers":    redactHeaders(r.Header, redact),
+				}))
+
+				if !rw.wroteHeader {
+					http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+//
+// helpers
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+func redactHeaders(headers http.Header, redact map[string]bool) map[string]string {
+	out := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if redact[http.CanonicalHeaderKey(k)] {
+			out[k] = redactedHeaderValue
+			continue
+		}
+		out[k] = strings.Join(v, ", ")
+	}
+
+	return out
+}
+
+type recoveryResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoveryResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoveryResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoveryResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (w *recoveryResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
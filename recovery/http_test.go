@@ -0,0 +1,96 @@
+package recovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cdr.dev/grip/logging"
+	"cdr.dev/grip/message"
+	"cdr.dev/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/foo/bar", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Secret-Token", "hunter2")
+		req.Header.Set("User-Agent", "grip-test")
+		return req
+	}
+
+	t.Run("NoPanic", func(t *testing.T) {
+		sender := send.MakeInternalLogger()
+		handler := NewHTTPMiddleware(logging.MakeGrip(sender), HTTPOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, newRequest())
+		assert.Equal(t, http.StatusTeapot, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get(DefaultRequestIDHeader))
+		assert.False(t, sender.HasMessage())
+	})
+	t.Run("Panic", func(t *testing.T) {
+		sender := send.MakeInternalLogger()
+		handler := NewHTTPMiddleware(logging.MakeGrip(sender), HTTPOptions{
+			RedactHeaders: []string{"x-secret-token"},
+		})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("sorry")
+		}))
+
+		req := newRequest()
+		req.Header.Set(DefaultRequestIDHeader, "req-42")
+		rec := httptest.NewRecorder()
+		assert.NotPanics(t, func() { handler.ServeHTTP(rec, req) })
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+		msg, ok := sender.GetMessageSafe()
+		require.True(t, ok)
+		assert.Contains(t, msg.Rendered, "hit panic; recovering")
+		assert.Contains(t, msg.Rendered, "sorry")
+
+		fields, ok := msg.Message.Raw().(message.Fields)
+		require.True(t, ok)
+		assert.Equal(t, "req-42", fields["request_id"])
+		assert.Equal(t, http.MethodPost, fields["method"])
+		assert.Equal(t, "/foo/bar", fields["path"])
+		assert.Contains(t, fields, "stack")
+
+		headers, ok := fields["headers"].(map[string]string)
+		require.True(t, ok)
+		assert.Equal(t, redactedHeaderValue, headers["Authorization"])
+		assert.Equal(t, redactedHeaderValue, headers["X-Secret-Token"])
+		assert.Equal(t, "grip-test", headers["User-Agent"])
+	})
+	t.Run("PanicAfterWrite", func(t *testing.T) {
+		sender := send.MakeInternalLogger()
+		handler := NewHTTPMiddleware(logging.MakeGrip(sender), HTTPOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			panic("sorry")
+		}))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, newRequest())
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.True(t, sender.HasMessage())
+	})
+	t.Run("Abort", func(t *testing.T) {
+		abort := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})
+
+		sender := send.MakeInternalLogger()
+		handler := NewHTTPMiddleware(logging.MakeGrip(sender), HTTPOptions{RepanicOnAbort: true})(abort)
+		assert.Panics(t, func() { handler.ServeHTTP(httptest.NewRecorder(), newRequest()) })
+		assert.False(t, sender.HasMessage())
+
+		handler = NewHTTPMiddleware(logging.MakeGrip(sender), HTTPOptions{})(abort)
+		rec := httptest.NewRecorder()
+		assert.NotPanics(t, func() { handler.ServeHTTP(rec, newRequest()) })
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.True(t, sender.HasMessage())
+	})
+}
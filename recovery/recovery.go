@@ -15,8 +15,9 @@
 package recovery
 
 import (
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"cdr.dev/grip"
 	"cdr.dev/grip/level"
@@ -24,7 +25,34 @@ import (
 	"cdr.dev/grip/message"
 )
 
-const killOverrideVarName = "__GRIP_EXIT_OVERRIDE"
+var (
+	exitMutex        sync.RWMutex
+	exitHandler      func(int)
+	exitFlushTimeout time.Duration
+)
+
+// SetExitHandler replaces the function that the "Exit" handlers in
+// this package call, after logging the panic and flushing the
+// logger's sender, to exit the process. This is primarily useful in
+// tests, to observe fatal paths without exiting. A nil handler
+// restores the default, os.Exit.
+func SetExitHandler(fn func(code int)) {
+	exitMutex.Lock()
+	defer exitMutex.Unlock()
+
+	exitHandler = fn
+}
+
+// SetExitFlushTimeout sets how long the "Exit" handlers in this
+// package wait for the logger's sender to flush buffered messages
+// before exiting. Values less than or equal to zero restore the
+// default, logging.DefaultExitFlushTimeout.
+func SetExitFlushTimeout(dur time.Duration) {
+	exitMutex.Lock()
+	defer exitMutex.Unlock()
+
+	exitFlushTimeout = dur
+}
 
 // LogStackTraceAndExit captures a panic, captures and logs a stack
 // trace at the Emergency level and then exits.
@@ -192,12 +220,33 @@ func logAndExit(p interface{}, logger grip.Journaler, msg message.Composer) {
 	_ = msg.Annotate("stack", message.NewStack(3, "").Raw().(message.StackTrace).Frames)
 	_ = msg.Annotate(message.FieldsMsgName, "hit panic; exiting")
 
-	// check this env var so that we can avoid exiting in the test.
-	if os.Getenv(killOverrideVarName) == "" {
-		logger.EmergencyFatal(msg)
+	exitLogger(logger).EmergencyFatal(msg)
+}
+
+// exitLogger returns the logger that the "Exit" handlers use. Loggers
+// that set their own exit handler, and loggers other than Grip, which
+// handle exiting themselves, are used as is. Otherwise, the handler
+// uses a logger for the same sender, with the exit handler set for
+// this package, and the logger's flush timeout, or, if it does not
+// set one, the timeout set for this package.
+func exitLogger(logger grip.Journaler) grip.Journaler {
+	g, ok := logger.(*logging.Grip)
+	if !ok || g.ExitHandler() != nil {
+		return logger
+	}
+
+	exitMutex.RLock()
+	defer exitMutex.RUnlock()
+
+	fatal := logging.MakeGrip(g.GetSender())
+	fatal.SetExitHandler(exitHandler)
+	if timeout := g.ExitFlushTimeout(); timeout > 0 {
+		fatal.SetExitFlushTimeout(timeout)
 	} else {
-		logger.Emergency(msg)
+		fatal.SetExitFlushTimeout(exitFlushTimeout)
 	}
+
+	return fatal
 }
 
 func handleWithError(p error, err error, logger grip.Journaler, msg message.Composer) {
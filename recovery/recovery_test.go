@@ -2,7 +2,6 @@ package recovery
 
 import (
 	"errors"
-	"os"
 	"strings"
 	"testing"
 
@@ -16,6 +15,7 @@ import (
 type RecoverySuite struct {
 	sender       *send.InternalSender
 	globalSender send.Sender
+	exitCodes    []int
 	suite.Suite
 }
 
@@ -24,14 +24,15 @@ func TestRecoverySuite(t *testing.T) {
 }
 
 func (s *RecoverySuite) SetupSuite() {
-	s.Require().NoError(os.Setenv(killOverrideVarName, "true"))
+	SetExitHandler(func(code int) { s.exitCodes = append(s.exitCodes, code) })
 }
 
 func (s *RecoverySuite) TearDownSuite() {
-	s.Require().NoError(os.Setenv(killOverrideVarName, ""))
+	SetExitHandler(nil)
 }
 
 func (s *RecoverySuite) SetupTest() {
+	s.exitCodes = nil
 	s.sender = send.MakeInternalLogger()
 	s.globalSender = grip.GetSender()
 	s.Require().NoError(grip.SetSender(s.sender))
@@ -49,6 +50,7 @@ func (s *RecoverySuite) TestWithoutPanicNoErrorsLoged() {
 	s.False(s.sender.HasMessage())
 	LogStackTraceAndExit()
 	s.False(s.sender.HasMessage())
+	s.Empty(s.exitCodes)
 	s.NoError(HandlePanicWithError(nil, nil))
 	s.False(s.sender.HasMessage())
 }
@@ -78,6 +80,7 @@ func (s *RecoverySuite) TestPanicsCausesLogsWithExitHandler() {
 	s.True(strings.Contains(msg.Rendered, "hit panic; exiting"))
 	s.True(strings.Contains(msg.Rendered, "sorry buddy"))
 	s.True(strings.Contains(msg.Rendered, "exit op"))
+	s.Equal([]int{1}, s.exitCodes)
 }
 
 func (s *RecoverySuite) TestPanicCausesLogsWithErrorHandler() {
@@ -174,6 +177,7 @@ func (s *RecoverySuite) TestPanicsCausesAnnotateLogsWithExitHandler() {
 	s.True(strings.Contains(msg.Rendered, "hit panic; exiting"))
 	s.True(strings.Contains(msg.Rendered, "sorry buddy"))
 	s.True(strings.Contains(msg.Rendered, "exit op1"))
+	s.Equal([]int{1}, s.exitCodes)
 }
 
 func (s *RecoverySuite) TestPanicAnnotatesLogsWithErrorHandler() {
@@ -220,6 +224,7 @@ func (s *RecoverySuite) TestPanicsCausesSendJournalerLogsWithExitHandler() {
 	s.True(strings.Contains(msg.Rendered, "hit panic; exiting"))
 	s.True(strings.Contains(msg.Rendered, "sorry buddy"))
 	s.True(strings.Contains(msg.Rendered, "exit op2"))
+	s.Equal([]int{1}, s.exitCodes)
 }
 
 func (s *RecoverySuite) TestPanicSendJournalerLogsWithErrorHandler() {
@@ -240,3 +245,17 @@ func (s *RecoverySuite) TestPanicSendJournalerLogsWithErrorHandler() {
 	s.True(strings.Contains(msg.Rendered, "get a grip"))
 	s.True(strings.Contains(msg.Rendered, "foo='bar1'"))
 }
+
+func (s *RecoverySuite) TestPanicsCausesSendJournalerExitHandlerOverride() {
+	codes := []int{}
+	logger := logging.MakeGrip(s.sender)
+	logger.SetExitHandler(func(code int) { codes = append(codes, code) })
+
+	s.NotPanics(func() {
+		defer SendStackTraceMessageAndExit(logger, message.Fields{"foo": "exit op3"})
+		panic("sorry buddy")
+	})
+	s.True(s.sender.HasMessage())
+	s.Equal([]int{1}, codes)
+	s.Empty(s.exitCodes)
+}
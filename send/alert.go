@@ -0,0 +1,429 @@
+package send
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+const (
+	defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+	// limits of the PagerDuty Events v2 API.
+	pagerDutyMaxSummary  = 1024
+	pagerDutyMaxDedupKey = 255
+)
+
+// AlertOptions configures a sender that triggers and resolves
+// incidents in PagerDuty, with the Events v2 API, or in Prometheus
+// Alertmanager, or in both.
+//
+// Every message triggers an incident, except for alert messages, from
+// message.NewAlertResolution, that resolve them. Incidents are
+// identified by their deduplication key, which is the DedupKey of
+// alert messages, or derived from the values of DedupFields, or, if
+// none of those fields are set, from the message text.
+type AlertOptions struct {
+	// PagerDutyRoutingKey is the integration key of a PagerDuty
+	// service, and PagerDutyURL defaults to the Events v2 endpoint.
+	PagerDutyRoutingKey string
+	PagerDutyURL        string
+
+	// AlertmanagerURL is the base URL of an Alertmanager, such as
+	// http://alertmanager:9093. Alerts have the labels in
+	// AlertmanagerLabels, along with the alertname, which is the
+	// sender's name, the dedup_key, and the instance, which is the
+	// Source. The severity is an annotation, so that alerts keep
+	// their identity when their priority changes. Alerts that are not
+	// resolved expire after AlertmanagerTTL, if it is set, or else
+	// after Alertmanager's resolve_timeout.
+	AlertmanagerURL    string
+	AlertmanagerLabels map[string]string
+	AlertmanagerTTL    time.Duration
+
+	// DedupFields are the fields of structured messages that
+	// identify incidents.
+	DedupFields []string
+
+	// Severities overrides the severity of priorities, which are
+	// otherwise critical for critical and above, error, warning for
+	// warning and notice, and info.
+	Severities map[level.Priority]string
+
+	// Source is the affected system, and defaults to the hostname.
+	// Component, Group, and Class are optional, and are sent to
+	// PagerDuty.
+	Source    string
+	Component string
+	Group     string
+	Class     string
+
+	// Timeout limits the duration of each request, and defaults to
+	// 10 seconds. Client defaults to http.DefaultClient.
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// Validate checks the options and sets defaults for unspecified
+// values.
+func (o *AlertOptions) Validate() error {
+	errs := []string{}
+
+	if o.PagerDutyRoutingKey == "" && o.AlertmanagerURL == "" {
+		errs = append(errs, "must specify a pagerduty routing key or an alertmanager url")
+	}
+
+	if o.PagerDutyRoutingKey != "" && o.PagerDutyURL == "" {
+		o.PagerDutyURL = defaultPagerDutyURL
+	}
+	for _, u := range []string{o.PagerDutyURL, o.AlertmanagerURL} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("invalid url '%s'", u))
+		}
+	}
+	o.AlertmanagerURL = strings.TrimSuffix(o.AlertmanagerURL, "/")
+
+	for p, severity := range o.Severities {
+		if !p.IsValid() {
+			errs = append(errs, fmt.Sprintf("invalid priority %d", p))
+		}
+		switch severity {
+		case "critical", "error", "warning", "info":
+		default:
+			errs = append(errs, fmt.Sprintf("invalid severity '%s'", severity))
+		}
+	}
+
+	if o.AlertmanagerTTL < 0 || o.Timeout < 0 {
+		errs = append(errs, "durations cannot be negative")
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+
+	if o.Source == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			o.Source = hostname
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type alertLogger struct {
+	opts AlertOptions
+
+	// alerts are the labels and start times of the alerts triggered
+	// in Alertmanager, by dedup key, which must be repeated when
+	// they are resolved.
+	mu     sync.Mutex
+	alerts map[string]alertmanagerAlert
+	*Base
+}
+
+// NewAlertLogger constructs a Sender that pages with PagerDuty or
+// Alertmanager. Use the threshold of the level to only page for the
+// most urgent messages.
+func NewAlertLogger(name string, opts AlertOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeAlertLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeAlertLogger constructs an unconfigured alerting sender. Pass to
+// Journaler.SetSender or call SetName before using.
+func MakeAlertLogger(opts AlertOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &alertLogger{
+		opts:   opts,
+		alerts: map[string]alertmanagerAlert{},
+		Base:   NewBase(""),
+	}
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	return s, nil
+}
+
+func (s *alertLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	if g, ok := m.(*message.GroupComposer); ok {
+		for _, c := range g.Messages() {
+			s.Send(c)
+		}
+		return
+	}
+
+	a := s.alert(m)
+	if a.DedupKey == "" {
+		s.ErrorHandler()(errors.New("cannot determine the dedup key of the alert"), m)
+		return
+	}
+
+	if s.opts.PagerDutyRoutingKey != "" {
+		if err := s.sendPagerDuty(m.Priority(), a); err != nil {
+			s.ErrorHandler()(fmt.Errorf("sending pagerduty event: %w", err), m)
+		}
+	}
+	if s.opts.AlertmanagerURL != "" {
+		if err := s.sendAlertmanager(m.Priority(), a); err != nil {
+			s.ErrorHandler()(fmt.Errorf("sending alertmanager alert: %w", err), m)
+		}
+	}
+}
+
+// alert returns the alert for the message, with its dedup key.
+func (s *alertLogger) alert(m message.Composer) message.Alert {
+	var a message.Alert
+	switch raw := m.Raw().(type) {
+	case *message.Alert:
+		a = *raw
+	case message.Fields:
+		a.Summary = message.GetDefaultFieldsMessage(m, m.String())
+		a.Fields = make(message.Fields, len(raw))
+		for k, v := range raw {
+			if k != "metadata" && k != message.FieldsMsgName {
+				a.Fields[k] = v
+			}
+		}
+	default:
+		a.Summary = m.String()
+	}
+
+	if a.DedupKey == "" {
+		a.DedupKey = s.dedupKey(a)
+	}
+
+	return a
+}
+
+// dedupKey derives a key from the dedup fields, or the summary.
+func (s *alertLogger) dedupKey(a message.Alert) string {
+	parts := []string{}
+	for _, k := range s.opts.DedupFields {
+		if v, ok := a.Fields[k]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%v", k, v))
+		}
+	}
+
+	key := strings.Join(parts, ",")
+	if key == "" {
+		key = a.Summary
+	}
+	if len(key) > pagerDutyMaxDedupKey {
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+
+	return key
+}
+
+func (s *alertLogger) severity(p level.Priority) string {
+	if severity, ok := s.opts.Severities[p]; ok {
+		return severity
+	}
+
+	switch {
+	case p >= level.Critical:
+		return "critical"
+	case p >= level.Error:
+		return "error"
+	case p >= level.Notice:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string         `json:"summary"`
+	Source        string         `json:"source"`
+	Severity      string         `json:"severity"`
+	Timestamp     string         `json:"timestamp"`
+	Component     string         `json:"component,omitempty"`
+	Group         string         `json:"group,omitempty"`
+	Class         string         `json:"class,omitempty"`
+	CustomDetails message.Fields `json:"custom_details,omitempty"`
+}
+
+func (s *alertLogger) sendPagerDuty(p level.Priority, a message.Alert) error {
+	event := pagerDutyEvent{
+		RoutingKey:  s.opts.PagerDutyRoutingKey,
+		EventAction: "trigger",
+		DedupKey:    a.DedupKey,
+	}
+
+	if a.Resolve {
+		event.EventAction = "resolve"
+	} else {
+		event.Payload = &pagerDutyPayload{
+			Summary:       truncateText(a.Summary, pagerDutyMaxSummary),
+			Source:        s.opts.Source,
+			Severity:      s.severity(p),
+			Timestamp:     time.Now().UTC().Format(time.RFC3339Nano),
+			Component:     s.opts.Component,
+			Group:         s.opts.Group,
+			Class:         s.opts.Class,
+			CustomDetails: a.Fields,
+		}
+	}
+
+	return s.post(s.opts.PagerDutyURL, event)
+}
+
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+func (s *alertLogger) sendAlertmanager(p level.Priority, a message.Alert) error {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	alert, triggered := s.alerts[a.DedupKey]
+	s.mu.Unlock()
+
+	if a.Resolve {
+		if !triggered {
+			// alerts triggered by another process, or before a
+			// restart, are resolved by their labels, which do not
+			// depend on the priority.
+			alert = s.newAlertmanagerAlert(p, a, now)
+		}
+		alert.EndsAt = &now
+	} else {
+		startsAt := now
+		if triggered {
+			startsAt = alert.StartsAt
+		}
+		alert = s.newAlertmanagerAlert(p, a, startsAt)
+		if s.opts.AlertmanagerTTL > 0 {
+			endsAt := now.Add(s.opts.AlertmanagerTTL)
+			alert.EndsAt = &endsAt
+		}
+	}
+
+	if err := s.post(s.opts.AlertmanagerURL+"/api/v2/alerts", []alertmanagerAlert{alert}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a.Resolve {
+		delete(s.alerts, a.DedupKey)
+	} else {
+		alert.EndsAt = nil
+		s.alerts[a.DedupKey] = alert
+	}
+
+	return nil
+}
+
+func (s *alertLogger) newAlertmanagerAlert(p level.Priority, a message.Alert, startsAt time.Time) alertmanagerAlert {
+	alert := alertmanagerAlert{
+		Labels:      map[string]string{},
+		Annotations: map[string]string{},
+		StartsAt:    startsAt,
+	}
+
+	for k, v := range s.opts.AlertmanagerLabels {
+		alert.Labels[k] = v
+	}
+	alert.Labels["alertname"] = s.Name()
+	alert.Labels["dedup_key"] = a.DedupKey
+	alert.Labels["instance"] = s.opts.Source
+
+	alert.Annotations["severity"] = s.severity(p)
+	if a.Summary != "" {
+		alert.Annotations["summary"] = a.Summary
+	}
+	for k, v := range a.Fields {
+		alert.Annotations[k] = fmt.Sprint(v)
+	}
+
+	return alert
+}
+
+// post sends the JSON body, and returns an error for responses other
+// than 2xx.
+func (s *alertLogger) post(url string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("responded with %s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package send
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// alertServerMock stands in for both PagerDuty and Alertmanager, and
+// records the decoded requests by path.
+type alertServerMock struct {
+	mu       sync.Mutex
+	requests map[string][]json.RawMessage
+	status   int
+}
+
+func newAlertServerMock(t *testing.T) (*alertServerMock, string) {
+	mock := &alertServerMock{requests: map[string][]json.RawMessage{}}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+
+	return mock, srv.URL
+}
+
+func (m *alertServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[r.URL.Path] = append(m.requests[r.URL.Path], body)
+	if m.status != 0 {
+		http.Error(w, `{"status":"invalid event"}`, m.status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (m *alertServerMock) pagerDutyEvents(t *testing.T) []pagerDutyEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []pagerDutyEvent{}
+	for _, body := range m.requests["/v2/enqueue"] {
+		event := pagerDutyEvent{}
+		require.NoError(t, json.Unmarshal(body, &event))
+		out = append(out, event)
+	}
+	return out
+}
+
+func (m *alertServerMock) alertmanagerAlerts(t *testing.T) []alertmanagerAlert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []alertmanagerAlert{}
+	for _, body := range m.requests["/api/v2/alerts"] {
+		alerts := []alertmanagerAlert{}
+		require.NoError(t, json.Unmarshal(body, &alerts))
+		require.Len(t, alerts, 1)
+		out = append(out, alerts[0])
+	}
+	return out
+}
+
+func TestAlertLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Alert, Threshold: level.Alert}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]AlertOptions{
+			"NoBackend":   {},
+			"BadURL":      {AlertmanagerURL: "alertmanager:9093"},
+			"BadSeverity": {PagerDutyRoutingKey: "key", Severities: map[level.Priority]string{level.Alert: "page"}},
+			"BadPriority": {PagerDutyRoutingKey: "key", Severities: map[level.Priority]string{1: "info"}},
+			"BadTTL":      {AlertmanagerURL: "http://localhost:9093", AlertmanagerTTL: -time.Minute},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewAlertLogger("alerts", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := AlertOptions{PagerDutyRoutingKey: "key", AlertmanagerURL: "http://localhost:9093/"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, defaultPagerDutyURL, opts.PagerDutyURL)
+		assert.Equal(t, "http://localhost:9093", opts.AlertmanagerURL)
+		assert.Equal(t, 10*time.Second, opts.Timeout)
+		assert.NotEmpty(t, opts.Source)
+	})
+	t.Run("PagerDuty", func(t *testing.T) {
+		mock, url := newAlertServerMock(t)
+		s, err := NewAlertLogger("alerts", AlertOptions{
+			PagerDutyRoutingKey: "routing-key",
+			PagerDutyURL:        url + "/v2/enqueue",
+			DedupFields:         []string{"service", "check"},
+			Source:              "db1",
+			Component:           "postgres",
+			Severities:          map[level.Priority]string{level.Alert: "error"},
+		}, info)
+		require.NoError(t, err)
+
+		s.Send(message.NewFieldsMessage(level.Error, "below threshold", message.Fields{"service": "db"}))
+		s.Send(message.NewFieldsMessage(level.Emergency, "database down", message.Fields{
+			"service": "db",
+			"check":   "connect",
+			"attempt": 3,
+		}))
+		s.Send(message.NewFieldsMessage(level.Alert, "replication lag", message.Fields{"service": "db"}))
+		s.Send(message.NewAlertResolution(level.Alert, "", message.Fields{"service": "db", "check": "connect"}))
+		s.Send(message.NewAlertMessage(level.Alert, message.Alert{Summary: "explicit", DedupKey: "custom-key"}))
+		s.Send(message.NewDefaultMessage(level.Alert, strings.Repeat("x", 2000)))
+
+		events := mock.pagerDutyEvents(t)
+		require.Len(t, events, 5)
+
+		assert.Equal(t, "routing-key", events[0].RoutingKey)
+		assert.Equal(t, "trigger", events[0].EventAction)
+		assert.Equal(t, "service=db,check=connect", events[0].DedupKey)
+		require.NotNil(t, events[0].Payload)
+		assert.Equal(t, "database down", events[0].Payload.Summary)
+		assert.Equal(t, "critical", events[0].Payload.Severity)
+		assert.Equal(t, "db1", events[0].Payload.Source)
+		assert.Equal(t, "postgres", events[0].Payload.Component)
+		assert.EqualValues(t, 3, events[0].Payload.CustomDetails["attempt"])
+		assert.NotContains(t, events[0].Payload.CustomDetails, "metadata")
+		_, err = time.Parse(time.RFC3339Nano, events[0].Payload.Timestamp)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "service=db", events[1].DedupKey)
+		assert.Equal(t, "error", events[1].Payload.Severity)
+
+		assert.Equal(t, "resolve", events[2].EventAction)
+		assert.Equal(t, "service=db,check=connect", events[2].DedupKey)
+		assert.Nil(t, events[2].Payload)
+
+		assert.Equal(t, "custom-key", events[3].DedupKey)
+		assert.Equal(t, "explicit", events[3].Payload.Summary)
+
+		assert.Len(t, events[4].DedupKey, 64)
+		assert.Len(t, events[4].Payload.Summary, pagerDutyMaxSummary)
+	})
+	t.Run("Alertmanager", func(t *testing.T) {
+		mock, url := newAlertServerMock(t)
+		s, err := NewAlertLogger("database", AlertOptions{
+			AlertmanagerURL:    url,
+			AlertmanagerLabels: map[string]string{"team": "storage"},
+			AlertmanagerTTL:    time.Hour,
+			Source:             "db1",
+			Severities:         map[level.Priority]string{level.Alert: "warning"},
+		}, info)
+		require.NoError(t, err)
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+
+		s.Send(message.NewFieldsMessage(level.Emergency, "database down", message.Fields{"attempt": 1}))
+		s.Send(message.NewFieldsMessage(level.Alert, "database down", message.Fields{"attempt": 2}))
+		// resolutions that fail are retried with the state of the
+		// triggered alert.
+		mock.mu.Lock()
+		mock.status = http.StatusServiceUnavailable
+		mock.mu.Unlock()
+		s.Send(message.NewAlertResolution(level.Alert, "database down", nil))
+		require.Len(t, errs, 1)
+		mock.mu.Lock()
+		mock.status = 0
+		mock.mu.Unlock()
+		s.Send(message.NewAlertResolution(level.Alert, "database down", nil))
+		require.Len(t, errs, 1)
+
+		alerts := mock.alertmanagerAlerts(t)
+		require.Len(t, alerts, 4)
+		assert.Equal(t, map[string]string{
+			"alertname": "database",
+			"dedup_key": "database down",
+			"instance":  "db1",
+			"team":      "storage",
+		}, alerts[0].Labels)
+		assert.Equal(t, map[string]string{"severity": "critical", "summary": "database down", "attempt": "1"}, alerts[0].Annotations)
+		require.NotNil(t, alerts[0].EndsAt)
+		assert.True(t, alerts[0].EndsAt.Sub(alerts[0].StartsAt) > 59*time.Minute)
+
+		// changing the priority updates the same alert
+		assert.Equal(t, alerts[0].Labels, alerts[1].Labels)
+		assert.Equal(t, "warning", alerts[1].Annotations["severity"])
+		assert.Equal(t, "2", alerts[1].Annotations["attempt"])
+		assert.True(t, alerts[1].StartsAt.Equal(alerts[0].StartsAt))
+
+		for _, alert := range alerts[2:] {
+			assert.Equal(t, alerts[0].Labels, alert.Labels)
+			assert.True(t, alert.StartsAt.Equal(alerts[0].StartsAt))
+			require.NotNil(t, alert.EndsAt)
+			assert.True(t, alert.EndsAt.Before(alerts[0].StartsAt.Add(time.Minute)))
+		}
+
+		// alerts without local state are resolved by their labels,
+		// whatever the priority of the resolution.
+		restarted, err := NewAlertLogger("database", AlertOptions{
+			AlertmanagerURL:    url,
+			AlertmanagerLabels: map[string]string{"team": "storage"},
+			Source:             "db1",
+			Severities:         map[level.Priority]string{level.Alert: "warning"},
+		}, info)
+		require.NoError(t, err)
+		restarted.Send(message.NewAlertResolution(level.Alert, "database down", nil))
+
+		alerts = mock.alertmanagerAlerts(t)
+		require.Len(t, alerts, 5)
+		assert.Equal(t, alerts[0].Labels, alerts[4].Labels)
+		assert.NotNil(t, alerts[4].EndsAt)
+	})
+	t.Run("Errors", func(t *testing.T) {
+		mock, url := newAlertServerMock(t)
+		s, err := NewAlertLogger("alerts", AlertOptions{
+			PagerDutyRoutingKey: "key",
+			PagerDutyURL:        url + "/v2/enqueue",
+			AlertmanagerURL:     url,
+		}, info)
+		require.NoError(t, err)
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+
+		mock.status = http.StatusBadRequest
+		s.Send(message.NewDefaultMessage(level.Alert, "rejected"))
+		require.Len(t, errs, 2)
+		assert.Equal(t, `sending pagerduty event: responded with 400 Bad Request: {"status":"invalid event"}`, errs[0].Error())
+		assert.Contains(t, errs[1].Error(), "sending alertmanager alert")
+
+		s.Send(message.NewAlertResolution(level.Alert, "", message.Fields{"service": "db"}))
+		require.Len(t, errs, 3)
+		assert.Contains(t, errs[2].Error(), "dedup key")
+	})
+}
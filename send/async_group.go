@@ -117,3 +117,14 @@ func (s *asyncGroupSender) Flush(ctx context.Context) error {
 
 	return lastErr
 }
+
+// QueueDepth reports the number of messages waiting in the buffers
+// of all of the underlying senders.
+func (s *asyncGroupSender) QueueDepth() int {
+	var out int
+	for _, p := range s.pipes {
+		out += len(p)
+	}
+
+	return out
+}
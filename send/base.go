@@ -113,6 +113,13 @@ func (b *Base) Formatter() MessageFormatter {
 	}
 }
 
+func (b *Base) rawFormatter() MessageFormatter {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.formatter
+}
+
 // SetErrorHandler configures the error handling function for this Sender.
 func (b *Base) SetErrorHandler(eh ErrorHandler) error {
 	if eh == nil {
@@ -141,6 +148,13 @@ func (b *Base) ErrorHandler() ErrorHandler {
 	}
 }
 
+func (b *Base) rawErrorHandler() ErrorHandler {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.errHandler
+}
+
 // SetLevel configures the level (default levels and threshold levels)
 // for the Sender.
 func (b *Base) SetLevel(l LevelInfo) error {
@@ -85,6 +85,14 @@ func (s *bufferedSender) Flush(_ context.Context) error {
 	return nil
 }
 
+// QueueDepth reports the number of buffered messages.
+func (s *bufferedSender) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.buffer)
+}
+
 // Close writes any buffered messages to the underlying Sender. This does not
 // close the underlying sender.
 func (s *bufferedSender) Close() error {
@@ -0,0 +1,533 @@
+package send
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+const defaultElasticsearchIndex = `grip-{{ .Time.Format "2006.01.02" }}`
+
+// ElasticsearchOptions configures a sender that writes messages to
+// Elasticsearch or OpenSearch with the _bulk API.
+//
+// Each message is a document with the fields of its Raw form, other
+// than its metadata, along with "@timestamp", "message", "level",
+// "logger", "hostname", "process", and "pid" from the message's
+// metadata, and the message's annotations. Raw forms that are not
+// objects are in the "raw" field.
+type ElasticsearchOptions struct {
+	// URL is the base URL of the cluster, such as
+	// https://localhost:9200. Username and Password, or APIKey,
+	// authenticate requests, and Headers are added to every request.
+	URL      string
+	Username string
+	Password string
+	APIKey   string
+	Headers  map[string]string
+
+	// Index is a text/template for the name of each document's
+	// index, rendered with the Time, Priority, Name of the logger,
+	// and Fields of structured messages. The default is daily
+	// indexes named as grip-2006.01.02. Set DataStream to write to
+	// data streams, which only accept the create operation, and
+	// Pipeline to process documents with an ingest pipeline.
+	Index      string
+	DataStream bool
+	Pipeline   string
+
+	// Documents are written when there are BatchSize of them, which
+	// defaults to 500, and every FlushInterval, which defaults to 5
+	// seconds. When MaxPending documents, which defaults to ten
+	// batches, are waiting to be written, because the cluster is slow
+	// or rejecting requests, sending blocks until they are written.
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxPending    int
+
+	// Requests and documents that fail because the cluster is
+	// overloaded (429 Too Many Requests) or unavailable (5xx) are
+	// retried up to MaxRetries times, which defaults to 3, with an
+	// exponential backoff from MinBackoff to MaxBackoff, which
+	// default to half a second and 30 seconds. Documents that fail
+	// for other reasons, such as mapping conflicts, are reported to
+	// the error handler and dropped.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Timeout limits the duration of each request, and defaults to
+	// 30 seconds. Client defaults to http.DefaultClient.
+	Timeout time.Duration
+	Client  *http.Client
+
+	index *template.Template
+}
+
+// Validate checks the options and sets defaults for unspecified
+// values.
+func (o *ElasticsearchOptions) Validate() error {
+	errs := []string{}
+
+	if o.URL == "" {
+		errs = append(errs, "no url specified")
+	} else if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, fmt.Sprintf("invalid url '%s'", o.URL))
+	}
+	o.URL = strings.TrimSuffix(o.URL, "/")
+
+	if o.APIKey != "" && (o.Username != "" || o.Password != "") {
+		errs = append(errs, "cannot specify both an api key and a username and password")
+	}
+
+	if o.Index == "" {
+		o.Index = defaultElasticsearchIndex
+	}
+	index, err := template.New("index").Option("missingkey=zero").Parse(o.Index)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("invalid index template: %s", err))
+	}
+	o.index = index
+
+	if o.BatchSize < 0 || o.MaxPending < 0 || o.MaxRetries < 0 {
+		errs = append(errs, "sizes and retries cannot be negative")
+	}
+	if o.FlushInterval < 0 || o.MinBackoff < 0 || o.MaxBackoff < 0 || o.Timeout < 0 {
+		errs = append(errs, "durations cannot be negative")
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = 500
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = 5 * time.Second
+	}
+	if o.MaxPending == 0 {
+		o.MaxPending = 10 * o.BatchSize
+	}
+	if o.MaxPending < o.BatchSize {
+		errs = append(errs, "maximum pending documents cannot be less than the batch size")
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		errs = append(errs, "maximum backoff cannot be less than the minimum")
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 30 * time.Second
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type elasticsearchLogger struct {
+	opts ElasticsearchOptions
+
+	// mu protects the pending documents and the number of documents
+	// being written, and space is signaled when writes finish.
+	// pushMu orders the writes.
+	mu       sync.Mutex
+	space    *sync.Cond
+	pending  []esDocument
+	inflight int
+	closed   bool
+	pushMu   sync.Mutex
+	*Base
+}
+
+type esDocument struct {
+	action []byte
+	source []byte
+	msg    message.Composer
+}
+
+// esFailure is a document that could not be written.
+type esFailure struct {
+	msg message.Composer
+	err error
+}
+
+// NewElasticsearchLogger constructs a Sender that writes messages to
+// Elasticsearch or OpenSearch in batches.
+func NewElasticsearchLogger(name string, opts ElasticsearchOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeElasticsearchLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeElasticsearchLogger constructs an unconfigured Elasticsearch
+// sender. Pass to Journaler.SetSender or call SetName before using.
+func MakeElasticsearchLogger(opts ElasticsearchOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &elasticsearchLogger{
+		opts: opts,
+		Base: NewBase(""),
+	}
+	s.space = sync.NewCond(&s.mu)
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the closer cannot use the error handler, as Close holds the
+	// lock of the Base, so it returns errors instead.
+	s.closer = func() error {
+		cancel()
+
+		s.mu.Lock()
+		s.closed = true
+		s.space.Broadcast()
+		s.mu.Unlock()
+
+		failures := s.flush()
+		if len(failures) > 0 {
+			return fmt.Errorf("writing %d documents failed, first: %w", len(failures), failures[0].err)
+		}
+		return nil
+	}
+
+	go s.flushLoop(ctx, opts.FlushInterval)
+
+	return s, nil
+}
+
+func (s *elasticsearchLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	if g, ok := m.(*message.GroupComposer); ok {
+		for _, c := range g.Messages() {
+			s.Send(c)
+		}
+		return
+	}
+
+	doc, err := s.document(m)
+	if err != nil {
+		s.ErrorHandler()(err, m)
+		return
+	}
+
+	s.mu.Lock()
+	for len(s.pending)+s.inflight >= s.opts.MaxPending && !s.closed {
+		s.space.Wait()
+	}
+	if s.closed {
+		s.mu.Unlock()
+		s.ErrorHandler()(errors.New("sender is closed"), m)
+		return
+	}
+	s.pending = append(s.pending, doc)
+	full := len(s.pending) >= s.opts.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		s.report(s.flush())
+	}
+}
+
+// Flush writes the pending documents.
+func (s *elasticsearchLogger) Flush(_ context.Context) error {
+	failures := s.flush()
+	s.report(failures)
+
+	if len(failures) > 0 {
+		return fmt.Errorf("writing %d documents failed", len(failures))
+	}
+	return nil
+}
+
+func (s *elasticsearchLogger) report(failures []esFailure) {
+	for _, f := range failures {
+		s.ErrorHandler()(f.err, f.msg)
+	}
+}
+
+func (s *elasticsearchLogger) flushLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.report(s.flush())
+		}
+	}
+}
+
+// flush writes the pending documents in batches, and returns the
+// documents that could not be written.
+func (s *elasticsearchLogger) flush() []esFailure {
+	s.pushMu.Lock()
+	defer s.pushMu.Unlock()
+
+	var failures []esFailure
+	for {
+		s.mu.Lock()
+		n := len(s.pending)
+		if n > s.opts.BatchSize {
+			n = s.opts.BatchSize
+		}
+		batch := s.pending[:n:n]
+		s.pending = s.pending[n:]
+		s.inflight = n
+		s.mu.Unlock()
+
+		if n == 0 {
+			return failures
+		}
+
+		failures = append(failures, s.bulk(batch)...)
+
+		s.mu.Lock()
+		s.inflight = 0
+		s.space.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// document renders the message as a bulk action and document.
+func (s *elasticsearchLogger) document(m message.Composer) (esDocument, error) {
+	source := map[string]interface{}{}
+
+	raw := m.Raw()
+	if fields, ok := raw.(message.Fields); ok {
+		for k, v := range fields {
+			source[k] = v
+		}
+	} else if out, err := json.Marshal(raw); err != nil {
+		return esDocument{}, fmt.Errorf("encoding message: %w", err)
+	} else if err = json.Unmarshal(out, &source); err != nil {
+		source = map[string]interface{}{"raw": json.RawMessage(out)}
+	}
+	delete(source, "metadata")
+
+	meta := composerMetadata(m)
+	for k, v := range meta.Context {
+		if _, ok := source[k]; !ok {
+			source[k] = v
+		}
+	}
+
+	ts := meta.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	source["@timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+	source["message"] = message.GetDefaultFieldsMessage(m, m.String())
+	source["level"] = m.Priority().String()
+	source["logger"] = s.Name()
+	source["hostname"] = meta.Hostname
+	source["process"] = meta.Process
+	source["pid"] = meta.Pid
+
+	index, err := s.index(m, ts)
+	if err != nil {
+		return esDocument{}, err
+	}
+
+	op := "index"
+	if s.opts.DataStream {
+		op = "create"
+	}
+	action, err := json.Marshal(map[string]interface{}{op: map[string]string{"_index": index}})
+	if err != nil {
+		return esDocument{}, err
+	}
+
+	body, err := json.Marshal(source)
+	if err != nil {
+		return esDocument{}, fmt.Errorf("encoding document: %w", err)
+	}
+
+	return esDocument{action: action, source: body, msg: m}, nil
+}
+
+func (s *elasticsearchLogger) index(m message.Composer, ts time.Time) (string, error) {
+	data := struct {
+		Time     time.Time
+		Priority level.Priority
+		Name     string
+		Fields   message.Fields
+	}{
+		Time:     ts.UTC(),
+		Priority: m.Priority(),
+		Name:     s.Name(),
+	}
+	data.Fields, _ = m.Raw().(message.Fields)
+
+	buf := &bytes.Buffer{}
+	if err := s.opts.index.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("rendering index name: %w", err)
+	}
+
+	// fields missing from a message render as "<no value>" even
+	// with missingkey=zero, and index names must be lower case.
+	index := strings.ReplaceAll(buf.String(), "<no value>", "")
+	index = strings.ToLower(strings.TrimSpace(index))
+	if index == "" {
+		return "", errors.New("index name is empty")
+	}
+
+	return index, nil
+}
+
+// bulkResponse is the part of the _bulk response that reports the
+// results of each item, keyed by the operation.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk writes the documents, retrying those that fail because the
+// cluster is overloaded or unavailable.
+func (s *elasticsearchLogger) bulk(docs []esDocument) []esFailure {
+	var failures []esFailure
+	backoff := s.opts.MinBackoff
+
+	for attempt := 0; len(docs) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+		}
+
+		resp, retryable, err := s.do(docs)
+		if err != nil {
+			if !retryable || attempt >= s.opts.MaxRetries {
+				for _, d := range docs {
+					failures = append(failures, esFailure{msg: d.msg, err: err})
+				}
+				return failures
+			}
+			continue
+		}
+
+		if !resp.Errors {
+			return failures
+		}
+
+		var retry []esDocument
+		for i, item := range resp.Items {
+			if i >= len(docs) {
+				break
+			}
+			for _, result := range item {
+				switch {
+				case result.Status >= 200 && result.Status <= 299:
+				case (result.Status == http.StatusTooManyRequests || result.Status >= 500) && attempt < s.opts.MaxRetries:
+					retry = append(retry, docs[i])
+				default:
+					failures = append(failures, esFailure{
+						msg: docs[i].msg,
+						err: fmt.Errorf("writing document failed with status %d: %s", result.Status, result.Error),
+					})
+				}
+			}
+		}
+		docs = retry
+	}
+
+	return failures
+}
+
+// do sends a bulk request, and returns whether the request should be
+// retried if it fails.
+func (s *elasticsearchLogger) do(docs []esDocument) (*bulkResponse, bool, error) {
+	body := &bytes.Buffer{}
+	for _, d := range docs {
+		body.Write(d.action)
+		body.WriteByte('\n')
+		body.Write(d.source)
+		body.WriteByte('\n')
+	}
+
+	path := s.opts.URL + "/_bulk"
+	if s.opts.Pipeline != "" {
+		path += "?pipeline=" + url.QueryEscape(s.opts.Pipeline)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case s.opts.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.opts.APIKey)
+	case s.opts.Username != "":
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+	for k, v := range s.opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("sending bulk request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		out, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retryable, fmt.Errorf("bulk request failed with %s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+
+	out := &bulkResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, false, fmt.Errorf("decoding bulk response: %w", err)
+	}
+	if out.Errors && len(out.Items) != len(docs) {
+		return nil, false, fmt.Errorf("bulk response has %d items for %d documents", len(out.Items), len(docs))
+	}
+
+	return out, false, nil
+}
@@ -0,0 +1,302 @@
+package send
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bulkItem struct {
+	action map[string]map[string]string
+	source map[string]interface{}
+}
+
+// bulkServerMock implements the _bulk API, failing documents with the
+// statuses returned by itemStatus, or failing the whole request with
+// status, and waiting for release before responding when it is set.
+type bulkServerMock struct {
+	mu         sync.Mutex
+	requests   []*http.Request
+	written    []bulkItem
+	status     int
+	itemStatus func(source map[string]interface{}, attempt int) int
+	attempts   map[string]int
+	release    chan struct{}
+}
+
+func (m *bulkServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.release != nil {
+		<-m.release
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests = append(m.requests, r)
+	if m.status != 0 {
+		http.Error(w, `{"error":"overloaded"}`, m.status)
+		return
+	}
+
+	resp := bulkResponse{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		item := bulkItem{}
+		if err := json.Unmarshal(scanner.Bytes(), &item.action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !scanner.Scan() {
+			http.Error(w, "missing document", http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &item.source); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status := http.StatusCreated
+		if m.itemStatus != nil {
+			msg := item.source["message"].(string)
+			m.attempts[msg]++
+			status = m.itemStatus(item.source, m.attempts[msg])
+		}
+
+		result := struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		}{Status: status}
+		if status != http.StatusCreated {
+			resp.Errors = true
+			result.Error = json.RawMessage(`{"type":"rejected"}`)
+		} else {
+			m.written = append(m.written, item)
+		}
+		for op := range item.action {
+			resp.Items = append(resp.Items, map[string]struct {
+				Status int             `json:"status"`
+				Error  json.RawMessage `json:"error"`
+			}{op: result})
+		}
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (m *bulkServerMock) documents() []bulkItem {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]bulkItem{}, m.written...)
+}
+
+func TestElasticsearchLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	newLogger := func(t *testing.T, mock *bulkServerMock, opts ElasticsearchOptions) (Sender, *[]error) {
+		mock.attempts = map[string]int{}
+		srv := httptest.NewServer(mock)
+		t.Cleanup(srv.Close)
+
+		opts.URL = srv.URL
+		if opts.FlushInterval == 0 {
+			opts.FlushInterval = time.Hour
+		}
+		s, err := NewElasticsearchLogger("search", opts, info)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+
+		errs := &[]error{}
+		var mu sync.Mutex
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) {
+			mu.Lock()
+			defer mu.Unlock()
+			*errs = append(*errs, err)
+		}))
+
+		return s, errs
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]ElasticsearchOptions{
+			"NoURL":      {},
+			"BadURL":     {URL: "localhost:9200"},
+			"Auth":       {URL: "http://localhost:9200", APIKey: "key", Username: "user"},
+			"Index":      {URL: "http://localhost:9200", Index: "logs-{{ .Time"},
+			"MaxPending": {URL: "http://localhost:9200", BatchSize: 10, MaxPending: 5},
+			"Negative":   {URL: "http://localhost:9200", MaxRetries: -1},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewElasticsearchLogger("search", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := ElasticsearchOptions{URL: "http://localhost:9200/"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, "http://localhost:9200", opts.URL)
+		assert.Equal(t, defaultElasticsearchIndex, opts.Index)
+		assert.Equal(t, 500, opts.BatchSize)
+		assert.Equal(t, 5000, opts.MaxPending)
+	})
+	t.Run("Documents", func(t *testing.T) {
+		mock := &bulkServerMock{}
+		s, errs := newLogger(t, mock, ElasticsearchOptions{
+			APIKey:   "secret",
+			Pipeline: "logs",
+			Index:    `{{ .Name }}-{{ .Fields.service }}-{{ .Time.Format "2006.01" }}`,
+		})
+
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewFieldsMessage(level.Error, "request failed", message.Fields{"service": "API", "status": 500}))
+		annotated := message.NewDefaultMessage(level.Info, "annotated")
+		require.NoError(t, annotated.Annotate("request", "abc"))
+		s.Send(annotated)
+		s.Send(message.NewLineMessage(level.Info, "line", 1))
+		require.NoError(t, s.Flush(context.Background()))
+		require.Empty(t, *errs)
+
+		require.Len(t, mock.requests, 1)
+		req := mock.requests[0]
+		assert.Equal(t, "ApiKey secret", req.Header.Get("Authorization"))
+		assert.Equal(t, "application/x-ndjson", req.Header.Get("Content-Type"))
+		assert.Equal(t, "logs", req.URL.Query().Get("pipeline"))
+
+		docs := mock.documents()
+		require.Len(t, docs, 3)
+		month := time.Now().UTC().Format("2006.01")
+
+		assert.Equal(t, "search-api-"+month, docs[0].action["index"]["_index"])
+		assert.Equal(t, "request failed", docs[0].source["message"])
+		assert.Equal(t, "error", docs[0].source["level"])
+		assert.Equal(t, "search", docs[0].source["logger"])
+		assert.EqualValues(t, 500, docs[0].source["status"])
+		assert.NotEmpty(t, docs[0].source["hostname"])
+		assert.NotEmpty(t, docs[0].source["pid"])
+		assert.NotContains(t, docs[0].source, "metadata")
+		ts, err := time.Parse(time.RFC3339Nano, docs[0].source["@timestamp"].(string))
+		require.NoError(t, err)
+		assert.True(t, time.Since(ts) < time.Minute)
+
+		// the index of messages without fields has no value for them
+		assert.Equal(t, "search--"+month, docs[1].action["index"]["_index"])
+		assert.Equal(t, "annotated", docs[1].source["message"])
+		assert.Equal(t, "abc", docs[1].source["request"])
+
+		assert.Equal(t, "line 1", docs[2].source["message"])
+	})
+	t.Run("DataStream", func(t *testing.T) {
+		mock := &bulkServerMock{}
+		s, errs := newLogger(t, mock, ElasticsearchOptions{Index: "logs-app", DataStream: true, Username: "user", Password: "pass"})
+
+		s.Send(message.NewDefaultMessage(level.Info, "streamed"))
+		require.NoError(t, s.Close())
+		require.Empty(t, *errs)
+
+		docs := mock.documents()
+		require.Len(t, docs, 1)
+		assert.Equal(t, map[string]map[string]string{"create": {"_index": "logs-app"}}, docs[0].action)
+		user, pass, ok := mock.requests[0].BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+	})
+	t.Run("PartialFailures", func(t *testing.T) {
+		mock := &bulkServerMock{itemStatus: func(source map[string]interface{}, attempt int) int {
+			switch source["message"] {
+			case "retried":
+				if attempt < 3 {
+					return http.StatusTooManyRequests
+				}
+			case "unavailable":
+				return http.StatusServiceUnavailable
+			case "mapping":
+				return http.StatusBadRequest
+			}
+			return http.StatusCreated
+		}}
+		s, errs := newLogger(t, mock, ElasticsearchOptions{BatchSize: 4, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 2})
+
+		for _, msg := range []string{"ok", "retried", "unavailable", "mapping"} {
+			s.Send(message.NewDefaultMessage(level.Info, msg))
+		}
+		require.Len(t, *errs, 2)
+
+		docs := mock.documents()
+		require.Len(t, docs, 2)
+		assert.Equal(t, "ok", docs[0].source["message"])
+		assert.Equal(t, "retried", docs[1].source["message"])
+		assert.Equal(t, 3, mock.attempts["unavailable"])
+		assert.Equal(t, 1, mock.attempts["mapping"])
+		assert.Contains(t, (*errs)[0].Error(), "status 400")
+		assert.Contains(t, (*errs)[1].Error(), "status 503")
+	})
+	t.Run("RequestFailures", func(t *testing.T) {
+		mock := &bulkServerMock{status: http.StatusTooManyRequests}
+		s, errs := newLogger(t, mock, ElasticsearchOptions{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 1})
+
+		s.Send(message.NewDefaultMessage(level.Info, "one"))
+		s.Send(message.NewDefaultMessage(level.Info, "two"))
+		assert.Error(t, s.Flush(context.Background()))
+		assert.Len(t, mock.requests, 2)
+		require.Len(t, *errs, 2)
+		assert.Contains(t, (*errs)[0].Error(), "bulk request failed with 429")
+
+		mock.status = http.StatusUnauthorized
+		s.Send(message.NewDefaultMessage(level.Info, "three"))
+		assert.Error(t, s.Flush(context.Background()))
+		assert.Len(t, mock.requests, 3)
+	})
+	t.Run("Backpressure", func(t *testing.T) {
+		mock := &bulkServerMock{release: make(chan struct{})}
+		s, errs := newLogger(t, mock, ElasticsearchOptions{BatchSize: 2, MaxPending: 2})
+
+		// the second message fills the batch, and blocks writing it
+		writing := make(chan struct{})
+		go func() {
+			defer close(writing)
+			s.Send(message.NewDefaultMessage(level.Info, "one"))
+			s.Send(message.NewDefaultMessage(level.Info, "two"))
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		blocked := make(chan struct{})
+		go func() {
+			defer close(blocked)
+			s.Send(message.NewDefaultMessage(level.Info, "three"))
+		}()
+
+		select {
+		case <-blocked:
+			require.FailNow(t, "send did not block while the backlog is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(mock.release)
+		<-writing
+		<-blocked
+		require.NoError(t, s.Flush(context.Background()))
+		assert.Empty(t, *errs)
+		assert.Len(t, mock.documents(), 3)
+	})
+	t.Run("Closed", func(t *testing.T) {
+		mock := &bulkServerMock{}
+		s, errs := newLogger(t, mock, ElasticsearchOptions{})
+		require.NoError(t, s.Close())
+
+		s.Send(message.NewDefaultMessage(level.Info, "late"))
+		require.Len(t, *errs, 1)
+		assert.Contains(t, (*errs)[0].Error(), "closed")
+	})
+}
@@ -0,0 +1,456 @@
+package send
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/message"
+)
+
+// FluentOptions configures a sender for the Fluentd forward protocol,
+// which Fluentd and Fluent Bit accept with their forward inputs.
+type FluentOptions struct {
+	// Network is "tcp", the default, or "unix". The Address
+	// defaults to 127.0.0.1:24224 for TCP.
+	Network string `bson:"network" json:"network" yaml:"network"`
+	Address string `bson:"address" json:"address" yaml:"address"`
+
+	// TagPrefix is prepended to the name of the sender, separated by
+	// a dot, to form the tag of the records.
+	TagPrefix string `bson:"tag_prefix" json:"tag_prefix" yaml:"tag_prefix"`
+
+	// RequireAck sends each message with a chunk ID, and waits up
+	// to AckTimeout, which defaults to 5 seconds, for the server to
+	// acknowledge it, resending it once on a new connection if it
+	// does not. Without acknowledgments, messages written to a
+	// connection that the server has closed may be lost.
+	RequireAck bool          `bson:"require_ack" json:"require_ack" yaml:"require_ack"`
+	AckTimeout time.Duration `bson:"ack_timeout" json:"ack_timeout" yaml:"ack_timeout"`
+
+	// SharedKey enables the handshake of servers configured with a
+	// security section, and Username and Password authenticate
+	// with servers that require user authentication. Hostname is
+	// the self_hostname sent in the handshake, and defaults to the
+	// name of the host.
+	SharedKey string `bson:"shared_key" json:"shared_key" yaml:"shared_key"`
+	Username  string `bson:"username" json:"username" yaml:"username"`
+	Password  string `bson:"password" json:"password" yaml:"password"`
+	Hostname  string `bson:"hostname" json:"hostname" yaml:"hostname"`
+
+	// DialTimeout and WriteTimeout default to 5 seconds. After a
+	// failed connection attempt, the sender reports errors without
+	// reconnecting for ReconnectInterval, which defaults to 1 second.
+	DialTimeout       time.Duration `bson:"dial_timeout" json:"dial_timeout" yaml:"dial_timeout"`
+	WriteTimeout      time.Duration `bson:"write_timeout" json:"write_timeout" yaml:"write_timeout"`
+	ReconnectInterval time.Duration `bson:"reconnect_interval" json:"reconnect_interval" yaml:"reconnect_interval"`
+}
+
+// Validate checks the options, and sets defaults for unset values.
+func (opts *FluentOptions) Validate() error {
+	if opts == nil {
+		return errors.New("must specify non-nil fluent options")
+	}
+
+	errs := []string{}
+
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	switch opts.Network {
+	case "tcp":
+		if opts.Address == "" {
+			opts.Address = "127.0.0.1:24224"
+		}
+	case "unix":
+		if opts.Address == "" {
+			errs = append(errs, "must specify the path of the unix socket")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported network '%s'", opts.Network))
+	}
+
+	if strings.ContainsAny(opts.TagPrefix, " \t\r\n") {
+		errs = append(errs, fmt.Sprintf("invalid tag prefix '%s'", opts.TagPrefix))
+	}
+
+	if opts.SharedKey == "" && (opts.Username != "" || opts.Password != "") {
+		errs = append(errs, "user authentication requires a shared key")
+	}
+
+	if opts.AckTimeout == 0 {
+		opts.AckTimeout = 5 * time.Second
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+	if opts.ReconnectInterval == 0 {
+		opts.ReconnectInterval = time.Second
+	}
+	if opts.AckTimeout < 0 || opts.DialTimeout < 0 || opts.WriteTimeout < 0 || opts.ReconnectInterval < 0 {
+		errs = append(errs, "timeouts must not be negative")
+	}
+
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+type fluentLogger struct {
+	opts FluentOptions
+
+	mu         sync.Mutex
+	conn       net.Conn
+	reader     *bufio.Reader
+	keepalive  bool
+	lastFailed time.Time
+
+	*Base
+}
+
+// NewFluentLogger constructs a Sender that sends messages to Fluentd
+// or Fluent Bit with the forward protocol, in the PackedForward mode.
+// Records are tagged with the name of the sender, and hold the fields
+// of structured messages, or the Raw form of other messages, with the
+// formatted message, level, hostname, and process.
+//
+// Each call to Send writes one message, and the messages of a group
+// composer are written together, so wrap the sender with
+// NewBufferedSender to send batches of records.
+//
+// The sender connects when it sends the first message, and reconnects
+// after errors.
+func NewFluentLogger(name string, opts FluentOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeFluentLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeFluentLogger constructs an unconfigured Fluentd forward sender.
+// Pass to Journaler.SetSender or call SetName before using.
+func MakeFluentLogger(opts FluentOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &fluentLogger{
+		opts: opts,
+		Base: NewBase(""),
+	}
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	s.closer = func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return s.disconnect()
+	}
+
+	return s, nil
+}
+
+func (s *fluentLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	msgs := []message.Composer{m}
+	if g, ok := m.(*message.GroupComposer); ok {
+		msgs = msgs[:0]
+		for _, c := range g.Messages() {
+			if s.Level().ShouldLog(c) {
+				msgs = append(msgs, c)
+			}
+		}
+	}
+
+	var entries []byte
+	size := 0
+	for _, c := range msgs {
+		record, ts, err := s.record(c)
+		if err != nil {
+			s.ErrorHandler()(err, c)
+			continue
+		}
+
+		entries = appendMsgpackArrayHeader(entries, 2)
+		entries = appendMsgpackEventTime(entries, ts)
+		entries = appendMsgpack(entries, record)
+		size++
+	}
+	if size == 0 {
+		return
+	}
+
+	if err := s.write(s.tag(), entries, size); err != nil {
+		s.ErrorHandler()(err, m)
+	}
+}
+
+func (s *fluentLogger) tag() string {
+	tag := strings.Join(strings.Fields(s.Name()), "_")
+	if s.opts.TagPrefix == "" {
+		return tag
+	}
+	if tag == "" {
+		return s.opts.TagPrefix
+	}
+
+	return s.opts.TagPrefix + "." + tag
+}
+
+// record converts the message to the record of a forward protocol
+// entry, and returns it with the time of the message.
+func (s *fluentLogger) record(m message.Composer) (map[string]interface{}, time.Time, error) {
+	record := map[string]interface{}{}
+
+	raw := m.Raw()
+	if fields, ok := raw.(message.Fields); ok {
+		for k, v := range fields {
+			record[k] = v
+		}
+	} else if out, err := json.Marshal(raw); err != nil {
+		return nil, time.Time{}, fmt.Errorf("encoding message: %w", err)
+	} else if err = json.Unmarshal(out, &record); err != nil {
+		record = map[string]interface{}{"raw": raw}
+	}
+	delete(record, "metadata")
+
+	meta := composerMetadata(m)
+	for k, v := range meta.Context {
+		if _, ok := record[k]; !ok {
+			record[k] = v
+		}
+	}
+
+	record["message"] = message.GetDefaultFieldsMessage(m, m.String())
+	record["level"] = m.Priority().String()
+	record["hostname"] = meta.Hostname
+	record["process"] = meta.Process
+	record["pid"] = meta.Pid
+
+	ts := meta.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	return record, ts, nil
+}
+
+// write sends the entries in the PackedForward mode, reconnecting and
+// retrying once if the connection has failed.
+func (s *fluentLogger) write(tag string, entries []byte, size int) error {
+	options := map[string]interface{}{"size": size}
+	var chunk string
+	if s.opts.RequireAck {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return fmt.Errorf("generating chunk id: %w", err)
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		options["chunk"] = chunk
+	}
+
+	msg := appendMsgpackArrayHeader(nil, 3)
+	msg = appendMsgpackString(msg, tag)
+	msg = appendMsgpackBinary(msg, entries)
+	msg = appendMsgpack(msg, options)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = s.connect(); err != nil {
+			return err
+		}
+
+		if err = s.send(msg, chunk); err == nil {
+			if !s.keepalive {
+				_ = s.disconnect()
+			}
+			return nil
+		}
+
+		_ = s.disconnect()
+	}
+
+	return err
+}
+
+func (s *fluentLogger) send(msg []byte, chunk string) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		return fmt.Errorf("writing to fluent server %s: %w", s.opts.Address, err)
+	}
+
+	if chunk == "" {
+		return nil
+	}
+
+	resp, err := s.read(s.opts.AckTimeout)
+	if err != nil {
+		return fmt.Errorf("waiting for ack from fluent server %s: %w", s.opts.Address, err)
+	}
+	ack, _ := resp.(map[string]interface{})
+	if id := msgpackString(ack["ack"]); id != chunk {
+		return fmt.Errorf("fluent server %s acknowledged chunk '%s' instead of '%s'", s.opts.Address, id, chunk)
+	}
+
+	return nil
+}
+
+func (s *fluentLogger) read(timeout time.Duration) (interface{}, error) {
+	if err := s.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	return readMsgpack(s.reader)
+}
+
+func (s *fluentLogger) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	if time.Since(s.lastFailed) < s.opts.ReconnectInterval {
+		return fmt.Errorf("not connected to fluent server %s", s.opts.Address)
+	}
+
+	conn, err := net.DialTimeout(s.opts.Network, s.opts.Address, s.opts.DialTimeout)
+	if err != nil {
+		s.lastFailed = time.Now()
+		return fmt.Errorf("connecting to fluent server %s: %w", s.opts.Address, err)
+	}
+
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	s.keepalive = true
+
+	if s.opts.SharedKey != "" {
+		if err = s.handshake(); err != nil {
+			_ = s.disconnect()
+			s.lastFailed = time.Now()
+			return fmt.Errorf("handshake with fluent server %s: %w", s.opts.Address, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *fluentLogger) disconnect() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	s.reader = nil
+	return err
+}
+
+// handshake authenticates the connection with the HELO, PING, and
+// PONG messages of the forward protocol.
+func (s *fluentLogger) handshake() error {
+	helo, err := s.read(s.opts.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("reading HELO: %w", err)
+	}
+	fields, _ := helo.([]interface{})
+	if len(fields) != 2 || msgpackString(fields[0]) != "HELO" {
+		return errors.New("expected HELO")
+	}
+	heloOpts, _ := fields[1].(map[string]interface{})
+	nonce := msgpackString(heloOpts["nonce"])
+	authSalt := msgpackString(heloOpts["auth"])
+	if keepalive, ok := heloOpts["keepalive"].(bool); ok {
+		s.keepalive = keepalive
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return fmt.Errorf("generating salt: %w", err)
+	}
+	sharedKeySalt := hex.EncodeToString(salt)
+
+	username, passwordDigest := "", ""
+	if authSalt != "" {
+		username = s.opts.Username
+		passwordDigest = fluentDigest(authSalt, s.opts.Username, s.opts.Password)
+	}
+
+	ping := appendMsgpack(nil, []string{
+		"PING",
+		s.opts.Hostname,
+		sharedKeySalt,
+		fluentDigest(sharedKeySalt, s.opts.Hostname, nonce, s.opts.SharedKey),
+		username,
+		passwordDigest,
+	})
+	if err = s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout)); err != nil {
+		return err
+	}
+	if _, err = s.conn.Write(ping); err != nil {
+		return fmt.Errorf("writing PING: %w", err)
+	}
+
+	pong, err := s.read(s.opts.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("reading PONG: %w", err)
+	}
+	fields, _ = pong.([]interface{})
+	if len(fields) != 5 || msgpackString(fields[0]) != "PONG" {
+		return errors.New("expected PONG")
+	}
+	if ok, _ := fields[1].(bool); !ok {
+		return fmt.Errorf("authentication failed: %s", msgpackString(fields[2]))
+	}
+	serverHostname := msgpackString(fields[3])
+	if msgpackString(fields[4]) != fluentDigest(sharedKeySalt, serverHostname, nonce, s.opts.SharedKey) {
+		return errors.New("server shared key mismatch")
+	}
+
+	return nil
+}
+
+// fluentDigest returns the hex encoded SHA-512 digest of the
+// concatenated values.
+func fluentDigest(values ...string) string {
+	h := sha512.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,297 @@
+package send
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fluentEntry struct {
+	time   time.Time
+	record map[string]interface{}
+}
+
+type fluentMessage struct {
+	tag     string
+	entries []fluentEntry
+	options map[string]interface{}
+}
+
+// fluentServerMock implements the forward protocol, with the
+// handshake if sharedKey is set, and acknowledges chunks, except for
+// the first dropAcks chunks, after which it closes the connection.
+type fluentServerMock struct {
+	mu          sync.Mutex
+	messages    []fluentMessage
+	connections int
+	sharedKey   string
+	password    string
+	dropAcks    int
+}
+
+func newFluentServerMock(t *testing.T, network, address string) (*fluentServerMock, string) {
+	listener, err := net.Listen(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	mock := &fluentServerMock{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mock.serve(conn)
+		}
+	}()
+
+	return mock, listener.Addr().String()
+}
+
+func (m *fluentServerMock) serve(conn net.Conn) {
+	defer conn.Close()
+
+	m.mu.Lock()
+	m.connections++
+	sharedKey, password := m.sharedKey, m.password
+	m.mu.Unlock()
+
+	if sharedKey != "" && !m.handshake(conn, sharedKey, password) {
+		return
+	}
+
+	for {
+		v, err := readMsgpack(conn)
+		if err != nil {
+			return
+		}
+		fields := v.([]interface{})
+		msg := fluentMessage{tag: fields[0].(string), options: fields[2].(map[string]interface{})}
+
+		entries := bytes.NewReader(fields[1].([]byte))
+		for {
+			entry, err := readMsgpack(entries)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return
+			}
+
+			pair := entry.([]interface{})
+			ts := pair[0].(msgpackExt)
+			msg.entries = append(msg.entries, fluentEntry{
+				time:   time.Unix(int64(binary.BigEndian.Uint32(ts.Data[:4])), int64(binary.BigEndian.Uint32(ts.Data[4:]))),
+				record: pair[1].(map[string]interface{}),
+			})
+		}
+
+		m.mu.Lock()
+		if chunk, ok := msg.options["chunk"]; ok && m.dropAcks > 0 {
+			m.dropAcks--
+			m.mu.Unlock()
+			return
+		} else if ok {
+			_, _ = conn.Write(appendMsgpack(nil, map[string]interface{}{"ack": chunk}))
+		}
+		m.messages = append(m.messages, msg)
+		m.mu.Unlock()
+	}
+}
+
+func (m *fluentServerMock) handshake(conn net.Conn, sharedKey, password string) bool {
+	_, _ = conn.Write(appendMsgpack(nil, []interface{}{"HELO", map[string]interface{}{
+		"nonce":     []byte("nonce"),
+		"auth":      "salt",
+		"keepalive": true,
+	}}))
+
+	v, err := readMsgpack(conn)
+	if err != nil {
+		return false
+	}
+	ping := v.([]interface{})
+	hostname, salt := ping[1].(string), ping[2].(string)
+
+	ok := ping[3] == fluentDigest(salt, hostname, "nonce", sharedKey) &&
+		ping[5] == fluentDigest("salt", ping[4].(string), password)
+	_, _ = conn.Write(appendMsgpack(nil, []interface{}{
+		"PONG", ok, "invalid credentials", "server", fluentDigest(salt, "server", "nonce", sharedKey),
+	}))
+
+	return ok
+}
+
+func (m *fluentServerMock) received() []fluentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]fluentMessage{}, m.messages...)
+}
+
+func TestFluentLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	newLogger := func(t *testing.T, name string, opts FluentOptions) (Sender, *[]error) {
+		s, err := NewFluentLogger(name, opts, info)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+
+		errs := &[]error{}
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { *errs = append(*errs, err) }))
+
+		return s, errs
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]FluentOptions{
+			"Network":   {Network: "udp"},
+			"NoSocket":  {Network: "unix"},
+			"TagPrefix": {TagPrefix: "my app"},
+			"NoKey":     {Username: "user", Password: "pass"},
+			"Timeout":   {AckTimeout: -time.Second},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewFluentLogger("fluent", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := FluentOptions{}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, "tcp", opts.Network)
+		assert.Equal(t, "127.0.0.1:24224", opts.Address)
+		assert.Equal(t, 5*time.Second, opts.AckTimeout)
+		assert.NotEmpty(t, opts.Hostname)
+	})
+	t.Run("Records", func(t *testing.T) {
+		mock, addr := newFluentServerMock(t, "tcp", "127.0.0.1:0")
+		s, errs := newLogger(t, "api server", FluentOptions{Address: addr, TagPrefix: "grip", RequireAck: true})
+
+		start := time.Now()
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewFieldsMessage(level.Error, "request failed", message.Fields{
+			"status":  500,
+			"latency": 1.5,
+			"tags":    []string{"a", "b"},
+		}))
+		annotated := message.NewDefaultMessage(level.Info, "annotated")
+		require.NoError(t, annotated.Annotate("request", "abc"))
+		s.Send(annotated)
+		require.Empty(t, *errs)
+
+		msgs := mock.received()
+		require.Len(t, msgs, 2)
+		assert.Equal(t, "grip.api_server", msgs[0].tag)
+		assert.EqualValues(t, 1, msgs[0].options["size"])
+		assert.NotEmpty(t, msgs[0].options["chunk"])
+
+		require.Len(t, msgs[0].entries, 1)
+		entry := msgs[0].entries[0]
+		assert.False(t, entry.time.Before(start.Truncate(time.Second)))
+		assert.Equal(t, "request failed", entry.record["message"])
+		assert.Equal(t, "error", entry.record["level"])
+		assert.EqualValues(t, 500, entry.record["status"])
+		assert.Equal(t, 1.5, entry.record["latency"])
+		assert.Equal(t, []interface{}{"a", "b"}, entry.record["tags"])
+		assert.NotEmpty(t, entry.record["hostname"])
+		assert.NotContains(t, entry.record, "metadata")
+
+		assert.Equal(t, "annotated", msgs[1].entries[0].record["message"])
+		assert.Equal(t, "abc", msgs[1].entries[0].record["request"])
+
+		mock.mu.Lock()
+		assert.Equal(t, 1, mock.connections)
+		mock.mu.Unlock()
+	})
+	t.Run("Group", func(t *testing.T) {
+		mock, addr := newFluentServerMock(t, "tcp", "127.0.0.1:0")
+		s, errs := newLogger(t, "fluent", FluentOptions{Address: addr, RequireAck: true})
+
+		s.Send(message.NewGroupComposer([]message.Composer{
+			message.NewDefaultMessage(level.Info, "one"),
+			message.NewDefaultMessage(level.Debug, "below threshold"),
+			message.NewDefaultMessage(level.Warning, "two"),
+		}))
+		require.Empty(t, *errs)
+
+		msgs := mock.received()
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "fluent", msgs[0].tag)
+		assert.EqualValues(t, 2, msgs[0].options["size"])
+		require.Len(t, msgs[0].entries, 2)
+		assert.Equal(t, "one", msgs[0].entries[0].record["message"])
+		assert.Equal(t, "two", msgs[0].entries[1].record["message"])
+	})
+	t.Run("Reconnect", func(t *testing.T) {
+		mock, addr := newFluentServerMock(t, "unix", filepath.Join(t.TempDir(), "fluent.sock"))
+		mock.mu.Lock()
+		mock.dropAcks = 1
+		mock.mu.Unlock()
+		s, errs := newLogger(t, "fluent", FluentOptions{Network: "unix", Address: addr, RequireAck: true})
+
+		// the first connection is closed without an ack, and the
+		// message is resent on a new connection.
+		s.Send(message.NewDefaultMessage(level.Info, "resent"))
+		require.Empty(t, *errs)
+		require.Len(t, mock.received(), 1)
+
+		mock.mu.Lock()
+		assert.Equal(t, 2, mock.connections)
+		mock.dropAcks = 2
+		mock.mu.Unlock()
+
+		s.Send(message.NewDefaultMessage(level.Info, "dropped"))
+		require.Len(t, *errs, 1)
+		assert.Contains(t, (*errs)[0].Error(), "waiting for ack")
+		assert.Len(t, mock.received(), 1)
+	})
+	t.Run("Handshake", func(t *testing.T) {
+		mock, addr := newFluentServerMock(t, "tcp", "127.0.0.1:0")
+		mock.mu.Lock()
+		mock.sharedKey = "secret"
+		mock.password = "pass"
+		mock.mu.Unlock()
+		s, errs := newLogger(t, "fluent", FluentOptions{Address: addr, SharedKey: "secret", Username: "user", Password: "pass"})
+
+		s.Send(message.NewDefaultMessage(level.Info, "authenticated"))
+		require.NoError(t, s.Close())
+		require.Empty(t, *errs)
+
+		var msgs []fluentMessage
+		for deadline := time.Now().Add(5 * time.Second); len(msgs) == 0 && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+			msgs = mock.received()
+		}
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "authenticated", msgs[0].entries[0].record["message"])
+
+		s, errs = newLogger(t, "fluent", FluentOptions{Address: addr, SharedKey: "secret", Username: "user", Password: "wrong"})
+		s.Send(message.NewDefaultMessage(level.Info, "rejected"))
+		require.Len(t, *errs, 1)
+		assert.Contains(t, (*errs)[0].Error(), "authentication failed: invalid credentials")
+	})
+	t.Run("Unavailable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := listener.Addr().String()
+		require.NoError(t, listener.Close())
+
+		s, errs := newLogger(t, "fluent", FluentOptions{Address: addr, ReconnectInterval: time.Hour})
+		s.Send(message.NewDefaultMessage(level.Info, "one"))
+		s.Send(message.NewDefaultMessage(level.Info, "two"))
+		require.Len(t, *errs, 2)
+		assert.Contains(t, (*errs)[0].Error(), "connecting to fluent server")
+		assert.Contains(t, (*errs)[1].Error(), "not connected to fluent server")
+	})
+}
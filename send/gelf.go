@@ -0,0 +1,420 @@
+package send
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/message"
+)
+
+const (
+	// gelfChunkHeaderSize is the size of the magic bytes, message
+	// ID, sequence number, and sequence count of each chunk.
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+// GELFOptions configures a sender for the Graylog Extended Log
+// Format.
+type GELFOptions struct {
+	// Network is "udp", the default, or "tcp". The Address defaults
+	// to 127.0.0.1:12201.
+	Network string `bson:"network" json:"network" yaml:"network"`
+	Address string `bson:"address" json:"address" yaml:"address"`
+
+	// Compression is "gzip", the default, "zlib", or "none", and is
+	// only supported over UDP, as TCP inputs do not accept
+	// compressed messages.
+	Compression string `bson:"compression" json:"compression" yaml:"compression"`
+
+	// ChunkSize is the maximum size of UDP datagrams, and defaults to
+	// 1420 bytes. Larger messages are split into as many as 128
+	// chunks.
+	ChunkSize int `bson:"chunk_size" json:"chunk_size" yaml:"chunk_size"`
+
+	// Host defaults to the name of the host.
+	Host string `bson:"host" json:"host" yaml:"host"`
+
+	// DialTimeout and WriteTimeout default to 5 seconds. After a
+	// failed connection attempt, the sender reports errors without
+	// reconnecting for ReconnectInterval, which defaults to 1 second.
+	DialTimeout       time.Duration `bson:"dial_timeout" json:"dial_timeout" yaml:"dial_timeout"`
+	WriteTimeout      time.Duration `bson:"write_timeout" json:"write_timeout" yaml:"write_timeout"`
+	ReconnectInterval time.Duration `bson:"reconnect_interval" json:"reconnect_interval" yaml:"reconnect_interval"`
+}
+
+// Validate checks the options, and sets defaults for unset values.
+func (opts *GELFOptions) Validate() error {
+	if opts == nil {
+		return errors.New("must specify non-nil gelf options")
+	}
+
+	errs := []string{}
+
+	if opts.Network == "" {
+		opts.Network = "udp"
+	}
+	if opts.Address == "" {
+		opts.Address = "127.0.0.1:12201"
+	}
+
+	switch opts.Network {
+	case "udp":
+		if opts.Compression == "" {
+			opts.Compression = "gzip"
+		}
+		switch opts.Compression {
+		case "gzip", "zlib", "none":
+		default:
+			errs = append(errs, fmt.Sprintf("unsupported compression '%s'", opts.Compression))
+		}
+	case "tcp":
+		if opts.Compression == "" {
+			opts.Compression = "none"
+		}
+		if opts.Compression != "none" {
+			errs = append(errs, "compression is not supported over tcp")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported network '%s'", opts.Network))
+	}
+
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 1420
+	}
+	if opts.ChunkSize <= gelfChunkHeaderSize {
+		errs = append(errs, fmt.Sprintf("chunk size must be greater than %d bytes", gelfChunkHeaderSize))
+	}
+
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+	if opts.ReconnectInterval == 0 {
+		opts.ReconnectInterval = time.Second
+	}
+	if opts.DialTimeout < 0 || opts.WriteTimeout < 0 || opts.ReconnectInterval < 0 {
+		errs = append(errs, "timeouts must not be negative")
+	}
+
+	if opts.Host == "" {
+		opts.Host, _ = os.Hostname()
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+type gelfLogger struct {
+	opts GELFOptions
+
+	mu         sync.Mutex
+	conn       net.Conn
+	lastFailed time.Time
+
+	*Base
+}
+
+// NewGELFLogger constructs a Sender that sends messages to Graylog in
+// the GELF 1.1 format, over UDP or TCP. Priorities are sent as syslog
+// levels, and the fields of structured messages as additional fields,
+// with the "message" field as the short message. Messages of more
+// than one line are sent with the first line as the short message,
+// and the whole message as the full message.
+//
+// The sender connects when it sends the first message, and reconnects
+// after errors.
+func NewGELFLogger(name string, opts GELFOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeGELFLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeGELFLogger constructs an unconfigured GELF sender. Pass to
+// Journaler.SetSender or call SetName before using.
+func MakeGELFLogger(opts GELFOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &gelfLogger{
+		opts: opts,
+		Base: NewBase(""),
+	}
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	s.closer = func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.conn == nil {
+			return nil
+		}
+
+		err := s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return s, nil
+}
+
+func (s *gelfLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	if g, ok := m.(*message.GroupComposer); ok {
+		for _, c := range g.Messages() {
+			s.Send(c)
+		}
+		return
+	}
+
+	payload, err := json.Marshal(s.payload(m))
+	if err != nil {
+		s.ErrorHandler()(fmt.Errorf("encoding gelf message: %w", err), m)
+		return
+	}
+
+	var packets [][]byte
+	if s.opts.Network == "udp" {
+		packets, err = s.chunk(payload)
+	} else {
+		packets = [][]byte{append(payload, 0)}
+	}
+	if err != nil {
+		s.ErrorHandler()(err, m)
+		return
+	}
+
+	if err = s.write(packets); err != nil {
+		s.ErrorHandler()(err, m)
+	}
+}
+
+func (s *gelfLogger) payload(m message.Composer) map[string]interface{} {
+	msg := message.GetDefaultFieldsMessage(m, m.String())
+	payload := map[string]interface{}{
+		"version": "1.1",
+		"host":    s.opts.Host,
+		"level":   syslogSeverity(m.Priority(), s.Level().Default),
+	}
+
+	short := strings.TrimSpace(msg)
+	if i := strings.IndexByte(short, '\n'); i >= 0 {
+		payload["full_message"] = msg
+		short = strings.TrimSpace(short[:i])
+	}
+	if short == "" {
+		// the short message is required, and must not be empty.
+		short = "-"
+	}
+	payload["short_message"] = short
+
+	meta := composerMetadata(m)
+	ts := meta.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	payload["timestamp"] = float64(ts.UnixNano()/int64(time.Millisecond)) / 1000
+
+	additional := map[string]interface{}{}
+	for k, v := range meta.Context {
+		additional[k] = v
+	}
+	if fields, ok := m.Raw().(message.Fields); ok {
+		for k, v := range fields {
+			switch k {
+			case message.FieldsMsgName, "metadata":
+				continue
+			}
+			additional[k] = v
+		}
+	}
+	additional["logger"] = s.Name()
+	additional["process"] = meta.Process
+	additional["pid"] = meta.Pid
+
+	for k, v := range additional {
+		payload["_"+gelfFieldName(k)] = gelfFieldValue(v)
+	}
+
+	return payload
+}
+
+// chunk compresses the payload, and splits it into chunks if it does
+// not fit in one datagram.
+func (s *gelfLogger) chunk(payload []byte) ([][]byte, error) {
+	if s.opts.Compression != "none" {
+		buf := &bytes.Buffer{}
+		var w io.WriteCloser
+		if s.opts.Compression == "gzip" {
+			w = gzip.NewWriter(buf)
+		} else {
+			w = zlib.NewWriter(buf)
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, fmt.Errorf("compressing gelf message: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("compressing gelf message: %w", err)
+		}
+		payload = buf.Bytes()
+	}
+
+	if len(payload) <= s.opts.ChunkSize {
+		return [][]byte{payload}, nil
+	}
+
+	size := s.opts.ChunkSize - gelfChunkHeaderSize
+	count := (len(payload) + size - 1) / size
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("gelf message of %d bytes exceeds the limit of %d chunks", len(payload), gelfMaxChunks)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generating gelf message id: %w", err)
+	}
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		data := payload[i*size:]
+		if len(data) > size {
+			data = data[:size]
+		}
+
+		chunk := make([]byte, 0, gelfChunkHeaderSize+len(data))
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunks = append(chunks, append(chunk, data...))
+	}
+
+	return chunks, nil
+}
+
+// write sends the packets, reconnecting and retrying once if the
+// connection has failed.
+func (s *gelfLogger) write(packets [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = s.connect(); err != nil {
+			return err
+		}
+
+		if err = s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout)); err == nil {
+			for _, packet := range packets {
+				if _, err = s.conn.Write(packet); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				return nil
+			}
+		}
+
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+
+	return fmt.Errorf("writing to gelf server %s: %w", s.opts.Address, err)
+}
+
+func (s *gelfLogger) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	if time.Since(s.lastFailed) < s.opts.ReconnectInterval {
+		return fmt.Errorf("not connected to gelf server %s", s.opts.Address)
+	}
+
+	conn, err := net.DialTimeout(s.opts.Network, s.opts.Address, s.opts.DialTimeout)
+	if err != nil {
+		s.lastFailed = time.Now()
+		return fmt.Errorf("connecting to gelf server %s: %w", s.opts.Address, err)
+	}
+
+	s.conn = conn
+	return nil
+}
+
+// gelfFieldName returns the name as a valid additional field name,
+// which consists of letters, numbers, underscores, dashes, and dots,
+// and is not "id", which is reserved.
+func gelfFieldName(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '-', c == '.':
+		default:
+			out[i] = '_'
+		}
+	}
+
+	if name := string(out); name != "id" {
+		return name
+	}
+
+	return "id_"
+}
+
+// gelfFieldValue returns numbers and strings unchanged, as the only
+// types of additional fields, and other values as strings.
+func gelfFieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case nil:
+		return ""
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if len(out) > 0 && out[0] == '"' {
+		var str string
+		if json.Unmarshal(out, &str) == nil {
+			return str
+		}
+	}
+
+	return string(out)
+}
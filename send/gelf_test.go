@@ -0,0 +1,303 @@
+package send
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gelfServerMock collects the messages sent to a UDP listener, which
+// it reassembles from chunks and decompresses, or to a TCP listener.
+type gelfServerMock struct {
+	mu       sync.Mutex
+	messages []map[string]interface{}
+	chunks   map[string][][]byte
+	packets  int
+}
+
+func newGELFServerMock(t *testing.T, network string) (*gelfServerMock, string) {
+	mock := &gelfServerMock{chunks: map[string][][]byte{}}
+
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				mock.receive(t, append([]byte{}, buf[:n]...))
+			}
+		}()
+
+		return mock, conn.LocalAddr().String()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					frame, err := r.ReadBytes(0)
+					if err != nil {
+						return
+					}
+					mock.decode(t, frame[:len(frame)-1])
+				}
+			}()
+		}
+	}()
+
+	return mock, listener.Addr().String()
+}
+
+func (m *gelfServerMock) receive(t *testing.T, packet []byte) {
+	m.mu.Lock()
+	m.packets++
+	if !bytes.HasPrefix(packet, []byte{0x1e, 0x0f}) {
+		m.mu.Unlock()
+		m.decode(t, packet)
+		return
+	}
+
+	id, seq, count := string(packet[2:10]), int(packet[10]), int(packet[11])
+	if m.chunks[id] == nil {
+		m.chunks[id] = make([][]byte, count)
+	}
+	m.chunks[id][seq] = packet[12:]
+	for _, chunk := range m.chunks[id] {
+		if chunk == nil {
+			m.mu.Unlock()
+			return
+		}
+	}
+	payload := bytes.Join(m.chunks[id], nil)
+	delete(m.chunks, id)
+	m.mu.Unlock()
+
+	m.decode(t, payload)
+}
+
+func (m *gelfServerMock) decode(t *testing.T, payload []byte) {
+	var r io.Reader = bytes.NewReader(payload)
+	var err error
+	switch {
+	case bytes.HasPrefix(payload, []byte{0x1f, 0x8b}):
+		r, err = gzip.NewReader(r)
+	case payload[0] == 0x78:
+		r, err = zlib.NewReader(r)
+	}
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	msg := map[string]interface{}{}
+	if !assert.NoError(t, json.NewDecoder(r).Decode(&msg)) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+}
+
+// wait returns the received messages once there are n of them.
+func (m *gelfServerMock) wait(t *testing.T, n int) []map[string]interface{} {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		m.mu.Lock()
+		if len(m.messages) >= n {
+			defer m.mu.Unlock()
+			return append([]map[string]interface{}{}, m.messages...)
+		}
+		m.mu.Unlock()
+	}
+
+	require.FailNow(t, "timed out waiting for gelf messages")
+	return nil
+}
+
+func TestGELFLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	newLogger := func(t *testing.T, opts GELFOptions) (Sender, *[]error) {
+		s, err := NewGELFLogger("graylog", opts, info)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+
+		errs := &[]error{}
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { *errs = append(*errs, err) }))
+
+		return s, errs
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]GELFOptions{
+			"Network":        {Network: "unix"},
+			"Compression":    {Compression: "snappy"},
+			"TCPCompression": {Network: "tcp", Compression: "gzip"},
+			"ChunkSize":      {ChunkSize: 12},
+			"Timeout":        {WriteTimeout: -time.Second},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewGELFLogger("graylog", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := GELFOptions{}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, "udp", opts.Network)
+		assert.Equal(t, "127.0.0.1:12201", opts.Address)
+		assert.Equal(t, "gzip", opts.Compression)
+		assert.Equal(t, 1420, opts.ChunkSize)
+		assert.NotEmpty(t, opts.Host)
+
+		opts = GELFOptions{Network: "tcp"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, "none", opts.Compression)
+	})
+	t.Run("UDP", func(t *testing.T) {
+		mock, addr := newGELFServerMock(t, "udp")
+		s, errs := newLogger(t, GELFOptions{Address: addr, Host: "web1"})
+
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewFieldsMessage(level.Error, "request failed", message.Fields{
+			"status":   500,
+			"ok":       false,
+			"id":       "abc",
+			"user.id":  7,
+			"bad key!": "x",
+			"err":      errors.New("timeout"),
+		}))
+		s.Send(message.NewDefaultMessage(level.Notice, "first line\nsecond line"))
+		require.Empty(t, *errs)
+
+		msgs := mock.wait(t, 2)
+		require.Len(t, msgs, 2)
+
+		msg := msgs[0]
+		assert.Equal(t, "1.1", msg["version"])
+		assert.Equal(t, "web1", msg["host"])
+		assert.Equal(t, "request failed", msg["short_message"])
+		assert.NotContains(t, msg, "full_message")
+		assert.EqualValues(t, 3, msg["level"])
+		assert.EqualValues(t, 500, msg["_status"])
+		assert.Equal(t, "false", msg["_ok"])
+		assert.Equal(t, "abc", msg["_id_"])
+		assert.EqualValues(t, 7, msg["_user.id"])
+		assert.Equal(t, "x", msg["_bad_key_"])
+		assert.Equal(t, "timeout", msg["_err"])
+		assert.Equal(t, "graylog", msg["_logger"])
+		assert.NotContains(t, msg, "_message")
+		assert.NotContains(t, msg, "_metadata")
+		ts := time.Unix(0, int64(msg["timestamp"].(float64)*float64(time.Second)))
+		assert.True(t, time.Since(ts) < time.Minute)
+
+		assert.Equal(t, "first line", msgs[1]["short_message"])
+		assert.Equal(t, "first line\nsecond line", msgs[1]["full_message"])
+		assert.EqualValues(t, 5, msgs[1]["level"])
+	})
+	t.Run("Chunking", func(t *testing.T) {
+		mock, addr := newGELFServerMock(t, "udp")
+		s, errs := newLogger(t, GELFOptions{Address: addr, Compression: "zlib", ChunkSize: 100})
+
+		// random data does not compress, so needs several chunks.
+		random := func(n int) string {
+			data := make([]byte, n)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+			return base64.StdEncoding.EncodeToString(data)
+		}
+		long := random(1000)
+		s.Send(message.NewDefaultMessage(level.Info, long))
+		require.Empty(t, *errs)
+
+		msgs := mock.wait(t, 1)
+		assert.Equal(t, long, msgs[0]["short_message"])
+		mock.mu.Lock()
+		assert.True(t, mock.packets > 1)
+		mock.mu.Unlock()
+
+		// messages that need more than 128 chunks are not sent.
+		s.Send(message.NewDefaultMessage(level.Info, random(20000)))
+		require.Len(t, *errs, 1)
+		assert.Contains(t, (*errs)[0].Error(), "exceeds the limit of 128 chunks")
+	})
+	t.Run("Uncompressed", func(t *testing.T) {
+		mock, addr := newGELFServerMock(t, "udp")
+		s, errs := newLogger(t, GELFOptions{Address: addr, Compression: "none"})
+
+		s.Send(message.NewDefaultMessage(level.Warning, "plain"))
+		require.Empty(t, *errs)
+		assert.Equal(t, "plain", mock.wait(t, 1)[0]["short_message"])
+	})
+	t.Run("TCP", func(t *testing.T) {
+		mock, addr := newGELFServerMock(t, "tcp")
+		s, errs := newLogger(t, GELFOptions{Network: "tcp", Address: addr})
+
+		s.Send(message.NewGroupComposer([]message.Composer{
+			message.NewDefaultMessage(level.Info, "one"),
+			message.NewDefaultMessage(level.Critical, "two"),
+		}))
+		require.Empty(t, *errs)
+
+		msgs := mock.wait(t, 2)
+		assert.Equal(t, "one", msgs[0]["short_message"])
+		assert.Equal(t, "two", msgs[1]["short_message"])
+		assert.EqualValues(t, 2, msgs[1]["level"])
+	})
+	t.Run("Unavailable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := listener.Addr().String()
+		require.NoError(t, listener.Close())
+
+		s, errs := newLogger(t, GELFOptions{Network: "tcp", Address: addr, ReconnectInterval: time.Hour})
+		s.Send(message.NewDefaultMessage(level.Info, "one"))
+		s.Send(message.NewDefaultMessage(level.Info, "two"))
+		require.Len(t, *errs, 2)
+		assert.Contains(t, (*errs)[0].Error(), "connecting to gelf server")
+		assert.Contains(t, (*errs)[1].Error(), "not connected to gelf server")
+	})
+}
+
+func TestGELFFieldName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"status":    "status",
+		"user.id":   "user.id",
+		"x-request": "x-request",
+		"bad key!":  "bad_key_",
+		"id":        "id_",
+	} {
+		assert.Equal(t, expected, gelfFieldName(name), name)
+	}
+}
@@ -0,0 +1,43 @@
+package send
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// DumpGoroutinesOnSignal starts a background goroutine that sends a
+// snapshot of the stacks of all goroutines, as a
+// message.GoroutineDump, to the sender at the specified priority
+// every time the process receives one of the signals. The handler
+// stops when the context is canceled. If no signals are specified,
+// DumpGoroutinesOnSignal does nothing.
+//
+// Typically you would use a signal that the process does not
+// otherwise handle, such as syscall.SIGUSR1, to capture diagnostics
+// from a live process that appears to be deadlocked without, as
+// SIGQUIT does, causing it to exit.
+func DumpGoroutinesOnSignal(ctx context.Context, s Sender, p level.Priority, sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		return
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sigs...)
+
+	go func() {
+		defer signal.Stop(sigChan)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				s.Send(message.NewGoroutines(p, "received "+sig.String()))
+			}
+		}
+	}()
+}
@@ -0,0 +1,35 @@
+package send
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpGoroutinesOnSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender := MakeInternalLogger()
+	require.NoError(t, sender.SetLevel(LevelInfo{Default: level.Info, Threshold: level.Info}))
+	DumpGoroutinesOnSignal(ctx, sender, level.Notice, syscall.SIGUSR1)
+
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+
+	select {
+	case msg := <-sender.output:
+		dump, ok := msg.Message.Raw().(*message.GoroutineDump)
+		require.True(t, ok)
+		assert.Equal(t, "received user defined signal 1", dump.Message)
+		assert.Equal(t, level.Notice, msg.Message.Priority())
+		assert.True(t, dump.Total > 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no goroutine dump after signal")
+	}
+}
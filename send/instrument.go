@@ -0,0 +1,340 @@
+package send
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// QueueDepthReporter is implemented by senders that hold messages in
+// memory before sending them, such as the buffered and async group
+// senders, and reports the number of messages waiting to be sent.
+type QueueDepthReporter interface {
+	QueueDepth() int
+}
+
+// PipelineMetrics collects metrics about the logging pipeline itself,
+// from senders wrapped with Instrument, and serves them in the
+// Prometheus text exposition format. The metrics are:
+//
+//	grip_messages_sent_total{sender,priority}
+//	grip_messages_filtered_total{sender,priority}
+//	grip_send_errors_total{sender,priority}
+//	grip_format_duration_seconds{sender}
+//	grip_send_duration_seconds{sender}
+//	grip_queue_depth{sender}
+//
+// Messages are "filtered" when they are not loggable or are below the
+// sender's threshold. The durations are summaries, reported with
+// quantiles. The zero value is not usable; construct PipelineMetrics
+// with NewPipelineMetrics.
+type PipelineMetrics struct {
+	mu       sync.Mutex
+	counts   map[pipelineKey]*pipelineCounts
+	latency  map[string]*pipelineLatency
+	queues   map[string]func() int
+	wrappers []*instrumentedSender
+}
+
+type pipelineKey struct {
+	sender   string
+	priority level.Priority
+}
+
+type pipelineCounts struct {
+	sent     uint64
+	filtered uint64
+	errors   uint64
+}
+
+type pipelineLatency struct {
+	format *message.Histogram
+	send   *message.Histogram
+}
+
+// NewPipelineMetrics constructs an empty PipelineMetrics.
+func NewPipelineMetrics() *PipelineMetrics {
+	return &PipelineMetrics{
+		counts:  map[pipelineKey]*pipelineCounts{},
+		latency: map[string]*pipelineLatency{},
+		queues:  map[string]func() int{},
+	}
+}
+
+// RegisterQueue reports the depth of a queue that is not otherwise
+// visible to the metrics, under the specified sender name.
+func (pm *PipelineMetrics) RegisterQueue(name string, depth func() int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.queues[name] = depth
+}
+
+func (pm *PipelineMetrics) count(name string, p level.Priority, fn func(*pipelineCounts)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	key := pipelineKey{sender: name, priority: p}
+	c, ok := pm.counts[key]
+	if !ok {
+		c = &pipelineCounts{}
+		pm.counts[key] = c
+	}
+	fn(c)
+}
+
+func (pm *PipelineMetrics) observe(name string, fn func(*pipelineLatency) *message.Histogram, dur time.Duration) {
+	pm.mu.Lock()
+	l, ok := pm.latency[name]
+	if !ok {
+		l = &pipelineLatency{
+			format: message.MakeHistogram("format"),
+			send:   message.MakeHistogram("send"),
+		}
+		pm.latency[name] = l
+	}
+	pm.mu.Unlock()
+
+	fn(l).AddDuration(dur)
+}
+
+// Instrument wraps a sender so that messages sent to it, and errors
+// and formatting in the sender, are recorded in the metrics. Changes
+// to the wrapper's formatter and error handler propagate to the
+// wrapped sender, and closing the wrapper closes the wrapped sender.
+//
+// Errors and formatting time are only recorded for senders that are
+// implemented in this package, or that use their formatter and error
+// handler only through the wrapper.
+func (pm *PipelineMetrics) Instrument(s Sender) Sender {
+	is := &instrumentedSender{Sender: s, metrics: pm, name: s.Name()}
+
+	if raw, ok := s.(rawHandlers); ok {
+		mf := raw.rawFormatter()
+		if mf == nil {
+			mf = func(m message.Composer) (string, error) { return m.String(), nil }
+		}
+		_ = is.SetFormatter(mf)
+
+		if eh := raw.rawErrorHandler(); eh != nil {
+			_ = is.SetErrorHandler(eh)
+		}
+	}
+
+	pm.mu.Lock()
+	pm.wrappers = append(pm.wrappers, is)
+	pm.mu.Unlock()
+
+	return is
+}
+
+// rawHandlers provides access to the formatter and error handler of
+// senders that embed Base, as the public methods return wrappers that
+// cannot themselves be wrapped without recursion.
+type rawHandlers interface {
+	rawFormatter() MessageFormatter
+	rawErrorHandler() ErrorHandler
+}
+
+type instrumentedSender struct {
+	Sender
+	metrics *PipelineMetrics
+
+	// the name is cached because the formatter and error handler
+	// run while the wrapped sender holds its own lock, which it
+	// also takes to report its name.
+	mu   sync.RWMutex
+	name string
+}
+
+func (s *instrumentedSender) Name() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.name
+}
+
+func (s *instrumentedSender) SetName(name string) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+
+	s.Sender.SetName(name)
+}
+
+func (s *instrumentedSender) Send(m message.Composer) {
+	name := s.Name()
+	l := s.Level()
+
+	if !m.Loggable() || (l.Valid() && !l.Loggable(m.Priority())) {
+		s.metrics.count(name, m.Priority(), func(c *pipelineCounts) { c.filtered++ })
+		s.Sender.Send(m)
+		return
+	}
+
+	start := time.Now()
+	s.Sender.Send(m)
+	s.metrics.observe(name, func(l *pipelineLatency) *message.Histogram { return l.send }, time.Since(start))
+	s.metrics.count(name, m.Priority(), func(c *pipelineCounts) { c.sent++ })
+}
+
+func (s *instrumentedSender) SetFormatter(mf MessageFormatter) error {
+	if mf == nil {
+		return s.Sender.SetFormatter(mf)
+	}
+
+	return s.Sender.SetFormatter(func(m message.Composer) (string, error) {
+		start := time.Now()
+		defer func() {
+			s.metrics.observe(s.Name(), func(l *pipelineLatency) *message.Histogram { return l.format }, time.Since(start))
+		}()
+
+		return mf(m)
+	})
+}
+
+func (s *instrumentedSender) SetErrorHandler(eh ErrorHandler) error {
+	if eh == nil {
+		return s.Sender.SetErrorHandler(eh)
+	}
+
+	return s.Sender.SetErrorHandler(func(err error, m message.Composer) {
+		if err != nil {
+			p := level.Invalid
+			if m != nil {
+				p = m.Priority()
+			}
+			s.metrics.count(s.Name(), p, func(c *pipelineCounts) { c.errors++ })
+		}
+
+		eh(err, m)
+	})
+}
+
+func (s *instrumentedSender) QueueDepth() int {
+	if q, ok := s.Sender.(QueueDepthReporter); ok {
+		return q.QueueDepth()
+	}
+
+	return 0
+}
+
+// Handler returns an http.Handler that serves the metrics in the
+// Prometheus text exposition format.
+func (pm *PipelineMetrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = pm.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the metrics to the writer in the Prometheus
+// text exposition format.
+func (pm *PipelineMetrics) WritePrometheus(w io.Writer) error {
+	queues := map[string]func() int{}
+
+	pm.mu.Lock()
+	keys := make([]pipelineKey, 0, len(pm.counts))
+	counts := make(map[pipelineKey]pipelineCounts, len(pm.counts))
+	for k, c := range pm.counts {
+		keys = append(keys, k)
+		counts[k] = *c
+	}
+	latency := make(map[string]*pipelineLatency, len(pm.latency))
+	for k, l := range pm.latency {
+		latency[k] = l
+	}
+	for k, q := range pm.queues {
+		queues[k] = q
+	}
+	wrappers := append([]*instrumentedSender{}, pm.wrappers...)
+	pm.mu.Unlock()
+
+	// the depth of the queues may depend on locks that are held
+	// while sending, so collect them without holding the lock.
+	for _, is := range wrappers {
+		if _, ok := is.Sender.(QueueDepthReporter); ok {
+			queues[is.Name()] = is.QueueDepth
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].sender != keys[j].sender {
+			return keys[i].sender < keys[j].sender
+		}
+		return keys[i].priority < keys[j].priority
+	})
+
+	buf := &strings.Builder{}
+	names := []string{"sender", "priority"}
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(pipelineCounts) uint64
+	}{
+		{"grip_messages_sent_total", "Messages passed to senders.", func(c pipelineCounts) uint64 { return c.sent }},
+		{"grip_messages_filtered_total", "Messages that were not loggable or were below the sender's threshold.", func(c pipelineCounts) uint64 { return c.filtered }},
+		{"grip_send_errors_total", "Errors reported by senders.", func(c pipelineCounts) uint64 { return c.errors }},
+	} {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, k := range keys {
+			if v := metric.value(counts[k]); v > 0 {
+				fmt.Fprintf(buf, "%s%s %d\n", metric.name, formatLabels(names, []string{k.sender, k.priority.String()}, "", ""), v)
+			}
+		}
+	}
+
+	senders := make([]string, 0, len(latency))
+	for name := range latency {
+		senders = append(senders, name)
+	}
+	sort.Strings(senders)
+
+	for _, metric := range []struct {
+		name      string
+		help      string
+		histogram func(*pipelineLatency) *message.Histogram
+	}{
+		{"grip_format_duration_seconds", "Time spent formatting messages.", func(l *pipelineLatency) *message.Histogram { return l.format }},
+		{"grip_send_duration_seconds", "Time spent sending messages.", func(l *pipelineLatency) *message.Histogram { return l.send }},
+	} {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s summary\n", metric.name, metric.help, metric.name)
+		for _, name := range senders {
+			summary := metric.histogram(latency[name]).Summary()
+			if summary.Count == 0 {
+				continue
+			}
+
+			labels := []string{name}
+			for _, q := range []struct {
+				quantile string
+				value    float64
+			}{{"0.5", summary.P50}, {"0.9", summary.P90}, {"0.99", summary.P99}} {
+				fmt.Fprintf(buf, "%s%s %s\n", metric.name, formatLabels([]string{"sender"}, labels, "quantile", q.quantile), formatMetricValue(q.value))
+			}
+			fmt.Fprintf(buf, "%s_sum%s %s\n", metric.name, formatLabels([]string{"sender"}, labels, "", ""), formatMetricValue(summary.Mean*float64(summary.Count)))
+			fmt.Fprintf(buf, "%s_count%s %d\n", metric.name, formatLabels([]string{"sender"}, labels, "", ""), summary.Count)
+		}
+	}
+
+	queueNames := make([]string, 0, len(queues))
+	for name := range queues {
+		queueNames = append(queueNames, name)
+	}
+	sort.Strings(queueNames)
+
+	fmt.Fprintf(buf, "# HELP grip_queue_depth Messages waiting to be sent.\n# TYPE grip_queue_depth gauge\n")
+	for _, name := range queueNames {
+		fmt.Fprintf(buf, "grip_queue_depth%s %d\n", formatLabels([]string{"sender"}, []string{name}, "", ""), queues[name]())
+	}
+
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
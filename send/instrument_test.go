@@ -0,0 +1,155 @@
+package send
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingSender struct {
+	*Base
+}
+
+func (s *failingSender) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	if _, err := s.Formatter()(m); err != nil {
+		s.ErrorHandler()(err, m)
+		return
+	}
+
+	if strings.Contains(m.String(), "fail") {
+		s.ErrorHandler()(errors.New("failed"), m)
+	}
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	scrape := func(t *testing.T, pm *PipelineMetrics) string {
+		rec := httptest.NewRecorder()
+		pm.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+		body, err := io.ReadAll(rec.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("Counts", func(t *testing.T) {
+		pm := NewPipelineMetrics()
+		base := &failingSender{Base: NewBase("failing")}
+		require.NoError(t, base.SetLevel(LevelInfo{Default: level.Info, Threshold: level.Info}))
+		var handled []error
+		require.NoError(t, base.SetErrorHandler(func(err error, _ message.Composer) { handled = append(handled, err) }))
+
+		s := pm.Instrument(base)
+		assert.Equal(t, "failing", s.Name())
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		s.Send(message.NewDefaultMessage(level.Error, "fail"))
+		s.Send(message.NewDefaultMessage(level.Error, "hi"))
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewDefaultMessage(level.Info, ""))
+
+		// the original error handler still runs
+		assert.Len(t, handled, 1)
+
+		body := scrape(t, pm)
+		for _, line := range []string{
+			"# TYPE grip_messages_sent_total counter",
+			`grip_messages_sent_total{sender="failing",priority="info"} 1`,
+			`grip_messages_sent_total{sender="failing",priority="error"} 2`,
+			`grip_messages_filtered_total{sender="failing",priority="debug"} 1`,
+			`grip_messages_filtered_total{sender="failing",priority="info"} 1`,
+			`grip_send_errors_total{sender="failing",priority="error"} 1`,
+			"# TYPE grip_send_duration_seconds summary",
+			`grip_send_duration_seconds_count{sender="failing"} 3`,
+			`grip_format_duration_seconds_count{sender="failing"} 3`,
+			"# TYPE grip_queue_depth gauge",
+		} {
+			assert.Contains(t, body, line+"\n")
+		}
+		assert.Contains(t, body, `grip_send_duration_seconds{sender="failing",quantile="0.99"} `)
+	})
+	t.Run("Handlers", func(t *testing.T) {
+		pm := NewPipelineMetrics()
+		base := &failingSender{Base: NewBase("failing")}
+		require.NoError(t, base.SetLevel(LevelInfo{Default: level.Info, Threshold: level.Info}))
+		s := pm.Instrument(base)
+
+		// handlers set through the wrapper are instrumented
+		var handled int
+		require.NoError(t, s.SetErrorHandler(func(error, message.Composer) { handled++ }))
+		require.NoError(t, s.SetFormatter(func(message.Composer) (string, error) { return "", errors.New("format") }))
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		assert.Equal(t, 1, handled)
+
+		s.SetName("renamed")
+		assert.Equal(t, "renamed", base.Name())
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+
+		body := scrape(t, pm)
+		assert.Contains(t, body, `grip_send_errors_total{sender="failing",priority="info"} 1`+"\n")
+		assert.Contains(t, body, `grip_send_errors_total{sender="renamed",priority="info"} 1`+"\n")
+		assert.Contains(t, body, `grip_format_duration_seconds_count{sender="renamed"} 1`+"\n")
+
+		assert.Error(t, s.SetFormatter(nil))
+		assert.Error(t, s.SetErrorHandler(nil))
+	})
+	t.Run("QueueDepth", func(t *testing.T) {
+		pm := NewPipelineMetrics()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sink := &failingSender{Base: NewBase("sink")}
+		require.NoError(t, sink.SetLevel(LevelInfo{Default: level.Info, Threshold: level.Info}))
+
+		buffered := NewBufferedSender(sink, time.Minute, 100)
+		buffered.SetName("buffered")
+		defer buffered.Close()
+		bs := pm.Instrument(buffered)
+		bs.Send(message.NewDefaultMessage(level.Info, "one"))
+		bs.Send(message.NewDefaultMessage(level.Info, "two"))
+
+		blocked := make(chan struct{})
+		async := NewAsyncGroupSender(ctx, 10, &blockingSender{Base: NewBase("blocked"), ch: blocked})
+		async.SetName("async")
+		as := pm.Instrument(async)
+		for i := 0; i < 4; i++ {
+			as.Send(message.NewDefaultMessage(level.Info, "queued"))
+		}
+
+		pm.RegisterQueue("custom", func() int { return 7 })
+
+		body := scrape(t, pm)
+		assert.Contains(t, body, `grip_queue_depth{sender="buffered"} 2`+"\n")
+		assert.Contains(t, body, `grip_queue_depth{sender="custom"} 7`+"\n")
+
+		// the async group's worker holds one message
+		var depth bytes.Buffer
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, `grip_queue_depth{sender="async"}`) {
+				depth.WriteString(line)
+			}
+		}
+		assert.Contains(t, []string{`grip_queue_depth{sender="async"} 3`, `grip_queue_depth{sender="async"} 4`}, depth.String())
+		close(blocked)
+	})
+}
+
+type blockingSender struct {
+	*Base
+	ch chan struct{}
+}
+
+func (s *blockingSender) Send(message.Composer) { <-s.ch }
@@ -0,0 +1,442 @@
+package send
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/message"
+)
+
+// LokiOptions configures a sender that pushes messages to Grafana
+// Loki.
+//
+// Messages are grouped into streams by their labels, which are the
+// static Labels, the logger's name as "logger", the priority as
+// "level", and the values of LabelFields in structured messages.
+// Since every distinct set of labels is a stream, only use fields with
+// a small number of values as labels. The line of each entry is
+// produced by the sender's formatter.
+type LokiOptions struct {
+	// URL is the base URL of Loki, such as http://loki:3100.
+	URL string
+	// TenantID, if set, is sent as the X-Scope-OrgID header, and
+	// Headers are added to every request, for instance for
+	// authentication.
+	TenantID string
+	Headers  map[string]string
+
+	Labels      map[string]string
+	LabelFields []string
+
+	// Compression is "gzip", or empty for none. Snappy is not
+	// supported, as Loki only accepts it for protobuf pushes.
+	Compression string
+
+	// Batches are pushed when they have BatchSize entries, which
+	// defaults to 1000, and every BatchWait, which defaults to one
+	// second.
+	BatchSize int
+	BatchWait time.Duration
+
+	// Pushes that fail with 429 Too Many Requests, 5xx responses, or
+	// connection errors are retried up to MaxRetries times, which
+	// defaults to 5, waiting for the Retry-After of the response, or
+	// else for an exponential backoff from MinBackoff to MaxBackoff,
+	// which default to half a second and 30 seconds. Other responses,
+	// such as Loki rejecting entries out of order, are reported to the
+	// error handler and the batch is dropped.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Timeout limits the duration of each request, and defaults to
+	// 10 seconds. Client defaults to http.DefaultClient.
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// Validate checks the options and sets defaults for unspecified
+// values.
+func (o *LokiOptions) Validate() error {
+	errs := []string{}
+
+	if o.URL == "" {
+		errs = append(errs, "no url specified")
+	} else if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, fmt.Sprintf("invalid url '%s'", o.URL))
+	}
+	o.URL = strings.TrimSuffix(o.URL, "/")
+
+	for k := range o.Labels {
+		if lokiLabelName(k) != k {
+			errs = append(errs, fmt.Sprintf("invalid label name '%s'", k))
+		}
+	}
+
+	switch o.Compression {
+	case "", "gzip":
+	default:
+		errs = append(errs, fmt.Sprintf("invalid compression '%s'", o.Compression))
+	}
+
+	if o.BatchSize < 0 || o.MaxRetries < 0 {
+		errs = append(errs, "batch size and retries cannot be negative")
+	}
+	if o.BatchWait < 0 || o.MinBackoff < 0 || o.MaxBackoff < 0 || o.Timeout < 0 {
+		errs = append(errs, "durations cannot be negative")
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = 1000
+	}
+	if o.BatchWait == 0 {
+		o.BatchWait = time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 5
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		errs = append(errs, "maximum backoff cannot be less than the minimum")
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type lokiLogger struct {
+	opts LokiOptions
+
+	// mu protects the pending batch and the last timestamps of the
+	// streams, and pushMu orders pushes.
+	mu       sync.Mutex
+	pending  map[string]*lokiStream
+	messages []message.Composer
+	last     map[string]time.Time
+	pushMu   sync.Mutex
+	*Base
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// NewLokiLogger constructs a Sender that pushes batches of messages
+// to Loki.
+func NewLokiLogger(name string, opts LokiOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeLokiLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeLokiLogger constructs an unconfigured Loki sender. Pass to
+// Journaler.SetSender or call SetName before using.
+func MakeLokiLogger(opts LokiOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &lokiLogger{
+		opts:    opts,
+		pending: map[string]*lokiStream{},
+		last:    map[string]time.Time{},
+		Base:    NewBase(""),
+	}
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	// the closer cannot use the error handler, as Close holds the
+	// lock of the Base, so it returns errors instead.
+	s.closer = func() error {
+		cancel()
+		_, err := s.flush()
+		return err
+	}
+
+	go s.flushLoop(ctx, opts.BatchWait)
+
+	return s, nil
+}
+
+func (s *lokiLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	if g, ok := m.(*message.GroupComposer); ok {
+		for _, c := range g.Messages() {
+			s.Send(c)
+		}
+		return
+	}
+
+	line, err := s.Formatter()(m)
+	if err != nil {
+		s.ErrorHandler()(err, m)
+		return
+	}
+
+	labels := s.labels(m)
+	key := lokiStreamKey(labels)
+	now := time.Now()
+
+	s.mu.Lock()
+	// entries of a stream must have increasing timestamps.
+	if last := s.last[key]; !now.After(last) {
+		now = last.Add(time.Nanosecond)
+	}
+	s.last[key] = now
+
+	stream, ok := s.pending[key]
+	if !ok {
+		stream = &lokiStream{Stream: labels}
+		s.pending[key] = stream
+	}
+	stream.Values = append(stream.Values, [2]string{strconv.FormatInt(now.UnixNano(), 10), line})
+	s.messages = append(s.messages, m)
+	full := len(s.messages) >= s.opts.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		if msg, err := s.flush(); err != nil {
+			s.ErrorHandler()(err, msg)
+		}
+	}
+}
+
+// Flush pushes the pending messages.
+func (s *lokiLogger) Flush(_ context.Context) error {
+	msg, err := s.flush()
+	if err != nil {
+		s.ErrorHandler()(err, msg)
+	}
+
+	return err
+}
+
+func (s *lokiLogger) flushLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if msg, err := s.flush(); err != nil {
+				s.ErrorHandler()(err, msg)
+			}
+		}
+	}
+}
+
+// flush pushes the pending batch, and returns the batch's messages as
+// a group if it fails.
+func (s *lokiLogger) flush() (message.Composer, error) {
+	s.pushMu.Lock()
+	defer s.pushMu.Unlock()
+
+	s.mu.Lock()
+	pending, messages := s.pending, s.messages
+	s.pending, s.messages = map[string]*lokiStream{}, nil
+	s.mu.Unlock()
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	if err := s.push(pending); err != nil {
+		return message.NewGroupComposer(messages), err
+	}
+
+	return nil, nil
+}
+
+func (s *lokiLogger) push(pending map[string]*lokiStream) error {
+	keys := make([]string, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	req := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, k := range keys {
+		req.Streams = append(req.Streams, pending[k])
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encoding loki push: %w", err)
+	}
+
+	switch s.opts.Compression {
+	case "gzip":
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		if _, err = zw.Write(body); err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("compressing loki push: %w", err)
+		}
+		body = buf.Bytes()
+	}
+
+	backoff := s.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := s.do(body)
+		if err == nil || retryAfter < 0 {
+			return err
+		}
+		if attempt >= s.opts.MaxRetries {
+			return fmt.Errorf("giving up after %d retries: %w", attempt, err)
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if wait > s.opts.MaxBackoff {
+			wait = s.opts.MaxBackoff
+		}
+		time.Sleep(wait)
+
+		if backoff *= 2; backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+}
+
+// do makes a single push, and returns a negative duration if it should
+// not be retried, or the Retry-After of the response, which is zero if
+// the response had none.
+func (s *lokiLogger) do(body []byte) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL+"/loki/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.opts.Compression != "" {
+		req.Header.Set("Content-Encoding", s.opts.Compression)
+	}
+	if s.opts.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.opts.TenantID)
+	}
+	for k, v := range s.opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("pushing to loki: %w", err)
+	}
+	defer resp.Body.Close()
+
+	out, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return -1, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, fmt.Errorf("loki responded with %s: %s", resp.Status, strings.TrimSpace(string(out)))
+	default:
+		return -1, fmt.Errorf("loki rejected push with %s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+}
+
+// labels returns the labels of the message's stream.
+func (s *lokiLogger) labels(m message.Composer) map[string]string {
+	labels := make(map[string]string, len(s.opts.Labels)+len(s.opts.LabelFields)+2)
+	for k, v := range s.opts.Labels {
+		labels[k] = v
+	}
+
+	if fields, ok := m.Raw().(message.Fields); ok {
+		for _, k := range s.opts.LabelFields {
+			v, ok := fields[k]
+			if !ok {
+				continue
+			}
+			if value := fmt.Sprint(v); value != "" {
+				labels[lokiLabelName(k)] = value
+			}
+		}
+	}
+
+	labels["logger"] = s.Name()
+	labels["level"] = m.Priority().String()
+
+	return labels
+}
+
+func lokiStreamKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// lokiLabelName returns the name as a valid label name, which has
+// letters, digits, and underscores, and does not start with a digit.
+func lokiLabelName(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			out[i] = '_'
+		}
+	}
+
+	return string(out)
+}
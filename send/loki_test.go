@@ -0,0 +1,238 @@
+package send
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type lokiPush struct {
+	header  http.Header
+	streams []lokiStream
+}
+
+// lokiServerMock decodes pushes, and responds to the first requests
+// with the statuses in responses.
+type lokiServerMock struct {
+	mu        sync.Mutex
+	pushes    []lokiPush
+	responses []int
+	attempts  int
+}
+
+func (m *lokiServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.attempts++
+	if len(m.responses) > 0 {
+		status := m.responses[0]
+		m.responses = m.responses[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		http.Error(w, "entry out of order", status)
+		return
+	}
+
+	if r.URL.Path != "/loki/api/v1/push" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+
+	req := struct {
+		Streams []lokiStream `json:"streams"`
+	}{}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.pushes = append(m.pushes, lokiPush{header: r.Header, streams: req.Streams})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *lokiServerMock) received() []lokiPush {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]lokiPush{}, m.pushes...)
+}
+
+func TestLokiLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	newLogger := func(t *testing.T, opts LokiOptions) (Sender, *lokiServerMock) {
+		mock := &lokiServerMock{}
+		srv := httptest.NewServer(mock)
+		t.Cleanup(srv.Close)
+
+		opts.URL = srv.URL
+		if opts.BatchWait == 0 {
+			opts.BatchWait = time.Hour
+		}
+		s, err := NewLokiLogger("loki", opts, info)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+
+		return s, mock
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]LokiOptions{
+			"NoURL":       {},
+			"BadURL":      {URL: "loki:3100"},
+			"BadLabel":    {URL: "http://loki:3100", Labels: map[string]string{"bad-label": "x"}},
+			"Compression": {URL: "http://loki:3100", Compression: "zstd"},
+			"Snappy":      {URL: "http://loki:3100", Compression: "snappy"},
+			"BatchSize":   {URL: "http://loki:3100", BatchSize: -1},
+			"Backoff":     {URL: "http://loki:3100", MinBackoff: time.Minute, MaxBackoff: time.Second},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewLokiLogger("loki", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := LokiOptions{URL: "http://loki:3100/"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, "http://loki:3100", opts.URL)
+		assert.Equal(t, 1000, opts.BatchSize)
+		assert.Equal(t, time.Second, opts.BatchWait)
+		assert.Equal(t, 5, opts.MaxRetries)
+	})
+	t.Run("Streams", func(t *testing.T) {
+		s, mock := newLogger(t, LokiOptions{
+			TenantID:    "tenant",
+			Labels:      map[string]string{"env": "test"},
+			LabelFields: []string{"service", "http.method"},
+			BatchSize:   4,
+		})
+
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewFieldsMessage(level.Info, "request", message.Fields{"service": "api", "http.method": "GET", "id": 1}))
+		s.Send(message.NewFieldsMessage(level.Info, "request", message.Fields{"service": "api", "http.method": "GET", "id": 2}))
+		s.Send(message.NewDefaultMessage(level.Error, "failure"))
+		assert.Empty(t, mock.received())
+		s.Send(message.NewFieldsMessage(level.Info, "request", message.Fields{"service": "web", "id": 3}))
+
+		pushes := mock.received()
+		require.Len(t, pushes, 1)
+		assert.Equal(t, "tenant", pushes[0].header.Get("X-Scope-OrgID"))
+		assert.Empty(t, pushes[0].header.Get("Content-Encoding"))
+
+		streams := pushes[0].streams
+		require.Len(t, streams, 3)
+		// streams are sorted by their labels
+		assert.Equal(t, map[string]string{"env": "test", "logger": "loki", "level": "info", "service": "api", "http_method": "GET"}, streams[0].Stream)
+		assert.Equal(t, map[string]string{"env": "test", "logger": "loki", "level": "error"}, streams[1].Stream)
+		assert.Equal(t, map[string]string{"env": "test", "logger": "loki", "level": "info", "service": "web"}, streams[2].Stream)
+
+		require.Len(t, streams[0].Values, 2)
+		assert.Equal(t, "[http.method='GET' id='1' message='request' service='api']", streams[0].Values[0][1])
+		first, err := strconv.ParseInt(streams[0].Values[0][0], 10, 64)
+		require.NoError(t, err)
+		second, err := strconv.ParseInt(streams[0].Values[1][0], 10, 64)
+		require.NoError(t, err)
+		assert.True(t, second > first)
+	})
+	t.Run("Flush", func(t *testing.T) {
+		s, mock := newLogger(t, LokiOptions{Compression: "gzip"})
+
+		s.Send(message.NewDefaultMessage(level.Info, "one"))
+		assert.Empty(t, mock.received())
+		require.NoError(t, s.Flush(context.Background()))
+
+		pushes := mock.received()
+		require.Len(t, pushes, 1)
+		assert.Equal(t, "gzip", pushes[0].header.Get("Content-Encoding"))
+		assert.Equal(t, "one", pushes[0].streams[0].Values[0][1])
+
+		// flushing without pending messages does not push
+		require.NoError(t, s.Flush(context.Background()))
+		assert.Len(t, mock.received(), 1)
+
+		s.Send(message.NewDefaultMessage(level.Info, "two"))
+		require.NoError(t, s.Close())
+		require.Len(t, mock.received(), 2)
+	})
+	t.Run("Interval", func(t *testing.T) {
+		s, mock := newLogger(t, LokiOptions{BatchWait: 10 * time.Millisecond})
+
+		s.Send(message.NewDefaultMessage(level.Info, "eventually"))
+		var pushes []lokiPush
+		for deadline := time.Now().Add(5 * time.Second); len(pushes) == 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			pushes = mock.received()
+		}
+		require.Len(t, pushes, 1)
+		assert.Empty(t, pushes[0].header.Get("Content-Encoding"))
+		assert.Equal(t, "eventually", pushes[0].streams[0].Values[0][1])
+	})
+	t.Run("Retries", func(t *testing.T) {
+		s, mock := newLogger(t, LokiOptions{MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, MaxRetries: 2})
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, m message.Composer) {
+			errs = append(errs, err)
+			assert.Len(t, m.(*message.GroupComposer).Messages(), 1)
+		}))
+
+		mock.responses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+		s.Send(message.NewDefaultMessage(level.Info, "retried"))
+		assert.NoError(t, s.Flush(context.Background()))
+		assert.Len(t, mock.received(), 1)
+		assert.Equal(t, 3, mock.attempts)
+
+		mock.responses = []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests}
+		s.Send(message.NewDefaultMessage(level.Info, "dropped"))
+		assert.Error(t, s.Flush(context.Background()))
+		require.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Error(), "giving up after 2 retries")
+
+		// rejected pushes are not retried
+		mock.responses = []int{http.StatusBadRequest}
+		mock.attempts = 0
+		s.Send(message.NewDefaultMessage(level.Info, "out of order"))
+		assert.Error(t, s.Flush(context.Background()))
+		require.Len(t, errs, 2)
+		assert.Equal(t, "loki rejected push with 400 Bad Request: entry out of order", errs[1].Error())
+		assert.Equal(t, 1, mock.attempts)
+	})
+}
+
+func TestLokiLabelName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"service":     "service",
+		"http.method": "http_method",
+		"1st":         "_st",
+		"a1":          "a1",
+		"Caps_OK":     "Caps_OK",
+	} {
+		assert.Equal(t, expected, lokiLabelName(name), name)
+	}
+}
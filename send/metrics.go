@@ -0,0 +1,457 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// MetricKind describes how a MetricRule aggregates the messages that
+// match it.
+type MetricKind int
+
+const (
+	// MetricCount counts matching messages.
+	MetricCount MetricKind = iota
+	// MetricSum adds up the values of a numeric field. Since the
+	// values may be negative, sums are exported as gauges.
+	MetricSum
+	// MetricGauge reports the most recent value of a numeric
+	// field.
+	MetricGauge
+	// MetricObserve summarizes the distribution of the values of
+	// a numeric field, as in message.Histogram.
+	MetricObserve
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case MetricCount:
+		return "count"
+	case MetricSum:
+		return "sum"
+	case MetricGauge:
+		return "gauge"
+	case MetricObserve:
+		return "observe"
+	default:
+		return fmt.Sprintf("MetricKind(%d)", int(k))
+	}
+}
+
+func (k MetricKind) promType() string {
+	switch k {
+	case MetricCount:
+		return "counter"
+	case MetricObserve:
+		return "summary"
+	default:
+		return "gauge"
+	}
+}
+
+// MetricRule describes a metric that a MetricsSender extracts from
+// messages. Messages that are structured as message.Fields provide
+// the values of numeric fields and of labels; other messages can only
+// be counted.
+type MetricRule struct {
+	// Name is the name of the metric, which must be a valid
+	// Prometheus metric name.
+	Name string
+	// Help describes the metric.
+	Help string
+	Kind MetricKind
+	// Field is the field that provides the value of MetricSum,
+	// MetricGauge, and MetricObserve metrics. Messages without
+	// the field, or where it is not a number, do not contribute
+	// to the metric. Durations are recorded in seconds.
+	Field string
+	// ByPriority adds a "priority" label with the priority of the
+	// message.
+	ByPriority bool
+	// Labels are the names of fields that become labels of the
+	// metric, with the field's value as the label value.
+	Labels []string
+	// Match, if specified, selects the messages that the rule
+	// applies to.
+	Match func(message.Composer) bool
+}
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate checks that the rule has a valid name and labels, and a
+// field if its kind requires one.
+func (r MetricRule) Validate() error {
+	if !metricNameRegexp.MatchString(r.Name) {
+		return fmt.Errorf("'%s' is not a valid metric name", r.Name)
+	}
+
+	switch r.Kind {
+	case MetricCount:
+	case MetricSum, MetricGauge, MetricObserve:
+		if r.Field == "" {
+			return fmt.Errorf("%s metric '%s' must specify a field", r.Kind, r.Name)
+		}
+	default:
+		return fmt.Errorf("metric '%s' has invalid kind %d", r.Name, r.Kind)
+	}
+
+	for _, l := range r.Labels {
+		if !labelNameRegexp.MatchString(l) || l == "priority" || l == "quantile" {
+			return fmt.Errorf("'%s' is not a valid label for metric '%s'", l, r.Name)
+		}
+	}
+
+	return nil
+}
+
+func (r MetricRule) labelNames() []string {
+	if !r.ByPriority {
+		return r.Labels
+	}
+
+	return append([]string{"priority"}, r.Labels...)
+}
+
+// MetricsOptions configures a MetricsSender.
+type MetricsOptions struct {
+	// Rules describe the metrics to extract from messages. At
+	// least one rule is required, and rule names must be unique.
+	Rules []MetricRule
+
+	// Target, if specified, receives a summary of the metrics as
+	// a single message every Interval, and when the sender is
+	// closed. The MetricsSender does not close the Target.
+	Target   Sender
+	Interval time.Duration
+	// Priority is the priority of the summary messages, and
+	// defaults to "Info".
+	Priority level.Priority
+}
+
+// Validate checks the options for required values and sets defaults.
+func (o *MetricsOptions) Validate() error {
+	if len(o.Rules) == 0 {
+		return errors.New("metrics sender must have at least one rule")
+	}
+
+	seen := map[string]bool{}
+	for _, r := range o.Rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("duplicate metric '%s'", r.Name)
+		}
+		seen[r.Name] = true
+	}
+
+	if o.Target != nil && o.Interval <= 0 {
+		return errors.New("metrics sender with a target must have a positive interval")
+	}
+
+	if o.Priority == level.Invalid {
+		o.Priority = level.Info
+	}
+
+	if !o.Priority.IsValid() {
+		return fmt.Errorf("%s (%d) is not a valid priority", o.Priority, o.Priority)
+	}
+
+	return nil
+}
+
+// MetricsSender is a Sender that turns messages into metrics,
+// according to a set of rules, rather than writing them anywhere. The
+// metrics are kept in memory for the life of the sender, and can be
+// sent periodically to another Sender as a summary message, or served
+// in the Prometheus text exposition format by the Handler.
+//
+// Use a multi sender to both log messages and collect metrics from
+// them.
+type MetricsSender struct {
+	Base
+	opts     MetricsOptions
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+type metricFamily struct {
+	rule   MetricRule
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels    []string
+	value     float64
+	histogram *message.Histogram
+}
+
+// NewMetricsSender constructs a MetricsSender, and returns an error if
+// the options are not valid.
+func NewMetricsSender(name string, opts MetricsOptions, l LevelInfo) (*MetricsSender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &MetricsSender{
+		Base:     *NewBase(name),
+		opts:     opts,
+		families: make(map[string]*metricFamily, len(opts.Rules)),
+	}
+
+	if err := s.SetLevel(l); err != nil {
+		return nil, err
+	}
+
+	for _, r := range opts.Rules {
+		s.families[r.Name] = &metricFamily{rule: r, series: map[string]*metricSeries{}}
+	}
+
+	if opts.Target != nil {
+		var ctx context.Context
+		ctx, s.cancel = context.WithCancel(context.Background())
+		s.wg.Add(1)
+		go s.emitLoop(ctx)
+	}
+
+	s.closer = func() error {
+		if s.cancel == nil {
+			return nil
+		}
+
+		s.cancel()
+		s.wg.Wait()
+		s.opts.Target.Send(s.Summary())
+
+		return nil
+	}
+
+	return s, nil
+}
+
+// Send records the metrics for the message.
+func (s *MetricsSender) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	fields, _ := m.Raw().(message.Fields)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.opts.Rules {
+		if r.Match != nil && !r.Match(m) {
+			continue
+		}
+
+		var value float64
+		if r.Kind != MetricCount {
+			var ok bool
+			if value, ok = metricValue(fields[r.Field]); !ok {
+				continue
+			}
+		}
+
+		labels := make([]string, 0, len(r.Labels)+1)
+		if r.ByPriority {
+			labels = append(labels, m.Priority().String())
+		}
+		for _, l := range r.Labels {
+			if v, ok := fields[l]; ok {
+				labels = append(labels, fmt.Sprint(v))
+			} else {
+				labels = append(labels, "")
+			}
+		}
+
+		family := s.families[r.Name]
+		key := strings.Join(labels, "\xff")
+		series, ok := family.series[key]
+		if !ok {
+			series = &metricSeries{labels: labels}
+			if r.Kind == MetricObserve {
+				series.histogram = message.MakeHistogram(r.Name)
+			}
+			family.series[key] = series
+		}
+
+		switch r.Kind {
+		case MetricCount:
+			series.value++
+		case MetricSum:
+			series.value += value
+		case MetricGauge:
+			series.value = value
+		case MetricObserve:
+			series.histogram.Add(value)
+		}
+	}
+}
+
+func metricValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case time.Duration:
+		return n.Seconds(), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// Summary returns a message, structured as message.Fields, that
+// reports the current value of every metric. Keys are metric names
+// with their labels, in the Prometheus style (e.g.
+// `requests{priority="info"}`), and the values of MetricObserve
+// metrics are message.HistogramSummary values.
+func (s *MetricsSender) Summary() message.Composer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := message.Fields{}
+	for _, family := range s.families {
+		names := family.rule.labelNames()
+		for _, series := range family.series {
+			key := family.rule.Name + formatLabels(names, series.labels, "", "")
+			if series.histogram != nil {
+				out[key] = series.histogram.Summary()
+			} else {
+				out[key] = series.value
+			}
+		}
+	}
+
+	return message.NewFieldsMessage(s.opts.Priority, "metrics", out)
+}
+
+// Handler returns an http.Handler that serves the metrics in the
+// Prometheus text exposition format.
+func (s *MetricsSender) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = s.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the metrics to the writer in the Prometheus
+// text exposition format.
+func (s *MetricsSender) WritePrometheus(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := &strings.Builder{}
+	for _, r := range s.opts.Rules {
+		family := s.families[r.Name]
+		names := r.labelNames()
+
+		if r.Help != "" {
+			fmt.Fprintf(buf, "# HELP %s %s\n", r.Name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(r.Help))
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", r.Name, r.Kind.promType())
+
+		keys := make([]string, 0, len(family.series))
+		for k := range family.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			series := family.series[k]
+			if series.histogram == nil {
+				fmt.Fprintf(buf, "%s%s %s\n", r.Name, formatLabels(names, series.labels, "", ""), formatMetricValue(series.value))
+				continue
+			}
+
+			summary := series.histogram.Summary()
+			for _, q := range []struct {
+				quantile string
+				value    float64
+			}{{"0.5", summary.P50}, {"0.9", summary.P90}, {"0.99", summary.P99}} {
+				fmt.Fprintf(buf, "%s%s %s\n", r.Name, formatLabels(names, series.labels, "quantile", q.quantile), formatMetricValue(q.value))
+			}
+			fmt.Fprintf(buf, "%s_sum%s %s\n", r.Name, formatLabels(names, series.labels, "", ""), formatMetricValue(summary.Sum))
+			fmt.Fprintf(buf, "%s_count%s %d\n", r.Name, formatLabels(names, series.labels, "", ""), summary.Count)
+		}
+	}
+
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(names)+1)
+	for idx, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape.Replace(values[idx])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, escape.Replace(extraValue)))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (s *MetricsSender) emitLoop(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.opts.Target.Send(s.Summary())
+		}
+	}
+}
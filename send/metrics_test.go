@@ -0,0 +1,149 @@
+package send
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsSender(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Debug}
+	rules := []MetricRule{
+		{Name: "log_messages", Help: "Messages logged.", Kind: MetricCount, ByPriority: true},
+		{Name: "bytes_sent", Kind: MetricSum, Field: "bytes", Labels: []string{"name"}},
+		{Name: "queue_depth", Kind: MetricGauge, Field: "depth"},
+		{Name: "request_seconds", Kind: MetricObserve, Field: "duration"},
+		{
+			Name:  "errors",
+			Kind:  MetricCount,
+			Match: func(m message.Composer) bool { return m.Priority() >= level.Error },
+		},
+	}
+
+	populate := func(s *MetricsSender) {
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		s.Send(message.NewDefaultMessage(level.Error, "oops"))
+		s.Send(message.NewDefaultMessage(level.Trace, "below threshold"))
+		s.Send(message.NewDefaultMessage(level.Info, ""))
+		s.Send(message.NewFields(level.Info, message.Fields{"name": "upload", "bytes": 100, "depth": 3}))
+		s.Send(message.NewFields(level.Info, message.Fields{"name": "upload", "bytes": int64(50), "depth": 7.5}))
+		s.Send(message.NewFields(level.Debug, message.Fields{"name": `a"b`, "bytes": "25"}))
+		s.Send(message.NewFields(level.Info, message.Fields{"bytes": "not a number"}))
+		for i := 1; i <= 10; i++ {
+			s.Send(message.NewFields(level.Info, message.Fields{"duration": time.Duration(i) * time.Second}))
+		}
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]MetricsOptions{
+			"NoRules":          {},
+			"InvalidName":      {Rules: []MetricRule{{Name: "bad name"}}},
+			"MissingField":     {Rules: []MetricRule{{Name: "sum", Kind: MetricSum}}},
+			"InvalidKind":      {Rules: []MetricRule{{Name: "k", Kind: 42}}},
+			"InvalidLabel":     {Rules: []MetricRule{{Name: "l", Labels: []string{"priority"}}}},
+			"Duplicate":        {Rules: []MetricRule{{Name: "d"}, {Name: "d"}}},
+			"TargetNoInterval": {Rules: []MetricRule{{Name: "t"}}, Target: MakeInternalLogger()},
+			"InvalidPriority":  {Rules: []MetricRule{{Name: "p"}}, Priority: 101},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewMetricsSender("metrics", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+	})
+	t.Run("Summary", func(t *testing.T) {
+		s, err := NewMetricsSender("metrics", MetricsOptions{Rules: rules}, info)
+		require.NoError(t, err)
+		populate(s)
+
+		msg := s.Summary()
+		assert.Equal(t, level.Info, msg.Priority())
+		fields := msg.Raw().(message.Fields)
+		assert.Equal(t, float64(14), fields[`log_messages{priority="info"}`])
+		assert.Equal(t, float64(1), fields[`log_messages{priority="error"}`])
+		assert.Equal(t, float64(1), fields[`log_messages{priority="debug"}`])
+		assert.Equal(t, float64(150), fields[`bytes_sent{name="upload"}`])
+		assert.Equal(t, float64(25), fields[`bytes_sent{name="a\"b"}`])
+		assert.Equal(t, float64(7.5), fields["queue_depth"])
+		assert.Equal(t, float64(1), fields["errors"])
+
+		summary := fields["request_seconds"].(message.HistogramSummary)
+		assert.Equal(t, uint64(10), summary.Count)
+		assert.Equal(t, float64(1), summary.Min)
+		assert.Equal(t, float64(10), summary.Max)
+		assert.Equal(t, float64(55), summary.Sum)
+		assert.Equal(t, float64(5), summary.P50)
+	})
+	t.Run("Prometheus", func(t *testing.T) {
+		s, err := NewMetricsSender("metrics", MetricsOptions{Rules: rules}, info)
+		require.NoError(t, err)
+		populate(s)
+
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+
+		body, err := io.ReadAll(rec.Body)
+		require.NoError(t, err)
+		for _, line := range []string{
+			"# HELP log_messages Messages logged.",
+			"# TYPE log_messages counter",
+			`log_messages{priority="info"} 14`,
+			`log_messages{priority="error"} 1`,
+			"# TYPE bytes_sent gauge",
+			`bytes_sent{name="upload"} 150`,
+			`bytes_sent{name="a\"b"} 25`,
+			"# TYPE queue_depth gauge",
+			"queue_depth 7.5",
+			"# TYPE request_seconds summary",
+			`request_seconds{quantile="0.5"} 5`,
+			`request_seconds{quantile="0.99"} 10`,
+			"request_seconds_sum 55",
+			"request_seconds_count 10",
+			"errors 1",
+		} {
+			assert.Contains(t, string(body), line+"\n")
+		}
+	})
+	t.Run("Target", func(t *testing.T) {
+		target := MakeInternalLogger()
+		s, err := NewMetricsSender("metrics", MetricsOptions{
+			Rules:    rules[:1],
+			Target:   target,
+			Interval: 10 * time.Millisecond,
+			Priority: level.Notice,
+		}, info)
+		require.NoError(t, err)
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+
+		// the first summaries may precede the message
+		var fields message.Fields
+		for start := time.Now(); time.Since(start) < 5*time.Second && fields[`log_messages{priority="info"}`] == nil; {
+			msg, ok := target.GetMessageSafe()
+			if !ok {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			assert.Equal(t, level.Notice, msg.Priority)
+			fields = msg.Message.Raw().(message.Fields)
+		}
+		assert.Equal(t, float64(1), fields[`log_messages{priority="info"}`])
+
+		require.NoError(t, s.Close())
+		for target.HasMessage() {
+			_, _ = target.GetMessageSafe()
+		}
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		time.Sleep(20 * time.Millisecond)
+		assert.False(t, target.HasMessage())
+		assert.NoError(t, s.Close())
+	})
+}
@@ -0,0 +1,416 @@
+package send
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"cdr.dev/grip/message"
+)
+
+// msgpackMaxLength limits the length of strings, binary data, arrays,
+// and maps read from a peer.
+const msgpackMaxLength = 16 * 1024 * 1024
+
+// msgpackExt is a MessagePack extension type, as decoded.
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// appendMsgpack appends the MessagePack encoding of the value. Values
+// without a MessagePack equivalent are encoded as their JSON
+// representation, or as strings.
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		return appendMsgpackInt(b, int64(v))
+	case int8:
+		return appendMsgpackInt(b, int64(v))
+	case int16:
+		return appendMsgpackInt(b, int64(v))
+	case int32:
+		return appendMsgpackInt(b, int64(v))
+	case int64:
+		return appendMsgpackInt(b, v)
+	case uint:
+		return appendMsgpackUint(b, uint64(v))
+	case uint8:
+		return appendMsgpackUint(b, uint64(v))
+	case uint16:
+		return appendMsgpackUint(b, uint64(v))
+	case uint32:
+		return appendMsgpackUint(b, uint64(v))
+	case uint64:
+		return appendMsgpackUint(b, v)
+	case float32:
+		b = append(b, 0xca)
+		return appendBigEndian32(b, math.Float32bits(v))
+	case float64:
+		b = append(b, 0xcb)
+		return appendBigEndian64(b, math.Float64bits(v))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i)
+		}
+		if f, err := v.Float64(); err == nil {
+			return appendMsgpack(b, f)
+		}
+		return appendMsgpackString(b, v.String())
+	case string:
+		return appendMsgpackString(b, v)
+	case []byte:
+		return appendMsgpackBinary(b, v)
+	case time.Time:
+		return appendMsgpackString(b, v.Format(time.RFC3339Nano))
+	case error:
+		return appendMsgpackString(b, v.Error())
+	case message.Fields:
+		return appendMsgpack(b, map[string]interface{}(v))
+	case map[string]interface{}:
+		b = appendMsgpackMapHeader(b, len(v))
+		for k, val := range v {
+			b = appendMsgpackString(b, k)
+			b = appendMsgpack(b, val)
+		}
+		return b
+	case map[string]string:
+		b = appendMsgpackMapHeader(b, len(v))
+		for k, val := range v {
+			b = appendMsgpackString(b, k)
+			b = appendMsgpackString(b, val)
+		}
+		return b
+	case []interface{}:
+		b = appendMsgpackArrayHeader(b, len(v))
+		for _, val := range v {
+			b = appendMsgpack(b, val)
+		}
+		return b
+	case []string:
+		b = appendMsgpackArrayHeader(b, len(v))
+		for _, val := range v {
+			b = appendMsgpackString(b, val)
+		}
+		return b
+	case fmt.Stringer:
+		return appendMsgpackString(b, v.String())
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return appendMsgpackString(b, fmt.Sprint(v))
+	}
+
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber()
+	if err = dec.Decode(&generic); err != nil {
+		return appendMsgpackString(b, string(out))
+	}
+
+	return appendMsgpack(b, generic)
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgpackUint(b, uint64(i))
+	case i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return appendBigEndian16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return appendBigEndian32(append(b, 0xd2), uint32(i))
+	default:
+		return appendBigEndian64(append(b, 0xd3), uint64(i))
+	}
+}
+
+func appendMsgpackUint(b []byte, u uint64) []byte {
+	switch {
+	case u <= math.MaxInt8:
+		return append(b, byte(u))
+	case u <= math.MaxUint8:
+		return append(b, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return appendBigEndian16(append(b, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return appendBigEndian32(append(b, 0xce), uint32(u))
+	default:
+		return appendBigEndian64(append(b, 0xcf), u)
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = appendBigEndian16(append(b, 0xda), uint16(n))
+	default:
+		b = appendBigEndian32(append(b, 0xdb), uint32(n))
+	}
+
+	return append(b, s...)
+}
+
+func appendMsgpackBinary(b []byte, data []byte) []byte {
+	switch n := len(data); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = appendBigEndian16(append(b, 0xc5), uint16(n))
+	default:
+		b = appendBigEndian32(append(b, 0xc6), uint32(n))
+	}
+
+	return append(b, data...)
+}
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendBigEndian16(append(b, 0xdc), uint16(n))
+	default:
+		return appendBigEndian32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return appendBigEndian16(append(b, 0xde), uint16(n))
+	default:
+		return appendBigEndian32(append(b, 0xdf), uint32(n))
+	}
+}
+
+// appendMsgpackEventTime appends the time as the EventTime extension
+// type of the Fluentd forward protocol, which has nanosecond
+// precision.
+func appendMsgpackEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = appendBigEndian32(b, uint32(t.Unix()))
+	return appendBigEndian32(b, uint32(t.Nanosecond()))
+}
+
+// readMsgpack decodes one value, as nil, bool, int64, uint64,
+// float64, string, []byte, []interface{}, map[string]interface{}, or
+// msgpackExt.
+func readMsgpack(r io.Reader) (interface{}, error) {
+	return readMsgpackValue(r, 0)
+}
+
+func readMsgpackValue(r io.Reader, depth int) (interface{}, error) {
+	if depth > 32 {
+		return nil, errors.New("msgpack value is nested too deeply")
+	}
+
+	head, err := readMsgpackBytes(r, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := head[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		data, err := readMsgpackBytes(r, int(c&0x1f))
+		return string(data), err
+	}
+
+	switch c := head[0]; c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMsgpackLength(r, 1<<(c-0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackLength(r, 1<<(c-0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackExt(r, n)
+	case 0xca:
+		data, err := readMsgpackBytes(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	case 0xcb:
+		data, err := readMsgpackBytes(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return readMsgpackUint(r, 1<<(c-0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extend from the size of the value.
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readMsgpackExt(r, 1<<(c-0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMsgpackLength(r, 1<<(c-0xd9))
+		if err != nil {
+			return nil, err
+		}
+		data, err := readMsgpackBytes(r, n)
+		return string(data), err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackLength(r, 2<<(c-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n, depth)
+	case 0xde, 0xdf:
+		n, err := readMsgpackLength(r, 2<<(c-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n, depth)
+	default:
+		return nil, fmt.Errorf("invalid msgpack type 0x%x", c)
+	}
+}
+
+func readMsgpackBytes(r io.Reader, n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readMsgpackUint(r io.Reader, size int) (uint64, error) {
+	data, err := readMsgpackBytes(r, size)
+	if err != nil {
+		return 0, err
+	}
+
+	var u uint64
+	for _, c := range data {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func readMsgpackLength(r io.Reader, size int) (int, error) {
+	n, err := readMsgpackUint(r, size)
+	if err != nil {
+		return 0, err
+	}
+	if n > msgpackMaxLength {
+		return 0, fmt.Errorf("msgpack length %d exceeds the limit of %d", n, msgpackMaxLength)
+	}
+	return int(n), nil
+}
+
+func readMsgpackExt(r io.Reader, n int) (interface{}, error) {
+	data, err := readMsgpackBytes(r, n+1)
+	if err != nil {
+		return nil, err
+	}
+	return msgpackExt{Type: int8(data[0]), Data: data[1:]}, nil
+}
+
+func readMsgpackArray(r io.Reader, n, depth int) (interface{}, error) {
+	out := []interface{}{}
+	for i := 0; i < n; i++ {
+		v, err := readMsgpackValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func readMsgpackMap(r io.Reader, n, depth int) (interface{}, error) {
+	out := map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		k, err := readMsgpackValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readMsgpackValue(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k := k.(type) {
+		case string:
+			out[k] = v
+		case []byte:
+			out[string(k)] = v
+		default:
+			out[fmt.Sprint(k)] = v
+		}
+	}
+	return out, nil
+}
+
+// msgpackString returns the value of a string or binary value, which
+// peers use interchangeably.
+func msgpackString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+func appendBigEndian16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendBigEndian32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendBigEndian64(b []byte, v uint64) []byte {
+	return appendBigEndian32(appendBigEndian32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,71 @@
+package send
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgpack(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	for name, test := range map[string]struct {
+		in       interface{}
+		expected interface{}
+	}{
+		"Nil":         {in: nil, expected: nil},
+		"True":        {in: true, expected: true},
+		"FixInt":      {in: 7, expected: int64(7)},
+		"NegFixInt":   {in: -7, expected: int64(-7)},
+		"Int8":        {in: int8(-100), expected: int64(-100)},
+		"Int16":       {in: -1000, expected: int64(-1000)},
+		"Int32":       {in: int32(-100000), expected: int64(-100000)},
+		"Int64":       {in: int64(math.MinInt64), expected: int64(math.MinInt64)},
+		"Uint8":       {in: uint8(200), expected: uint64(200)},
+		"Uint16":      {in: 60000, expected: uint64(60000)},
+		"Uint64":      {in: uint64(math.MaxUint64), expected: uint64(math.MaxUint64)},
+		"Float32":     {in: float32(1.5), expected: 1.5},
+		"Float64":     {in: 2.25, expected: 2.25},
+		"FixStr":      {in: "hello", expected: "hello"},
+		"Str8":        {in: strings.Repeat("a", 100), expected: strings.Repeat("a", 100)},
+		"Str16":       {in: strings.Repeat("a", 1000), expected: strings.Repeat("a", 1000)},
+		"Binary":      {in: []byte("data"), expected: []byte("data")},
+		"Time":        {in: ts, expected: "2020-01-02T03:04:05.000000006Z"},
+		"Error":       {in: errors.New("failed"), expected: "failed"},
+		"Strings":     {in: []string{"a", "b"}, expected: []interface{}{"a", "b"}},
+		"Array16":     {in: make([]interface{}, 20), expected: make([]interface{}, 20)},
+		"Fields":      {in: message.Fields{"a": 1, "b": []interface{}{"c"}}, expected: map[string]interface{}{"a": int64(1), "b": []interface{}{"c"}}},
+		"StringMap":   {in: map[string]string{"a": "b"}, expected: map[string]interface{}{"a": "b"}},
+		"Struct":      {in: struct{ Name string }{Name: "grip"}, expected: map[string]interface{}{"Name": "grip"}},
+		"StructValue": {in: struct{ N float64 }{N: 1e100}, expected: map[string]interface{}{"N": 1e100}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, err := readMsgpack(bytes.NewReader(appendMsgpack(nil, test.in)))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, out)
+		})
+	}
+
+	t.Run("EventTime", func(t *testing.T) {
+		out, err := readMsgpack(bytes.NewReader(appendMsgpackEventTime(nil, ts)))
+		require.NoError(t, err)
+		assert.Equal(t, msgpackExt{Type: 0, Data: []byte{0x5e, 0x0d, 0x5d, 0xa5, 0, 0, 0, 6}}, out)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := readMsgpack(bytes.NewReader([]byte{0xc1}))
+		assert.Error(t, err)
+
+		_, err = readMsgpack(bytes.NewReader([]byte{0xdb, 0xff, 0xff, 0xff, 0xff}))
+		assert.Error(t, err)
+
+		_, err = readMsgpack(bytes.NewReader([]byte{0x92, 0x01}))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,421 @@
+package send
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/message"
+)
+
+// ConnectionState describes the connection of a network sender.
+type ConnectionState int
+
+// The states of a network sender's connection.
+const (
+	// ConnectionConnecting senders are connecting, or waiting to
+	// reconnect after a failure, and buffer messages until they
+	// connect.
+	ConnectionConnecting ConnectionState = iota
+	ConnectionConnected
+	ConnectionClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionConnecting:
+		return "connecting"
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+// ConnectionStateReporter is implemented by senders that write to a
+// network connection, to report the state of the connection.
+type ConnectionStateReporter interface {
+	ConnectionState() ConnectionState
+}
+
+// NetworkOptions configures a sender that writes formatted messages
+// to a network connection.
+type NetworkOptions struct {
+	// Network is "tcp", "udp", or "unix", or any of the other
+	// networks supported by net.Dial.
+	Network string `bson:"network" json:"network" yaml:"network"`
+	Address string `bson:"address" json:"address" yaml:"address"`
+
+	// Framing is "newline", the default, which terminates each
+	// message with a newline unless it already ends with one, or
+	// "length", which prefixes each message with its length as a
+	// 4 byte big endian integer.
+	Framing string `bson:"framing" json:"framing" yaml:"framing"`
+
+	// BufferSize is the number of messages held while the sender
+	// is disconnected, and defaults to 1000. When the buffer is
+	// full, the oldest messages are dropped.
+	BufferSize int `bson:"buffer_size" json:"buffer_size" yaml:"buffer_size"`
+
+	// Reconnection attempts back off exponentially from MinBackoff,
+	// which defaults to 100 milliseconds, to MaxBackoff, which
+	// defaults to 30 seconds.
+	MinBackoff time.Duration `bson:"min_backoff" json:"min_backoff" yaml:"min_backoff"`
+	MaxBackoff time.Duration `bson:"max_backoff" json:"max_backoff" yaml:"max_backoff"`
+
+	// DialTimeout and WriteTimeout default to 5 seconds.
+	DialTimeout  time.Duration `bson:"dial_timeout" json:"dial_timeout" yaml:"dial_timeout"`
+	WriteTimeout time.Duration `bson:"write_timeout" json:"write_timeout" yaml:"write_timeout"`
+}
+
+// Validate checks the options, and sets defaults for unset values.
+func (opts *NetworkOptions) Validate() error {
+	if opts == nil {
+		return errors.New("must specify non-nil network options")
+	}
+
+	errs := []string{}
+
+	if opts.Network == "" {
+		errs = append(errs, "must specify a network")
+	}
+	if opts.Address == "" {
+		errs = append(errs, "must specify an address")
+	}
+
+	if opts.Framing == "" {
+		opts.Framing = "newline"
+	}
+	switch opts.Framing {
+	case "newline", "length":
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported framing '%s'", opts.Framing))
+	}
+
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1000
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+
+	if opts.BufferSize < 0 {
+		errs = append(errs, "buffer size must not be negative")
+	}
+	if opts.MinBackoff < 0 || opts.DialTimeout < 0 || opts.WriteTimeout < 0 {
+		errs = append(errs, "timeouts must not be negative")
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		errs = append(errs, "max backoff must not be less than min backoff")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+type networkMessage struct {
+	data []byte
+	msg  message.Composer
+}
+
+type networkLogger struct {
+	opts   NetworkOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu           sync.Mutex
+	conn         net.Conn
+	state        ConnectionState
+	reconnecting bool
+	buffer       []networkMessage
+	drained      chan struct{}
+	wake         chan struct{}
+
+	*Base
+}
+
+// NewNetworkLogger constructs a Sender that writes formatted messages
+// to a network connection, like NewStreamLogger, but handles network
+// failures. It connects in the background, and after a failed write
+// it reconnects with exponential backoff, holding messages in a
+// bounded buffer until it reconnects. The sender implements
+// ConnectionStateReporter, and QueueDepthReporter to report the
+// number of buffered messages.
+func NewNetworkLogger(name string, opts NetworkOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeNetworkLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeNetworkLogger constructs an unconfigured network sender, and
+// starts connecting. Pass to Journaler.SetSender or call SetName
+// before using.
+func MakeNetworkLogger(opts NetworkOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &networkLogger{
+		opts:    opts,
+		drained: make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		Base:    NewBase(""),
+	}
+	close(s.drained)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	s.closer = func() error {
+		s.cancel()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.state = ConnectionClosed
+		var err error
+		if s.conn != nil {
+			err = s.conn.Close()
+			s.conn = nil
+		}
+		if len(s.buffer) > 0 {
+			err = fmt.Errorf("%d buffered messages were not sent", len(s.buffer))
+			s.buffer = nil
+			close(s.drained)
+		}
+
+		return err
+	}
+
+	s.mu.Lock()
+	s.startReconnect()
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+func (s *networkLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	if g, ok := m.(*message.GroupComposer); ok {
+		for _, c := range g.Messages() {
+			s.Send(c)
+		}
+		return
+	}
+
+	msg, err := s.Formatter()(m)
+	if err != nil {
+		s.ErrorHandler()(err, m)
+		return
+	}
+
+	var data []byte
+	if s.opts.Framing == "length" {
+		n := len(msg)
+		data = append([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, msg...)
+	} else {
+		data = []byte(msg)
+		if !strings.HasSuffix(msg, "\n") {
+			data = append(data, '\n')
+		}
+	}
+
+	if err = s.write(networkMessage{data: data, msg: m}); err != nil {
+		s.ErrorHandler()(err, m)
+	}
+}
+
+// write sends the message if the sender is connected, and otherwise
+// buffers it, returning an error if the sender is closed.
+func (s *networkLogger) write(msg networkMessage) error {
+	s.mu.Lock()
+	var dropped message.Composer
+	defer func() {
+		s.mu.Unlock()
+
+		if dropped != nil {
+			s.ErrorHandler()(fmt.Errorf("dropped message while disconnected from %s", s.opts.Address), dropped)
+		}
+	}()
+
+	switch {
+	case s.state == ConnectionClosed:
+		return errors.New("sender is closed")
+	case s.conn != nil:
+		if err := s.writeConn(msg); err == nil {
+			return nil
+		}
+		s.disconnect()
+	}
+
+	if len(s.buffer) >= s.opts.BufferSize {
+		dropped = s.buffer[0].msg
+		s.buffer = s.buffer[1:]
+	}
+	if len(s.buffer) == 0 {
+		s.drained = make(chan struct{})
+	}
+	s.buffer = append(s.buffer, msg)
+
+	return nil
+}
+
+func (s *networkLogger) writeConn(msg networkMessage) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout)); err != nil {
+		return err
+	}
+
+	_, err := s.conn.Write(msg.data)
+	return err
+}
+
+// disconnect closes the failed connection, and reconnects in the
+// background. The caller must hold the lock.
+func (s *networkLogger) disconnect() {
+	_ = s.conn.Close()
+	s.conn = nil
+	s.state = ConnectionConnecting
+	s.startReconnect()
+}
+
+func (s *networkLogger) startReconnect() {
+	if s.reconnecting {
+		return
+	}
+
+	s.reconnecting = true
+	go s.reconnect()
+}
+
+func (s *networkLogger) reconnect() {
+	dialer := &net.Dialer{Timeout: s.opts.DialTimeout}
+	backoff := s.opts.MinBackoff
+
+	for {
+		conn, err := dialer.DialContext(s.ctx, s.opts.Network, s.opts.Address)
+		if err == nil && s.connected(conn) {
+			return
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+}
+
+// connected uses the new connection to send the buffered messages,
+// and returns false if that fails.
+func (s *networkLogger) connected(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == ConnectionClosed {
+		_ = conn.Close()
+		return true
+	}
+
+	s.conn = conn
+	for len(s.buffer) > 0 {
+		if err := s.writeConn(s.buffer[0]); err != nil {
+			_ = s.conn.Close()
+			s.conn = nil
+			return false
+		}
+		s.buffer = s.buffer[1:]
+	}
+
+	s.buffer = nil
+	s.state = ConnectionConnected
+	s.reconnecting = false
+	select {
+	case <-s.drained:
+	default:
+		close(s.drained)
+	}
+
+	return true
+}
+
+// ConnectionState reports the state of the sender's connection.
+func (s *networkLogger) ConnectionState() ConnectionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// QueueDepth reports the number of messages buffered while the sender
+// is disconnected.
+func (s *networkLogger) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.buffer)
+}
+
+// Flush retries the connection immediately if the sender is
+// disconnected, and waits for the buffered messages to be sent or for
+// the context to be done.
+func (s *networkLogger) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	drained := s.drained
+	pending := len(s.buffer)
+	s.mu.Unlock()
+
+	if pending == 0 {
+		return nil
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("flushing %d buffered messages: %w", pending, ctx.Err())
+	}
+}
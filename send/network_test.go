@@ -0,0 +1,229 @@
+package send
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptConns returns the connections accepted by the listener.
+func acceptConns(t *testing.T, listener net.Listener) <-chan net.Conn {
+	t.Cleanup(func() { _ = listener.Close() })
+
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			conns <- conn
+		}
+	}()
+
+	return conns
+}
+
+func nextConn(t *testing.T, conns <-chan net.Conn) net.Conn {
+	select {
+	case conn := <-conns:
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		return conn
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for a connection")
+		return nil
+	}
+}
+
+func waitForState(t *testing.T, s Sender, state ConnectionState) {
+	reporter := s.(ConnectionStateReporter)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if reporter.ConnectionState() == state {
+			return
+		}
+	}
+
+	require.FailNow(t, "timed out waiting for connection state", "state is %s, not %s", reporter.ConnectionState(), state)
+}
+
+func TestNetworkLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	newLogger := func(t *testing.T, opts NetworkOptions) (Sender, *[]error) {
+		s, err := NewNetworkLogger("network", opts, info)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+
+		errs := &[]error{}
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { *errs = append(*errs, err) }))
+
+		return s, errs
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]NetworkOptions{
+			"NoNetwork":  {Address: "localhost:514"},
+			"NoAddress":  {Network: "tcp"},
+			"Framing":    {Network: "tcp", Address: "localhost:514", Framing: "xml"},
+			"BufferSize": {Network: "tcp", Address: "localhost:514", BufferSize: -1},
+			"Backoff":    {Network: "tcp", Address: "localhost:514", MinBackoff: time.Minute, MaxBackoff: time.Second},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewNetworkLogger("network", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := NetworkOptions{Network: "tcp", Address: "localhost:514"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, "newline", opts.Framing)
+		assert.Equal(t, 1000, opts.BufferSize)
+		assert.Equal(t, 100*time.Millisecond, opts.MinBackoff)
+		assert.Equal(t, 30*time.Second, opts.MaxBackoff)
+	})
+	t.Run("Newline", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		conns := acceptConns(t, listener)
+
+		s, errs := newLogger(t, NetworkOptions{Network: "tcp", Address: listener.Addr().String()})
+		waitForState(t, s, ConnectionConnected)
+		conn := nextConn(t, conns)
+
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewDefaultMessage(level.Info, "one"))
+		s.Send(message.NewDefaultMessage(level.Info, "two\n"))
+		require.NoError(t, s.SetFormatter(func(m message.Composer) (string, error) {
+			return "[" + m.Priority().String() + "] " + m.String(), nil
+		}))
+		s.Send(message.NewDefaultMessage(level.Info, "three"))
+		require.Empty(t, *errs)
+
+		r := bufio.NewReader(conn)
+		for _, expected := range []string{"one\n", "two\n", "[info] three\n"} {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, expected, line)
+		}
+	})
+	t.Run("Length", func(t *testing.T) {
+		listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "network.sock"))
+		require.NoError(t, err)
+		conns := acceptConns(t, listener)
+
+		s, errs := newLogger(t, NetworkOptions{Network: "unix", Address: listener.Addr().String(), Framing: "length"})
+		waitForState(t, s, ConnectionConnected)
+		conn := nextConn(t, conns)
+
+		s.Send(message.NewDefaultMessage(level.Info, "framed\nmessage"))
+		require.Empty(t, *errs)
+
+		size := make([]byte, 4)
+		_, err = io.ReadFull(conn, size)
+		require.NoError(t, err)
+		data := make([]byte, binary.BigEndian.Uint32(size))
+		_, err = io.ReadFull(conn, data)
+		require.NoError(t, err)
+		assert.Equal(t, "framed\nmessage", string(data))
+	})
+	t.Run("UDP", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		s, errs := newLogger(t, NetworkOptions{Network: "udp", Address: conn.LocalAddr().String()})
+		waitForState(t, s, ConnectionConnected)
+
+		s.Send(message.NewDefaultMessage(level.Info, "datagram"))
+		require.Empty(t, *errs)
+
+		buf := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "datagram\n", string(buf[:n]))
+	})
+	t.Run("Reconnect", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "network.sock")
+		s, errs := newLogger(t, NetworkOptions{Network: "unix", Address: path, BufferSize: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Hour})
+		assert.Equal(t, ConnectionConnecting, s.(ConnectionStateReporter).ConnectionState())
+
+		// messages are buffered until the sender connects, dropping
+		// the oldest messages when the buffer is full.
+		for _, msg := range []string{"one", "two", "three"} {
+			s.Send(message.NewDefaultMessage(level.Info, msg))
+		}
+		require.Len(t, *errs, 1)
+		assert.Contains(t, (*errs)[0].Error(), "dropped message while disconnected")
+		assert.Equal(t, 2, s.(QueueDepthReporter).QueueDepth())
+
+		listener, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		conns := acceptConns(t, listener)
+
+		// flushing reconnects without waiting for the backoff.
+		time.Sleep(20 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, s.Flush(ctx))
+		assert.Equal(t, ConnectionConnected, s.(ConnectionStateReporter).ConnectionState())
+		assert.Zero(t, s.(QueueDepthReporter).QueueDepth())
+
+		conn := nextConn(t, conns)
+		r := bufio.NewReader(conn)
+		for _, expected := range []string{"two\n", "three\n"} {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, expected, line)
+		}
+
+		// writes to the closed connection fail, and the message is
+		// sent on a new connection.
+		require.NoError(t, conn.Close())
+		s.Send(message.NewDefaultMessage(level.Info, "four"))
+		require.NoError(t, s.Flush(ctx))
+		waitForState(t, s, ConnectionConnected)
+
+		line, err := bufio.NewReader(nextConn(t, conns)).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "four\n", line)
+		assert.Len(t, *errs, 1)
+	})
+	t.Run("Close", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "network.sock")
+		s, errs := newLogger(t, NetworkOptions{Network: "unix", Address: path})
+
+		s.Send(message.NewDefaultMessage(level.Info, "buffered"))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Error(t, s.Flush(ctx))
+
+		err := s.Close()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "1 buffered messages were not sent")
+		assert.Equal(t, ConnectionClosed, s.(ConnectionStateReporter).ConnectionState())
+
+		s.Send(message.NewDefaultMessage(level.Info, "closed"))
+		require.Len(t, *errs, 1)
+		assert.Equal(t, "sender is closed", (*errs)[0].Error())
+	})
+}
+
+func TestConnectionState(t *testing.T) {
+	assert.Equal(t, "connecting", ConnectionConnecting.String())
+	assert.Equal(t, "connected", ConnectionConnected.String())
+	assert.Equal(t, "closed", ConnectionClosed.String())
+	assert.Equal(t, "ConnectionState(7)", ConnectionState(7).String())
+}
@@ -0,0 +1,551 @@
+package send
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+const (
+	slackWebhookURL = "GRIP_SLACK_WEBHOOK_URL"
+
+	defaultSlackAPIURL = "https://slack.com/api"
+
+	// limits on the size of Block Kit layouts, from
+	// https://api.slack.com/reference/block-kit/blocks
+	slackMaxBlocks        = 50
+	slackMaxHeaderLength  = 150
+	slackMaxTextLength    = 3000
+	slackMaxFieldLength   = 2000
+	slackMaxSectionFields = 10
+)
+
+// SlackBlockOptions configures a Slack sender that posts Block Kit
+// layouts, either with a bot token or to an incoming webhook.
+type SlackBlockOptions struct {
+	// Name is the name of the sender, and Hostname is reported in
+	// the context of each message, defaulting to the system's
+	// hostname. Set Hostname to "!" to omit it.
+	Name     string `bson:"name" json:"name" yaml:"name"`
+	Hostname string `bson:"hostname" json:"hostname" yaml:"hostname"`
+
+	// Either Token or WebhookURL must be set. Messages sent with a
+	// token are posted to Channel with chat.postMessage, while
+	// webhooks post to the channel they were created for.
+	Token      string `bson:"token" json:"token" yaml:"token"`
+	WebhookURL string `bson:"webhook_url" json:"webhook_url" yaml:"webhook_url"`
+	Channel    string `bson:"channel" json:"channel" yaml:"channel"`
+
+	// Username and IconURL set the display name and icon of
+	// messages posted with a token.
+	Username string `bson:"username" json:"username" yaml:"username"`
+	IconURL  string `bson:"icon_url" json:"icon_url" yaml:"icon_url"`
+
+	// MaxRetries is the number of times a message is retried when
+	// Slack responds with 429 Too Many Requests, waiting as long as
+	// the Retry-After header asks, up to MaxRetryWait. Defaults to
+	// 3 retries and one minute.
+	MaxRetries   int           `bson:"max_retries" json:"max_retries" yaml:"max_retries"`
+	MaxRetryWait time.Duration `bson:"max_retry_wait" json:"max_retry_wait" yaml:"max_retry_wait"`
+
+	// ThreadWindow enables threading of repeated messages, at or
+	// above ThreadThreshold (which defaults to error): if the same
+	// message is sent again within the window of the first, it is
+	// posted as a reply in the first message's thread. Threading
+	// requires a token, as webhooks do not report the timestamps of
+	// their messages.
+	ThreadWindow    time.Duration  `bson:"thread_window" json:"thread_window" yaml:"thread_window"`
+	ThreadThreshold level.Priority `bson:"thread_threshold" json:"thread_threshold" yaml:"thread_threshold"`
+
+	// APIURL is the base URL of the Slack web API, and Client is the
+	// HTTP client used for requests. Both have reasonable defaults.
+	APIURL string       `bson:"api_url" json:"api_url" yaml:"api_url"`
+	Client *http.Client `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the options specify where to post messages,
+// and sets defaults for unspecified values.
+func (o *SlackBlockOptions) Validate() error {
+	if o == nil {
+		return errors.New("slack options cannot be nil")
+	}
+
+	errs := []string{}
+	if o.Name == "" {
+		errs = append(errs, "no logger/journal name specified")
+	}
+
+	switch {
+	case o.Token == "" && o.WebhookURL == "":
+		errs = append(errs, "must specify a token or a webhook url")
+	case o.Token != "" && o.WebhookURL != "":
+		errs = append(errs, "cannot specify both a token and a webhook url")
+	case o.Token != "" && o.Channel == "":
+		errs = append(errs, "no channel specified")
+	case o.WebhookURL != "" && o.ThreadWindow > 0:
+		errs = append(errs, "cannot thread messages sent to a webhook")
+	}
+
+	if o.MaxRetries < 0 || o.MaxRetryWait < 0 || o.ThreadWindow < 0 {
+		errs = append(errs, "retries and durations cannot be negative")
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.MaxRetryWait == 0 {
+		o.MaxRetryWait = time.Minute
+	}
+
+	if o.ThreadThreshold == level.Invalid {
+		o.ThreadThreshold = level.Error
+	} else if !o.ThreadThreshold.IsValid() {
+		errs = append(errs, fmt.Sprintf("invalid thread threshold %d", o.ThreadThreshold))
+	}
+
+	if o.APIURL == "" {
+		o.APIURL = defaultSlackAPIURL
+	}
+	o.APIURL = strings.TrimSuffix(o.APIURL, "/")
+
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if o.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			o.Hostname = hostname
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+type slackBlockLogger struct {
+	opts SlackBlockOptions
+
+	mu      sync.Mutex
+	threads map[string]*slackThread
+	*Base
+}
+
+// slackThread tracks the first post of a repeated message.
+type slackThread struct {
+	ts      string
+	channel string
+	started time.Time
+	repeats int
+}
+
+// NewSlackBlockLogger constructs a Sender that posts messages to Slack
+// as Block Kit layouts. Each message has a header with its priority,
+// its text, a section with the fields of structured messages, and
+// code blocks for stack traces.
+func NewSlackBlockLogger(opts *SlackBlockOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeSlackBlockLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, opts.Name, l)
+}
+
+// MakeSlackBlockLogger is equivalent to NewSlackBlockLogger, but if
+// the options have neither a token nor a webhook URL, it reads them
+// from the "GRIP_SLACK_CLIENT_TOKEN" and "GRIP_SLACK_WEBHOOK_URL"
+// environment variables, and it logs all messages.
+func MakeSlackBlockLogger(opts *SlackBlockOptions) (Sender, error) {
+	if opts != nil && opts.Token == "" && opts.WebhookURL == "" {
+		opts.Token = os.Getenv(slackClientToken)
+		opts.WebhookURL = os.Getenv(slackWebhookURL)
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &slackBlockLogger{
+		opts:    *opts,
+		threads: map[string]*slackThread{},
+		Base:    NewBase(opts.Name),
+	}
+
+	if err := s.SetLevel(LevelInfo{level.Trace, level.Trace}); err != nil {
+		return nil, err
+	}
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	if err := s.SetErrorHandler(ErrorHandlerFromLogger(fallback)); err != nil {
+		return nil, err
+	}
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	return s, nil
+}
+
+func (s *slackBlockLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	msg := s.opts.produceBlocks(s.Name(), m)
+
+	// requests are serialized, so that a rate limited sender waits
+	// once rather than once for every pending message.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, thread := s.thread(m)
+	if thread != nil {
+		thread.repeats++
+		msg.ThreadTS = thread.ts
+		msg.Channel = thread.channel
+		msg.Text = fmt.Sprintf("occurrence %d: %s", thread.repeats+1, msg.Text)
+	}
+
+	resp, err := s.post(msg)
+	if err != nil {
+		s.ErrorHandler()(err, m)
+		return
+	}
+
+	if key != "" && thread == nil && resp.TS != "" {
+		s.threads[key] = &slackThread{ts: resp.TS, channel: resp.Channel, started: time.Now()}
+	}
+}
+
+// thread returns the key of messages that may be threaded, and the
+// thread for the message if it repeats a recent message. Callers must
+// hold the lock.
+func (s *slackBlockLogger) thread(m message.Composer) (string, *slackThread) {
+	if s.opts.ThreadWindow <= 0 || m.Priority() < s.opts.ThreadThreshold {
+		return "", nil
+	}
+
+	now := time.Now()
+	for k, t := range s.threads {
+		if now.Sub(t.started) > s.opts.ThreadWindow {
+			delete(s.threads, k)
+		}
+	}
+
+	key := slackThreadKey(m)
+	return key, s.threads[key]
+}
+
+// slackThreadKey identifies repeated messages by their priority and
+// text, ignoring the fields and stack traces, which are likely to
+// change between occurrences.
+func slackThreadKey(m message.Composer) string {
+	text := m.String()
+	switch raw := m.Raw().(type) {
+	case message.Fields:
+		text = message.GetDefaultFieldsMessage(m, "")
+		if text == "" {
+			text = fmt.Sprint(raw["error"])
+		}
+	case message.StackTrace:
+		if c, ok := raw.Context.(message.Composer); ok {
+			text = c.String()
+		}
+	}
+
+	return m.Priority().String() + ":" + text
+}
+
+// slackPostResponse is the response of chat.postMessage.
+type slackPostResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// post sends the message, retrying requests that are rate limited.
+func (s *slackBlockLogger) post(msg *slackBlockMessage) (*slackPostResponse, error) {
+	url := s.opts.WebhookURL
+	if url == "" {
+		url = s.opts.APIURL + "/chat.postMessage"
+		msg.Username = s.opts.Username
+		msg.IconURL = s.opts.IconURL
+	} else {
+		msg.Channel = ""
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("encoding slack message: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, retryAfter, err := s.do(url, body)
+		if err == nil || retryAfter < 0 {
+			return resp, err
+		}
+
+		if attempt >= s.opts.MaxRetries {
+			return nil, fmt.Errorf("giving up after %d retries: %w", attempt, err)
+		}
+		if retryAfter > s.opts.MaxRetryWait {
+			return nil, fmt.Errorf("retry after %s exceeds the maximum wait: %w", retryAfter, err)
+		}
+
+		time.Sleep(retryAfter)
+	}
+}
+
+// do makes a single request, and returns how long to wait before
+// retrying it, or a negative duration if it should not be retried.
+func (s *slackBlockLogger) do(url string, body []byte) (*slackPostResponse, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, -1, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if s.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.opts.Token)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, -1, fmt.Errorf("posting to slack: %w", err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, -1, fmt.Errorf("reading slack response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, slackRetryAfter(resp.Header.Get("Retry-After")), errors.New("slack rate limit exceeded")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, -1, fmt.Errorf("slack responded with %s: %s", resp.Status, strings.TrimSpace(string(payload)))
+	}
+
+	// webhooks respond with "ok" rather than json.
+	if s.opts.WebhookURL != "" {
+		return &slackPostResponse{OK: true}, -1, nil
+	}
+
+	out := &slackPostResponse{}
+	if err = json.Unmarshal(payload, out); err != nil {
+		return nil, -1, fmt.Errorf("decoding slack response: %w", err)
+	}
+	if !out.OK {
+		return nil, -1, fmt.Errorf("slack error: %s", out.Error)
+	}
+
+	return out, -1, nil
+}
+
+// slackRetryAfter parses the Retry-After header, which Slack sends as
+// a number of seconds, defaulting to one second.
+func slackRetryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil || seconds < 0 {
+		return time.Second
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+////////////////////////////////////////////////////////////////////////
+//
+// Block Kit layouts
+//
+////////////////////////////////////////////////////////////////////////
+
+type slackBlockMessage struct {
+	Channel     string       `json:"channel,omitempty"`
+	Text        string       `json:"text"`
+	Blocks      []slackBlock `json:"blocks,omitempty"`
+	Attachments interface{}  `json:"attachments,omitempty"`
+	ThreadTS    string       `json:"thread_ts,omitempty"`
+	Username    string       `json:"username,omitempty"`
+	IconURL     string       `json:"icon_url,omitempty"`
+}
+
+type slackBlock struct {
+	Type     string       `json:"type"`
+	Text     *slackText   `json:"text,omitempty"`
+	Fields   []*slackText `json:"fields,omitempty"`
+	Elements []*slackText `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func slackPlainText(text string, max int) *slackText {
+	return &slackText{Type: "plain_text", Text: truncateText(text, max)}
+}
+
+func slackMarkdown(text string, max int) *slackText {
+	return &slackText{Type: "mrkdwn", Text: truncateText(text, max)}
+}
+
+// slackCodeBlock formats the text as preformatted markdown, keeping
+// the beginning of the text if it is too long, as stack traces are
+// most useful with their first frames.
+func slackCodeBlock(text string) *slackText {
+	const fence = "```"
+	text = strings.ReplaceAll(strings.TrimSpace(text), fence, "'''")
+	return &slackText{
+		Type: "mrkdwn",
+		Text: fence + "\n" + truncateText(text, slackMaxTextLength-2*len(fence)-2) + "\n" + fence,
+	}
+}
+
+func slackPriorityEmoji(p level.Priority) string {
+	switch {
+	case p >= level.Critical:
+		return ":rotating_light:"
+	case p >= level.Error:
+		return ":x:"
+	case p >= level.Notice:
+		return ":warning:"
+	default:
+		return ":information_source:"
+	}
+}
+
+// produceBlocks renders the message as a Block Kit layout.
+func (o *SlackBlockOptions) produceBlocks(name string, m message.Composer) *slackBlockMessage {
+	out := &slackBlockMessage{Channel: o.Channel}
+
+	if slackMsg, ok := m.Raw().(*message.Slack); ok {
+		if slackMsg.Target != "" {
+			out.Channel = slackMsg.Target
+		}
+		out.Text = slackMsg.Msg
+		out.Attachments = slackMsg.Attachments
+		return out
+	}
+
+	p := m.Priority()
+	text := m.String()
+	var fields message.Fields
+	var stack string
+
+	switch raw := m.Raw().(type) {
+	case message.Fields:
+		fields = raw
+		text = message.GetDefaultFieldsMessage(m, "")
+		if frames, ok := slackFieldsStack(raw); ok {
+			stack = slackStackFrames(frames)
+		} else if extended, ok := raw["extended"].(string); ok {
+			stack = extended
+		}
+	case message.StackTrace:
+		if c, ok := raw.Context.(message.Composer); ok {
+			text = c.String()
+		}
+		stack = slackStackFrames(raw.Frames)
+	}
+
+	out.Text = text
+	if out.Text == "" {
+		out.Text = m.String()
+	}
+
+	out.Blocks = append(out.Blocks, slackBlock{
+		Type: "header",
+		Text: slackPlainText(fmt.Sprintf("%s %s", slackPriorityEmoji(p), strings.ToUpper(p.String())), slackMaxHeaderLength),
+	})
+
+	if text != "" {
+		out.Blocks = append(out.Blocks, slackBlock{Type: "section", Text: slackMarkdown(text, slackMaxTextLength)})
+	}
+
+	out.Blocks = append(out.Blocks, slackFieldSections(fields)...)
+
+	if stack != "" {
+		out.Blocks = append(out.Blocks, slackBlock{Type: "section", Text: slackCodeBlock(stack)})
+	}
+
+	context := []*slackText{slackMarkdown(fmt.Sprintf("*logger:* %s", name), slackMaxTextLength)}
+	if o.Hostname != "" && o.Hostname != "!" {
+		context = append(context, slackMarkdown(fmt.Sprintf("*host:* %s", o.Hostname), slackMaxTextLength))
+	}
+	out.Blocks = append(out.Blocks, slackBlock{Type: "context", Elements: context})
+
+	if len(out.Blocks) > slackMaxBlocks {
+		out.Blocks = append(out.Blocks[:slackMaxBlocks-1], out.Blocks[len(out.Blocks)-1])
+	}
+
+	return out
+}
+
+// slackFieldSections renders the fields, sorted by key, as sections
+// of at most ten fields each.
+func slackFieldSections(fields message.Fields) []slackBlock {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		switch k {
+		case message.FieldsMsgName, "metadata", "stack.frames", "extended":
+			continue
+		case "stack":
+			if _, ok := fields[k].(message.StackFrames); ok {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var blocks []slackBlock
+	for i, k := range keys {
+		if i%slackMaxSectionFields == 0 {
+			blocks = append(blocks, slackBlock{Type: "section"})
+		}
+		block := &blocks[len(blocks)-1]
+		block.Fields = append(block.Fields, slackMarkdown(fmt.Sprintf("*%s*\n%v", k, fields[k]), slackMaxFieldLength))
+	}
+
+	return blocks
+}
+
+// slackFieldsStack returns the stack trace of structured messages,
+// which is in the "stack.frames" field of wrapped errors, or in the
+// "stack" field of messages annotated by the recovery package.
+func slackFieldsStack(fields message.Fields) (message.StackFrames, bool) {
+	if frames, ok := fields["stack.frames"].(message.StackFrames); ok {
+		return frames, true
+	}
+
+	frames, ok := fields["stack"].(message.StackFrames)
+	return frames, ok
+}
+
+func slackStackFrames(frames message.StackFrames) string {
+	lines := make([]string, 0, len(frames))
+	for _, f := range frames {
+		lines = append(lines, fmt.Sprintf("%s\n\t%s:%d", f.Function, f.File, f.Line))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,288 @@
+package send
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slackServerMock records the messages posted to it, and responds to
+// the first requests as rate limited.
+type slackServerMock struct {
+	mu          sync.Mutex
+	requests    []map[string]interface{}
+	auth        []string
+	rateLimited int
+	retryAfter  string
+	webhook     bool
+}
+
+func (m *slackServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rateLimited > 0 {
+		m.rateLimited--
+		w.Header().Set("Retry-After", m.retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.requests = append(m.requests, body)
+	m.auth = append(m.auth, r.Header.Get("Authorization"))
+
+	if m.webhook {
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+
+	if r.URL.Path != "/chat.postMessage" {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": "unknown_method"})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":      true,
+		"channel": "C123",
+		"ts":      fmt.Sprintf("1700000000.%06d", len(m.requests)),
+	})
+}
+
+func (m *slackServerMock) sent() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]map[string]interface{}{}, m.requests...)
+}
+
+func TestSlackBlockLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]*SlackBlockOptions{
+			"Nil":         nil,
+			"NoName":      {Token: "xoxb", Channel: "#test"},
+			"NoEndpoint":  {Name: "slack"},
+			"Both":        {Name: "slack", Token: "xoxb", Channel: "#test", WebhookURL: "http://localhost"},
+			"NoChannel":   {Name: "slack", Token: "xoxb"},
+			"ThreadHook":  {Name: "slack", WebhookURL: "http://localhost", ThreadWindow: time.Minute},
+			"Negative":    {Name: "slack", Token: "xoxb", Channel: "#test", MaxRetries: -1},
+			"BadPriority": {Name: "slack", Token: "xoxb", Channel: "#test", ThreadThreshold: 101},
+		} {
+			t.Run(name, func(t *testing.T) {
+				assert.Error(t, opts.Validate())
+			})
+		}
+
+		opts := &SlackBlockOptions{Name: "slack", Token: "xoxb", Channel: "#test", APIURL: "http://localhost/api/"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, 3, opts.MaxRetries)
+		assert.Equal(t, time.Minute, opts.MaxRetryWait)
+		assert.Equal(t, level.Error, opts.ThreadThreshold)
+		assert.Equal(t, "http://localhost/api", opts.APIURL)
+		assert.NotNil(t, opts.Client)
+		assert.NotEmpty(t, opts.Hostname)
+	})
+	t.Run("Blocks", func(t *testing.T) {
+		opts := &SlackBlockOptions{Name: "slack", Token: "xoxb", Channel: "#test", Hostname: "host.example.com"}
+		require.NoError(t, opts.Validate())
+
+		fields := map[string]interface{}{}
+		for i := 0; i < 12; i++ {
+			fields[fmt.Sprintf("key%02d", i)] = i
+		}
+		fields["metadata"] = "ignored"
+		msg := opts.produceBlocks("slack", message.NewFieldsMessage(level.Error, "request failed", fields))
+		assert.Equal(t, "#test", msg.Channel)
+		assert.Equal(t, "request failed", msg.Text)
+
+		require.Len(t, msg.Blocks, 5)
+		assert.Equal(t, "header", msg.Blocks[0].Type)
+		assert.Equal(t, ":x: ERROR", msg.Blocks[0].Text.Text)
+		assert.Equal(t, "request failed", msg.Blocks[1].Text.Text)
+		require.Len(t, msg.Blocks[2].Fields, 10)
+		assert.Equal(t, "*key00*\n0", msg.Blocks[2].Fields[0].Text)
+		require.Len(t, msg.Blocks[3].Fields, 2)
+		assert.Equal(t, "*key11*\n11", msg.Blocks[3].Fields[1].Text)
+		assert.Equal(t, "context", msg.Blocks[4].Type)
+		require.Len(t, msg.Blocks[4].Elements, 2)
+		assert.Equal(t, "*host:* host.example.com", msg.Blocks[4].Elements[1].Text)
+
+		msg = opts.produceBlocks("slack", message.NewStack(1, "stacked"))
+		require.Len(t, msg.Blocks, 4)
+		assert.Equal(t, "stacked", msg.Text)
+		assert.Equal(t, "stacked", msg.Blocks[1].Text.Text)
+		code := msg.Blocks[2].Text.Text
+		assert.True(t, strings.HasPrefix(code, "```\ncdr.dev/grip/send.TestSlackBlockLogger"), code)
+		assert.True(t, strings.HasSuffix(code, "\n```"), code)
+
+		msg = opts.produceBlocks("slack", message.WrapError(errors.New("boom"), message.Fields{"op": "write"}))
+		assert.Equal(t, "*error*\nboom", msg.Blocks[1].Fields[0].Text)
+
+		// messages annotated like those of the recovery package
+		recovered := message.MakeFields(message.Fields{"operation": "op"})
+		require.NoError(t, recovered.Annotate("panic", "boom"))
+		require.NoError(t, recovered.Annotate("stack", message.NewStack(1, "").Raw().(message.StackTrace).Frames))
+		require.NoError(t, recovered.Annotate(message.FieldsMsgName, "hit panic; recovering"))
+		msg = opts.produceBlocks("slack", recovered)
+		require.Len(t, msg.Blocks, 5)
+		assert.Equal(t, "hit panic; recovering", msg.Blocks[1].Text.Text)
+		require.Len(t, msg.Blocks[2].Fields, 2)
+		assert.Equal(t, "*operation*\nop", msg.Blocks[2].Fields[0].Text)
+		assert.Equal(t, "*panic*\nboom", msg.Blocks[2].Fields[1].Text)
+		code = msg.Blocks[3].Text.Text
+		assert.True(t, strings.HasPrefix(code, "```\ncdr.dev/grip/send.TestSlackBlockLogger"), code)
+
+		long := strings.Repeat("é", slackMaxTextLength)
+		msg = opts.produceBlocks("slack", message.NewDefaultMessage(level.Info, long))
+		assert.Equal(t, ":information_source: INFO", msg.Blocks[0].Text.Text)
+		assert.True(t, len(msg.Blocks[1].Text.Text) <= slackMaxTextLength)
+		assert.True(t, strings.HasSuffix(msg.Blocks[1].Text.Text, "é…"))
+
+		msg = opts.produceBlocks("slack", message.NewSlackMessage(level.Info, "@user", "legacy", nil))
+		assert.Equal(t, "@user", msg.Channel)
+		assert.Equal(t, "legacy", msg.Text)
+		assert.Empty(t, msg.Blocks)
+	})
+	t.Run("Token", func(t *testing.T) {
+		mock := &slackServerMock{}
+		srv := httptest.NewServer(mock)
+		defer srv.Close()
+
+		s, err := NewSlackBlockLogger(&SlackBlockOptions{
+			Name:     "slack",
+			Token:    "xoxb-token",
+			Channel:  "#test",
+			Username: "grip",
+			APIURL:   srv.URL,
+		}, info)
+		require.NoError(t, err)
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewDefaultMessage(level.Warning, "hello"))
+		require.Empty(t, errs)
+
+		sent := mock.sent()
+		require.Len(t, sent, 1)
+		assert.Equal(t, "Bearer xoxb-token", mock.auth[0])
+		assert.Equal(t, "#test", sent[0]["channel"])
+		assert.Equal(t, "hello", sent[0]["text"])
+		assert.Equal(t, "grip", sent[0]["username"])
+		assert.Len(t, sent[0]["blocks"], 3)
+	})
+	t.Run("Webhook", func(t *testing.T) {
+		mock := &slackServerMock{webhook: true}
+		srv := httptest.NewServer(mock)
+		defer srv.Close()
+
+		s, err := NewSlackBlockLogger(&SlackBlockOptions{Name: "slack", WebhookURL: srv.URL + "/hook", Channel: "#ignored"}, info)
+		require.NoError(t, err)
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		require.Empty(t, errs)
+
+		sent := mock.sent()
+		require.Len(t, sent, 1)
+		assert.Empty(t, mock.auth[0])
+		assert.NotContains(t, sent[0], "channel")
+		assert.Equal(t, "hello", sent[0]["text"])
+	})
+	t.Run("RetryAfter", func(t *testing.T) {
+		mock := &slackServerMock{rateLimited: 2, retryAfter: "0"}
+		srv := httptest.NewServer(mock)
+		defer srv.Close()
+
+		s, err := NewSlackBlockLogger(&SlackBlockOptions{Name: "slack", Token: "xoxb", Channel: "#test", APIURL: srv.URL}, info)
+		require.NoError(t, err)
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+		s.Send(message.NewDefaultMessage(level.Info, "eventually"))
+		assert.Empty(t, errs)
+		assert.Len(t, mock.sent(), 1)
+
+		// gives up after the maximum number of retries
+		mock.rateLimited = 10
+		s.Send(message.NewDefaultMessage(level.Info, "never"))
+		require.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Error(), "giving up after 3 retries")
+		assert.Equal(t, 6, mock.rateLimited)
+
+		// and does not wait longer than the maximum
+		mock.rateLimited = 1
+		mock.retryAfter = "3600"
+		start := time.Now()
+		s.Send(message.NewDefaultMessage(level.Info, "too long"))
+		require.Len(t, errs, 2)
+		assert.Contains(t, errs[1].Error(), "exceeds the maximum wait")
+		assert.True(t, time.Since(start) < time.Minute)
+	})
+	t.Run("Threads", func(t *testing.T) {
+		mock := &slackServerMock{}
+		srv := httptest.NewServer(mock)
+		defer srv.Close()
+
+		s, err := NewSlackBlockLogger(&SlackBlockOptions{
+			Name:         "slack",
+			Token:        "xoxb",
+			Channel:      "#test",
+			APIURL:       srv.URL,
+			ThreadWindow: time.Hour,
+		}, info)
+		require.NoError(t, err)
+
+		s.Send(message.NewFieldsMessage(level.Error, "disk full", message.Fields{"attempt": 1}))
+		s.Send(message.NewFieldsMessage(level.Error, "disk full", message.Fields{"attempt": 2}))
+		s.Send(message.NewFieldsMessage(level.Error, "disk full", message.Fields{"attempt": 3}))
+		s.Send(message.NewDefaultMessage(level.Error, "other error"))
+		s.Send(message.NewDefaultMessage(level.Warning, "warning"))
+		s.Send(message.NewDefaultMessage(level.Warning, "warning"))
+
+		sent := mock.sent()
+		require.Len(t, sent, 6)
+		assert.NotContains(t, sent[0], "thread_ts")
+		assert.Equal(t, "1700000000.000001", sent[1]["thread_ts"])
+		assert.Equal(t, "C123", sent[1]["channel"])
+		assert.Equal(t, "occurrence 2: disk full", sent[1]["text"])
+		assert.Equal(t, "1700000000.000001", sent[2]["thread_ts"])
+		assert.Equal(t, "occurrence 3: disk full", sent[2]["text"])
+		for _, msg := range sent[3:] {
+			assert.NotContains(t, msg, "thread_ts")
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		mock := &slackServerMock{}
+		srv := httptest.NewServer(mock)
+		defer srv.Close()
+
+		s, err := NewSlackBlockLogger(&SlackBlockOptions{Name: "slack", Token: "xoxb", Channel: "#test", APIURL: srv.URL + "/other"}, info)
+		require.NoError(t, err)
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		require.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Error(), "unknown_method")
+	})
+}
@@ -2,17 +2,20 @@ package send
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/mail"
 	"net/smtp"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"cdr.dev/grip/message"
 )
@@ -20,6 +23,12 @@ import (
 type smtpLogger struct {
 	opts *SMTPOptions
 	*Base
+
+	// digest state, used when opts.DigestInterval is set.
+	mu         sync.Mutex
+	pending    []message.Composer
+	digestSize int
+	cancel     context.CancelFunc
 }
 
 // NewSMTPLogger constructs a Sender implementation that delivers mail
@@ -63,15 +72,104 @@ func MakeSMTPLogger(opts *SMTPOptions) (Sender, error) {
 		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
 	}
 
+	s.closer = func() error {
+		if s.cancel != nil {
+			s.cancel()
+		}
+
+		var err error
+		if batch := s.takeDigest(); batch != nil {
+			err = s.opts.sendMail(batch)
+		}
+
+		s.opts.disconnect()
+
+		return err
+	}
+
 	s.SetName(opts.Name)
 
+	if opts.DigestInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+		s.digestSize = opts.DigestMaxMessages
+		go s.digestLoop(ctx, opts.DigestInterval)
+	}
+
 	return s, nil
 }
 
 func (s *smtpLogger) Send(m message.Composer) {
-	if s.Level().ShouldLog(m) {
-		if err := s.opts.sendMail(m); err != nil {
-			s.ErrorHandler()(err, m)
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	// emails carry their own recipients, and are never part of a digest.
+	if _, isEmail := m.Raw().(*message.Email); s.digestSize > 0 && !isEmail {
+		s.mu.Lock()
+		s.pending = append(s.pending, m)
+		full := len(s.pending) >= s.digestSize
+		s.mu.Unlock()
+
+		if full {
+			s.sendDigest()
+		}
+		return
+	}
+
+	if err := s.opts.sendMail(m); err != nil {
+		s.ErrorHandler()(err, m)
+	}
+}
+
+// Flush sends any messages waiting for the next digest.
+func (s *smtpLogger) Flush(_ context.Context) error {
+	s.sendDigest()
+	return nil
+}
+
+func (s *smtpLogger) digestLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendDigest()
+		}
+	}
+}
+
+// takeDigest returns the pending messages as a single composer, at
+// the priority of the most severe message, or nil if there are none.
+func (s *smtpLogger) takeDigest() message.Composer {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	p := batch[0].Priority()
+	for _, m := range batch[1:] {
+		if m.Priority() > p {
+			p = m.Priority()
+		}
+	}
+
+	return message.NewGroupComposerWithPriority(p, batch)
+}
+
+// sendDigest sends the pending messages after releasing the digest
+// lock, so that Send does not wait on the server.
+func (s *smtpLogger) sendDigest() {
+	if batch := s.takeDigest(); batch != nil {
+		if err := s.opts.sendMail(batch); err != nil {
+			s.ErrorHandler()(err, batch)
 		}
 	}
 }
@@ -102,15 +200,42 @@ type SMTPOptions struct { // nolint
 	From string
 	// Server, Port, and UseSSL control how we connect to the SMTP
 	// server. If unspecified, these options default to
-	// "localhost", port, and false.
+	// "localhost", port, and false. UseSSL is equivalent to
+	// setting StartTLS to SMTPStartTLSRequired.
 	Server string
 	Port   int
 	UseSSL bool
+	// StartTLS controls whether the client negotiates TLS with
+	// STARTTLS, using TLSConfig if it is set. The server name
+	// in the TLS configuration defaults to Server.
+	StartTLS  SMTPStartTLSPolicy
+	TLSConfig *tls.Config
 	// Username and password define how the client authenticates
 	// to the SMTP server. If no Username is specified, the client
 	// will not authenticate to the server.
-	Username string
-	Password string
+	//
+	// AuthMechanism selects the SASL mechanism, and defaults to
+	// PLAIN. For XOAUTH2, the Password is the OAuth 2.0 access
+	// token, unless TokenSource is set, in which case it is
+	// called for a fresh token each time the client connects.
+	Username      string
+	Password      string
+	AuthMechanism SMTPAuthMechanism
+	TokenSource   func() (string, error)
+
+	// IdleTimeout keeps the connection to the server open between
+	// messages, and closes it once it has been idle for the
+	// timeout. By default, the client connects for every message.
+	IdleTimeout time.Duration
+
+	// DigestInterval, if set, combines the messages sent within
+	// each interval into a single email, which is sent at the end
+	// of the interval, or when there are DigestMaxMessages
+	// messages (100 by default). The digest is passed to
+	// GetContents as a *message.GroupComposer. Email composers are
+	// always sent immediately.
+	DigestInterval    time.Duration
+	DigestMaxMessages int
 
 	// These options control the output behavior. You must specify
 	// a subject for the emails, *or* one of the bool options that
@@ -137,12 +262,40 @@ type SMTPOptions struct { // nolint
 	MessageAsSubject              bool
 	PlainTextContents             bool
 
-	client   smtpClient
-	fromAddr *mail.Address
-	toAddrs  []*mail.Address
-	mutex    sync.Mutex
+	client    smtpClient
+	connected bool
+	lastUsed  time.Time
+	idleTimer *time.Timer
+	fromAddr  *mail.Address
+	toAddrs   []*mail.Address
+	mutex     sync.Mutex
 }
 
+// SMTPStartTLSPolicy controls the use of STARTTLS by the SMTP sender.
+type SMTPStartTLSPolicy int
+
+const (
+	// SMTPStartTLSNever sends mail without TLS.
+	SMTPStartTLSNever SMTPStartTLSPolicy = iota
+	// SMTPStartTLSOpportunistic uses STARTTLS when the server
+	// advertises it, and sends without TLS otherwise.
+	SMTPStartTLSOpportunistic
+	// SMTPStartTLSRequired fails to send mail when the server does
+	// not support STARTTLS.
+	SMTPStartTLSRequired
+)
+
+// SMTPAuthMechanism names a SASL mechanism for authenticating to an
+// SMTP server.
+type SMTPAuthMechanism string
+
+// The supported SASL mechanisms.
+const (
+	SMTPAuthPlain   SMTPAuthMechanism = "PLAIN"
+	SMTPAuthCRAMMD5 SMTPAuthMechanism = "CRAM-MD5"
+	SMTPAuthXOAUTH2 SMTPAuthMechanism = "XOAUTH2"
+)
+
 // ResetRecipients removes all recipients from the configuration
 // object. You can reset the recipients at any time, but you must have
 // at least one recipient configured when you use this options object to
@@ -218,6 +371,18 @@ func (o *SMTPOptions) Validate() error {
 		o.client = &smtpClientImpl{}
 	}
 
+	if o.UseSSL && o.StartTLS == SMTPStartTLSNever {
+		o.StartTLS = SMTPStartTLSRequired
+	}
+
+	if o.AuthMechanism == "" {
+		o.AuthMechanism = SMTPAuthPlain
+	}
+
+	if o.DigestInterval > 0 && o.DigestMaxMessages <= 0 {
+		o.DigestMaxMessages = 100
+	}
+
 	if o.GetContents == nil {
 		o.PlainTextContents = true
 		o.GetContents = func(opts *SMTPOptions, m message.Composer) (string, string) {
@@ -272,6 +437,28 @@ func (o *SMTPOptions) Validate() error {
 		errs = append(errs, "no recipient addresses defined.")
 	}
 
+	if o.StartTLS < SMTPStartTLSNever || o.StartTLS > SMTPStartTLSRequired {
+		errs = append(errs, fmt.Sprintf("invalid STARTTLS policy %d", o.StartTLS))
+	}
+
+	switch o.AuthMechanism {
+	case SMTPAuthPlain:
+	case SMTPAuthCRAMMD5:
+		if o.Username == "" {
+			errs = append(errs, "CRAM-MD5 authentication requires a username")
+		}
+	case SMTPAuthXOAUTH2:
+		if o.Username == "" || (o.Password == "" && o.TokenSource == nil) {
+			errs = append(errs, "XOAUTH2 authentication requires a username and a token")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported authentication mechanism '%s'", o.AuthMechanism))
+	}
+
+	if o.IdleTimeout < 0 || o.DigestInterval < 0 {
+		errs = append(errs, "timeouts and intervals must not be negative")
+	}
+
 	// put additional pre-flight checks above this line, as needed.
 
 	if len(errs) > 0 {
@@ -287,15 +474,13 @@ func (o *SMTPOptions) sendMail(m message.Composer) error {
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
-	if err := o.client.Create(o); err != nil {
-		return err
-	}
-	defer o.client.Close()
-
-	var subject, body string
+	var subject, body, htmlBody string
 	toAddrs := o.toAddrs
 	fromAddr := o.fromAddr
 	isPlainText := o.PlainTextContents
+	var ccAddrs, bccAddrs []*mail.Address
+	var replyTo *mail.Address
+	var attachments []message.EmailAttachment
 	var headers map[string][]string
 
 	if emailMsg, ok := m.Raw().(*message.Email); ok {
@@ -307,43 +492,121 @@ func (o *SMTPOptions) sendMail(m message.Composer) error {
 			}
 		}
 
-		toAddrs = make([]*mail.Address, len(emailMsg.Recipients))
-
-		for i := range emailMsg.Recipients {
-			toAddrs[i], err = mail.ParseAddress(emailMsg.Recipients[i])
+		if toAddrs, err = parseAddresses(emailMsg.Recipients); err != nil {
+			return fmt.Errorf("invalid recipient: %+v", err)
+		}
+		if ccAddrs, err = parseAddresses(emailMsg.Cc); err != nil {
+			return fmt.Errorf("invalid cc recipient: %+v", err)
+		}
+		if bccAddrs, err = parseAddresses(emailMsg.Bcc); err != nil {
+			return fmt.Errorf("invalid bcc recipient: %+v", err)
+		}
+		if len(emailMsg.ReplyTo) != 0 {
+			replyTo, err = mail.ParseAddress(emailMsg.ReplyTo)
 			if err != nil {
-				return fmt.Errorf("invalid recipient: %+v", err)
+				return fmt.Errorf("invalid reply-to address: %+v", err)
 			}
 		}
 
 		subject = emailMsg.Subject
 		body = emailMsg.Body
-		isPlainText = emailMsg.PlainTextContents
+		htmlBody = emailMsg.HTMLBody
+		isPlainText = emailMsg.PlainTextContents || (body != "" && htmlBody != "")
+		attachments = emailMsg.Attachments
 		headers = emailMsg.Headers
 	}
 	if fromAddr == nil {
 		return fmt.Errorf("no from address specified, cannot send mail")
 	}
-	if len(toAddrs) == 0 {
+	if len(toAddrs)+len(ccAddrs)+len(bccAddrs) == 0 {
 		return fmt.Errorf("no recipients specified, cannot send mail")
 	}
 
+	if len(subject) == 0 && len(body) == 0 && len(htmlBody) == 0 {
+		subject, body = o.GetContents(o, m)
+	}
+
+	// build the body before starting the transaction, so that
+	// errors reading attachments do not leave it incomplete.
+	entity, err := buildEmailBody(body, htmlBody, isPlainText, attachments)
+	if err != nil {
+		return err
+	}
+
+	contents := &bytes.Buffer{}
+	fmt.Fprintf(contents, "From: %s\r\n", fromAddr.String())
+	if len(toAddrs) > 0 {
+		fmt.Fprintf(contents, "To: %s\r\n", formatAddresses(toAddrs))
+	}
+	if len(ccAddrs) > 0 {
+		fmt.Fprintf(contents, "Cc: %s\r\n", formatAddresses(ccAddrs))
+	}
+	if replyTo != nil {
+		fmt.Fprintf(contents, "Reply-To: %s\r\n", replyTo.String())
+	}
+	fmt.Fprintf(contents, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	contents.WriteString("MIME-Version: 1.0\r\n")
+
+	headerNames := make([]string, 0, len(headers))
+	for k := range headers {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+
+	for _, k := range headerNames {
+		switch k {
+		case "To", "From", "Subject", "Content-Transfer-Encoding", "Bcc":
+			continue
+		case "Cc":
+			if len(ccAddrs) > 0 {
+				continue
+			}
+		case "Reply-To":
+			if replyTo != nil {
+				continue
+			}
+		case "Content-Type":
+			// multipart bodies must declare their own boundary
+			if entity.isMultipart() {
+				continue
+			}
+			entity.header.Del("Content-Type")
+		}
+		for _, v := range headers[k] {
+			fmt.Fprintf(contents, "%s: %s\r\n", k, v)
+		}
+	}
+
+	entity.writeTo(contents)
+
+	recipients := make([]*mail.Address, 0, len(toAddrs)+len(ccAddrs)+len(bccAddrs))
+	for _, addrs := range [][]*mail.Address{toAddrs, ccAddrs, bccAddrs} {
+		recipients = append(recipients, addrs...)
+	}
+
+	if err = o.connect(); err != nil {
+		return err
+	}
+	err = o.transact(fromAddr, recipients, contents)
+	o.release(err)
+
+	return err
+}
+
+// transact sends a single message on the current connection.
+func (o *SMTPOptions) transact(fromAddr *mail.Address, recipients []*mail.Address, contents *bytes.Buffer) error {
 	if err := o.client.Mail(fromAddr.Address); err != nil {
 		return fmt.Errorf("error establishing mail sender (%s): %+v", fromAddr, err)
 	}
 
-	var err error
 	var errs []string
-	var recipients []string
 
 	// Set the recipients
-	for _, target := range toAddrs {
-		if err = o.client.Rcpt(target.Address); err != nil {
+	for _, target := range recipients {
+		if err := o.client.Rcpt(target.Address); err != nil {
 			errs = append(errs,
 				fmt.Sprintf("Error establishing mail recipient (%s): %+v", target.String(), err))
-			continue
 		}
-		recipients = append(recipients, target.String())
 	}
 	if len(errs) > 0 {
 		return errors.New(strings.Join(errs, "; "))
@@ -354,47 +617,101 @@ func (o *SMTPOptions) sendMail(m message.Composer) error {
 	if err != nil {
 		return err
 	}
-	defer wc.Close()
 
-	if len(subject) == 0 && len(body) == 0 {
-		subject, body = o.GetContents(o, m)
+	// write the body
+	if _, err = contents.WriteTo(wc); err != nil {
+		_ = wc.Close()
+		return err
 	}
 
-	contents := []string{
-		fmt.Sprintf("From: %s", fromAddr.String()),
-		fmt.Sprintf("To: %s", strings.Join(recipients, ", ")),
-		fmt.Sprintf("Subject: %s", subject),
-		"MIME-Version: 1.0",
-	}
+	// the server accepts or rejects the message when the data is closed
+	return wc.Close()
+}
 
-	skipContentType := false
-	for k, v := range headers {
-		if k == "To" || k == "From" || k == "Subject" || k == "Content-Transfer-Encoding" {
-			continue
-		}
-		if k == "Content-Type" {
-			skipContentType = true
-		}
-		for i := range v {
-			contents = append(contents, fmt.Sprintf("%s: %s", k, v[i]))
+// connect reuses the open connection, if the server accepts a reset,
+// or opens a new connection.
+func (o *SMTPOptions) connect() error {
+	if o.connected {
+		if err := o.client.Reset(); err == nil {
+			return nil
 		}
+		o.closeConnection()
 	}
 
-	if !skipContentType {
-		if isPlainText {
-			contents = append(contents, "Content-Type: text/plain; charset=\"utf-8\"")
-		} else {
-			contents = append(contents, "Content-Type: text/html; charset=\"utf-8\"")
+	if err := o.client.Create(o); err != nil {
+		return err
+	}
+	o.connected = true
+
+	return nil
+}
+
+// release keeps the connection open for reuse if the sender has an
+// idle timeout and the last message was sent successfully, and closes
+// it otherwise.
+func (o *SMTPOptions) release(err error) {
+	if err != nil || o.IdleTimeout <= 0 {
+		o.closeConnection()
+		return
+	}
+
+	o.lastUsed = time.Now()
+	if o.idleTimer == nil {
+		o.idleTimer = time.AfterFunc(o.IdleTimeout, o.closeIdle)
+	} else {
+		o.idleTimer.Reset(o.IdleTimeout)
+	}
+}
+
+func (o *SMTPOptions) closeIdle() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// the timer may fire while a message is being sent, after which
+	// the timer is reset.
+	if o.connected && time.Since(o.lastUsed) >= o.IdleTimeout {
+		o.closeConnection()
+	}
+}
+
+// disconnect closes the connection to the server, if it is open.
+func (o *SMTPOptions) disconnect() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.closeConnection()
+}
+
+func (o *SMTPOptions) closeConnection() {
+	if o.idleTimer != nil {
+		o.idleTimer.Stop()
+	}
+
+	if o.connected {
+		_ = o.client.Close()
+		o.connected = false
+	}
+}
+
+func parseAddresses(addrs []string) ([]*mail.Address, error) {
+	out := make([]*mail.Address, len(addrs))
+	for i := range addrs {
+		var err error
+		if out[i], err = mail.ParseAddress(addrs[i]); err != nil {
+			return nil, err
 		}
 	}
 
-	contents = append(contents,
-		"Content-Transfer-Encoding: base64",
-		base64.StdEncoding.EncodeToString([]byte(body)))
+	return out, nil
+}
 
-	// write the body
-	_, err = bytes.NewBufferString(strings.Join(contents, "\r\n")).WriteTo(wc)
-	return err
+func formatAddresses(addrs []*mail.Address) string {
+	out := make([]string, len(addrs))
+	for i := range addrs {
+		out[i] = addrs[i].String()
+	}
+
+	return strings.Join(out, ", ")
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -408,6 +725,7 @@ type smtpClient interface {
 	Mail(string) error
 	Rcpt(string) error
 	Data() (io.WriteCloser, error)
+	Reset() error
 	Close() error
 }
 
@@ -422,25 +740,52 @@ func (c *smtpClientImpl) Create(opts *SMTPOptions) error {
 		return err
 	}
 
-	if opts.UseSSL {
-		config := &tls.Config{ServerName: opts.Server}
-		err = c.Client.StartTLS(config)
+	if err = c.setup(opts); err != nil {
+		_ = c.Client.Close()
+		return err
+	}
 
-	} else {
-		var hostname string
-		hostname, err = os.Hostname()
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		err = c.Hello(hostname)
-	}
+func (c *smtpClientImpl) setup(opts *SMTPOptions) error {
+	hostname, err := os.Hostname()
 	if err != nil {
 		return err
 	}
 
+	if err = c.Hello(hostname); err != nil {
+		return err
+	}
+
+	if opts.StartTLS != SMTPStartTLSNever {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && opts.StartTLS == SMTPStartTLSRequired {
+			return fmt.Errorf("server %s does not support STARTTLS", opts.Server)
+		}
+
+		if ok {
+			config := &tls.Config{}
+			if opts.TLSConfig != nil {
+				config = opts.TLSConfig.Clone()
+			}
+			if config.ServerName == "" {
+				config.ServerName = opts.Server
+			}
+
+			if err = c.Client.StartTLS(config); err != nil {
+				return err
+			}
+		}
+	}
+
 	if opts.Username != "" {
-		if err = c.Client.Auth(smtp.PlainAuth("", opts.Username, opts.Password, opts.Server)); err != nil {
+		auth, err := opts.auth()
+		if err != nil {
+			return err
+		}
+
+		if err = c.Client.Auth(auth); err != nil {
 			return err
 		}
 	}
@@ -448,6 +793,63 @@ func (c *smtpClientImpl) Create(opts *SMTPOptions) error {
 	return nil
 }
 
+// Close ends the session with the server, and closes the connection
+// even if the server does not respond.
 func (c *smtpClientImpl) Close() error {
-	return c.Client.Close()
+	if err := c.Client.Quit(); err != nil {
+		return c.Client.Close()
+	}
+
+	return nil
+}
+
+func (o *SMTPOptions) auth() (smtp.Auth, error) {
+	switch o.AuthMechanism {
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(o.Username, o.Password), nil
+	case SMTPAuthXOAUTH2:
+		token := o.Password
+		if o.TokenSource != nil {
+			var err error
+			if token, err = o.TokenSource(); err != nil {
+				return nil, fmt.Errorf("getting XOAUTH2 token: %w", err)
+			}
+		}
+
+		return &xoauth2Auth{username: o.Username, token: token}, nil
+	default:
+		return smtp.PlainAuth("", o.Username, o.Password, o.Server), nil
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 SASL mechanism, used by Gmail and
+// Office 365, which authenticates with an OAuth 2.0 bearer token.
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// the token grants access like a password, so, as with PLAIN,
+	// only send it over TLS or to the local host.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	return string(SMTPAuthXOAUTH2), []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.username, a.token)), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sends a JSON error description in response to
+		// invalid credentials, and expects an empty response before
+		// failing the authentication.
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
 }
@@ -0,0 +1,197 @@
+package send
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cdr.dev/grip/message"
+)
+
+// mimeEntity is a MIME body with its content headers, which is
+// either the whole body of an email or a part of a multipart body.
+type mimeEntity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (e mimeEntity) isMultipart() bool {
+	mt, _, _ := mime.ParseMediaType(e.header.Get("Content-Type"))
+	return strings.HasPrefix(mt, "multipart/")
+}
+
+// writeTo writes the content headers, in a stable order, followed by
+// the body.
+func (e mimeEntity) writeTo(buf *bytes.Buffer) {
+	keys := make([]string, 0, len(e.header))
+	for k := range e.header {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		// the content type leads, as in the other headers we write.
+		if keys[i] == "Content-Type" || keys[j] == "Content-Type" {
+			return keys[i] == "Content-Type"
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, k := range keys {
+		for _, v := range e.header[k] {
+			fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(e.body)
+}
+
+// buildEmailBody assembles the body of an email from the text and
+// HTML contents and the attachments. The structure is, omitting any
+// parts that are not needed:
+//
+//	multipart/mixed
+//		multipart/alternative
+//			text/plain
+//			multipart/related
+//				text/html
+//				inline attachments
+//		attachments
+//
+// When there is no HTML content, the text is sent as HTML unless
+// plainText is set, for compatibility with single bodies.
+func buildEmailBody(text, html string, plainText bool, attachments []message.EmailAttachment) (mimeEntity, error) {
+	if html == "" && !plainText {
+		text, html = "", text
+	}
+
+	var inline, attached []mimeEntity
+	for _, a := range attachments {
+		part, err := attachmentEntity(a)
+		if err != nil {
+			return mimeEntity{}, err
+		}
+
+		if a.Inline && html != "" {
+			inline = append(inline, part)
+		} else {
+			attached = append(attached, part)
+		}
+	}
+
+	var alternatives []mimeEntity
+	if text != "" || html == "" {
+		alternatives = append(alternatives, textEntity("text/plain", text))
+	}
+	if html != "" {
+		htmlPart := textEntity("text/html", html)
+		if len(inline) > 0 {
+			htmlPart = multipartEntity("related", append([]mimeEntity{htmlPart}, inline...))
+		}
+		alternatives = append(alternatives, htmlPart)
+	}
+
+	body := alternatives[0]
+	if len(alternatives) > 1 {
+		body = multipartEntity("alternative", alternatives)
+	}
+
+	if len(attached) > 0 {
+		body = multipartEntity("mixed", append([]mimeEntity{body}, attached...))
+	}
+
+	return body, nil
+}
+
+func textEntity(contentType, content string) mimeEntity {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"}))
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	return mimeEntity{header: header, body: encodeBase64Lines([]byte(content))}
+}
+
+func attachmentEntity(a message.EmailAttachment) (mimeEntity, error) {
+	if err := a.Validate(); err != nil {
+		return mimeEntity{}, err
+	}
+
+	data := a.Data
+	if len(data) == 0 {
+		var err error
+		if data, err = os.ReadFile(a.Path); err != nil {
+			return mimeEntity{}, fmt.Errorf("reading attachment: %w", err)
+		}
+	}
+
+	name := a.Filename
+	if name == "" {
+		name = filepath.Base(a.Path)
+	}
+
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return mimeEntity{}, fmt.Errorf("invalid content type for attachment '%s': %w", name, err)
+	}
+	params["name"] = name
+
+	disposition := "attachment"
+	if a.Inline {
+		disposition = "inline"
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	header.Set("Content-Transfer-Encoding", "base64")
+	if a.ContentID != "" {
+		header.Set("Content-ID", fmt.Sprintf("<%s>", a.ContentID))
+	}
+
+	return mimeEntity{header: header, body: encodeBase64Lines(data)}, nil
+}
+
+func multipartEntity(subtype string, parts []mimeEntity) mimeEntity {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for _, p := range parts {
+		// writes to a bytes.Buffer do not fail
+		w, _ := mw.CreatePart(p.header)
+		_, _ = w.Write(p.body)
+	}
+	_ = mw.Close()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mw.Boundary()}))
+
+	return mimeEntity{header: header, body: buf.Bytes()}
+}
+
+// encodeBase64Lines encodes the data in base64, in lines of 76
+// characters as required by RFC 2045.
+func encodeBase64Lines(data []byte) []byte {
+	const lineLength = 76
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	buf := bytes.NewBuffer(make([]byte, 0, len(encoded)+2*(len(encoded)/lineLength+1)))
+	for len(encoded) > lineLength {
+		buf.WriteString(encoded[:lineLength])
+		buf.WriteString("\r\n")
+		encoded = encoded[lineLength:]
+	}
+	buf.WriteString(encoded)
+
+	return buf.Bytes()
+}
@@ -1,9 +1,15 @@
 package send
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"strings"
+	"sync"
 )
 
 type bufferCloser struct {
@@ -15,23 +21,36 @@ func (bufferCloser) Close() error {
 }
 
 type smtpClientMock struct {
+	mu         sync.Mutex
 	failCreate bool
 	failMail   bool
 	failRcpt   bool
 	failData   bool
+	failReset  bool
 	message    bufferCloser
 	numMsgs    int
+	numCreates int
+	numResets  int
+	numCloses  int
+	rcpts      []string
 }
 
 func (c *smtpClientMock) Create(opts *SMTPOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.failCreate {
 		return errors.New("failed creation")
 	}
+	c.numCreates++
 
 	return nil
 }
 
 func (c *smtpClientMock) Mail(to string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.failMail {
 		return errors.New("failed to send mail")
 	}
@@ -40,14 +59,21 @@ func (c *smtpClientMock) Mail(to string) error {
 }
 
 func (c *smtpClientMock) Rcpt(addr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.failRcpt {
 		return errors.New("fail recpt")
 	}
+	c.rcpts = append(c.rcpts, addr)
 
 	return nil
 }
 
 func (c *smtpClientMock) Data() (io.WriteCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.failData {
 		return nil, errors.New("failed data")
 	}
@@ -57,6 +83,92 @@ func (c *smtpClientMock) Data() (io.WriteCloser, error) {
 	return c.message, nil
 }
 
+func (c *smtpClientMock) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.numResets++
+	if c.failReset {
+		return errors.New("failed reset")
+	}
+
+	return nil
+}
+
 func (c *smtpClientMock) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.numCloses++
 	return nil
 }
+
+func (c *smtpClientMock) sent() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.numMsgs
+}
+
+func (c *smtpClientMock) lastMessage() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.message.String()
+}
+
+// smtpServerMock is a minimal SMTP server, which advertises the
+// extensions, records the AUTH exchange, and accepts the credentials.
+type smtpServerMock struct {
+	extensions []string
+	auth       []string
+}
+
+func (srv *smtpServerMock) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for i, line := range lines {
+			sep := "-"
+			if i == len(lines)-1 {
+				sep = " "
+			}
+			fmt.Fprintf(conn, "%s%s%s\r\n", line[:3], sep, line[3:])
+		}
+	}
+
+	reply("220localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.Fields(strings.TrimSpace(line))
+		if len(cmd) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(cmd[0]) {
+		case "EHLO":
+			lines := []string{"250localhost"}
+			for _, ext := range srv.extensions {
+				lines = append(lines, "250"+ext)
+			}
+			reply(lines...)
+		case "AUTH":
+			srv.auth = append(srv.auth, cmd[1:]...)
+			if cmd[1] == "CRAM-MD5" {
+				reply("334" + base64.StdEncoding.EncodeToString([]byte("<challenge@localhost>")))
+				resp, _ := r.ReadString('\n')
+				srv.auth = append(srv.auth, strings.TrimSpace(resp))
+			}
+			reply("235ok")
+		case "QUIT":
+			reply("221bye")
+			return
+		default:
+			reply("250ok")
+		}
+	}
+}
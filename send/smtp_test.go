@@ -1,10 +1,23 @@
 package send
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"cdr.dev/grip/level"
 	"cdr.dev/grip/message"
@@ -322,3 +335,438 @@ func (s *SMTPSuite) TestSendMethodWithEmailComposerOverridesSMTPOptions() {
 		s.Contains(data, contains[i])
 	}
 }
+
+func (s *SMTPSuite) sendEmail(e message.Email) (*mail.Message, *smtpClientMock) {
+	mock := &smtpClientMock{}
+	s.opts.client = mock
+
+	m := message.NewEmailMessage(level.Notice, e)
+	s.Require().True(m.Loggable())
+	s.Require().NoError(s.opts.sendMail(m))
+	s.Require().Equal(1, mock.numMsgs)
+
+	msg, err := mail.ReadMessage(strings.NewReader(mock.message.String()))
+	s.Require().NoError(err)
+
+	return msg, mock
+}
+
+type mimeTestPart struct {
+	Header textproto.MIMEHeader
+	Body   string
+}
+
+func (s *SMTPSuite) readParts(contentType string, body io.Reader) (string, []mimeTestPart) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	s.Require().NoError(err)
+	s.Require().True(strings.HasPrefix(mediaType, "multipart/"), mediaType)
+
+	var parts []mimeTestPart
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		s.Require().NoError(err)
+
+		data, err := io.ReadAll(p)
+		s.Require().NoError(err)
+		parts = append(parts, mimeTestPart{Header: p.Header, Body: string(data)})
+	}
+
+	return mediaType, parts
+}
+
+func (s *SMTPSuite) readNestedParts(p mimeTestPart) (string, []mimeTestPart) {
+	return s.readParts(p.Header.Get("Content-Type"), strings.NewReader(p.Body))
+}
+
+func (s *SMTPSuite) decodePart(p mimeTestPart) string {
+	s.Equal("base64", p.Header.Get("Content-Transfer-Encoding"))
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(p.Body, "\r\n", ""))
+	s.Require().NoError(err)
+	return string(data)
+}
+
+func (p mimeTestPart) filename() string {
+	_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	return params["filename"]
+}
+
+func (s *SMTPSuite) TestSendMailWithAlternativeBodies() {
+	msg, mock := s.sendEmail(message.Email{
+		From:       "from@example.com",
+		Recipients: []string{"to@example.com"},
+		Cc:         []string{"Copy <cc@example.com>"},
+		Bcc:        []string{"hidden@example.com"},
+		ReplyTo:    "replies@example.com",
+		Subject:    "Résumé",
+		Body:       "plain text",
+		HTMLBody:   "<p>html</p>",
+		Headers: map[string][]string{
+			"Content-Type": []string{"text/plain"},
+			"Bcc":          []string{"leaked@example.com"},
+		},
+	})
+
+	s.Equal([]string{"to@example.com", "cc@example.com", "hidden@example.com"}, mock.rcpts)
+	s.Equal("<to@example.com>", msg.Header.Get("To"))
+	s.Equal(`"Copy" <cc@example.com>`, msg.Header.Get("Cc"))
+	s.Equal("<replies@example.com>", msg.Header.Get("Reply-To"))
+	s.Empty(msg.Header.Get("Bcc"))
+	s.NotContains(mock.message.String(), "hidden@example.com")
+	s.NotContains(mock.message.String(), "leaked@example.com")
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	s.NoError(err)
+	s.Equal("Résumé", subject)
+
+	mediaType, parts := s.readParts(msg.Header.Get("Content-Type"), msg.Body)
+	s.Equal("multipart/alternative", mediaType)
+	s.Require().Len(parts, 2)
+	s.Equal(`text/plain; charset=utf-8`, parts[0].Header.Get("Content-Type"))
+	s.Equal("plain text", s.decodePart(parts[0]))
+	s.Equal(`text/html; charset=utf-8`, parts[1].Header.Get("Content-Type"))
+	s.Equal("<p>html</p>", s.decodePart(parts[1]))
+}
+
+func (s *SMTPSuite) TestSendMailWithAttachments() {
+	dir := s.T().TempDir()
+	path := filepath.Join(dir, "report.csv")
+	s.Require().NoError(os.WriteFile(path, []byte("a,b\n1,2\n"), 0600))
+	large := bytes.Repeat([]byte{0xff, 0x00, 0x7f}, 100)
+
+	msg, _ := s.sendEmail(message.Email{
+		Recipients: []string{"to@example.com"},
+		Subject:    "attachments",
+		Body:       "see attached",
+		HTMLBody:   `<img src="cid:logo">`,
+		Attachments: []message.EmailAttachment{
+			{Path: path},
+			{Filename: "data.bin", Data: large},
+			{Filename: "logo.png", Data: []byte("png"), Inline: true, ContentID: "logo"},
+		},
+	})
+
+	mediaType, parts := s.readParts(msg.Header.Get("Content-Type"), msg.Body)
+	s.Equal("multipart/mixed", mediaType)
+	s.Require().Len(parts, 3)
+
+	mediaType, alternatives := s.readNestedParts(parts[0])
+	s.Equal("multipart/alternative", mediaType)
+	s.Require().Len(alternatives, 2)
+	s.Equal("see attached", s.decodePart(alternatives[0]))
+
+	mediaType, related := s.readNestedParts(alternatives[1])
+	s.Equal("multipart/related", mediaType)
+	s.Require().Len(related, 2)
+	s.Equal(`<img src="cid:logo">`, s.decodePart(related[0]))
+	s.Equal("<logo>", related[1].Header.Get("Content-ID"))
+	s.Equal("inline", strings.SplitN(related[1].Header.Get("Content-Disposition"), ";", 2)[0])
+	s.Equal("image/png", strings.SplitN(related[1].Header.Get("Content-Type"), ";", 2)[0])
+	s.Equal("png", s.decodePart(related[1]))
+
+	s.Equal("report.csv", parts[1].filename())
+	s.Equal("a,b\n1,2\n", s.decodePart(parts[1]))
+
+	s.Equal("data.bin", parts[2].filename())
+	s.Equal("application/octet-stream; name=data.bin", parts[2].Header.Get("Content-Type"))
+	for _, line := range strings.Split(parts[2].Body, "\r\n") {
+		s.True(len(line) <= 76)
+	}
+	s.Equal(string(large), s.decodePart(parts[2]))
+}
+
+func (s *SMTPSuite) TestSendMailWithMissingAttachmentFails() {
+	mock := &smtpClientMock{}
+	s.opts.client = mock
+
+	m := message.NewEmailMessage(level.Notice, message.Email{
+		Recipients:  []string{"to@example.com"},
+		Subject:     "attachments",
+		Body:        "see attached",
+		Attachments: []message.EmailAttachment{{Path: filepath.Join(s.T().TempDir(), "missing")}},
+	})
+	s.Error(s.opts.sendMail(m))
+	s.Equal(0, mock.numMsgs)
+}
+
+func (s *SMTPSuite) TestSendMailWithTemplate() {
+	tmpl, err := message.ParseEmailTemplate("{{.service}} failed", "{{.service}}: {{.error}}", "<b>{{.service}}</b>: {{.error}}")
+	s.Require().NoError(err)
+
+	mock := &smtpClientMock{}
+	s.opts.client = mock
+	m := message.NewEmailTemplateMessage(level.Error, message.Email{Recipients: []string{"to@example.com"}}, tmpl,
+		message.Fields{"service": "api", "error": "<timeout>"})
+	s.Require().True(m.Loggable())
+	s.Require().NoError(s.opts.sendMail(m))
+
+	msg, err := mail.ReadMessage(strings.NewReader(mock.message.String()))
+	s.Require().NoError(err)
+	s.Equal("api failed", msg.Header.Get("Subject"))
+
+	_, parts := s.readParts(msg.Header.Get("Content-Type"), msg.Body)
+	s.Require().Len(parts, 2)
+	s.Equal("api: <timeout>", s.decodePart(parts[0]))
+	s.Equal("<b>api</b>: &lt;timeout&gt;", s.decodePart(parts[1]))
+}
+
+func (s *SMTPSuite) TestOptionsValidateAuthAndTLS() {
+	opts := func() *SMTPOptions {
+		return &SMTPOptions{
+			Name:    "sender",
+			Subject: "subject",
+			client:  &smtpClientMock{},
+			toAddrs: []*mail.Address{{Address: "one@example.com"}},
+		}
+	}
+
+	o := opts()
+	o.UseSSL = true
+	s.NoError(o.Validate())
+	s.Equal(SMTPStartTLSRequired, o.StartTLS)
+	s.Equal(SMTPAuthPlain, o.AuthMechanism)
+
+	o = opts()
+	o.DigestInterval = time.Minute
+	s.NoError(o.Validate())
+	s.Equal(100, o.DigestMaxMessages)
+
+	for _, mutate := range []func(*SMTPOptions){
+		func(o *SMTPOptions) { o.StartTLS = 42 },
+		func(o *SMTPOptions) { o.AuthMechanism = "LOGIN" },
+		func(o *SMTPOptions) { o.AuthMechanism = SMTPAuthCRAMMD5 },
+		func(o *SMTPOptions) { o.AuthMechanism, o.Username = SMTPAuthXOAUTH2, "user" },
+		func(o *SMTPOptions) { o.IdleTimeout = -time.Second },
+		func(o *SMTPOptions) { o.DigestInterval = -time.Second },
+	} {
+		o = opts()
+		mutate(o)
+		s.Error(o.Validate())
+	}
+
+	o = opts()
+	o.AuthMechanism, o.Username = SMTPAuthXOAUTH2, "user"
+	o.TokenSource = func() (string, error) { return "token", nil }
+	s.NoError(o.Validate())
+}
+
+func (s *SMTPSuite) setupClient(srv *smtpServerMock, opts *SMTPOptions) error {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.serve(server)
+	}()
+
+	c, err := smtp.NewClient(client, "localhost")
+	s.Require().NoError(err)
+	impl := &smtpClientImpl{Client: c}
+
+	err = impl.setup(opts)
+	s.NoError(impl.Close())
+	<-done
+
+	return err
+}
+
+func (s *SMTPSuite) TestClientSetup() {
+	s.Run("StartTLSRequired", func() {
+		s.opts.StartTLS = SMTPStartTLSRequired
+		err := s.setupClient(&smtpServerMock{}, s.opts)
+		s.Require().Error(err)
+		s.Contains(err.Error(), "STARTTLS")
+	})
+	s.Run("StartTLSOpportunistic", func() {
+		s.opts.StartTLS = SMTPStartTLSOpportunistic
+		s.NoError(s.setupClient(&smtpServerMock{}, s.opts))
+	})
+	s.Run("Plain", func() {
+		s.opts.StartTLS = SMTPStartTLSNever
+		s.opts.Server = "localhost"
+		s.opts.Username, s.opts.Password = "user", "pass"
+		s.opts.AuthMechanism = SMTPAuthPlain
+
+		srv := &smtpServerMock{extensions: []string{"AUTH PLAIN"}}
+		s.NoError(s.setupClient(srv, s.opts))
+		s.Require().Len(srv.auth, 2)
+		s.Equal("PLAIN", srv.auth[0])
+		s.Equal(base64.StdEncoding.EncodeToString([]byte("\x00user\x00pass")), srv.auth[1])
+	})
+	s.Run("CRAMMD5", func() {
+		s.opts.Username, s.opts.Password = "user", "pass"
+		s.opts.AuthMechanism = SMTPAuthCRAMMD5
+
+		srv := &smtpServerMock{extensions: []string{"AUTH CRAM-MD5"}}
+		s.NoError(s.setupClient(srv, s.opts))
+		s.Require().Len(srv.auth, 2)
+		s.Equal("CRAM-MD5", srv.auth[0])
+		resp, err := base64.StdEncoding.DecodeString(srv.auth[1])
+		s.NoError(err)
+		s.True(strings.HasPrefix(string(resp), "user "))
+	})
+	s.Run("XOAUTH2", func() {
+		s.opts.Server = "localhost"
+		s.opts.Username, s.opts.Password = "user@example.com", ""
+		s.opts.AuthMechanism = SMTPAuthXOAUTH2
+		s.opts.TokenSource = func() (string, error) { return "fresh-token", nil }
+
+		srv := &smtpServerMock{extensions: []string{"AUTH XOAUTH2"}}
+		s.NoError(s.setupClient(srv, s.opts))
+		s.Require().Len(srv.auth, 2)
+		s.Equal("XOAUTH2", srv.auth[0])
+		s.Equal(base64.StdEncoding.EncodeToString([]byte("user=user@example.com\x01auth=Bearer fresh-token\x01\x01")), srv.auth[1])
+
+		s.opts.TokenSource = func() (string, error) { return "", errors.New("expired") }
+		s.Error(s.setupClient(&smtpServerMock{extensions: []string{"AUTH XOAUTH2"}}, s.opts))
+	})
+	s.Run("XOAUTH2RequiresTLS", func() {
+		auth := &xoauth2Auth{username: "user", token: "token"}
+		_, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"})
+		s.Error(err)
+
+		mech, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+		s.NoError(err)
+		s.Equal("XOAUTH2", mech)
+
+		resp, err := auth.Next([]byte(`{"status":"401"}`), true)
+		s.NoError(err)
+		s.Empty(resp)
+	})
+}
+
+func (s *SMTPSuite) TestConnectionReuse() {
+	mock := &smtpClientMock{}
+	s.opts.client = mock
+	s.opts.IdleTimeout = time.Hour
+
+	m := message.NewString("hello world!")
+	for i := 0; i < 3; i++ {
+		s.NoError(s.opts.sendMail(m))
+	}
+	s.Equal(3, mock.numMsgs)
+	s.Equal(1, mock.numCreates)
+	s.Equal(2, mock.numResets)
+	s.Equal(0, mock.numCloses)
+
+	// a connection that fails to reset is replaced
+	mock.failReset = true
+	s.NoError(s.opts.sendMail(m))
+	s.Equal(2, mock.numCreates)
+	s.Equal(1, mock.numCloses)
+	mock.failReset = false
+
+	// errors close the connection
+	mock.failData = true
+	s.Error(s.opts.sendMail(m))
+	s.Equal(2, mock.numCloses)
+	mock.failData = false
+	s.NoError(s.opts.sendMail(m))
+	s.Equal(3, mock.numCreates)
+
+	s.opts.disconnect()
+	s.Equal(3, mock.numCloses)
+	s.opts.disconnect()
+	s.Equal(3, mock.numCloses)
+}
+
+func (s *SMTPSuite) TestConnectionClosedWithoutIdleTimeout() {
+	mock := &smtpClientMock{}
+	s.opts.client = mock
+
+	m := message.NewString("hello world!")
+	s.NoError(s.opts.sendMail(m))
+	s.NoError(s.opts.sendMail(m))
+	s.Equal(2, mock.numCreates)
+	s.Equal(2, mock.numCloses)
+	s.Equal(0, mock.numResets)
+}
+
+func (s *SMTPSuite) TestIdleConnectionCloses() {
+	mock := &smtpClientMock{}
+	s.opts.client = mock
+	s.opts.IdleTimeout = 10 * time.Millisecond
+
+	s.NoError(s.opts.sendMail(message.NewString("hello world!")))
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		s.opts.mutex.Lock()
+		connected := s.opts.connected
+		s.opts.mutex.Unlock()
+		if !connected {
+			break
+		}
+	}
+
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	s.Equal(1, mock.numCloses)
+}
+
+func (s *SMTPSuite) TestDigest() {
+	s.Run("MaxMessages", func() {
+		mock := &smtpClientMock{}
+		s.opts.client = mock
+		s.opts.DigestInterval = time.Hour
+		s.opts.DigestMaxMessages = 3
+
+		sender, err := NewSMTPLogger(s.opts, LevelInfo{level.Trace, level.Info})
+		s.Require().NoError(err)
+
+		sender.Send(message.NewDefaultMessage(level.Info, "one"))
+		sender.Send(message.NewDefaultMessage(level.Debug, "filtered"))
+		sender.Send(message.NewDefaultMessage(level.Error, "two"))
+		s.Equal(0, mock.sent())
+		sender.Send(message.NewDefaultMessage(level.Info, "three"))
+		s.Equal(1, mock.sent())
+
+		body := decodeSingleBody(s, mock.lastMessage())
+		s.Equal("one\ntwo\nthree", body)
+
+		// emails are not part of a digest
+		sender.Send(message.NewEmailMessage(level.Info, message.Email{
+			Recipients: []string{"to@example.com"},
+			Subject:    "direct",
+			Body:       "body",
+		}))
+		s.Equal(2, mock.sent())
+
+		sender.Send(message.NewDefaultMessage(level.Info, "flushed"))
+		s.NoError(sender.Flush(context.Background()))
+		s.Equal(3, mock.sent())
+		s.NoError(sender.Flush(context.Background()))
+		s.Equal(3, mock.sent())
+
+		sender.Send(message.NewDefaultMessage(level.Info, "closed"))
+		s.NoError(sender.Close())
+		s.Equal(4, mock.sent())
+		s.Equal("closed", decodeSingleBody(s, mock.lastMessage()))
+	})
+	s.Run("Interval", func() {
+		mock := &smtpClientMock{}
+		s.opts.client = mock
+		s.opts.DigestInterval = 10 * time.Millisecond
+		s.opts.DigestMaxMessages = 0
+
+		sender, err := NewSMTPLogger(s.opts, LevelInfo{level.Trace, level.Info})
+		s.Require().NoError(err)
+		defer sender.Close()
+
+		sender.Send(message.NewDefaultMessage(level.Info, "one"))
+		sender.Send(message.NewDefaultMessage(level.Info, "two"))
+		for start := time.Now(); time.Since(start) < 5*time.Second && mock.sent() == 0; {
+			time.Sleep(time.Millisecond)
+		}
+		s.Equal(1, mock.sent())
+		s.Equal("one\ntwo", decodeSingleBody(s, mock.lastMessage()))
+	})
+}
+
+func decodeSingleBody(s *SMTPSuite, raw string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	s.Require().NoError(err)
+	data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, msg.Body))
+	s.Require().NoError(err)
+	return string(data)
+}
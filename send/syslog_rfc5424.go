@@ -0,0 +1,416 @@
+package send
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/grip/message"
+)
+
+// SyslogFacility is the facility of a syslog message, as defined in
+// RFC 5424.
+type SyslogFacility int
+
+// The syslog facilities.
+const (
+	SyslogFacilityKern SyslogFacility = iota
+	SyslogFacilityUser
+	SyslogFacilityMail
+	SyslogFacilityDaemon
+	SyslogFacilityAuth
+	SyslogFacilitySyslog
+	SyslogFacilityLPR
+	SyslogFacilityNews
+	SyslogFacilityUUCP
+	SyslogFacilityCron
+	SyslogFacilityAuthPriv
+	SyslogFacilityFTP
+	_
+	_
+	_
+	_
+	SyslogFacilityLocal0
+	SyslogFacilityLocal1
+	SyslogFacilityLocal2
+	SyslogFacilityLocal3
+	SyslogFacilityLocal4
+	SyslogFacilityLocal5
+	SyslogFacilityLocal6
+	SyslogFacilityLocal7
+)
+
+// DefaultSyslogStructuredDataID is the SD-ID used for the fields of
+// structured messages, which uses the enterprise number reserved for
+// documentation.
+const DefaultSyslogStructuredDataID = "fields@32473"
+
+// SyslogOptions configures an RFC 5424 syslog sender.
+type SyslogOptions struct {
+	// Network is "udp", "tcp", or "tls". Messages are sent one per
+	// datagram over UDP, and with octet-counting framing over TCP
+	// and TLS, as described in RFC 6587 and RFC 5425.
+	Network string `bson:"network" json:"network" yaml:"network"`
+	Address string `bson:"address" json:"address" yaml:"address"`
+	// TLSConfig configures TLS connections. The server name
+	// defaults to the host of the Address.
+	TLSConfig *tls.Config `bson:"-" json:"-" yaml:"-"`
+
+	// Facility defaults to user, as the zero value is the kernel
+	// facility, which is reserved for the kernel. Hostname defaults
+	// to the name of the host, AppName to the name of the sender,
+	// and ProcID to the process ID.
+	Facility SyslogFacility `bson:"facility" json:"facility" yaml:"facility"`
+	Hostname string         `bson:"hostname" json:"hostname" yaml:"hostname"`
+	AppName  string         `bson:"app_name" json:"app_name" yaml:"app_name"`
+	ProcID   string         `bson:"proc_id" json:"proc_id" yaml:"proc_id"`
+
+	// MsgID identifies the type of the messages. If MsgIDField is
+	// set, the value of that field of structured messages takes
+	// precedence.
+	MsgID      string `bson:"msg_id" json:"msg_id" yaml:"msg_id"`
+	MsgIDField string `bson:"msg_id_field" json:"msg_id_field" yaml:"msg_id_field"`
+
+	// StructuredDataID is the SD-ID of the STRUCTURED-DATA element
+	// that holds the fields of structured messages, and defaults
+	// to DefaultSyslogStructuredDataID.
+	StructuredDataID string `bson:"structured_data_id" json:"structured_data_id" yaml:"structured_data_id"`
+
+	// MaxMessageSize limits the size of UDP messages, which are
+	// truncated, and defaults to 2048 bytes.
+	MaxMessageSize int `bson:"max_message_size" json:"max_message_size" yaml:"max_message_size"`
+
+	// DialTimeout and WriteTimeout default to 5 seconds. After a
+	// failed connection attempt, the sender reports errors without
+	// reconnecting for ReconnectInterval, which defaults to 1 second.
+	DialTimeout       time.Duration `bson:"dial_timeout" json:"dial_timeout" yaml:"dial_timeout"`
+	WriteTimeout      time.Duration `bson:"write_timeout" json:"write_timeout" yaml:"write_timeout"`
+	ReconnectInterval time.Duration `bson:"reconnect_interval" json:"reconnect_interval" yaml:"reconnect_interval"`
+}
+
+// Validate checks the options, and sets defaults for unset values.
+func (opts *SyslogOptions) Validate() error {
+	if opts == nil {
+		return errors.New("must specify non-nil syslog options")
+	}
+
+	errs := []string{}
+
+	switch opts.Network {
+	case "udp", "tcp", "tls":
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported network '%s'", opts.Network))
+	}
+
+	if opts.Address == "" {
+		errs = append(errs, "must specify an address")
+	}
+
+	if opts.Facility == SyslogFacilityKern {
+		opts.Facility = SyslogFacilityUser
+	}
+	if opts.Facility < SyslogFacilityKern || opts.Facility > SyslogFacilityLocal7 {
+		errs = append(errs, fmt.Sprintf("invalid facility %d", opts.Facility))
+	}
+
+	if opts.StructuredDataID == "" {
+		opts.StructuredDataID = DefaultSyslogStructuredDataID
+	}
+	if opts.StructuredDataID != syslogSDName(opts.StructuredDataID) {
+		errs = append(errs, fmt.Sprintf("invalid structured data id '%s'", opts.StructuredDataID))
+	}
+
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = 2048
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+	if opts.ReconnectInterval == 0 {
+		opts.ReconnectInterval = time.Second
+	}
+
+	if opts.MaxMessageSize < 480 {
+		// RFC 5426 requires receivers to accept 480 byte messages.
+		errs = append(errs, "max message size must be at least 480 bytes")
+	}
+	if opts.DialTimeout < 0 || opts.WriteTimeout < 0 || opts.ReconnectInterval < 0 {
+		errs = append(errs, "timeouts must not be negative")
+	}
+
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	if opts.ProcID == "" {
+		opts.ProcID = strconv.Itoa(os.Getpid())
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+type rfc5424Logger struct {
+	opts SyslogOptions
+
+	mu         sync.Mutex
+	conn       net.Conn
+	lastFailed time.Time
+
+	*Base
+}
+
+// NewRFC5424Logger constructs a Sender that sends messages to a syslog
+// server in the RFC 5424 format, which, unlike NewSyslogLogger, is
+// available on all platforms and supports TLS. The fields of
+// structured messages are sent as STRUCTURED-DATA, with the "message"
+// field as the MSG, and other messages are sent with the formatted
+// message as the MSG.
+//
+// The sender connects when it sends the first message, and reconnects
+// after errors.
+func NewRFC5424Logger(name string, opts SyslogOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeRFC5424Logger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeRFC5424Logger constructs an unconfigured RFC 5424 syslog sender.
+// Pass to Journaler.SetSender or call SetName before using.
+func MakeRFC5424Logger(opts SyslogOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &rfc5424Logger{
+		opts: opts,
+		Base: NewBase(""),
+	}
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	s.closer = func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.conn == nil {
+			return nil
+		}
+
+		err := s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return s, nil
+}
+
+func (s *rfc5424Logger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	msg, err := s.format(m, time.Now())
+	if err != nil {
+		s.ErrorHandler()(err, m)
+		return
+	}
+
+	if err = s.write(msg); err != nil {
+		s.ErrorHandler()(err, m)
+	}
+}
+
+// write sends the message, reconnecting and retrying once if the
+// connection has failed.
+func (s *rfc5424Logger) write(msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.opts.Network == "udp" {
+		if len(msg) > s.opts.MaxMessageSize {
+			msg = msg[:s.opts.MaxMessageSize]
+		}
+	} else {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = s.connect(); err != nil {
+			return err
+		}
+
+		if err = s.conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout)); err == nil {
+			if _, err = s.conn.Write(msg); err == nil {
+				return nil
+			}
+		}
+
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+func (s *rfc5424Logger) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	if time.Since(s.lastFailed) < s.opts.ReconnectInterval {
+		return fmt.Errorf("not connected to syslog server %s", s.opts.Address)
+	}
+
+	dialer := &net.Dialer{Timeout: s.opts.DialTimeout}
+
+	var err error
+	if s.opts.Network == "tls" {
+		config := &tls.Config{}
+		if s.opts.TLSConfig != nil {
+			config = s.opts.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(s.opts.Address)
+		}
+
+		s.conn, err = tls.DialWithDialer(dialer, "tcp", s.opts.Address, config)
+	} else {
+		s.conn, err = dialer.Dial(s.opts.Network, s.opts.Address)
+	}
+
+	if err != nil {
+		s.conn = nil
+		s.lastFailed = time.Now()
+		return fmt.Errorf("connecting to syslog server %s: %w", s.opts.Address, err)
+	}
+
+	return nil
+}
+
+// format renders the message as:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (s *rfc5424Logger) format(m message.Composer, ts time.Time) ([]byte, error) {
+	var msg string
+	structured := "-"
+	msgID := s.opts.MsgID
+
+	if fields, ok := m.Raw().(message.Fields); ok {
+		msg = message.GetDefaultFieldsMessage(m, "")
+		if v, ok := fields[s.opts.MsgIDField]; ok && s.opts.MsgIDField != "" {
+			msgID = fmt.Sprint(v)
+		}
+		structured = s.structuredData(fields)
+	} else {
+		var err error
+		if msg, err = s.Formatter()(m); err != nil {
+			return nil, err
+		}
+	}
+
+	appName := s.opts.AppName
+	if appName == "" {
+		appName = s.Name()
+	}
+
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "<%d>1 %s %s %s %s %s %s",
+		int(s.opts.Facility)*8+syslogSeverity(m.Priority(), s.Level().Default),
+		ts.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(s.opts.Hostname, 255),
+		syslogHeaderField(appName, 48),
+		syslogHeaderField(s.opts.ProcID, 128),
+		syslogHeaderField(msgID, 32),
+		structured,
+	)
+	if msg != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+	}
+
+	return []byte(buf.String()), nil
+}
+
+func (s *rfc5424Logger) structuredData(fields message.Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		switch k {
+		case message.FieldsMsgName, "metadata", s.opts.MsgIDField:
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return "-"
+	}
+	sort.Strings(keys)
+
+	buf := &strings.Builder{}
+	buf.WriteByte('[')
+	buf.WriteString(s.opts.StructuredDataID)
+	for _, k := range keys {
+		fmt.Fprintf(buf, ` %s="%s"`, syslogSDName(k), syslogSDEscaper.Replace(fmt.Sprint(fields[k])))
+	}
+	buf.WriteByte(']')
+
+	return buf.String()
+}
+
+var syslogSDEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// syslogHeaderField returns the value as a header field of at most
+// the specified length, of printable ASCII characters, using the
+// NILVALUE for empty values.
+func syslogHeaderField(value string, max int) string {
+	out := make([]byte, 0, len(value))
+	for i := 0; i < len(value) && len(out) < max; i++ {
+		if c := value[i]; c > ' ' && c <= '~' {
+			out = append(out, c)
+		} else {
+			out = append(out, '_')
+		}
+	}
+
+	if len(out) == 0 {
+		return "-"
+	}
+
+	return string(out)
+}
+
+// syslogSDName returns the name as a valid SD-NAME, which is at most
+// 32 printable ASCII characters, excluding '=', ' ', ']', and '"'.
+func syslogSDName(name string) string {
+	out := []byte(syslogHeaderField(name, 32))
+	for i, c := range out {
+		switch c {
+		case '=', ']', '"':
+			out[i] = '_'
+		}
+	}
+
+	return string(out)
+}
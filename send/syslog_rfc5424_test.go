@@ -0,0 +1,272 @@
+package send
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTLSConfigs returns server and client TLS configurations for a
+// self-signed certificate for localhost.
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client := &tls.Config{RootCAs: pool}
+
+	return server, client
+}
+
+// readOctetCounted reads messages framed with octet counting.
+func readOctetCounted(conn net.Conn, out chan<- string) {
+	r := bufio.NewReader(conn)
+	for {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			return
+		}
+		buf := make([]byte, n)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		out <- string(buf)
+	}
+}
+
+func receive(t *testing.T, ch <-chan string) string {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for message")
+		return ""
+	}
+}
+
+func TestRFC5424Logger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	t.Run("Options", func(t *testing.T) {
+		for name, opts := range map[string]SyslogOptions{
+			"Network":        {Network: "sctp", Address: "localhost:514"},
+			"Address":        {Network: "udp"},
+			"Facility":       {Network: "udp", Address: "localhost:514", Facility: 24},
+			"SDID":           {Network: "udp", Address: "localhost:514", StructuredDataID: "a b"},
+			"MaxMessageSize": {Network: "udp", Address: "localhost:514", MaxMessageSize: 100},
+			"Timeout":        {Network: "udp", Address: "localhost:514", DialTimeout: -1},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewRFC5424Logger("syslog", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := SyslogOptions{Network: "udp", Address: "localhost:514"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, SyslogFacilityUser, opts.Facility)
+		assert.Equal(t, DefaultSyslogStructuredDataID, opts.StructuredDataID)
+		assert.Equal(t, 2048, opts.MaxMessageSize)
+		assert.Equal(t, strconv.Itoa(os.Getpid()), opts.ProcID)
+		assert.NotEmpty(t, opts.Hostname)
+	})
+	t.Run("Format", func(t *testing.T) {
+		s, err := NewRFC5424Logger("my app", SyslogOptions{
+			Network:    "udp",
+			Address:    "localhost:514",
+			Facility:   SyslogFacilityLocal0,
+			Hostname:   "host.example.com",
+			ProcID:     "42",
+			MsgIDField: "event",
+		}, info)
+		require.NoError(t, err)
+		logger := s.(*rfc5424Logger)
+		ts := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+		out, err := logger.format(message.NewFieldsMessage(level.Error, "request failed", message.Fields{
+			"event":   "http",
+			"path":    `/a]b"c\d`,
+			"status":  500,
+			"bad key": "x",
+		}), ts)
+		require.NoError(t, err)
+		assert.Equal(t, `<131>1 2024-01-02T03:04:05.000006Z host.example.com my_app 42 http `+
+			`[fields@32473 bad_key="x" path="/a\]b\"c\\d" status="500"] request failed`, string(out))
+
+		out, err = logger.format(message.NewDefaultMessage(level.Debug, "plain message"), ts)
+		require.NoError(t, err)
+		assert.Equal(t, "<135>1 2024-01-02T03:04:05.000006Z host.example.com my_app 42 - - plain message", string(out))
+
+		out, err = logger.format(message.NewSimpleFields(level.Trace, message.Fields{"event": "only"}), ts)
+		require.NoError(t, err)
+		assert.Equal(t, "<135>1 2024-01-02T03:04:05.000006Z host.example.com my_app 42 only -", string(out))
+
+		require.NoError(t, s.SetFormatter(func(m message.Composer) (string, error) { return "formatted " + m.String(), nil }))
+		out, err = logger.format(message.NewDefaultMessage(level.Emergency, "msg"), ts)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(out), "<128>1 "))
+		assert.True(t, strings.HasSuffix(string(out), " - - formatted msg"))
+	})
+	t.Run("UDP", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		s, err := NewRFC5424Logger("udp", SyslogOptions{
+			Network:        "udp",
+			Address:        conn.LocalAddr().String(),
+			MaxMessageSize: 512,
+		}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		s.Send(message.NewDefaultMessage(level.Info, strings.Repeat("x", 1000)))
+
+		buf := make([]byte, 4096)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(buf[:n]), "<14>1 "))
+		assert.True(t, strings.HasSuffix(string(buf[:n]), " udp "+strconv.Itoa(os.Getpid())+" - - hello"))
+
+		n, _, err = conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, 512, n)
+	})
+	t.Run("TCP", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		msgs := make(chan string, 100)
+		conns := make(chan net.Conn, 10)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conns <- conn
+				go readOctetCounted(conn, msgs)
+			}
+		}()
+
+		s, err := NewRFC5424Logger("tcp", SyslogOptions{Network: "tcp", Address: ln.Addr().String()}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		s.Send(message.NewDefaultMessage(level.Info, "one\ntwo"))
+		s.Send(message.NewDefaultMessage(level.Info, "three"))
+		assert.True(t, strings.HasSuffix(receive(t, msgs), " - - one\ntwo"))
+		assert.True(t, strings.HasSuffix(receive(t, msgs), " - - three"))
+
+		// the sender reconnects after the server closes the connection
+		(<-conns).Close()
+		var errs int
+		require.NoError(t, s.SetErrorHandler(func(error, message.Composer) { errs++ }))
+		for i := 0; i < 100 && len(conns) == 0; i++ {
+			s.Send(message.NewDefaultMessage(level.Info, "reconnect"))
+			time.Sleep(time.Millisecond)
+		}
+		assert.Len(t, conns, 1)
+		assert.Zero(t, errs)
+		assert.True(t, strings.HasSuffix(receive(t, msgs), " - - reconnect"))
+	})
+	t.Run("TLS", func(t *testing.T) {
+		serverConfig, clientConfig := newTestTLSConfigs(t)
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		msgs := make(chan string, 10)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			readOctetCounted(conn, msgs)
+		}()
+
+		_, port, err := net.SplitHostPort(ln.Addr().String())
+		require.NoError(t, err)
+
+		s, err := NewRFC5424Logger("tls", SyslogOptions{
+			Network:   "tls",
+			Address:   net.JoinHostPort("localhost", port),
+			TLSConfig: clientConfig,
+		}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		s.Send(message.NewFieldsMessage(level.Warning, "secure", message.Fields{"k": "v"}))
+		msg := receive(t, msgs)
+		assert.True(t, strings.HasPrefix(msg, "<12>1 "))
+		assert.True(t, strings.HasSuffix(msg, ` [fields@32473 k="v"] secure`))
+	})
+	t.Run("ConnectionFailure", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		s, err := NewRFC5424Logger("failing", SyslogOptions{
+			Network:           "tcp",
+			Address:           addr,
+			ReconnectInterval: time.Hour,
+		}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+		s.Send(message.NewDefaultMessage(level.Info, "one"))
+		s.Send(message.NewDefaultMessage(level.Info, "two"))
+		require.Len(t, errs, 2)
+		assert.Contains(t, errs[0].Error(), "connecting to syslog server")
+		assert.Contains(t, errs[1].Error(), "not connected")
+	})
+}
@@ -1,18 +1,42 @@
 package send
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"cdr.dev/grip/level"
 	"cdr.dev/grip/message"
 	"github.com/coreos/go-systemd/journal"
+	"golang.org/x/sys/unix"
 )
 
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+// SystemdOptions configures the systemd journal sender.
+type SystemdOptions struct {
+	// SocketPath is the path of journald's native protocol socket,
+	// and defaults to /run/systemd/journal/socket.
+	SocketPath string
+	// Fields are added to every message, and must be valid journal
+	// field names.
+	Fields map[string]string
+}
+
 type systemdJournal struct {
 	options map[string]string
+	socket  *net.UnixAddr
+	conn    *net.UnixConn
 	*Base
 }
 
@@ -29,6 +53,17 @@ func NewSystemdLogger(name string, l LevelInfo) (Sender, error) {
 	return setup(s, name, l)
 }
 
+// NewSystemdLoggerWithOptions is the same as NewSystemdLogger, but
+// allows setting the socket and additional fields.
+func NewSystemdLoggerWithOptions(name string, opts SystemdOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeSystemdLoggerWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
 // MakeSystemdLogger constructs an unconfigured systemd journald
 // logger. Pass to Journaler.SetSender or call SetName before using.
 func MakeSystemdLogger() (Sender, error) {
@@ -36,10 +71,47 @@ func MakeSystemdLogger() (Sender, error) {
 		return nil, errors.New("systemd journal logging is not available on this platform")
 	}
 
+	return MakeSystemdLoggerWithOptions(SystemdOptions{})
+}
+
+// MakeSystemdLoggerWithOptions constructs an unconfigured systemd
+// journald logger. Pass to Journaler.SetSender or call SetName before
+// using.
+//
+// The sender writes the journal's native protocol, and the fields of
+// structured messages are sent as journal fields, with the keys in
+// upper case and invalid characters replaced by underscores, along
+// with the priority, the logger's name as SYSLOG_IDENTIFIER, and the
+// call site as CODE_FILE, CODE_LINE, and CODE_FUNC. The call site is
+// the first caller outside of grip's packages.
+func MakeSystemdLoggerWithOptions(opts SystemdOptions) (Sender, error) {
+	if opts.SocketPath == "" {
+		opts.SocketPath = defaultJournalSocket
+	}
+
+	for k := range opts.Fields {
+		if journalFieldName(k) != k {
+			return nil, fmt.Errorf("invalid journal field name '%s'", k)
+		}
+	}
+
+	// the sender's socket is unconnected, and bound to an
+	// automatically assigned address, so that it survives
+	// journald restarting.
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("creating journal socket: %w", err)
+	}
+
 	s := &systemdJournal{
-		options: make(map[string]string),
+		options: make(map[string]string, len(opts.Fields)),
+		socket:  &net.UnixAddr{Name: opts.SocketPath, Net: "unixgram"},
+		conn:    conn,
 		Base:    NewBase(""),
 	}
+	for k, v := range opts.Fields {
+		s.options[k] = v
+	}
 
 	fallback := log.New(os.Stdout, "", log.LstdFlags)
 	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
@@ -48,6 +120,10 @@ func MakeSystemdLogger() (Sender, error) {
 		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
 	}
 
+	s.closer = func() error {
+		return s.conn.Close()
+	}
+
 	return s, nil
 }
 
@@ -59,13 +135,219 @@ func (s *systemdJournal) Send(m message.Composer) {
 	}()
 
 	if s.Level().ShouldLog(m) {
-		err := journal.Send(m.String(), s.level.convertPrioritySystemd(m.Priority()), s.options)
-		if err != nil {
+		if err := s.write(s.entry(m)); err != nil {
 			s.ErrorHandler()(err, m)
 		}
 	}
 }
 
+// entry encodes the message in the journal's native protocol.
+func (s *systemdJournal) entry(m message.Composer) []byte {
+	buf := &bytes.Buffer{}
+	set := map[string]bool{}
+	add := func(k, v string) {
+		set[k] = true
+		appendJournalField(buf, k, v)
+	}
+
+	msg := m.String()
+	fields := journalRawFields(m.Raw())
+	if fields != nil {
+		msg = message.GetDefaultFieldsMessage(m, msg)
+	}
+
+	add("MESSAGE", msg)
+	add("PRIORITY", strconv.Itoa(int(s.Level().convertPrioritySystemd(m.Priority()))))
+	add("GRIP_LEVEL", m.Priority().String())
+	add("SYSLOG_IDENTIFIER", s.Name())
+
+	for k, v := range s.options {
+		if !set[k] {
+			add(k, v)
+		}
+	}
+
+	for k, v := range fields {
+		switch k {
+		case message.FieldsMsgName, "metadata":
+			continue
+		}
+
+		name := journalFieldName(k)
+		if name == "" || set[name] {
+			continue
+		}
+		add(name, journalFieldValue(v))
+	}
+
+	if !set["CODE_FILE"] {
+		if frame, ok := journalCallSite(); ok {
+			add("CODE_FILE", frame.File)
+			add("CODE_LINE", strconv.Itoa(frame.Line))
+			add("CODE_FUNC", frame.Function)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// write sends the entry to journald as a datagram, or, if it is too
+// large, in a sealed memfd or a temporary file, as journald does not
+// accept fragmented entries.
+func (s *systemdJournal) write(entry []byte) error {
+	_, _, err := s.conn.WriteMsgUnix(entry, nil, s.socket)
+	if err == nil || !isJournalSpaceError(err) {
+		return err
+	}
+
+	file, err := journalTempFile(entry)
+	if err != nil {
+		return fmt.Errorf("writing large journal entry: %w", err)
+	}
+	defer file.Close()
+
+	_, _, err = s.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), s.socket)
+	return err
+}
+
+func isJournalSpaceError(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)
+}
+
+func journalTempFile(entry []byte) (*os.File, error) {
+	fd, err := unix.MemfdCreate("journal-entry", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err == nil {
+		file := os.NewFile(uintptr(fd), "journal-entry")
+		if _, err = file.Write(entry); err == nil {
+			// journald only accepts memfds that cannot change.
+			_, err = unix.FcntlInt(file.Fd(), unix.F_ADD_SEALS,
+				unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL)
+		}
+		if err == nil {
+			return file, nil
+		}
+		_ = file.Close()
+	}
+
+	// kernels before 3.17 do not support memfds.
+	file, err := os.CreateTemp("/dev/shm", "journal.")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Remove(file.Name()); err == nil {
+		_, err = file.Write(entry)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// appendJournalField writes a field in the native protocol, where
+// values that contain newlines are preceded by their length.
+func appendJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.ContainsRune(value, '\n') {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName returns the key as a journal field name, which has
+// at most 64 upper case letters, digits, and underscores, and starts
+// with a letter, or an empty string if there is no valid name.
+func journalFieldName(key string) string {
+	out := make([]byte, 0, len(key))
+	for i := 0; i < len(key) && len(out) < 64; i++ {
+		switch c := key[i]; {
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			out = append(out, c)
+		case c >= 'a' && c <= 'z':
+			out = append(out, c-'a'+'A')
+		default:
+			out = append(out, '_')
+		}
+	}
+
+	// leading underscores are reserved for fields set by journald.
+	for len(out) > 0 && (out[0] == '_' || (out[0] >= '0' && out[0] <= '9')) {
+		out = out[1:]
+	}
+
+	return string(out)
+}
+
+func journalRawFields(raw interface{}) map[string]interface{} {
+	switch fields := raw.(type) {
+	case message.Fields:
+		return fields
+	case map[string]interface{}:
+		return fields
+	case map[string]string:
+		out := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			out[k] = v
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func journalFieldValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(val)
+	default:
+		if out, err := json.Marshal(val); err == nil {
+			return string(out)
+		}
+		return fmt.Sprintf("%+v", val)
+	}
+}
+
+// journalCallSite returns the first frame outside of grip's packages,
+// other than tests.
+func journalCallSite() (runtime.Frame, bool) {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !isGripFrame(frame) && !strings.HasPrefix(frame.Function, "runtime.") {
+			frame.File = filepath.ToSlash(frame.File)
+			return frame, true
+		}
+		if !more {
+			return runtime.Frame{}, false
+		}
+	}
+}
+
+func isGripFrame(frame runtime.Frame) bool {
+	if strings.HasSuffix(frame.File, "_test.go") {
+		return false
+	}
+
+	return strings.HasPrefix(frame.Function, "cdr.dev/grip.") || strings.HasPrefix(frame.Function, "cdr.dev/grip/")
+}
+
 func (l LevelInfo) convertPrioritySystemd(p level.Priority) journal.Priority {
 	switch p {
 	case level.Emergency:
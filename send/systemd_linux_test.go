@@ -0,0 +1,224 @@
+package send
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// journalStandIn listens on a unix datagram socket in place of
+// journald, and decodes the entries, including those passed as file
+// descriptors.
+type journalStandIn struct {
+	path string
+	conn *net.UnixConn
+}
+
+func newJournalStandIn(t *testing.T) *journalStandIn {
+	path := filepath.Join(t.TempDir(), "journal.socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &journalStandIn{path: path, conn: conn}
+}
+
+// receive returns the next entry, and whether it was sent as a file
+// descriptor with the seals on the file.
+func (j *journalStandIn) receive(t *testing.T) (map[string][]string, int) {
+	require.NoError(t, j.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	buf := make([]byte, 1<<16)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := j.conn.ReadMsgUnix(buf, oob)
+	require.NoError(t, err)
+
+	data := buf[:n]
+	seals := -1
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		require.NoError(t, err)
+		require.Len(t, fds, 1)
+
+		file := os.NewFile(uintptr(fds[0]), "entry")
+		defer file.Close()
+		seals, _ = unix.FcntlInt(file.Fd(), unix.F_GET_SEALS, 0)
+		_, err = file.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		data, err = io.ReadAll(file)
+		require.NoError(t, err)
+	}
+
+	return parseJournalEntry(t, data), seals
+}
+
+func parseJournalEntry(t *testing.T, data []byte) map[string][]string {
+	out := map[string][]string{}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			require.Empty(t, line)
+			return out
+		}
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		if idx := strings.IndexByte(line, '='); idx >= 0 {
+			out[line[:idx]] = append(out[line[:idx]], line[idx+1:])
+			continue
+		}
+
+		var size uint64
+		require.NoError(t, binary.Read(r, binary.LittleEndian, &size))
+		value := make([]byte, size+1)
+		_, err = io.ReadFull(r, value)
+		require.NoError(t, err)
+		require.Equal(t, byte('\n'), value[size])
+		out[line] = append(out[line], string(value[:size]))
+	}
+}
+
+func TestSystemdLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	t.Run("InvalidField", func(t *testing.T) {
+		s, err := NewSystemdLoggerWithOptions("journal", SystemdOptions{Fields: map[string]string{"lower": "x"}}, info)
+		assert.Error(t, err)
+		assert.Nil(t, s)
+	})
+	t.Run("Fields", func(t *testing.T) {
+		journal := newJournalStandIn(t)
+		s, err := NewSystemdLoggerWithOptions("journal-test", SystemdOptions{
+			SocketPath: journal.path,
+			Fields:     map[string]string{"SERVICE": "api"},
+		}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		s.Send(message.NewFieldsMessage(level.Error, "request failed", message.Fields{
+			"status":          500,
+			"request-id":      "abc",
+			"_private":        "leading underscores are trimmed",
+			"multi":           "line one\nline two",
+			"nested":          map[string]int{"a": 1},
+			"err":             errors.New("boom"),
+			"priority":        "ignored",
+			"MESSAGE":         "ignored",
+			"!!!":             "ignored",
+			"metadata":        "ignored",
+			"syslog_facility": "3",
+		}))
+
+		entry, seals := journal.receive(t)
+		assert.Equal(t, -1, seals)
+		assert.Equal(t, []string{"request failed"}, entry["MESSAGE"])
+		assert.Equal(t, []string{"3"}, entry["PRIORITY"])
+		assert.Equal(t, []string{"error"}, entry["GRIP_LEVEL"])
+		assert.Equal(t, []string{"journal-test"}, entry["SYSLOG_IDENTIFIER"])
+		assert.Equal(t, []string{"api"}, entry["SERVICE"])
+		assert.Equal(t, []string{"500"}, entry["STATUS"])
+		assert.Equal(t, []string{"abc"}, entry["REQUEST_ID"])
+		assert.Equal(t, []string{"leading underscores are trimmed"}, entry["PRIVATE"])
+		assert.Equal(t, []string{"line one\nline two"}, entry["MULTI"])
+		assert.Equal(t, []string{`{"a":1}`}, entry["NESTED"])
+		assert.Equal(t, []string{"boom"}, entry["ERR"])
+		assert.Equal(t, []string{"3"}, entry["SYSLOG_FACILITY"])
+		assert.NotContains(t, entry, "METADATA")
+
+		// the call site is this test, not the sender
+		require.Len(t, entry["CODE_FILE"], 1)
+		assert.True(t, strings.HasSuffix(entry["CODE_FILE"][0], "send/systemd_linux_test.go"), entry["CODE_FILE"][0])
+		assert.NotEmpty(t, entry["CODE_LINE"])
+		assert.Equal(t, []string{"cdr.dev/grip/send.TestSystemdLogger.func2"}, entry["CODE_FUNC"])
+	})
+	t.Run("Messages", func(t *testing.T) {
+		journal := newJournalStandIn(t)
+		s, err := NewSystemdLoggerWithOptions("journal-test", SystemdOptions{SocketPath: journal.path}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewDefaultMessage(level.Warning, "multi\nline"))
+		entry, _ := journal.receive(t)
+		assert.Equal(t, []string{"multi\nline"}, entry["MESSAGE"])
+		assert.Equal(t, []string{"4"}, entry["PRIORITY"])
+
+		s.Send(message.NewSimpleFields(level.Info, message.Fields{"key": "value"}))
+		entry, _ = journal.receive(t)
+		assert.Equal(t, []string{"[key='value']"}, entry["MESSAGE"])
+		assert.Equal(t, []string{"value"}, entry["KEY"])
+
+		// messages may specify their own call site
+		s.Send(message.NewSimpleFields(level.Info, message.Fields{"code_file": "main.go", "code_line": 7}))
+		entry, _ = journal.receive(t)
+		assert.Equal(t, []string{"main.go"}, entry["CODE_FILE"])
+		assert.Equal(t, []string{"7"}, entry["CODE_LINE"])
+		assert.NotContains(t, entry, "CODE_FUNC")
+	})
+	t.Run("LargeEntry", func(t *testing.T) {
+		journal := newJournalStandIn(t)
+		s, err := NewSystemdLoggerWithOptions("journal-test", SystemdOptions{SocketPath: journal.path}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+
+		large := strings.Repeat("x", 8<<20)
+		s.Send(message.NewDefaultMessage(level.Info, large))
+		require.Empty(t, errs)
+
+		entry, seals := journal.receive(t)
+		assert.Equal(t, []string{large}, entry["MESSAGE"])
+		// temporary files, used when memfds are unavailable, have no seals
+		if seals >= 0 {
+			assert.Equal(t, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL, seals)
+		}
+	})
+	t.Run("NoJournal", func(t *testing.T) {
+		s, err := NewSystemdLoggerWithOptions("journal-test", SystemdOptions{
+			SocketPath: filepath.Join(t.TempDir(), "missing.socket"),
+		}, info)
+		require.NoError(t, err)
+		defer s.Close()
+
+		var errs []error
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { errs = append(errs, err) }))
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		assert.Len(t, errs, 1)
+	})
+}
+
+func TestJournalFieldName(t *testing.T) {
+	for key, expected := range map[string]string{
+		"simple":                 "SIMPLE",
+		"CamelCase":              "CAMELCASE",
+		"with.dots-and space":    "WITH_DOTS_AND_SPACE",
+		"__trusted":              "TRUSTED",
+		"1st":                    "ST",
+		"_9":                     "",
+		"":                       "",
+		strings.Repeat("a", 100): strings.Repeat("A", 64),
+	} {
+		assert.Equal(t, expected, journalFieldName(key), key)
+	}
+}
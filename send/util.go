@@ -0,0 +1,77 @@
+package send
+
+import (
+	"reflect"
+	"unicode/utf8"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// syslogSeverity returns the syslog severity of the priority, using
+// the severity of the default priority for priorities that do not
+// have one.
+func syslogSeverity(p, fallback level.Priority) int {
+	switch p {
+	case level.Emergency:
+		return 0
+	case level.Alert:
+		return 1
+	case level.Critical:
+		return 2
+	case level.Error:
+		return 3
+	case level.Warning:
+		return 4
+	case level.Notice:
+		return 5
+	case level.Info:
+		return 6
+	case level.Debug, level.Trace:
+		return 7
+	default:
+		if fallback != p && fallback.IsValid() {
+			return syslogSeverity(fallback, fallback)
+		}
+		return 5
+	}
+}
+
+// truncateText shortens the text to at most max bytes, ending it with
+// an ellipsis, without splitting multi-byte characters.
+func truncateText(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+
+	const ellipsis = "…"
+	cut := max - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+
+	return text[:cut] + ellipsis
+}
+
+// composerMetadata returns a copy of the metadata of composers that
+// embed message.Base, collecting it if the composer has not.
+func composerMetadata(m message.Composer) *message.Base {
+	meta := &message.Base{}
+
+	v := reflect.ValueOf(m)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		if f := v.FieldByName("Base"); f.IsValid() && f.Type() == reflect.TypeOf(message.Base{}) {
+			*meta = f.Interface().(message.Base)
+		}
+	}
+
+	meta.Level = m.Priority()
+	if meta.Pid == 0 {
+		_ = meta.Collect()
+	}
+
+	return meta
+}
@@ -0,0 +1,388 @@
+package send
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// WebhookOptions configures a sender that posts messages to an HTTP
+// endpoint, such as the incoming webhooks of chat services.
+//
+// The body of each request is produced by Template if it is set, or
+// else by Mapping if it is set, or else is the JSON encoding of the
+// WebhookMessage. Groups of messages, such as those produced by a
+// buffered sender, are posted in a single request: the template
+// renders the group, which has the individual messages in Messages,
+// while mapped and JSON bodies are arrays.
+type WebhookOptions struct {
+	// URL is the address of the endpoint, and Method defaults to
+	// POST.
+	URL    string
+	Method string
+	// Headers are added to every request. The Content-Type defaults
+	// to application/json.
+	Headers map[string]string
+
+	// Template renders the body of requests from a WebhookMessage.
+	// Use ParseWebhookTemplate to parse templates with the json
+	// function, which encodes values as JSON.
+	Template *template.Template
+	// Mapping produces a JSON object for each message, where the
+	// keys are the keys of the object, which are nested when they
+	// contain dots, and the values name parts of the message:
+	// "message", "priority", "level", "raw", "fields",
+	// "fields.<key>", "metadata", or "metadata.<key>", where the keys
+	// of the metadata are "hostname", "time", "process", "pid", and
+	// "context".
+	Mapping map[string]string
+
+	// SigningSecret, if set, signs the body of each request with
+	// HMAC-SHA256, and the signature is sent in the SignatureHeader,
+	// which defaults to X-Signature-256, as "sha256=<hex digest>".
+	SigningSecret   string
+	SignatureHeader string
+
+	// Timeout limits the duration of each request, and defaults to
+	// 10 seconds. Client defaults to http.DefaultClient.
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// Validate checks the options and sets defaults for unspecified
+// values.
+func (o *WebhookOptions) Validate() error {
+	errs := []string{}
+
+	if o.URL == "" {
+		errs = append(errs, "no url specified")
+	} else if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, fmt.Sprintf("invalid url '%s'", o.URL))
+	}
+
+	if o.Method == "" {
+		o.Method = http.MethodPost
+	}
+
+	if o.Template != nil && o.Mapping != nil {
+		errs = append(errs, "cannot specify both a template and a mapping")
+	}
+	for k, v := range o.Mapping {
+		if k == "" || strings.HasPrefix(k, ".") || strings.HasSuffix(k, ".") || strings.Contains(k, "..") {
+			errs = append(errs, fmt.Sprintf("invalid mapping key '%s'", k))
+		}
+		if !isValidWebhookSource(v) {
+			errs = append(errs, fmt.Sprintf("invalid mapping value '%s' for '%s'", v, k))
+		}
+	}
+
+	if o.SigningSecret != "" && o.SignatureHeader == "" {
+		o.SignatureHeader = "X-Signature-256"
+	}
+
+	if o.Timeout < 0 {
+		errs = append(errs, "timeout cannot be negative")
+	} else if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// WebhookMessage is the data that webhook templates render, and the
+// default body of webhook requests.
+type WebhookMessage struct {
+	Priority level.Priority `json:"priority"`
+	Message  string         `json:"message"`
+	// Fields are the fields of structured messages.
+	Fields message.Fields `json:"fields,omitempty"`
+	Raw    interface{}    `json:"raw"`
+	// Metadata is the message's metadata, with the time, hostname
+	// and process collected when the message was sent if the
+	// message did not collect them.
+	Metadata *message.Base `json:"metadata"`
+	// Messages are the messages of a group, or, for a single
+	// message, the message itself.
+	Messages []WebhookMessage `json:"-"`
+}
+
+// ParseWebhookTemplate parses a template for webhook requests, which
+// may use the json function to encode values, as in
+// {"text": {{ json .Message }}}.
+func ParseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			out, err := json.Marshal(v)
+			return string(out), err
+		},
+	}).Parse(text)
+}
+
+type webhookLogger struct {
+	opts WebhookOptions
+	*Base
+}
+
+// NewWebhookLogger constructs a Sender that posts messages to an HTTP
+// endpoint, reporting failed requests and responses other than 2xx to
+// the error handler.
+func NewWebhookLogger(name string, opts WebhookOptions, l LevelInfo) (Sender, error) {
+	s, err := MakeWebhookLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(s, name, l)
+}
+
+// MakeWebhookLogger constructs an unconfigured webhook sender. Pass
+// to Journaler.SetSender or call SetName before using.
+func MakeWebhookLogger(opts WebhookOptions) (Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string, len(opts.Headers))
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	opts.Headers = headers
+
+	s := &webhookLogger{
+		opts: opts,
+		Base: NewBase(""),
+	}
+
+	fallback := log.New(os.Stdout, "", log.LstdFlags)
+	_ = s.SetErrorHandler(ErrorHandlerFromLogger(fallback))
+
+	s.reset = func() {
+		fallback.SetPrefix(fmt.Sprintf("[%s] ", s.Name()))
+	}
+
+	return s, nil
+}
+
+func (s *webhookLogger) Send(m message.Composer) {
+	if !s.Level().ShouldLog(m) {
+		return
+	}
+
+	body, err := s.body(m)
+	if err != nil {
+		s.ErrorHandler()(fmt.Errorf("rendering webhook payload: %w", err), m)
+		return
+	}
+
+	if err = s.post(body); err != nil {
+		s.ErrorHandler()(err, m)
+	}
+}
+
+// body renders the request body for the message, or for the loggable
+// messages of a group.
+func (s *webhookLogger) body(m message.Composer) ([]byte, error) {
+	var msg WebhookMessage
+	group, isGroup := m.(*message.GroupComposer)
+	if isGroup {
+		msg = WebhookMessage{
+			Priority: m.Priority(),
+			Message:  m.String(),
+			Raw:      m.Raw(),
+			Metadata: composerMetadata(m),
+		}
+		for _, c := range group.Messages() {
+			if s.Level().ShouldLog(c) {
+				msg.Messages = append(msg.Messages, newWebhookMessage(c))
+			}
+		}
+	} else {
+		msg = newWebhookMessage(m)
+		msg.Messages = []WebhookMessage{msg}
+	}
+
+	switch {
+	case s.opts.Template != nil:
+		buf := &bytes.Buffer{}
+		if err := s.opts.Template.Execute(buf, msg); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case s.opts.Mapping != nil:
+		if !isGroup {
+			return json.Marshal(s.mapped(msg))
+		}
+		out := make([]map[string]interface{}, 0, len(msg.Messages))
+		for _, c := range msg.Messages {
+			out = append(out, s.mapped(c))
+		}
+		return json.Marshal(out)
+	case isGroup:
+		return json.Marshal(msg.Messages)
+	default:
+		return json.Marshal(msg)
+	}
+}
+
+func (s *webhookLogger) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, s.opts.Method, s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.opts.SigningSecret != "" {
+		req.Header.Set(s.opts.SignatureHeader, "sha256="+webhookSignature(s.opts.SigningSecret, body))
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// read some of the body to report errors, and the rest of it
+	// so that the connection can be reused.
+	payload, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s: %s", resp.Status, strings.TrimSpace(string(payload)))
+	}
+
+	return nil
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookMessage(m message.Composer) WebhookMessage {
+	msg := WebhookMessage{
+		Priority: m.Priority(),
+		Message:  m.String(),
+		Raw:      m.Raw(),
+		Metadata: composerMetadata(m),
+	}
+
+	if fields, ok := msg.Raw.(message.Fields); ok {
+		msg.Fields = make(message.Fields, len(fields))
+		for k, v := range fields {
+			if k != "metadata" {
+				msg.Fields[k] = v
+			}
+		}
+		msg.Message = message.GetDefaultFieldsMessage(m, msg.Message)
+	}
+
+	return msg
+}
+
+func isValidWebhookSource(source string) bool {
+	switch source {
+	case "message", "priority", "level", "raw", "fields", "metadata",
+		"metadata.hostname", "metadata.time", "metadata.process", "metadata.pid", "metadata.context":
+		return true
+	default:
+		return strings.HasPrefix(source, "fields.") && len(source) > len("fields.")
+	}
+}
+
+// mapped produces the JSON object for a message from the mapping.
+func (s *webhookLogger) mapped(msg WebhookMessage) map[string]interface{} {
+	keys := make([]string, 0, len(s.opts.Mapping))
+	for k := range s.opts.Mapping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := map[string]interface{}{}
+	for _, key := range keys {
+		source := s.opts.Mapping[key]
+		var value interface{}
+		switch source {
+		case "message":
+			value = msg.Message
+		case "priority":
+			value = msg.Priority.String()
+		case "level":
+			value = int(msg.Priority)
+		case "raw":
+			value = msg.Raw
+		case "fields":
+			value = msg.Fields
+		case "metadata":
+			value = msg.Metadata
+		case "metadata.hostname":
+			value = msg.Metadata.Hostname
+		case "metadata.time":
+			value = msg.Metadata.Time
+		case "metadata.process":
+			value = msg.Metadata.Process
+		case "metadata.pid":
+			value = msg.Metadata.Pid
+		case "metadata.context":
+			value = msg.Metadata.Context
+		default:
+			var ok bool
+			if value, ok = msg.Fields[strings.TrimPrefix(source, "fields.")]; !ok {
+				continue
+			}
+		}
+
+		setWebhookValue(out, strings.Split(key, "."), value)
+	}
+
+	return out
+}
+
+// setWebhookValue sets the value in nested objects, unless one of the
+// keys is already set to a value other than an object. Keys are set
+// in order, so "a" takes precedence over "a.b".
+func setWebhookValue(out map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := out[key].(map[string]interface{})
+		if !ok {
+			if _, exists := out[key]; exists {
+				return
+			}
+			next = map[string]interface{}{}
+			out[key] = next
+		}
+		out = next
+	}
+
+	out[path[len(path)-1]] = value
+}
@@ -0,0 +1,224 @@
+package send
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookRequest struct {
+	method string
+	header http.Header
+	body   []byte
+}
+
+// webhookServerMock records requests, and responds with the status.
+type webhookServerMock struct {
+	mu       sync.Mutex
+	requests []webhookRequest
+	status   int
+	delay    time.Duration
+}
+
+func (m *webhookServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	time.Sleep(m.delay)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, webhookRequest{method: r.Method, header: r.Header, body: body})
+
+	if m.status != 0 {
+		http.Error(w, "endpoint unavailable", m.status)
+	}
+}
+
+func (m *webhookServerMock) last(t *testing.T) webhookRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	require.NotEmpty(t, m.requests)
+	return m.requests[len(m.requests)-1]
+}
+
+func TestWebhookLogger(t *testing.T) {
+	info := LevelInfo{Default: level.Info, Threshold: level.Info}
+
+	newLogger := func(t *testing.T, opts WebhookOptions) (Sender, *webhookServerMock, *[]error) {
+		mock := &webhookServerMock{}
+		srv := httptest.NewServer(mock)
+		t.Cleanup(srv.Close)
+
+		opts.URL = srv.URL + "/hook"
+		s, err := NewWebhookLogger("webhook", opts, info)
+		require.NoError(t, err)
+
+		errs := &[]error{}
+		require.NoError(t, s.SetErrorHandler(func(err error, _ message.Composer) { *errs = append(*errs, err) }))
+
+		return s, mock, errs
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		tmpl, err := ParseWebhookTemplate("{}")
+		require.NoError(t, err)
+
+		for name, opts := range map[string]WebhookOptions{
+			"NoURL":      {},
+			"BadURL":     {URL: "ftp://example.com"},
+			"Both":       {URL: "http://localhost", Template: tmpl, Mapping: map[string]string{"a": "message"}},
+			"BadKey":     {URL: "http://localhost", Mapping: map[string]string{"a..b": "message"}},
+			"BadSource":  {URL: "http://localhost", Mapping: map[string]string{"a": "fields."}},
+			"BadTimeout": {URL: "http://localhost", Timeout: -1},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, err := NewWebhookLogger("webhook", opts, info)
+				assert.Error(t, err)
+				assert.Nil(t, s)
+			})
+		}
+
+		opts := WebhookOptions{URL: "https://example.com", SigningSecret: "secret"}
+		require.NoError(t, opts.Validate())
+		assert.Equal(t, http.MethodPost, opts.Method)
+		assert.Equal(t, "X-Signature-256", opts.SignatureHeader)
+		assert.Equal(t, 10*time.Second, opts.Timeout)
+		assert.NotNil(t, opts.Client)
+	})
+	t.Run("Default", func(t *testing.T) {
+		s, mock, errs := newLogger(t, WebhookOptions{
+			Method:  http.MethodPut,
+			Headers: map[string]string{"Authorization": "Bearer token"},
+		})
+
+		m := message.NewFieldsMessage(level.Error, "request failed", message.Fields{"status": 500})
+		require.NoError(t, m.Annotate("request", "abc"))
+		s.Send(m)
+		require.Empty(t, *errs)
+
+		req := mock.last(t)
+		assert.Equal(t, http.MethodPut, req.method)
+		assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+		assert.Equal(t, "Bearer token", req.header.Get("Authorization"))
+		assert.Empty(t, req.header.Get("X-Signature-256"))
+
+		out := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(req.body, &out))
+		assert.Equal(t, "request failed", out["message"])
+		assert.EqualValues(t, level.Error, out["priority"])
+		assert.Equal(t, map[string]interface{}{"status": 500.0, "message": "request failed", "request": "abc"}, out["fields"])
+		metadata := out["metadata"].(map[string]interface{})
+		assert.NotEmpty(t, metadata["hostname"])
+		assert.NotEmpty(t, metadata["pid"])
+
+		// annotations of other messages are in the metadata
+		m = message.NewDefaultMessage(level.Info, "annotated")
+		require.NoError(t, m.Annotate("request", "abc"))
+		s.Send(m)
+		require.Empty(t, *errs)
+
+		out = map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(mock.last(t).body, &out))
+		assert.NotContains(t, out, "fields")
+		metadata = out["metadata"].(map[string]interface{})
+		assert.NotEmpty(t, metadata["hostname"])
+		assert.Equal(t, map[string]interface{}{"request": "abc"}, metadata["context"])
+	})
+	t.Run("Template", func(t *testing.T) {
+		tmpl, err := ParseWebhookTemplate(`{"text": {{ json .Message }}, "level": "{{ .Priority }}", "count": {{ len .Messages }}}`)
+		require.NoError(t, err)
+		s, mock, errs := newLogger(t, WebhookOptions{Template: tmpl, Headers: map[string]string{"Content-Type": "application/vnd.custom+json"}})
+
+		s.Send(message.NewDefaultMessage(level.Debug, "below threshold"))
+		s.Send(message.NewDefaultMessage(level.Warning, `quoted "text"`))
+		require.Empty(t, *errs)
+
+		req := mock.last(t)
+		assert.Equal(t, "application/vnd.custom+json", req.header.Get("Content-Type"))
+		assert.JSONEq(t, `{"text": "quoted \"text\"", "level": "warning", "count": 1}`, string(req.body))
+
+		s.Send(message.NewGroupComposer([]message.Composer{
+			message.NewDefaultMessage(level.Info, "one"),
+			message.NewDefaultMessage(level.Debug, "skipped"),
+			message.NewDefaultMessage(level.Error, "two"),
+		}))
+		require.Empty(t, *errs)
+		assert.JSONEq(t, `{"text": "one\nskipped\ntwo", "level": "error", "count": 2}`, string(mock.last(t).body))
+
+		tmpl, err = ParseWebhookTemplate(`{{ .Missing }}`)
+		require.NoError(t, err)
+		s, _, errs = newLogger(t, WebhookOptions{Template: tmpl})
+		s.Send(message.NewDefaultMessage(level.Info, "hello"))
+		require.Len(t, *errs, 1)
+		assert.Contains(t, (*errs)[0].Error(), "rendering webhook payload")
+	})
+	t.Run("Mapping", func(t *testing.T) {
+		s, mock, errs := newLogger(t, WebhookOptions{Mapping: map[string]string{
+			"content":         "message",
+			"meta.level":      "priority",
+			"meta.host":       "metadata.hostname",
+			"meta.status":     "fields.status",
+			"meta.missing":    "fields.missing",
+			"content.ignored": "priority",
+		}})
+
+		s.Send(message.NewFieldsMessage(level.Error, "request failed", message.Fields{"status": 500}))
+		require.Empty(t, *errs)
+
+		out := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(mock.last(t).body, &out))
+		assert.Equal(t, "request failed", out["content"])
+		meta := out["meta"].(map[string]interface{})
+		assert.Equal(t, "error", meta["level"])
+		assert.NotEmpty(t, meta["host"])
+		assert.EqualValues(t, 500, meta["status"])
+		assert.NotContains(t, meta, "missing")
+
+		s.Send(message.NewGroupComposer([]message.Composer{
+			message.NewDefaultMessage(level.Info, "one"),
+			message.NewDefaultMessage(level.Info, "two"),
+		}))
+		require.Empty(t, *errs)
+		var batch []map[string]interface{}
+		require.NoError(t, json.Unmarshal(mock.last(t).body, &batch))
+		require.Len(t, batch, 2)
+		assert.Equal(t, "two", batch[1]["content"])
+	})
+	t.Run("Signature", func(t *testing.T) {
+		s, mock, errs := newLogger(t, WebhookOptions{SigningSecret: "secret", SignatureHeader: "X-Hub-Signature-256"})
+
+		s.Send(message.NewDefaultMessage(level.Info, "signed"))
+		require.Empty(t, *errs)
+
+		req := mock.last(t)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		_, _ = mac.Write(req.body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.header.Get("X-Hub-Signature-256"))
+	})
+	t.Run("Errors", func(t *testing.T) {
+		s, mock, errs := newLogger(t, WebhookOptions{Timeout: 50 * time.Millisecond})
+
+		mock.status = http.StatusServiceUnavailable
+		s.Send(message.NewDefaultMessage(level.Info, "unavailable"))
+		require.Len(t, *errs, 1)
+		assert.Equal(t, "webhook responded with 503 Service Unavailable: endpoint unavailable", (*errs)[0].Error())
+
+		mock.status = 0
+		mock.delay = time.Second
+		s.Send(message.NewDefaultMessage(level.Info, "slow"))
+		require.Len(t, *errs, 2)
+		assert.Contains(t, (*errs)[1].Error(), "posting to webhook")
+	})
+}
@@ -0,0 +1,93 @@
+package grip
+
+import (
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/message"
+)
+
+// Timer measures the duration of an operation, and logs the duration
+// when the operation completes. Use StartTimer to measure a block:
+//
+//	defer grip.StartTimer(logger, level.Info, "rebuilt index").Stop()
+//
+// or Time to measure a function.
+type Timer struct {
+	logger    Journaler
+	priority  level.Priority
+	message   string
+	fields    message.Fields
+	histogram *message.Histogram
+	start     time.Time
+}
+
+// StartTimer starts a Timer that logs to the specified logger, or the
+// standard logger in the grip package if the logger is nil, at the
+// specified priority, when it is stopped.
+func StartTimer(logger Journaler, p level.Priority, msg string) *Timer {
+	if logger == nil {
+		logger = std
+	}
+
+	return &Timer{
+		logger:   logger,
+		priority: p,
+		message:  msg,
+		start:    time.Now(),
+	}
+}
+
+// Time runs the function and logs its duration, as in StartTimer, and
+// returns the duration.
+func Time(logger Journaler, p level.Priority, msg string, fn func()) (dur time.Duration) {
+	t := StartTimer(logger, p, msg)
+	defer func() { dur = t.Stop() }()
+
+	fn()
+
+	return
+}
+
+// WithFields adds fields to the message that the Timer logs.
+func (t *Timer) WithFields(f message.Fields) *Timer {
+	if t.fields == nil {
+		t.fields = message.Fields{}
+	}
+
+	for k, v := range f {
+		t.fields[k] = v
+	}
+
+	return t
+}
+
+// Record adds the duration of the operation to the Histogram, in
+// addition to logging it, when the Timer is stopped.
+func (t *Timer) Record(h *message.Histogram) *Timer {
+	t.histogram = h
+	return t
+}
+
+// Elapsed returns the time since the Timer started.
+func (t *Timer) Elapsed() time.Duration { return time.Since(t.start) }
+
+// Stop logs the duration of the operation, with the duration in
+// milliseconds in the "duration_ms" field, and returns the
+// duration.
+func (t *Timer) Stop() time.Duration {
+	dur := time.Since(t.start)
+
+	if t.histogram != nil {
+		t.histogram.AddDuration(dur)
+	}
+
+	fields := message.Fields{"duration_ms": float64(dur) / float64(time.Millisecond)}
+	for k, v := range t.fields {
+		fields[k] = v
+	}
+
+	t.logger.Log(t.priority, message.MakeFieldsMessage(t.message, fields))
+
+	return dur
+}
@@ -0,0 +1,62 @@
+package grip
+
+import (
+	"testing"
+	"time"
+
+	"cdr.dev/grip/level"
+	"cdr.dev/grip/logging"
+	"cdr.dev/grip/message"
+	"cdr.dev/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimer(t *testing.T) {
+	setup := func(t *testing.T) (Journaler, *send.InternalSender) {
+		sender := send.MakeInternalLogger()
+		logger := logging.NewGrip("test")
+		require.NoError(t, logger.SetSender(sender))
+		return logger, sender
+	}
+
+	t.Run("Block", func(t *testing.T) {
+		logger, sender := setup(t)
+
+		timer := StartTimer(logger, level.Info, "block").WithFields(message.Fields{"op": "test"})
+		time.Sleep(10 * time.Millisecond)
+		dur := timer.Stop()
+		assert.True(t, dur >= 10*time.Millisecond)
+
+		require.Equal(t, 1, sender.Len())
+		msg := sender.GetMessage()
+		assert.Equal(t, level.Info, msg.Priority)
+		fields := msg.Message.Raw().(message.Fields)
+		assert.Equal(t, "block", fields["message"])
+		assert.Equal(t, "test", fields["op"])
+		assert.True(t, fields["duration_ms"].(float64) >= 10)
+	})
+	t.Run("Func", func(t *testing.T) {
+		logger, sender := setup(t)
+
+		hist := message.MakeHistogram("latency")
+		var called bool
+		dur := Time(logger, level.Debug, "func", func() { called = true })
+		assert.True(t, called)
+		assert.True(t, dur > 0)
+		require.Equal(t, 1, sender.Len())
+		assert.Equal(t, level.Debug, sender.GetMessage().Priority)
+
+		for i := 0; i < 3; i++ {
+			StartTimer(logger, level.Info, "recorded").Record(hist).Stop()
+		}
+		assert.Equal(t, uint64(3), hist.Summary().Count)
+		assert.Equal(t, "seconds", hist.Raw().(*message.Histogram).Unit)
+	})
+	t.Run("Panic", func(t *testing.T) {
+		logger, sender := setup(t)
+
+		assert.Panics(t, func() { Time(logger, level.Info, "panic", func() { panic("oops") }) })
+		assert.Equal(t, 1, sender.Len())
+	})
+}